@@ -2,17 +2,26 @@ package main
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
-	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -24,6 +33,12 @@ var (
 	router   *gin.Engine
 	v        *vmm.VMM
 	CFPrefix = "matrisea-cvd-" // container name prefix
+	// vmmReady is closed once v has been initialized, i.e. Docker is reachable
+	vmmReady = make(chan struct{})
+	// startLimiter caps the number of VMs booting at the same time during bulk starts
+	startLimiter = make(chan struct{}, 2)
+	// longest device name accepted by wsCreateVM unless force_long_name is set, see MAX_DEVICE_NAME_LENGTH
+	MaxDeviceNameLength = 20
 )
 
 var wsUpgrader = websocket.Upgrader{
@@ -46,6 +61,73 @@ const (
 	STEP_START_VM
 )
 
+func (s CreateVMStep) String() string {
+	switch s {
+	case STEP_START:
+		return "start"
+	case STEP_PREFLIGHT_CHECKS:
+		return "preflight_checks"
+	case STEP_CREATE_VM:
+		return "create_vm"
+	case STEP_LOAD_IMAGES:
+		return "load_images"
+	case STEP_START_VM:
+		return "start_vm"
+	}
+	return fmt.Sprintf("step_%d", int(s))
+}
+
+// number of the latest log lines kept in a vmm.CreateFailure
+const createFailureLogLines = 200
+
+// createVMSession is the state of one wsCreateVM call
+type createVMSession struct {
+	conn       *Connection
+	reqID      string // correlates the log lines and responses of one creation
+	deviceName string
+	timer      *createVMTimer
+	// VMStart's callback may keep logging from another goroutine after a boot timeout
+	logMu   sync.Mutex
+	logTail []string
+}
+
+// createVMTimer records how long each CreateVMStep takes
+type createVMTimer struct {
+	// the durations are serialized by the connection's writer while later steps are recorded
+	mu        sync.Mutex
+	lastLap   time.Time
+	durations map[string]float64
+}
+
+func newCreateVMTimer() *createVMTimer {
+	return &createVMTimer{
+		lastLap:   time.Now(),
+		durations: map[string]float64{},
+	}
+}
+
+// lap records the time elapsed since the previous lap as the duration of step, and returns it in seconds
+func (t *createVMTimer) lap(step CreateVMStep) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	elapsed := now.Sub(t.lastLap).Seconds()
+	t.durations[step.String()] = elapsed
+	t.lastLap = now
+	return elapsed
+}
+
+// snapshot returns a copy of the durations recorded so far
+func (t *createVMTimer) snapshot() map[string]float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	durations := make(map[string]float64, len(t.durations))
+	for step, d := range t.durations {
+		durations[step] = d
+	}
+	return durations
+}
+
 // message type for the main WebSocket connection (/api/v1/ws)
 type WsMessageType int
 
@@ -73,6 +155,8 @@ type WebSocketResponse struct {
 	Data     ResponseBody  `json:"data"`
 	HasError bool          `json:"has_error" binding:"required"`
 	ErrorMsg string        `json:"error"`
+	// set on the responses of a VM creation to correlate them with the server log
+	RequestID string `json:"request_id,omitempty"`
 }
 
 type ResponseBody interface {
@@ -89,12 +173,44 @@ type CreateVMRequest struct {
 	KernelImage string `json:"kernel_image"`
 	AOSPVersion string `json:"aosp_version"`
 	Cmdline     string `json:"cmdline"`
+	WaitForUI   bool   `json:"wait_for_ui"` // wait for the boot animation to end before completing STEP_START_VM
+	Daemon      bool   `json:"daemon"`      // run launch_cvd detached from the API server, see vmm.VMStartOptions
+	Image       string `json:"image"`       // cuttlefish image, defaults to vmm.CFImage
+	// container restart policy, defaults to DEFAULT_RESTART_POLICY
+	RestartPolicy string `json:"restart_policy"`
+	// "true"/"false" to override launch_cvd's default SELinux settings of the guest
+	GuestEnforceSecurity string `json:"guest_enforce_security"`
+	GuestAuditSecurity   string `json:"guest_audit_security"`
+	// optional boot/vendor_boot images in the upload folder that override the ones in the system image
+	BootImage       string   `json:"boot_image"`
+	VendorBootImage string   `json:"vendor_boot_image"`
+	DNS             []string `json:"dns"`          // custom DNS servers of the VM, inherited from the host if empty
+	SDCardMB        int      `json:"sdcard_mb"`    // size of a blank sdcard, launch_cvd's default if 0
+	SDCardImage     string   `json:"sdcard_image"` // optional sdcard image in the upload folder
+	// optional prebuilt super image in the upload folder that overrides super.img in the system image
+	SuperImage string `json:"super_image"`
+	// host CPUs to pin the VM to e.g. "0-3,8", not pinned if empty
+	CpusetCpus string `json:"cpuset_cpus"`
+	// size of the userdata partition, the system image's own size if 0
+	DataImageMB int `json:"data_image_mb"`
+	// boot the VM when the API server starts if its container is up but the VM isn't
+	Autostart bool `json:"autostart"`
+	// launch_cvd's --gpu_mode e.g. "gfxstream", see vmm.GPUModes
+	GPUMode string `json:"gpu_mode"`
+	// custom metadata e.g. {"team": "qa"}, returned as "labels" by GET /vms
+	Labels map[string]string `json:"labels"`
+	// allow names longer than MaxDeviceNameLength, up to what fits in a container name
+	ForceLongName bool `json:"force_long_name"`
+	// seed the VM with the device folder kept by removing a VM of the same name with keep_data
+	ReuseData bool `json:"reuse_data"`
 }
 
 func (r *CreateVMRequest) AbstractRequestBodyMethod() {}
 
 type CreateVMResponse struct {
 	Step CreateVMStep `json:"step" binding:"required"`
+	// Seconds spent in each step so far, keyed by step name e.g. "load_images"
+	StepDurations map[string]float64 `json:"step_durations,omitempty"`
 }
 
 func (r *CreateVMResponse) AbstractResponseBodyMethod() {}
@@ -108,6 +224,7 @@ func (r *ListVMResponse) AbstractResponseBodyMethod() {}
 type InstallAPKRequest struct {
 	DeviceName string `json:"name" binding:"required"`
 	File       string `json:"file" binding:"required"`
+	Launch     bool   `json:"launch"` // open the app after it's installed
 }
 
 func (r *InstallAPKRequest) AbstractRequestBodyMethod() {}
@@ -115,6 +232,11 @@ func (r *InstallAPKRequest) AbstractRequestBodyMethod() {}
 type InstallAPKResponse struct {
 	DeviceName string `json:"name" binding:"required"`
 	File       string `json:"file" binding:"required"`
+	// e.g. "com.example.app", empty if it couldn't be read from the APK
+	PackageName string `json:"package_name"`
+	// whether the app was launched if requested, a failed launch doesn't fail the install
+	Launched    bool   `json:"launched"`
+	LaunchError string `json:"launch_error,omitempty"`
 }
 
 func (r *InstallAPKResponse) AbstractResponseBodyMethod() {}
@@ -126,43 +248,245 @@ type CreateVMLogResponse struct {
 func (r *CreateVMLogResponse) AbstractResponseBodyMethod() {}
 
 func main() {
-	v = vmm.NewVMM(getenv("DATA_DIR", "/data"))
+	// Docker may start after matrisea (e.g. in a compose stack), so keep retrying in the background
+	// and serve /health as unhealthy in the meantime.
+	go connectVMM(getenv("DATA_DIR", "/data"))
+	if n, err := strconv.Atoi(getenv("BULK_START_CONCURRENCY", "")); err == nil && n > 0 {
+		startLimiter = make(chan struct{}, n)
+	}
 
 	router = gin.Default()
 	config := cors.DefaultConfig()
-	config.AllowHeaders = []string{"Origin", "x-requested-with", "content-type"}
+	config.AllowHeaders = []string{"Origin", "x-requested-with", "content-type", "x-admin-token"}
 	// TODO read from config files
 	config.AllowOriginFunc = func(origin string) bool {
 		return true
 	}
 	router.Use(cors.New(config))
 
+	router.GET("/health", getHealth)
+
 	api := router.Group("/api")
 	v1 := api.Group("/v1")
+	v1.Use(requireVMM)
 	{
 		v1.GET("/ws", func(c *gin.Context) { // websocket
 			wsHandler(c.Writer, c.Request)
 		})
+		v1.POST("/vms/bulk", bulkVMAction)
+		v1.GET("/vms/export.csv", exportVMs)
 		v1.GET("/vms/:name", getVM)
 		v1.POST("/vms/:name/start", startVM)
+		v1.GET("/creates/failures", getCreateFailures)
+		v1.GET("/webrtc/devices", getWebRTCDevices)
 		v1.POST("/vms/:name/stop", stopVM)
+		v1.POST("/vms/:name/restart", restartVM)
+		v1.POST("/vms/:name/instances/:num/stop", stopVMInstance)
 		v1.POST("/vms/:name/upload", uploadDeviceFile)
 		v1.GET("/vms/:name/apks", getApkFileList)
 		v1.GET("/vms/:name/dir", getWorkspaceFileList)
 		v1.GET("/vms/:name/files", downloadWorkspaceFile)
+		v1.GET("/vms/:name/bundle", downloadDeviceBundle)
 		v1.POST("/vms/:name/config", updateVMConfig)
+		v1.GET("/vms/:name/config/export", exportVMConfig)
+		v1.POST("/vms/:name/config/import", importVMConfig)
+		v1.GET("/vms/:name/ports", getVMPorts)
+		v1.GET("/vms/:name/adb/serial", getADBSerial)
+		v1.GET("/vms/:name/disk", getVMDiskUsage)
+		v1.GET("/vms/:name/foreground", getForegroundActivity)
+		v1.POST("/vms/:name/packages/:pkg/clear", clearAppData)
+		v1.POST("/vms/:name/packages/:pkg/stop", stopApp)
+		v1.POST("/vms/:name/battery", setBattery)
+		v1.GET("/vms/:name/screen", getScreen)
+		v1.POST("/vms/:name/screen", setScreen)
+		v1.POST("/vms/:name/call", simulateCall)
+		v1.POST("/vms/:name/sms", simulateSMS)
+		v1.POST("/vms/:name/location", setLocation)
+		v1.DELETE("/vms/:name/location/route", stopLocationRoute)
+		v1.GET("/vms/:name/build-fingerprint", getBuildFingerprint)
+		v1.GET("/vms/:name/daemon-log/:daemon", getDaemonLog)
+		v1.GET("/vms/:name/hosts", listHostEntries)
+		v1.POST("/vms/:name/hosts", addHostEntry)
+		v1.DELETE("/vms/:name/hosts/:hostname", removeHostEntry)
+		v1.POST("/vms/:name/locale", setLocale)
+		v1.POST("/vms/:name/timezone", setTimezone)
+		v1.POST("/vms/:name/trace", captureTrace)
+		v1.POST("/vms/:name/backup", backupApp)
+		v1.POST("/vms/:name/adb/reset", resetADBServer)
+		v1.POST("/vms/:name/repair", repairVMDaemons)
+		v1.POST("/vms/:name/boot-failure/ack", acknowledgeBootFailure)
+		v1.POST("/vms/:name/sdcard", updateSDCard)
+		v1.GET("/vms/:name/guest/files", getGuestFileList)
+		v1.POST("/vms/:name/guest/pull", pullGuestFile)
+		v1.POST("/vms/:name/guest/push", pushGuestFile)
+		v1.GET("/vms/:name/guest/network", getGuestNetwork)
+		v1.GET("/vms/:name/guest/processes", getGuestProcesses)
+		v1.DELETE("/vms/:name/guest/processes/:pid", killGuestProcess)
 		v1.DELETE("/vms/:name", removeVM)
 		v1.GET("/vms/:name/ws", TerminalHandler)           // websocket
 		v1.GET("/vms/:name/log/:source", LogStreamHandler) // websocket
+		v1.GET("/vms/:name/terminal-recordings", getTerminalRecordings)
+		v1.GET("/vms/:name/terminal-recordings/:file", downloadTerminalRecording)
 		v1.GET("/files/system", getSystemImageList)
 		v1.GET("/files/cvd", getCVDImageList)
+		v1.GET("/files/boot", getBootImageList)
 		v1.POST("/files/upload", uploadImageFile)
+		v1.POST("/files/fetch-aosp", fetchAOSP)
+		v1.GET("/files/fetch-aosp/:id", getFetchAOSP)
+		v1.POST("/files/fetch-aosp/:id/cancel", cancelFetchAOSP)
+		v1.GET("/files/fetch-aosp/:id/ws", FetchAOSPStreamHandler) // websocket
 		v1.GET("/ips", getConnectionIPs)
+		v1.GET("/disk", getDiskUsage)
+		v1.GET("/settings", getSettings)
+
+		admin := v1.Group("/admin")
+		admin.Use(requireAdmin)
+		admin.POST("/prune", pruneVMs)
+		admin.POST("/reap", reapVMs)
+		admin.POST("/settings", updateSettings)
+		admin.GET("/all-cuttlefish", listAllCuttlefish)
+		// the server posts to any registered URL, and the URLs may carry secrets
+		admin.GET("/webhooks", getWebhooks)
+		admin.POST("/webhooks", addWebhook)
+		admin.DELETE("/webhooks/:id", removeWebhook)
 	}
 	router.Run()
 	defer v.Close()
 }
 
+// connectVMM creates the VMM with exponential backoff until the Docker daemon becomes reachable.
+func connectVMM(dataDir string) {
+	backoff := 1 * time.Second
+	maxBackoff := 30 * time.Second
+	for {
+		vm, err := vmm.NewVMM(dataDir)
+		if err == nil {
+			configureVMM(vm)
+			v = vm
+			close(vmmReady)
+			log.Println("VMM is ready")
+			// boot the VMs brought back by their restart policy, e.g. after a host reboot
+			if started := v.VMAutostart(); len(started) > 0 {
+				log.Printf("Auto-started %d VM(s): %v\n", len(started), started)
+			}
+			return
+		}
+		log.Printf("Failed to initialize VMM, retry in %s. Reason: %v\n", backoff, err)
+		time.Sleep(backoff)
+		backoff = backoff * 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// configureVMM applies settings from environment variables
+//   - LAUNCH_FLAG_ALLOWLIST: comma-separated launch_cvd flags that overrides vmm.DefaultAllowedLaunchFlags
+//   - OFFLINE: if "true", VMs are set up without installing packages from the network
+//   - DEFAULT_RESTART_POLICY: restart policy of new VM containers e.g. "unless-stopped"
+//   - EXEC_TIMEOUT: maximum duration of a command run in a container e.g. "5m"
+//   - LONG_EXEC_TIMEOUT: maximum duration of a command that may take long e.g. unzipping an image, defaults to "2h"
+//   - TMP_DIR: base folder of temporary files, defaults to DATA_DIR/tmp
+//   - MAX_BOOT_ATTEMPTS: failed boots in a row before a VM is no longer auto-started, 0 to disable
+//   - DISK_LIMIT_CHECKS: consecutive disk checks over the limit before a VM is stopped, defaults to 3
+//   - GUEST_NETWORK_CHECK_HOST: host pinged by GET /vms/:name/guest/network, defaults to vmm.GuestNetworkCheckHost
+//   - REAP_AFTER: remove VMs whose containers have exited or died for longer than this e.g. "24h", disabled if empty
+//   - REAP_DRY_RUN: if "true", the periodic reaper only logs the VMs to be removed
+//   - MAX_DEVICE_NAME_LENGTH: longest device name accepted without force_long_name, defaults to 20
+//   - KEEP_DATA_ON_REMOVE: if "true", removed VMs keep their device folders unless keep_data=false is given
+func configureVMM(vm *vmm.VMM) {
+	if flagAllowlist := getenv("LAUNCH_FLAG_ALLOWLIST", ""); flagAllowlist != "" {
+		vm.AllowedLaunchFlags = strings.Split(flagAllowlist, ",")
+	}
+	vm.Offline = getenv("OFFLINE", "") == "true"
+	vm.DefaultRestartPolicy = getenv("DEFAULT_RESTART_POLICY", "")
+	if maxBootAttempts, err := strconv.Atoi(getenv("MAX_BOOT_ATTEMPTS", "")); err == nil {
+		vm.MaxBootAttempts = maxBootAttempts
+	}
+	if diskLimitChecks, err := strconv.Atoi(getenv("DISK_LIMIT_CHECKS", "")); err == nil {
+		vm.DiskLimitChecks = diskLimitChecks
+	}
+	if tmpDir := getenv("TMP_DIR", ""); tmpDir != "" {
+		expanded, err := vmm.ExpandPath(tmpDir)
+		if err != nil {
+			log.Printf("Ignored invalid TMP_DIR %s. reason: %v\n", tmpDir, err)
+		} else {
+			vm.TmpDir = expanded
+		}
+	}
+	if host := getenv("GUEST_NETWORK_CHECK_HOST", ""); host != "" {
+		vmm.GuestNetworkCheckHost = host
+	}
+	if reapAfter := getenv("REAP_AFTER", ""); reapAfter != "" {
+		d, err := time.ParseDuration(reapAfter)
+		if err != nil {
+			log.Printf("Ignored invalid REAP_AFTER %s. reason: %v\n", reapAfter, err)
+		} else {
+			vm.ReapAfter = d
+		}
+	}
+	vm.ReapDryRun = getenv("REAP_DRY_RUN", "") == "true"
+	vm.KeepDataOnRemove = getenv("KEEP_DATA_ON_REMOVE", "") == "true"
+	if maxLen, err := strconv.Atoi(getenv("MAX_DEVICE_NAME_LENGTH", "")); err == nil && maxLen > 0 {
+		MaxDeviceNameLength = maxLen
+	}
+	if execTimeout := getenv("EXEC_TIMEOUT", ""); execTimeout != "" {
+		timeout, err := time.ParseDuration(execTimeout)
+		if err != nil {
+			log.Printf("Ignored invalid EXEC_TIMEOUT %s. reason: %v\n", execTimeout, err)
+		} else {
+			vm.ExecTimeout = timeout
+		}
+	}
+	if longExecTimeout := getenv("LONG_EXEC_TIMEOUT", ""); longExecTimeout != "" {
+		timeout, err := time.ParseDuration(longExecTimeout)
+		if err != nil {
+			log.Printf("Ignored invalid LONG_EXEC_TIMEOUT %s. reason: %v\n", longExecTimeout, err)
+		} else {
+			vm.LongExecTimeout = timeout
+		}
+	}
+}
+
+// requireVMM rejects API calls until the VMM has been initialized.
+func requireVMM(c *gin.Context) {
+	select {
+	case <-vmmReady:
+		c.Next()
+	default:
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Docker daemon is not reachable yet"})
+	}
+}
+
+// requireAdmin guards destructive endpoints. The admin API is disabled unless ADMIN_TOKEN is set, in which case
+// requests must carry the same token in the X-Admin-Token header.
+func requireAdmin(c *gin.Context) {
+	token := getenv("ADMIN_TOKEN", "")
+	if token == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin API is disabled, set ADMIN_TOKEN to enable it"})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(c.GetHeader("X-Admin-Token")), []byte(token)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+		return
+	}
+	c.Next()
+}
+
+func getHealth(c *gin.Context) {
+	select {
+	case <-vmmReady:
+		// the daemon may have become unresponsive since the VMM was initialized
+		if err := v.CheckDocker(); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	default:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": "Docker daemon is not reachable yet"})
+	}
+}
+
 // Open a shared WS connection for features that require either
 // - periodic query e.g. wsListVM() OR
 // - live update e.g. wsCreateVM()
@@ -178,7 +502,11 @@ func main() {
 // - create a handler with name starts with `ws` e.g. wsXxx
 // - register the handler in wsHandler() as a switch case
 func wsHandler(w http.ResponseWriter, r *http.Request) {
-	wsConn, err := wsUpgrader.Upgrade(w, r, nil)
+	header, ok := wsAuthorize(w, r)
+	if !ok {
+		return
+	}
+	wsConn, err := wsUpgrader.Upgrade(w, r, header)
 	if err != nil {
 		log.Printf("Failed to set websocket upgrade: %+v", err)
 		return
@@ -244,7 +572,7 @@ func wsError(c *Connection, t WsMessageType, msg string) {
 
 func wsInstallAPK(c *Connection, req InstallAPKRequest) {
 	containerName := CFPrefix + req.DeviceName
-	err := v.VMInstallAPK(containerName, req.File)
+	result, err := v.VMInstallAPKWithOptions(containerName, req.File, vmm.InstallAPKOptions{Launch: req.Launch})
 	if err != nil {
 		wsError(c, WS_TYPE_INSTALL_APK, err.Error())
 		return
@@ -253,8 +581,11 @@ func wsInstallAPK(c *Connection, req InstallAPKRequest) {
 		Type:     WS_TYPE_INSTALL_APK,
 		HasError: false,
 		Data: &InstallAPKResponse{
-			DeviceName: req.DeviceName,
-			File:       req.File,
+			DeviceName:  req.DeviceName,
+			File:        req.File,
+			PackageName: result.PackageName,
+			Launched:    result.Launched,
+			LaunchError: result.LaunchError,
 		},
 	}
 }
@@ -282,20 +613,27 @@ func wsListVM(c *Connection) {
 // Create and start a new VM in multiple steps (CreateVMStep).
 // Send live updates through websocket
 func wsCreateVM(c *Connection, req CreateVMRequest) {
+	s := &createVMSession{
+		conn:       c,
+		reqID:      newRequestID(),
+		deviceName: req.DeviceName,
+		timer:      newCreateVMTimer(),
+	}
+	log.Printf("[%s] CreateVM %s requested", s.reqID, req.DeviceName)
 	// 1 - STEP_START: request received
-	wsCreateVMCompleteStep(c, STEP_START)
+	wsCreateVMCompleteStep(s, STEP_START)
 
 	// 2 - STEP_PREFLIGHT_CHECKS
 	vmList, err := v.VMList()
 	if err != nil {
-		wsCreateVMFailStep(c, STEP_PREFLIGHT_CHECKS, "Failed to retrieve VM info")
+		wsCreateVMFailStep(s, STEP_PREFLIGHT_CHECKS, "Failed to retrieve VM info: "+err.Error())
 		return
 	}
-	// check if a device of the same name already exists
-	// TODO move name check before submit
+	// check if a device of the same name already exists to fail early, VMCreate checks again in case of a
+	// concurrent create of the same name
 	for _, vm := range vmList {
 		if vm.Name == req.DeviceName {
-			wsCreateVMFailStep(c, STEP_PREFLIGHT_CHECKS, "A VM of the same name already exists.")
+			wsCreateVMFailStep(s, STEP_PREFLIGHT_CHECKS, "A VM of the same name already exists.")
 			return
 		}
 	}
@@ -306,37 +644,107 @@ func wsCreateVM(c *Connection, req CreateVMRequest) {
 		systemImagePath,
 		cvdImagePath,
 	}
+	bootImagePath := v.UploadDir + "/" + req.BootImage
+	if req.BootImage != "" {
+		images = append(images, bootImagePath)
+	}
+	vendorBootImagePath := v.UploadDir + "/" + req.VendorBootImage
+	if req.VendorBootImage != "" {
+		images = append(images, vendorBootImagePath)
+	}
+	sdcardImagePath := v.UploadDir + "/" + req.SDCardImage
+	if req.SDCardImage != "" {
+		images = append(images, sdcardImagePath)
+	}
+	superImagePath := v.UploadDir + "/" + req.SuperImage
+	if req.SuperImage != "" {
+		images = append(images, superImagePath)
+	}
 	for _, img := range images {
 		if _, err := os.Stat(img); os.IsNotExist(err) {
-			wsCreateVMFailStep(c, STEP_PREFLIGHT_CHECKS, "Cannot find the selected image(s)")
+			wsCreateVMFailStep(s, STEP_PREFLIGHT_CHECKS, "Cannot find the selected image(s)")
+			return
+		}
+	}
+	if !hasExtension(req.SystemImage, systemImageExtensions) || !hasExtension(req.CVDImage, cvdImageExtensions) {
+		wsCreateVMFailStep(s, STEP_PREFLIGHT_CHECKS, fmt.Sprintf("Unsupported image(s), the system image must be %s and the CVD image must be %s",
+			strings.Join(systemImageExtensions, "/"), strings.Join(cvdImageExtensions, "/")))
+		return
+	}
+	if req.SuperImage != "" {
+		if err := vmm.ValidateSuperImage(superImagePath); err != nil {
+			wsCreateVMFailStep(s, STEP_PREFLIGHT_CHECKS, err.Error())
+			return
+		}
+	}
+	if req.AOSPVersion != "" {
+		aospVersion, err := vmm.NormalizeAOSPVersion(req.AOSPVersion)
+		if err != nil {
+			wsCreateVMFailStep(s, STEP_PREFLIGHT_CHECKS, err.Error())
 			return
 		}
+		req.AOSPVersion = string(aospVersion)
+	}
+
+	// hold the VM's CPUs and memory until it has booted or failed to, so that concurrent creates can't oversubscribe
+	// the host while this one is loading images
+	release, err := v.ReserveResources(CFPrefix+req.DeviceName, req.CPU, req.RAM)
+	if err != nil {
+		wsCreateVMFailStep(s, STEP_PREFLIGHT_CHECKS, err.Error())
+		return
 	}
+	defer release()
+
+	// preflight checks don't have a complete message so only record the time
+	s.timer.lap(STEP_PREFLIGHT_CHECKS)
 
 	// 3 - STEP_CREATE_VM
-	match, _ := regexp.MatchString("^[a-zA-z0-9-_]+$", req.DeviceName)
-	if !match {
-		wsCreateVMFailStep(c, STEP_CREATE_VM, "Failed to create VM. Reason: device name contains characters other than alphanumerics and _-")
+	if err := v.ValidateDeviceName(req.DeviceName); err != nil {
+		wsCreateVMFailStep(s, STEP_CREATE_VM, "Failed to create VM. Reason: "+err.Error())
 		return
 	}
-	if len(req.DeviceName) > 20 {
-		wsCreateVMFailStep(c, STEP_CREATE_VM, "Failed to create VM. Reason: device name exceed 20 characters")
+	if max := MaxDeviceNameLength; !req.ForceLongName && max < v.MaxDeviceNameLength() && len(req.DeviceName) > max {
+		wsCreateVMFailStep(s, STEP_CREATE_VM, fmt.Sprintf("Failed to create VM. Reason: device name exceeds %d characters, "+
+			"set force_long_name to allow up to %d", max, v.MaxDeviceNameLength()))
 		return
 	}
-	containerName, err := v.VMCreate(req.DeviceName, req.CPU, req.RAM, req.AOSPVersion, req.Cmdline)
+	containerName, err := v.VMCreateWithOptions(req.DeviceName, vmm.VMCreateOptions{
+		CPU:         req.CPU,
+		RAM:         req.RAM,
+		AOSPVersion: req.AOSPVersion,
+		Cmdline:     req.Cmdline,
+		Image:       req.Image,
+
+		RestartPolicy:        req.RestartPolicy,
+		GuestEnforceSecurity: req.GuestEnforceSecurity,
+		GuestAuditSecurity:   req.GuestAuditSecurity,
+		BootImage:            req.BootImage,
+		VendorBootImage:      req.VendorBootImage,
+		DNS:                  req.DNS,
+		SDCardMB:             req.SDCardMB,
+		SDCardImage:          req.SDCardImage,
+		SuperImage:           req.SuperImage,
+		CpusetCpus:           req.CpusetCpus,
+		DataImageMB:          req.DataImageMB,
+		Autostart:            req.Autostart,
+		GPUMode:              req.GPUMode,
+		Labels:               req.Labels,
+		ReuseData:            req.ReuseData,
+	})
 
 	if err != nil {
-		wsCreateVMFailStep(c, STEP_CREATE_VM, "Failed to create VM. Reason: "+err.Error())
+		wsCreateVMFailStep(s, STEP_CREATE_VM, "Failed to create VM. Reason: "+err.Error())
 		return
 	}
-	wsCreateVMLog(c, "Created device container "+containerName)
-	wsCreateVMLog(c, "Running pre-boot setup...")
+	wsCreateVMLog(s, "Created device container "+containerName)
+	wsCreateVMLog(s, "Running pre-boot setup...")
 	err = v.VMPreBootSetup(containerName)
 	if err != nil {
-		wsCreateVMFailStep(c, STEP_CREATE_VM, "Failed to complete pre-boot setup. Reason: "+err.Error())
+		// err tells the failed sub-step e.g. "failed to install tools: failed to install adb..."
+		wsCreateVMFailStep(s, STEP_CREATE_VM, "Pre-boot setup failed: "+err.Error())
 		return
 	}
-	wsCreateVMCompleteStep(c, STEP_CREATE_VM)
+	wsCreateVMCompleteStep(s, STEP_CREATE_VM)
 
 	// 4 - STEP_LOAD_IMAGES
 	// ** Time and space considerations on image loading **
@@ -348,74 +756,185 @@ func wsCreateVM(c *Connection, req CreateVMRequest) {
 	// save lots of time in docker copy (1GB tar + 1GB untar + 13GB unzip).
 
 	// Load system image (.zip) and unzip in the container
-	wsCreateVMLog(c, "Loading system image "+req.SystemImage+"...")
-	err = v.VMLoadFile(containerName, systemImagePath)
+	wsCreateVMLog(s, "Loading system image "+req.SystemImage+"...")
+	err = v.VMLoadFileWithProgress(containerName, systemImagePath, wsCreateVMCopyProgress(s, "system image"))
 	if err != nil {
-		wsCreateVMFailStep(c, STEP_LOAD_IMAGES, "Failed to load system iamge. Reason: "+err.Error())
+		wsCreateVMFailStep(s, STEP_LOAD_IMAGES, "Failed to load system iamge. Reason: "+err.Error())
 		return
 	}
-	wsCreateVMLog(c, "Unzipping system image "+req.SystemImage+"...")
-	err = v.VMUnzipImage(containerName, req.SystemImage)
+	wsCreateVMLog(s, "Unzipping system image "+req.SystemImage+"...")
+	err = v.VMUnzipImageWithProgress(containerName, req.SystemImage, func(p vmm.UnzipProgress) {
+		wsCreateVMLog(s, "Unzipping system image: "+p.String())
+	})
 	if err != nil {
-		wsCreateVMFailStep(c, STEP_LOAD_IMAGES, "Failed to unzip system iamge. Reason: "+err.Error())
+		wsCreateVMFailStep(s, STEP_LOAD_IMAGES, "Failed to unzip system iamge. Reason: "+err.Error())
 		return
 	}
 	// Load CVD image (.tar)
-	wsCreateVMLog(c, "Loading CVD image "+req.CVDImage+"...")
-	err = v.VMLoadFile(containerName, cvdImagePath)
+	wsCreateVMLog(s, "Loading CVD image "+req.CVDImage+"...")
+	err = v.VMLoadFileWithProgress(containerName, cvdImagePath, wsCreateVMCopyProgress(s, "CVD image"))
 	if err != nil {
-		wsCreateVMFailStep(c, STEP_LOAD_IMAGES, "Failed to load system iamge. Reason: "+err.Error())
+		wsCreateVMFailStep(s, STEP_LOAD_IMAGES, "Failed to load system iamge. Reason: "+err.Error())
 		return
 	}
-	wsCreateVMCompleteStep(c, STEP_LOAD_IMAGES)
+	// Load boot/vendor_boot image overrides (.img)
+	if req.BootImage != "" {
+		wsCreateVMLog(s, "Loading boot image "+req.BootImage+"...")
+		if err := v.VMLoadFileWithProgress(containerName, bootImagePath, wsCreateVMCopyProgress(s, "boot image")); err != nil {
+			wsCreateVMFailStep(s, STEP_LOAD_IMAGES, "Failed to load boot image. Reason: "+err.Error())
+			return
+		}
+	}
+	if req.VendorBootImage != "" {
+		wsCreateVMLog(s, "Loading vendor_boot image "+req.VendorBootImage+"...")
+		if err := v.VMLoadFileWithProgress(containerName, vendorBootImagePath, wsCreateVMCopyProgress(s, "vendor_boot image")); err != nil {
+			wsCreateVMFailStep(s, STEP_LOAD_IMAGES, "Failed to load vendor_boot image. Reason: "+err.Error())
+			return
+		}
+	}
+	if req.SDCardImage != "" {
+		wsCreateVMLog(s, "Loading sdcard image "+req.SDCardImage+"...")
+		if err := v.VMLoadFileWithProgress(containerName, sdcardImagePath, wsCreateVMCopyProgress(s, "sdcard image")); err != nil {
+			wsCreateVMFailStep(s, STEP_LOAD_IMAGES, "Failed to load sdcard image. Reason: "+err.Error())
+			return
+		}
+	}
+	if req.SuperImage != "" {
+		wsCreateVMLog(s, "Loading super image "+req.SuperImage+"...")
+		if err := v.VMLoadFileWithProgress(containerName, superImagePath, wsCreateVMCopyProgress(s, "super image")); err != nil {
+			wsCreateVMFailStep(s, STEP_LOAD_IMAGES, "Failed to load super image. Reason: "+err.Error())
+			return
+		}
+	}
+	wsCreateVMCompleteStep(s, STEP_LOAD_IMAGES)
 
 	// 5 - STEP_START_VM
-	err = v.VMStart(containerName, false, "", func(lines string) {
-		wsCreateVMLog(c, lines)
+	result, err := v.VMStart(containerName, false, vmm.VMStartOptions{WaitForUI: req.WaitForUI, Daemon: req.Daemon}, func(lines string) {
+		wsCreateVMLog(s, lines)
 	})
 	if err != nil {
-		wsCreateVMFailStep(c, STEP_START_VM, "VM failed to start. Reason: "+err.Error())
+		wsCreateVMFailStep(s, STEP_START_VM, bootFailureMessage(result))
 		return
 	}
-	wsCreateVMCompleteStep(c, STEP_START_VM)
+	wsCreateVMCompleteStep(s, STEP_START_VM)
 }
 
-func wsCreateVMCompleteStep(c *Connection, step CreateVMStep) {
-	log.Printf("CreateVM done step %d", step)
-	c.send <- &WebSocketResponse{
-		Type: WS_TYPE_CREATE_VM,
+func wsCreateVMCompleteStep(s *createVMSession, step CreateVMStep) {
+	elapsed := s.timer.lap(step)
+	log.Printf("[%s] CreateVM done step %d in %.1fs", s.reqID, step, elapsed)
+	s.conn.send <- &WebSocketResponse{
+		Type:      WS_TYPE_CREATE_VM,
+		RequestID: s.reqID,
 		Data: &CreateVMResponse{
-			Step: step,
+			Step:          step,
+			StepDurations: s.timer.snapshot(),
 		},
 	}
 }
 
-func wsCreateVMFailStep(c *Connection, step CreateVMStep, errorMsg string) {
-	log.Printf("CreateVM failed at step %d due to %s", step, errorMsg)
-	c.send <- &WebSocketResponse{
-		Type: WS_TYPE_CREATE_VM,
+func wsCreateVMFailStep(s *createVMSession, step CreateVMStep, errorMsg string) {
+	elapsed := s.timer.lap(step)
+	log.Printf("[%s] CreateVM failed at step %d after %.1fs due to %s", s.reqID, step, elapsed, errorMsg)
+	// keep a record for GET /creates/failures
+	s.logMu.Lock()
+	logTail := strings.Join(s.logTail, "\n")
+	s.logMu.Unlock()
+	err := v.RecordCreateFailure(vmm.CreateFailure{
+		Device:    s.deviceName,
+		RequestID: s.reqID,
+		Step:      step.String(),
+		Error:     errorMsg,
+		Log:       logTail,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		log.Printf("[%s] CreateVM failed to record the failure: %v", s.reqID, err)
+	}
+	s.conn.send <- &WebSocketResponse{
+		Type:      WS_TYPE_CREATE_VM,
+		RequestID: s.reqID,
 		Data: &CreateVMResponse{
-			Step: step,
+			Step:          step,
+			StepDurations: s.timer.snapshot(),
 		},
 		HasError: true,
 		ErrorMsg: errorMsg,
 	}
 }
 
-func wsCreateVMLog(c *Connection, lines string) {
-	c.send <- &WebSocketResponse{
-		Type: WS_TYPE_CREATE_VM_LOG,
+// wsCreateVMCopyProgress returns a VMLoadFileWithProgress callback that logs e.g.
+// "Copying system image: 4.2GB/13GB (38%, 120MB/s, ~1m18s left)"
+func wsCreateVMCopyProgress(s *createVMSession, name string) func(vmm.CopyProgress) {
+	return func(p vmm.CopyProgress) {
+		wsCreateVMLog(s, fmt.Sprintf("Copying %s: %s", name, p))
+	}
+}
+
+// newRequestID returns a short random ID for correlating the log lines of a request.
+func newRequestID() string {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
+
+func wsCreateVMLog(s *createVMSession, lines string) {
+	log.Printf("[%s] CreateVM: %s", s.reqID, strings.TrimRight(lines, "\n"))
+	s.logMu.Lock()
+	s.logTail = append(s.logTail, strings.Split(strings.TrimRight(lines, "\n"), "\n")...)
+	if len(s.logTail) > createFailureLogLines {
+		s.logTail = s.logTail[len(s.logTail)-createFailureLogLines:]
+	}
+	s.logMu.Unlock()
+	s.conn.send <- &WebSocketResponse{
+		Type:      WS_TYPE_CREATE_VM_LOG,
+		RequestID: s.reqID,
 		Data: &CreateVMLogResponse{
 			Log: lines,
 		},
 	}
 }
 
+// getWebRTCDevices lists the devices that can be streamed over WebRTC, see vmm.VMListWebRTCDevices. The operator URL
+// points to the operator's port on the host that the client reached the API server through.
+func getWebRTCDevices(c *gin.Context) {
+	devices, err := v.VMListWebRTCDevices()
+	if err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	host, _, err := net.SplitHostPort(c.Request.Host)
+	if err != nil {
+		// no port in the Host header, e.g. example.com or [::1]
+		host = strings.Trim(c.Request.Host, "[]")
+	}
+	vms := make([]gin.H, len(devices))
+	for i, device := range devices {
+		vms[i] = gin.H{
+			"name":         strings.TrimPrefix(device.ContainerName, CFPrefix),
+			"device_id":    device.DeviceID,
+			"operator_url": "http://" + net.JoinHostPort(host, strconv.Itoa(device.OperatorPort)),
+		}
+	}
+	c.JSON(200, gin.H{"devices": vms})
+}
+
+// getCreateFailures lists the latest failed VM creations with the log tail of each
+func getCreateFailures(c *gin.Context) {
+	failures, err := v.ListCreateFailures()
+	if err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"failures": failures})
+}
+
 func getVM(c *gin.Context) {
 	name := c.Param("name")
 	vmList, err := v.VMList()
 	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		abortWithVMError(c, err)
 		return
 	}
 	for _, vm := range vmList {
@@ -430,180 +949,1237 @@ func getVM(c *gin.Context) {
 func startVM(c *gin.Context) {
 	name := CFPrefix + c.Param("name")
 	// TODO add default options
-	if err := v.VMStart(name, true, "", func(string) {}); err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+	opts := vmm.VMStartOptions{Daemon: c.Query("daemon") == "true", GPUMode: c.Query("gpu_mode")}
+	result, err := v.VMStart(name, true, opts, func(string) {})
+	if errors.Is(err, vmm.ErrOperationInProgress) || errors.Is(err, vmm.ErrVMAlreadyRunning) {
+		abortWithVMError(c, err)
 		return
 	}
-	c.JSON(200, gin.H{"message": "ok"})
+	if err != nil {
+		c.AbortWithStatusJSON(500, gin.H{
+			"error":  APIError{Code: ErrCodeBootFailed, Message: bootFailureMessage(result)},
+			"result": result,
+		})
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok", "result": result})
+}
+
+// bootFailureMessage explains a failed vmm.BootResult to users
+func bootFailureMessage(result vmm.BootResult) string {
+	switch result.Status {
+	case vmm.BootStatusTimeout:
+		return fmt.Sprintf("VM didn't finish booting in %.0fs, it may still be booting in the background. Reason: %s",
+			result.ElapsedSeconds, result.Reason)
+	case vmm.BootStatusCrashed:
+		return fmt.Sprintf("launch_cvd exited after %.0fs. Reason: %s. Last output:\n%s",
+			result.ElapsedSeconds, result.Reason, strings.Join(result.LastLogLines, "\n"))
+	}
+	return "VM failed to start. Reason: " + result.Reason
 }
 
 func stopVM(c *gin.Context) {
 	name := CFPrefix + c.Param("name")
 	if err := v.VMStop(name); err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		abortWithVMError(c, err)
 		return
 	}
 	c.JSON(200, gin.H{"message": "ok"})
 }
 
-func removeVM(c *gin.Context) {
+// restartVM reboots the VM's guest without recreating its container, and returns once launch_cvd is relaunched
+func restartVM(c *gin.Context) {
 	name := CFPrefix + c.Param("name")
-	if err := v.VMRemove(name); err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+	if err := v.VMRestart(name); err != nil {
+		abortWithVMError(c, err)
 		return
 	}
 	c.JSON(200, gin.H{"message": "ok"})
 }
 
-type ConfigKV struct {
-	key   string `json:"key"`
-	value string `json:"value"`
+// stopVMInstance stops one guest instance of a VM launched with --num_instances
+func stopVMInstance(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	num, err := strconv.Atoi(c.Param("num"))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "invalid instance number "+c.Param("num"))
+		return
+	}
+	if err := v.VMStopInstance(name, num); err != nil {
+		abortWithVMError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
 }
 
-// TODO accept multiple key-value pairs
-func updateVMConfig(c *gin.Context) {
+// removeVM removes a VM. With keep_data=true its device folder is kept so that it can be reused by a new VM of the
+// same name, otherwise it's removed unless KEEP_DATA_ON_REMOVE is set.
+func removeVM(c *gin.Context) {
 	name := CFPrefix + c.Param("name")
-	json := make(map[string]interface{})
-	c.BindJSON(&json)
-
-	fmt.Println(json)
-	if json["key"] == vmm.CONFIG_KEY_CMDLINE {
-		err := v.ContainerUpdateConfig(name, vmm.CONFIG_KEY_CMDLINE, fmt.Sprintf("%v", json["value"]))
+	opts := vmm.VMRemoveOptions{KeepData: v.KeepDataOnRemove}
+	if keepData := c.Query("keep_data"); keepData != "" {
+		keep, err := strconv.ParseBool(keepData)
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-				"message": err.Error(),
-			})
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "invalid keep_data "+keepData)
 			return
 		}
-		c.JSON(200, gin.H{"message": "ok"})
+		opts.KeepData = keep
+	}
+	if err := v.VMRemoveWithOptions(name, opts); err != nil {
+		abortWithVMError(c, err)
 		return
 	}
-	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-		"message": "invalid config key",
-	})
+	c.JSON(200, gin.H{"message": "ok"})
 }
 
-func getSystemImageList(c *gin.Context) {
-	getFilesInFolder(c, ".zip", v.UploadDir)
+// acknowledgeBootFailure lets a VM marked as boot-failed be auto-started again
+func acknowledgeBootFailure(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	if err := v.VMAcknowledgeBootFailure(name); err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
 }
 
-func getCVDImageList(c *gin.Context) {
-	getFilesInFolder(c, ".tar", v.UploadDir)
+type BulkVMRequest struct {
+	Action string   `json:"action" binding:"required"` // "stop", "start" or "remove"
+	Names  []string `json:"names" binding:"required"`
 }
 
-func getApkFileList(c *gin.Context) {
-	containerName := CFPrefix + c.Param("name")
-	getFilesInFolder(c, ".apk", path.Join(v.DevicesDir, containerName))
+type BulkVMResult struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
 }
 
-func getFilesInFolder(c *gin.Context, fileExtension string, folder string) {
-	var files []string
-
-	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
-		if strings.HasSuffix(path, fileExtension) {
-			files = append(files, filepath.Base(path))
+// bulkVMAction applies the same action to multiple VMs. A failure on one VM doesn't abort the others, so the
+// response always has one result per VM in the same order as the request. Bulk starts wait for the VMs to boot, so
+// that startLimiter caps the boots rather than just the launches, and report the boot failures.
+func bulkVMAction(c *gin.Context) {
+	var req BulkVMRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var action func(containerName string) error
+	switch req.Action {
+	case "stop":
+		action = v.VMStop
+	case "remove":
+		action = v.VMRemove
+	case "start":
+		action = func(containerName string) error {
+			// launch_cvd is CPU and IO heavy at boot, so only let a few VMs boot at once
+			startLimiter <- struct{}{}
+			defer func() { <-startLimiter }()
+			result, err := v.VMStart(containerName, false, vmm.VMStartOptions{}, func(string) {})
+			if err != nil && result.Status != vmm.BootStatusFailed {
+				return errors.New(bootFailureMessage(result))
+			}
+			return err
 		}
-		return nil
-	})
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"message": err.Error(),
-		})
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid bulk action " + req.Action})
 		return
 	}
-	c.JSON(200, gin.H{"files": files})
-}
 
-func uploadImageFile(c *gin.Context) {
-	uploadFile(c, []string{".zip", ".tar", ".gz"}, v.UploadDir)
+	results := make([]BulkVMResult, len(req.Names))
+	var wg sync.WaitGroup
+	for i, name := range req.Names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			results[i].Name = name
+			if err := action(CFPrefix + name); err != nil {
+				log.Printf("Bulk %s failed on VM %s: %v\n", req.Action, name, err)
+				results[i].Error = err.Error()
+			}
+		}(i, name)
+	}
+	wg.Wait()
+	c.JSON(200, gin.H{"results": results})
 }
 
-func uploadDeviceFile(c *gin.Context) {
-	containerName := CFPrefix + c.Param("name")
-	uploadFile(c, []string{".apk"}, path.Join(v.DevicesDir, containerName))
+// getVMDiskUsage reports how much of the disk limit a VM has used, so that users can clean up before diskSheriff
+// stops the VM
+func getVMDiskUsage(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	usage, err := v.VMGetDiskUsage(name)
+	if err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"usage": usage, "limit": diskLimitBytes()})
 }
 
-func uploadFile(c *gin.Context, allowedExtensions []string, dstFolder string) {
-	file, err := c.FormFile("file")
-	// The file cannot be received.
+// getDiskUsage reports the disk usage of all VMs in bytes and the sum of them
+func getDiskUsage(c *gin.Context) {
+	usage, err := v.VMGetAllDiskUsage()
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"message": "No file is received",
-		})
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
 		return
 	}
+	vms := map[string]int64{}
+	var total int64
+	for containerName, size := range usage {
+		vms[strings.TrimPrefix(containerName, CFPrefix)] = size
+		if size > 0 {
+			total += size
+		}
+	}
+	c.JSON(200, gin.H{"vms": vms, "total": total, "limit": diskLimitBytes()})
+}
 
-	// Retrieve file information
-	ext := filepath.Ext(file.Filename)
-
-	for _, e := range allowedExtensions {
-		if ext == e {
-			// The file is received, so let's save it
-			if err := c.SaveUploadedFile(file, path.Join(dstFolder, file.Filename)); err != nil {
-				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-					"message": "Unable to save the file",
-				})
-				return
-			}
+// diskLimitBytes is the per-VM disk limit enforced by diskSheriff
+func diskLimitBytes() int64 {
+	return int64(vmm.HomeDirSizeLimit) * 1024 * 1024 * 1024
+}
 
-			// File saved successfully. Return proper result
-			c.JSON(http.StatusOK, gin.H{
-				"message": "success",
-			})
-			return
-		}
+// getVMPorts returns the ports of a VM so that clients don't need to derive them from cf_instance
+func getVMPorts(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	ports, err := v.VMGetPorts(name)
+	if err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
 	}
-	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-		"error": "Unsupported file formats"},
-	)
+	c.JSON(200, ports)
 }
 
-func getWorkspaceFileList(c *gin.Context) {
-	containerName := CFPrefix + c.Param("name")
-	p := c.DefaultQuery("path", "")
-	if p == "" {
-		log.Println("Error : empty query string")
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid query path"})
+// getADBSerial returns the serial for connecting an external adb to the VM, e.g. {"serial": "172.17.0.2:6520",
+// "ip": "172.17.0.2", "port": 6520, "host_serial": "127.0.0.1:6520"} where host_serial is the port published on the
+// Docker host's loopback.
+func getADBSerial(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	serial, err := v.VMGetADBSerial(name)
+	if err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
 		return
 	}
-	files, err := v.ContainerListFiles(containerName, p)
+	ip, portStr, err := net.SplitHostPort(serial)
 	if err != nil {
-		log.Println(err.Error())
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid query path"})
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
 		return
 	}
-	c.JSON(200, gin.H{"files": files})
+	port, _ := strconv.Atoi(portStr)
+	c.JSON(200, gin.H{
+		"serial":      serial,
+		"ip":          ip,
+		"port":        port,
+		"host_serial": net.JoinHostPort("127.0.0.1", portStr),
+	})
 }
 
-func downloadWorkspaceFile(c *gin.Context) {
-	containerName := CFPrefix + c.Param("name")
-	p := c.DefaultQuery("path", "")
-	if p == "" {
-		log.Println("Error : empty query string")
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid query path"})
+func getForegroundActivity(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	activity, err := v.VMGetForegroundActivity(name)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
-	reader, err := v.ContainerReadFile(containerName, p)
-	if err != nil {
-		log.Println(err.Error())
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	c.JSON(200, gin.H{"activity": activity})
+}
+
+// clearAppData resets an app to its first-run state without reinstalling it
+func clearAppData(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	if err := v.VMClearAppData(name, c.Param("pkg")); err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
 		return
 	}
-	defer reader.Close()
+	c.JSON(200, gin.H{"message": "ok"})
+}
 
-	tr := tar.NewReader(reader)
-	// first param is the header of the tar file
-	header, err := tr.Next()
-	if err != nil {
-		log.Println(err.Error())
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+func stopApp(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	if err := v.VMStopApp(name, c.Param("pkg")); err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
 		return
 	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
 
-	extraHeaders := map[string]string{
-		"Content-Disposition": fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(p)),
+type BatteryRequest struct {
+	Level    *int `json:"level"` // 0-100, required unless reset is set
+	Charging bool `json:"charging"`
+	Reset    bool `json:"reset"` // go back to the VM's real battery state, other fields are ignored
+}
+
+// setBattery simulates the battery state. Sensors are not covered as the sensor HALs of cuttlefish's Android 9-12
+// images have no adb interface to inject sensor data.
+func setBattery(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	var req BatteryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	// a missing level must not drain the battery to 0%
+	if !req.Reset && (req.Level == nil || *req.Level < 0 || *req.Level > 100) {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "level between 0 and 100 is required")
+		return
+	}
+	var err error
+	if req.Reset {
+		err = v.VMResetBattery(name)
+	} else {
+		err = v.VMSetBattery(name, *req.Level, req.Charging)
+	}
+	if err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
+
+type ScreenRequest struct {
+	// "off", "on", or "wake" to also dismiss the lock screen
+	Action string `json:"action" binding:"required"`
+}
+
+func getScreen(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	state, err := v.VMGetScreenState(name)
+	if err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"state": state})
+}
+
+// setScreen turns the screen on or off and returns the resulting state e.g. {"state": "Asleep"}
+func setScreen(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	var req ScreenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	var state vmm.ScreenState
+	var err error
+	switch req.Action {
+	case "off":
+		state, err = v.VMScreenOff(name)
+	case "on":
+		state, err = v.VMScreenOn(name)
+	case "wake":
+		state, err = v.VMWake(name)
+	default:
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "invalid screen action "+req.Action)
+		return
+	}
+	if err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"state": state})
+}
+
+type CallRequest struct {
+	Number string `json:"number" binding:"required"` // caller's number e.g. "+6581234567"
+}
+
+func simulateCall(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	var req CallRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := v.VMSimulateCall(name, req.Number); err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
+
+type SMSRequest struct {
+	Number string `json:"number" binding:"required"` // sender's number e.g. "+6581234567"
+	Text   string `json:"text" binding:"required"`
+}
+
+func simulateSMS(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	var req SMSRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := v.VMSimulateSMS(name, req.Number, req.Text); err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
+
+// LocationRequest sets either a single location, or a route that is replayed in the background
+type LocationRequest struct {
+	Lat        *float64            `json:"lat"`
+	Lon        *float64            `json:"lon"`
+	Route      []vmm.LocationPoint `json:"route"`
+	IntervalMS int                 `json:"interval_ms"` // between the points of the route, defaults to 1000
+}
+
+func setLocation(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	var req LocationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	var err error
+	switch {
+	case len(req.Route) > 0:
+		interval := time.Second
+		if req.IntervalMS > 0 {
+			interval = time.Duration(req.IntervalMS) * time.Millisecond
+		}
+		err = v.VMPlayRoute(name, req.Route, interval)
+	case req.Lat != nil && req.Lon != nil:
+		err = v.VMSetLocation(name, *req.Lat, *req.Lon)
+	default:
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "either lat and lon or route is required")
+		return
+	}
+	if errors.Is(err, vmm.ErrMockLocationDisabled) {
+		abortWithError(c, http.StatusConflict, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
+
+func stopLocationRoute(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	if !v.VMStopRoute(name) {
+		abortWithError(c, http.StatusNotFound, ErrCodeInvalidRequest, "no route is being played")
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
+
+// getBuildFingerprint reads the fingerprint from the guest, which also refreshes the one returned by GET /vms
+func getBuildFingerprint(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	fingerprint, err := v.VMGetBuildFingerprint(name)
+	if err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"build_fingerprint": fingerprint})
+}
+
+// getDaemonLog returns the log of a daemon in the container as plain text, see vmm.DaemonLogs
+func getDaemonLog(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	daemon := c.Param("daemon")
+	if !isDaemonLog(daemon) {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "invalid daemon "+daemon+", expecting one of "+strings.Join(vmm.DaemonLogs, ", "))
+		return
+	}
+	daemonLog, err := v.VMGetDaemonLog(name, daemon)
+	if err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.String(200, daemonLog)
+}
+
+func isDaemonLog(daemon string) bool {
+	for _, d := range vmm.DaemonLogs {
+		if d == daemon {
+			return true
+		}
+	}
+	return false
+}
+
+func listHostEntries(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	entries, err := v.VMListHostEntries(name)
+	if err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"entries": entries})
+}
+
+type HostEntryRequest struct {
+	Hostname string `json:"hostname" binding:"required"` // e.g. "api.example.com"
+	IP       string `json:"ip" binding:"required"`
+}
+
+func addHostEntry(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	var req HostEntryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := v.VMAddHostEntry(name, req.Hostname, req.IP); err != nil {
+		abortWithHostsError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
+
+func removeHostEntry(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	if err := v.VMRemoveHostEntry(name, c.Param("hostname")); err != nil {
+		abortWithHostsError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
+
+// abortWithHostsError tells apart a VM that needs a restart to remount /system from other failures
+func abortWithHostsError(c *gin.Context, err error) {
+	if errors.Is(err, vmm.ErrRemountNeedsReboot) {
+		abortWithError(c, http.StatusConflict, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	abortWithError(c, 500, ErrCodeInternal, err.Error())
+}
+
+type LocaleRequest struct {
+	Locale string `json:"locale" binding:"required"` // e.g. "fr-FR"
+}
+
+func setLocale(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	var req LocaleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := v.VMSetLocale(name, req.Locale); err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
+
+type TimezoneRequest struct {
+	Timezone string `json:"timezone" binding:"required"` // e.g. "Asia/Singapore"
+}
+
+func setTimezone(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	var req TimezoneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := v.VMSetTimezone(name, req.Timezone); err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
+
+func resetADBServer(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	if err := v.VMResetADBServer(name); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
+
+// repairVMDaemons restores websockify and adb in a VM without going through the full pre-boot setup.
+func repairVMDaemons(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	if err := v.VMRepairDaemons(name); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
+
+type SDCardRequest struct {
+	Action string `json:"action" binding:"required"` // "resize" or "wipe"
+	SizeMB int    `json:"size_mb"`                   // new size for "resize"
+}
+
+// updateSDCard resizes or wipes the blank sdcard of a stopped VM. Changes take effect on the next start.
+func updateSDCard(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	var req SDCardRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var err error
+	switch req.Action {
+	case "resize":
+		err = v.VMResizeSDCard(name, req.SizeMB)
+	case "wipe":
+		err = v.VMWipeSDCard(name)
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid sdcard action " + req.Action})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
+
+type CaptureTraceRequest struct {
+	Process string `json:"process" binding:"required"`
+	Type    string `json:"type"` // "anr" (default) or "heap"
+}
+
+// captureTrace saves an ANR trace or a heap dump of a guest process to the device folder.
+// The file can be downloaded afterwards from /data in the container.
+func captureTrace(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	var req CaptureTraceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var hostPath string
+	var err error
+	switch req.Type {
+	case "", "anr":
+		hostPath, err = v.VMCaptureTrace(name, req.Process)
+	case "heap":
+		hostPath, err = v.VMCaptureHeapDump(name, req.Process)
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid trace type " + req.Type})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"file": filepath.Base(hostPath)})
+}
+
+type BackupAppRequest struct {
+	Package string `json:"package" binding:"required"`
+}
+
+// backupApp backs up the data of an app with adb backup, which is confirmed on the VM's screen automatically.
+// The .ab file can be downloaded afterwards through GET /vms/:name/files?path=/data/<file>.
+func backupApp(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	var req BackupAppRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	hostPath, err := v.VMBackupApp(name, req.Package)
+	if err != nil {
+		abortWithVMError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"file": filepath.Base(hostPath)})
+}
+
+// guestFileError maps guest paths that are not accessible even as root to 403
+func guestFileError(c *gin.Context, err error) {
+	if errors.Is(err, vmm.ErrPermissionDenied) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(500, gin.H{"error": err.Error()})
+}
+
+// getGuestFileList lists a folder on the VM, e.g. /sdcard/Download
+func getGuestFileList(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	p := c.DefaultQuery("path", "/")
+	files, err := v.VMListGuestFiles(name, p)
+	if err != nil {
+		guestFileError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"path": p, "files": files})
+}
+
+// getGuestNetwork checks if the VM is online by pinging ?host=, which defaults to vmm.GuestNetworkCheckHost
+func getGuestNetwork(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	status, err := v.VMCheckGuestNetwork(name, c.DefaultQuery("host", vmm.GuestNetworkCheckHost))
+	if err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(200, status)
+}
+
+func getGuestProcesses(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	processes, err := v.VMListGuestProcesses(name)
+	if err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"processes": processes})
+}
+
+func killGuestProcess(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	pid, err := strconv.Atoi(c.Param("pid"))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "invalid pid "+c.Param("pid"))
+		return
+	}
+	if err := v.VMKillGuestProcess(name, pid); err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
+
+type GuestFileRequest struct {
+	Path string `json:"path" binding:"required"` // path on the VM
+	File string `json:"file"`                    // file in the device folder, only for push
+}
+
+// pullGuestFile copies a file from the VM to the device folder. The file can then be downloaded through
+// GET /vms/:name/files?path=/data/<file>.
+func pullGuestFile(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	var req GuestFileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	hostPath, err := v.VMPullGuestFile(name, req.Path)
+	if err != nil {
+		guestFileError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"file": filepath.Base(hostPath)})
+}
+
+// pushGuestFile copies a file uploaded to the device folder through POST /vms/:name/upload to the VM.
+func pushGuestFile(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	var req GuestFileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.File == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	if err := v.VMPushGuestFile(name, req.File, req.Path); err != nil {
+		guestFileError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
+
+type PruneRequest struct {
+	// VMs with any of these tags are kept. Defaults to ["keep"]
+	KeepTags []string `json:"keep_tags"`
+	DryRun   bool     `json:"dry_run"`
+}
+
+// pruneVMs removes all VMs except the protected ones. Use dry_run to preview the VMs to be removed.
+func pruneVMs(c *gin.Context) {
+	var req PruneRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.KeepTags) == 0 {
+		req.KeepTags = []string{"keep"}
+	}
+	result, err := v.VMPruneWithOptions(vmm.VMPruneOptions{
+		KeepTags: req.KeepTags,
+		DryRun:   req.DryRun,
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	names := make([]string, len(result.Removed))
+	for i, containerName := range result.Removed {
+		names[i] = strings.TrimPrefix(containerName, CFPrefix)
+	}
+	failed := map[string]string{}
+	for containerName, reason := range result.Failed {
+		failed[strings.TrimPrefix(containerName, CFPrefix)] = reason
+	}
+	c.JSON(200, gin.H{"dry_run": req.DryRun, "vms": names, "failed": failed})
+}
+
+type ReapRequest struct {
+	// Go duration e.g. "24h". Defaults to REAP_AFTER, or defaultReapAfter if the periodic reaper is disabled
+	OlderThan string `json:"older_than"`
+	DryRun    bool   `json:"dry_run"`
+}
+
+// listAllCuttlefish lists the cuttlefish containers of all VMMs on the host, e.g. to debug cf_instance conflicts
+// between a dev and a test instance.
+func listAllCuttlefish(c *gin.Context) {
+	containers, err := v.VMListAllCuttlefish()
+	if err != nil {
+		abortWithVMError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"containers": containers})
+}
+
+// default ReapRequest.OlderThan when REAP_AFTER isn't set
+const defaultReapAfter = 24 * time.Hour
+
+// reapVMs removes the VMs whose containers have exited or died for a while, see vmm.VMReap
+func reapVMs(c *gin.Context) {
+	var req ReapRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	olderThan := v.ReapAfter
+	if olderThan <= 0 {
+		olderThan = defaultReapAfter
+	}
+	if req.OlderThan != "" {
+		d, err := time.ParseDuration(req.OlderThan)
+		if err != nil || d < 0 {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "invalid older_than "+req.OlderThan)
+			return
+		}
+		olderThan = d
+	}
+	result, err := v.VMReap(olderThan, req.DryRun)
+	if err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	names := make([]string, len(result.Removed))
+	for i, containerName := range result.Removed {
+		names[i] = strings.TrimPrefix(containerName, CFPrefix)
+	}
+	failed := map[string]string{}
+	for containerName, reason := range result.Failed {
+		failed[strings.TrimPrefix(containerName, CFPrefix)] = reason
+	}
+	c.JSON(200, gin.H{"dry_run": req.DryRun, "older_than": olderThan.String(), "vms": names, "failed": failed})
+}
+
+// Settings are host-wide settings that can be changed at runtime. Durations are in Go's format e.g. "5m".
+type Settings struct {
+	BootTimeout string `json:"boot_timeout"` // maximum waiting time for a VM to boot
+}
+
+func getSettings(c *gin.Context) {
+	c.JSON(200, Settings{BootTimeout: v.GetBootTimeout().String()})
+}
+
+// updateSettings changes the settings given in the request and leaves the others unchanged
+func updateSettings(c *gin.Context) {
+	var req Settings
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if req.BootTimeout != "" {
+		d, err := time.ParseDuration(req.BootTimeout)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "invalid boot_timeout: "+err.Error())
+			return
+		}
+		if err := v.SetBootTimeout(d); err != nil {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+			return
+		}
+	}
+	getSettings(c)
+}
+
+type WebhookRequest struct {
+	URL    string             `json:"url" binding:"required"`
+	Events []vmm.WebhookEvent `json:"events"` // all events if empty
+}
+
+func getWebhooks(c *gin.Context) {
+	hooks, err := v.ListWebhooks()
+	if err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"webhooks": hooks, "events": vmm.WebhookEvents})
+}
+
+// addWebhook registers a URL to receive a POST request on VM lifecycle events, see vmm.WebhookPayload
+func addWebhook(c *gin.Context) {
+	var req WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	hook, err := v.AddWebhook(req.URL, req.Events)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusCreated, hook)
+}
+
+func removeWebhook(c *gin.Context) {
+	if err := v.RemoveWebhook(c.Param("id")); err != nil {
+		abortWithError(c, http.StatusNotFound, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
+
+type ConfigKV struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// exportVMConfig downloads the VM's configs as a JSON file, which can be imported to a VM on another host with
+// importVMConfig
+func exportVMConfig(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	data, err := v.VMExportConfig(name)
+	if err != nil {
+		abortWithError(c, 500, ErrCodeInternal, err.Error())
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-config.json\"", c.Param("name")))
+	c.Data(200, "application/json", data)
+}
+
+// importVMConfig applies the configs in the request body, as exported by exportVMConfig, to the VM
+func importVMConfig(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	data, err := c.GetRawData()
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	err = v.VMImportConfig(name, data)
+	if errors.Is(err, vmm.ErrInvalidConfig) {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if err != nil {
+		abortWithVMError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"message": "ok"})
+}
+
+// configIntValue reads an integer config value sent as a JSON number or a string, e.g. 1000000 or "1000000"
+func configIntValue(value interface{}) (int, error) {
+	switch value := value.(type) {
+	case float64:
+		// JSON numbers are decoded as float64, which prints large values in exponent form
+		if value != math.Trunc(value) || value > math.MaxInt32 || value < math.MinInt32 {
+			return 0, fmt.Errorf("%v is not an integer", value)
+		}
+		return int(value), nil
+	case string:
+		return strconv.Atoi(value)
+	}
+	return 0, fmt.Errorf("%v is not a number", value)
+}
+
+// TODO accept multiple key-value pairs
+func updateVMConfig(c *gin.Context) {
+	name := CFPrefix + c.Param("name")
+	json := make(map[string]interface{})
+	c.BindJSON(&json)
+
+	fmt.Println(json)
+	if json["key"] == vmm.CONFIG_KEY_CMDLINE {
+		cmdline := fmt.Sprintf("%v", json["value"])
+		if _, rejected := v.FilterLaunchFlags(cmdline); len(rejected) > 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"message": fmt.Sprintf("disallowed launch_cvd flags %v", rejected),
+			})
+			return
+		}
+		err := v.ContainerUpdateConfig(name, vmm.CONFIG_KEY_CMDLINE, cmdline)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"message": err.Error(),
+			})
+			return
+		}
+		c.JSON(200, gin.H{"message": "ok"})
+		return
+	}
+	if json["key"] == vmm.CONFIG_KEY_GUEST_ENFORCE_SECURITY || json["key"] == vmm.CONFIG_KEY_GUEST_AUDIT_SECURITY {
+		key := fmt.Sprintf("%v", json["key"])
+		value := fmt.Sprintf("%v", json["value"])
+		if err := vmm.ValidateSecurityConfig(key, value); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"message": err.Error(),
+			})
+			return
+		}
+		if err := v.ContainerUpdateConfig(name, key, value); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"message": err.Error(),
+			})
+			return
+		}
+		c.JSON(200, gin.H{"message": "ok"})
+		return
+	}
+	if json["key"] == vmm.CONFIG_KEY_DATA_IMAGE_MB {
+		sizeMB, err := configIntValue(json["value"])
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "invalid data partition size: "+err.Error())
+			return
+		}
+		if err := v.VMResizeData(name, sizeMB); err != nil {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+			return
+		}
+		c.JSON(200, gin.H{"message": "ok"})
+		return
+	}
+	if json["key"] == vmm.CONFIG_KEY_WEBSOCKIFY_LOG_LEVEL {
+		level := fmt.Sprintf("%v", json["value"])
+		if err := vmm.ValidateWebsockifyLogLevel(level); err != nil {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+			return
+		}
+		// restarts websockify if it's running so the level takes effect right away
+		if err := v.VMSetWebsockifyLogLevel(name, level); err != nil {
+			abortWithVMError(c, err)
+			return
+		}
+		c.JSON(200, gin.H{"message": "ok"})
+		return
+	}
+	if json["key"] == vmm.CONFIG_KEY_AUTOSTART {
+		value := fmt.Sprintf("%v", json["value"])
+		if value != "true" && value != "false" {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "autostart must be true or false")
+			return
+		}
+		if err := v.ContainerUpdateConfig(name, vmm.CONFIG_KEY_AUTOSTART, value); err != nil {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+			return
+		}
+		c.JSON(200, gin.H{"message": "ok"})
+		return
+	}
+	if json["key"] == vmm.CONFIG_KEY_TAGS {
+		err := v.ContainerUpdateConfig(name, vmm.CONFIG_KEY_TAGS, fmt.Sprintf("%v", json["value"]))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"message": err.Error(),
+			})
+			return
+		}
+		c.JSON(200, gin.H{"message": "ok"})
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+		"message": "invalid config key",
+	})
+}
+
+// Supported files in the upload folder. System images are unzipped in the container and CVD images are untarred by
+// docker, which also decompresses gzipped tars. A bare .gz can't be used by either.
+var (
+	systemImageExtensions = []string{".zip"}
+	cvdImageExtensions    = []string{".tar", ".tar.gz"}
+	diskImageExtensions   = []string{".img"} // boot, vendor_boot, sdcard and super images
+)
+
+func hasExtension(fileName string, extensions []string) bool {
+	for _, ext := range extensions {
+		if strings.HasSuffix(fileName, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func getSystemImageList(c *gin.Context) {
+	getFilesInFolder(c, systemImageExtensions, v.UploadDir)
+}
+
+func getCVDImageList(c *gin.Context) {
+	getFilesInFolder(c, cvdImageExtensions, v.UploadDir)
+}
+
+// getBootImageList lists candidates of boot/vendor_boot image overrides
+func getBootImageList(c *gin.Context) {
+	getFilesInFolder(c, diskImageExtensions, v.UploadDir)
+}
+
+func getApkFileList(c *gin.Context) {
+	containerName := CFPrefix + c.Param("name")
+	getFilesInFolder(c, []string{".apk"}, path.Join(v.DevicesDir, containerName))
+}
+
+func getFilesInFolder(c *gin.Context, fileExtensions []string, folder string) {
+	var files []string
+
+	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if hasExtension(path, fileExtensions) {
+			files = append(files, filepath.Base(path))
+		}
+		return nil
+	})
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{"files": files})
+}
+
+func uploadImageFile(c *gin.Context) {
+	if file, err := c.FormFile("file"); err == nil && strings.HasSuffix(file.Filename, ".gz") && !hasExtension(file.Filename, cvdImageExtensions) {
+		abortWithError(c, http.StatusBadRequest, ErrCodeUnsupportedFile,
+			"Only gzipped tar archives (.tar.gz) are supported. Decompress "+file.Filename+" with gunzip and upload the result instead")
+		return
+	}
+	extensions := append(append(append([]string{}, systemImageExtensions...), cvdImageExtensions...), diskImageExtensions...)
+	uploadFile(c, extensions, v.UploadDir)
+}
+
+func uploadDeviceFile(c *gin.Context) {
+	containerName := CFPrefix + c.Param("name")
+	uploadFile(c, []string{".apk"}, path.Join(v.DevicesDir, containerName))
+}
+
+func uploadFile(c *gin.Context, allowedExtensions []string, dstFolder string) {
+	file, err := c.FormFile("file")
+	// The file cannot be received.
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "No file is received")
+		return
+	}
+
+	if hasExtension(file.Filename, allowedExtensions) {
+		// The file is received, so let's save it
+		if err := c.SaveUploadedFile(file, path.Join(dstFolder, file.Filename)); err != nil {
+			abortWithError(c, http.StatusInternalServerError, ErrCodeInternal, "Unable to save the file")
+			return
+		}
+
+		// File saved successfully. Return proper result
+		c.JSON(http.StatusOK, gin.H{
+			"message": "success",
+		})
+		return
+	}
+	abortWithError(c, http.StatusBadRequest, ErrCodeUnsupportedFile,
+		"Unsupported file formats, must be one of "+strings.Join(allowedExtensions, ", "))
+}
+
+func getWorkspaceFileList(c *gin.Context) {
+	containerName := CFPrefix + c.Param("name")
+	p, err := vmm.ConfinePath(c.DefaultQuery("path", ""), vmm.HomeDir)
+	if err != nil {
+		log.Println("Error : " + err.Error())
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid query path")
+		return
+	}
+	files, err := v.ContainerListFiles(containerName, p)
+	if err != nil {
+		log.Println(err.Error())
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid query path")
+		return
+	}
+	c.JSON(200, gin.H{"files": files})
+}
+
+func downloadWorkspaceFile(c *gin.Context) {
+	containerName := CFPrefix + c.Param("name")
+	// files pulled from the VM are saved to the device folder
+	p, err := vmm.ConfinePath(c.DefaultQuery("path", ""), vmm.HomeDir, vmm.DeviceDir)
+	if err != nil {
+		log.Println("Error : " + err.Error())
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid query path")
+		return
+	}
+	reader, err := v.ContainerReadFile(containerName, p)
+	if err != nil {
+		log.Println(err.Error())
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	defer reader.Close()
+
+	tr := tar.NewReader(reader)
+	// first param is the header of the tar file
+	header, err := tr.Next()
+	if err != nil {
+		log.Println(err.Error())
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	extraHeaders := map[string]string{
+		"Content-Disposition": fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(p)),
+	}
+	c.DataFromReader(http.StatusOK, header.Size, "application/octet-stream", tr, extraHeaders)
+}
+
+// files larger than this are left out of slim bundles, e.g. heap dumps and sdcard images
+var slimBundleMaxFileSize int64 = 100 * 1024 * 1024
+
+// downloadDeviceBundle streams the VM's device folder on the host as a zip file. The zip is written as the folder is
+// walked, so it's never held in memory or on disk as a whole.
+func downloadDeviceBundle(c *gin.Context) {
+	containerName := CFPrefix + c.Param("name")
+	folder := path.Join(v.DevicesDir, containerName)
+	if info, err := os.Stat(folder); err != nil || !info.IsDir() {
+		abortWithError(c, http.StatusNotFound, ErrCodeInvalidRequest, "device folder of "+c.Param("name")+" not found")
+		return
+	}
+	slim := c.Query("slim") == "true"
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", c.Param("name")))
+	zw := zip.NewWriter(c.Writer)
+	err := filepath.Walk(folder, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || (slim && info.Size() > slimBundleMaxFileSize) {
+			return nil
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(folder, p)
+		header.Name = filepath.ToSlash(rel)
+		header.Method = zip.Deflate
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		// the response has already started so the client sees a truncated zip
+		log.Printf("downloadDeviceBundle (%s): %v\n", containerName, err)
 	}
-	c.DataFromReader(http.StatusOK, header.Size, "application/octet-stream", tr, extraHeaders)
 }
 
 func getConnectionIPs(c *gin.Context) {
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestConfigIntValue(t *testing.T) {
+	testCases := []struct {
+		value   interface{}
+		want    int
+		wantErr bool
+	}{
+		{float64(8192), 8192, false},
+		// printed as 1e+06 by %v
+		{float64(1000000), 1000000, false},
+		{"1000000", 1000000, false},
+		{float64(1.5), 0, true},
+		{"1e+06", 0, true},
+		{true, 0, true},
+		{nil, 0, true},
+	}
+	for _, tc := range testCases {
+		got, err := configIntValue(tc.value)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("configIntValue(%v) error = %v, want error %v", tc.value, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("configIntValue(%v) = %d, want %d", tc.value, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"sea.com/matrisea/vmm"
+)
+
+// Error codes returned in APIError.Code. Clients should branch on the code rather than the message.
+const (
+	ErrCodeInvalidRequest  = "invalid_request"
+	ErrCodeUnsupportedFile = "unsupported_file"
+	ErrCodeBootFailed      = "boot_failed"
+	ErrCodeInternal        = "internal_error"
+	ErrCodeDockerDown      = "docker_unresponsive"
+	// another operation on the same VM is in progress, retry after it completes
+	ErrCodeOperationInProgress = "operation_in_progress"
+)
+
+// APIError is the body of every error response, i.e. {"error": {"code": "...", "message": "..."}}
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// abortWithError writes an error response and stops the remaining handlers
+func abortWithError(c *gin.Context, status int, code string, message string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": APIError{Code: code, Message: message}})
+}
+
+// abortWithVMError writes the error of an operation that changes a VM, i.e. 409 if another operation is in progress
+// on the VM or the VM is already running, 400 if the VM isn't running or the package name is invalid, 503 if the
+// Docker daemon is unresponsive, and 500 otherwise
+func abortWithVMError(c *gin.Context, err error) {
+	if errors.Is(err, vmm.ErrOperationInProgress) {
+		abortWithError(c, http.StatusConflict, ErrCodeOperationInProgress, err.Error())
+		return
+	}
+	if errors.Is(err, vmm.ErrVMAlreadyRunning) {
+		abortWithError(c, http.StatusConflict, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if errors.Is(err, vmm.ErrVMNotRunning) || errors.Is(err, vmm.ErrInvalidPackageName) {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if errors.Is(err, vmm.ErrDockerUnresponsive) {
+		abortWithError(c, http.StatusServiceUnavailable, ErrCodeDockerDown, err.Error())
+		return
+	}
+	abortWithError(c, 500, ErrCodeInternal, err.Error())
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"sea.com/matrisea/vmm"
+)
+
+// Names of VMStatus in reports and filters
+var vmStatusNames = map[vmm.VMStatus]string{
+	vmm.VMReady:            "ready",
+	vmm.VMRunning:          "running",
+	vmm.VMContainerError:   "error",
+	vmm.VMInitializing:     "initializing",
+	vmm.VMPartiallyRunning: "partially_running",
+}
+
+var vmExportHeader = []string{"name", "status", "cpu", "ram_gb", "aosp_version", "tags", "created", "disk_usage_bytes"}
+
+// exportVMs returns the VM list as a CSV file for reporting. The list can be filtered with
+//   - tag: only VMs with all of the given tags, can be repeated
+//   - status: only VMs in any of the given statuses e.g. "running", can be repeated
+func exportVMs(c *gin.Context) {
+	statuses := map[string]bool{}
+	for _, status := range c.QueryArray("status") {
+		if !isVMStatusName(status) {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "invalid status "+status)
+			return
+		}
+		statuses[status] = true
+	}
+	tags := c.QueryArray("tag")
+
+	vmList, err := v.VMList()
+	if err != nil {
+		abortWithVMError(c, err)
+		return
+	}
+	usage, err := v.VMGetAllDiskUsage()
+	if err != nil {
+		// disk usage is nice to have in the report
+		log.Printf("exportVMs: failed to get disk usage: %v\n", err)
+		usage = map[string]int64{}
+	}
+
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"vms-%s.csv\"", time.Now().Format("20060102-150405")))
+	w := csv.NewWriter(c.Writer)
+	w.Write(vmExportHeader)
+	for _, vm := range vmList {
+		if len(statuses) > 0 && !statuses[vmStatusNames[vm.Status]] {
+			continue
+		}
+		if !hasAllTags(vm.Tags, tags) {
+			continue
+		}
+		diskUsage := ""
+		if size, ok := usage[CFPrefix+vm.Name]; ok && size >= 0 {
+			diskUsage = strconv.FormatInt(size, 10)
+		}
+		created := vm.Created
+		if ts, err := strconv.ParseInt(vm.Created, 10, 64); err == nil {
+			created = time.Unix(ts, 0).UTC().Format(time.RFC3339)
+		}
+		w.Write([]string{
+			vm.Name,
+			vmStatusNames[vm.Status],
+			strconv.Itoa(vm.CPU),
+			strconv.Itoa(vm.RAM),
+			vm.OSVersion,
+			strings.Join(vm.Tags, " "),
+			created,
+			diskUsage,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Printf("exportVMs: %v\n", err)
+	}
+}
+
+func isVMStatusName(name string) bool {
+	for _, n := range vmStatusNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAllTags(vmTags []string, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range vmTags {
+			found = found || t == tag
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"sea.com/matrisea/vmm"
+)
+
+// Server-side fetching of AOSP images. A fetch runs in the background as a job and reports progress through
+// GET /files/fetch-aosp/:id (polling) or GET /files/fetch-aosp/:id/ws (websocket).
+// A cancelled or failed fetch can be resumed by starting a new fetch of the same build. Starting a fetch of a build
+// that is already being fetched returns the running job instead.
+// Finished jobs are kept for fetchJobRetention so that clients can read the result, then removed.
+
+type FetchAOSPRequest struct {
+	Branch  string `json:"branch"`   // defaults to vmm.DefaultAOSPBranch
+	Target  string `json:"target"`   // defaults to vmm.DefaultAOSPTarget
+	BuildID string `json:"build_id"` // defaults to the latest build
+}
+
+type FetchJobStatus struct {
+	ID       string   `json:"id"`
+	Status   string   `json:"status"` // "running", "done", "failed" or "cancelled"
+	Messages []string `json:"messages"`
+	// latest byte-level progress of each file
+	Progress map[string]vmm.FetchProgress `json:"progress"`
+	Files    []string                     `json:"files"` // downloaded files in the upload folder
+	Error    string                       `json:"error,omitempty"`
+}
+
+type FetchJob struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	build  string // "<target>/<build id>", empty for the latest build
+	FetchJobStatus
+}
+
+var (
+	fetchJobs   = map[string]*FetchJob{}
+	fetchJobsMu sync.Mutex
+	fetchJobSeq = 0
+	// how long a finished job can still be read through GET /files/fetch-aosp/:id
+	fetchJobRetention = 1 * time.Hour
+)
+
+func (j *FetchJob) onProgress(p vmm.FetchProgress) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if p.File != "" {
+		j.Progress[p.File] = p
+		return
+	}
+	log.Printf("FetchAOSP (%s): %s\n", j.ID, p.Message)
+	j.Messages = append(j.Messages, p.Message)
+}
+
+func (j *FetchJob) finish(files []string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Files = files
+	switch {
+	case err == nil:
+		j.Status = "done"
+	case errors.Is(err, context.Canceled):
+		j.Status = "cancelled"
+	default:
+		j.Status = "failed"
+		j.Error = err.Error()
+	}
+	log.Printf("FetchAOSP (%s): %s\n", j.ID, j.Status)
+}
+
+func (j *FetchJob) isRunning() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Status == "running"
+}
+
+// snapshot returns a copy of the job status that is safe to serialize
+func (j *FetchJob) snapshot() FetchJobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	progress := map[string]vmm.FetchProgress{}
+	for file, p := range j.Progress {
+		progress[file] = p
+	}
+	return FetchJobStatus{
+		ID:       j.ID,
+		Status:   j.Status,
+		Messages: append([]string{}, j.Messages...),
+		Progress: progress,
+		Files:    append([]string{}, j.Files...),
+		Error:    j.Error,
+	}
+}
+
+func getFetchJob(id string) (*FetchJob, bool) {
+	fetchJobsMu.Lock()
+	defer fetchJobsMu.Unlock()
+	job, ok := fetchJobs[id]
+	return job, ok
+}
+
+func removeFetchJob(id string) {
+	fetchJobsMu.Lock()
+	defer fetchJobsMu.Unlock()
+	delete(fetchJobs, id)
+}
+
+// fetchAOSP starts downloading AOSP images to the upload folder in the background.
+func fetchAOSP(c *gin.Context) {
+	var req FetchAOSPRequest
+	// all fields are optional so an empty body fetches the latest default build
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	build := ""
+	if req.BuildID != "" {
+		target := req.Target
+		if target == "" {
+			target = vmm.DefaultAOSPTarget
+		}
+		build = target + "/" + req.BuildID
+	}
+	fetchJobsMu.Lock()
+	for _, running := range fetchJobs {
+		if build != "" && running.build == build && running.isRunning() {
+			fetchJobsMu.Unlock()
+			c.JSON(202, gin.H{"id": running.ID})
+			return
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	fetchJobSeq++
+	job := &FetchJob{
+		cancel: cancel,
+		build:  build,
+		FetchJobStatus: FetchJobStatus{
+			ID:       strconv.Itoa(fetchJobSeq),
+			Status:   "running",
+			Progress: map[string]vmm.FetchProgress{},
+		},
+	}
+	fetchJobs[job.ID] = job
+	fetchJobsMu.Unlock()
+
+	go func() {
+		defer cancel()
+		files, err := v.FetchAOSPImages(ctx, vmm.FetchAOSPOptions{
+			Branch:  req.Branch,
+			Target:  req.Target,
+			BuildID: req.BuildID,
+		}, job.onProgress)
+		job.finish(files, err)
+		time.AfterFunc(fetchJobRetention, func() { removeFetchJob(job.ID) })
+	}()
+	c.JSON(202, gin.H{"id": job.ID})
+}
+
+func getFetchAOSP(c *gin.Context) {
+	job, ok := getFetchJob(c.Param("id"))
+	if !ok {
+		c.JSON(404, gin.H{"error": "fetch job not found"})
+		return
+	}
+	c.JSON(200, job.snapshot())
+}
+
+// cancelFetchAOSP stops a running fetch. Partial downloads are kept for resuming.
+func cancelFetchAOSP(c *gin.Context) {
+	job, ok := getFetchJob(c.Param("id"))
+	if !ok {
+		c.JSON(404, gin.H{"error": "fetch job not found"})
+		return
+	}
+	job.cancel()
+	c.JSON(200, gin.H{"message": "ok"})
+}
+
+// FetchAOSPStreamHandler sends new progress messages and the byte-level progress of a fetch job over websocket
+// every second, followed by the final job status when the fetch finishes.
+func FetchAOSPStreamHandler(c *gin.Context) {
+	header, ok := wsAuthorize(c.Writer, c.Request)
+	if !ok {
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, header)
+	if err != nil {
+		log.Print("upgrade:", err)
+		return
+	}
+	defer conn.Close()
+
+	job, ok := getFetchJob(c.Param("id"))
+	if !ok {
+		conn.WriteJSON(gin.H{"error": "fetch job not found"})
+		return
+	}
+	sent := 0
+	for {
+		snapshot := job.snapshot()
+		for _, msg := range snapshot.Messages[sent:] {
+			if err := conn.WriteJSON(gin.H{"message": msg}); err != nil {
+				return
+			}
+		}
+		sent = len(snapshot.Messages)
+		if snapshot.Status != "running" {
+			conn.WriteJSON(snapshot)
+			return
+		}
+		if err := conn.WriteJSON(gin.H{"progress": snapshot.Progress}); err != nil {
+			return
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"path"
 	"strings"
 	"time"
 
@@ -18,7 +17,11 @@ var (
 )
 
 func LogStreamHandler(c *gin.Context) {
-	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	header, ok := wsAuthorize(c.Writer, c.Request)
+	if !ok {
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, header)
 	if err != nil {
 		log.Print("upgrade:", err)
 		return
@@ -27,16 +30,9 @@ func LogStreamHandler(c *gin.Context) {
 
 	containerName := CFPrefix + c.Param("name")
 
-	var logFile string
-	switch c.Param("source") {
-	case "launcher":
-		logFile = path.Join(vmm.HomeDir, "cuttlefish_runtime/launcher.log")
-	case "kernel":
-		logFile = path.Join(vmm.HomeDir, "cuttlefish_runtime/kernel.log")
-	case "logcat":
-		logFile = path.Join(vmm.HomeDir, "cuttlefish_runtime/logcat")
-	default:
-		log.Printf("Invalid log source %s on %s", c.Param("source"), containerName)
+	logFile, err := vmm.LogSourcePath(c.Param("source"))
+	if err != nil {
+		wsLogSendError(conn, err.Error()+"\n")
 		return
 	}
 
@@ -47,7 +43,7 @@ func LogStreamHandler(c *gin.Context) {
 
 	cmd := []string{"tail", "-n", "2000", "-f", logFile}
 	// run bash in container and get the hijacked session
-	_, hijackedResp, err := v.ContainerAttachToProcess(containerName, cmd, []string{})
+	ir, hijackedResp, err := v.ContainerAttachToProcess(containerName, cmd, []string{})
 	if err != nil {
 		wsLogSendError(conn, fmt.Sprintf("Failed to get log due to %v\n", err))
 		return
@@ -56,9 +52,10 @@ func LogStreamHandler(c *gin.Context) {
 	// clean up after quit
 	defer func() {
 		hijackedResp.Conn.Write([]byte("exit\r"))
-		if err := v.ContainerKillProcess(containerName, strings.Join(cmd, " ")); err != nil {
+		if err := v.ContainerKillExec(containerName, ir.ID); err != nil {
 			log.Printf("Failed to kill log writer %s of container %s on exit due to %s", logFile, containerName, err.Error())
 		}
+		v.ContainerReleaseProcess(ir.ID)
 	}()
 	defer hijackedResp.Close()
 
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Terminal sessions are recorded to the device folder in asciicast v2 format (https://docs.asciinema.org/manual/asciicast/v2/)
+// when TERMINAL_RECORDING=true, and can be replayed with `asciinema play`.
+
+const terminalRecordingFolder = "terminal-recordings"
+
+// terminalRecorder writes the input, output and resize events of a terminal session to an asciicast file.
+type terminalRecorder struct {
+	mu    sync.Mutex
+	file  *os.File
+	start time.Time
+	// the first write error, after which events are dropped
+	err error
+}
+
+type TerminalRecording struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Modified int64  `json:"modified"` // unix timestamp
+}
+
+func terminalRecordingEnabled() bool {
+	return getenv("TERMINAL_RECORDING", "") == "true"
+}
+
+func terminalRecordingDir(containerName string) string {
+	return path.Join(v.DevicesDir, containerName, terminalRecordingFolder)
+}
+
+// newTerminalRecorder creates a timestamped recording file in the device folder and writes the asciicast header.
+func newTerminalRecorder(containerName string) (*terminalRecorder, error) {
+	dir := terminalRecordingDir(containerName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	file, err := os.Create(path.Join(dir, fmt.Sprintf("terminal-%s.cast", start.Format("20060102-150405.000"))))
+	if err != nil {
+		return nil, err
+	}
+	// the actual size is recorded by the first resize event
+	header, _ := json.Marshal(gin.H{"version": 2, "width": 80, "height": 24, "timestamp": start.Unix()})
+	if _, err := file.Write(append(header, '\n')); err != nil {
+		file.Close()
+		return nil, err
+	}
+	log.Printf("%s: recording terminal session to %s\n", containerName, file.Name())
+	return &terminalRecorder{file: file, start: start}, nil
+}
+
+func (r *terminalRecorder) event(code string, data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	line, _ := json.Marshal([]interface{}{time.Since(r.start).Seconds(), code, data})
+	if _, r.err = r.file.Write(append(line, '\n')); r.err != nil {
+		log.Printf("Stopped recording %s due to %v\n", r.file.Name(), r.err)
+	}
+}
+
+func (r *terminalRecorder) resize(cols uint, rows uint) {
+	r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// stream returns a writer that records everything written to it as events of code, i.e. "i" for input or "o" for
+// output. Writes never fail so that recording errors don't break the terminal.
+func (r *terminalRecorder) stream(code string) io.Writer {
+	return recorderStream{r, code}
+}
+
+func (r *terminalRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the output may still be copied for a moment after the session ends
+	r.err = os.ErrClosed
+	return r.file.Close()
+}
+
+type recorderStream struct {
+	r    *terminalRecorder
+	code string
+}
+
+func (s recorderStream) Write(p []byte) (int, error) {
+	s.r.event(s.code, string(p))
+	return len(p), nil
+}
+
+// getTerminalRecordings lists the recorded terminal sessions of a VM, the latest first.
+func getTerminalRecordings(c *gin.Context) {
+	containerName := CFPrefix + c.Param("name")
+	recordings := []TerminalRecording{}
+	files, err := ioutil.ReadDir(terminalRecordingDir(containerName))
+	if err != nil && !os.IsNotExist(err) {
+		abortWithError(c, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		if f := files[i]; !f.IsDir() && strings.HasSuffix(f.Name(), ".cast") {
+			recordings = append(recordings, TerminalRecording{Name: f.Name(), Size: f.Size(), Modified: f.ModTime().Unix()})
+		}
+	}
+	c.JSON(200, gin.H{"enabled": terminalRecordingEnabled(), "recordings": recordings})
+}
+
+func downloadTerminalRecording(c *gin.Context) {
+	containerName := CFPrefix + c.Param("name")
+	name := c.Param("file")
+	if name != filepath.Base(name) || !strings.HasSuffix(name, ".cast") {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "invalid recording "+name)
+		return
+	}
+	file := path.Join(terminalRecordingDir(containerName), name)
+	if _, err := os.Stat(file); err != nil {
+		abortWithError(c, http.StatusNotFound, ErrCodeInvalidRequest, "recording "+name+" not found")
+		return
+	}
+	c.FileAttachment(file, name)
+}
@@ -1,17 +1,65 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
+// TerminalControlMessage is sent by the frontend as a websocket text frame to control the terminal, while user
+// input is sent as binary frames. e.g. {"type": "resize", "cols": 80, "rows": 24}
+type TerminalControlMessage struct {
+	Type string `json:"type"` // "resize"
+	Cols uint   `json:"cols"`
+	Rows uint   `json:"rows"`
+}
+
+var (
+	// terminal sessions opened with ?keepalive=true, keyed by reconnect token
+	terminalSessions   = map[string]*terminalSession{}
+	terminalSessionsMu sync.Mutex
+	// terminal output kept for replaying to a reconnecting client
+	terminalScrollbackSize = 64 * 1024
+)
+
+// terminalSession is a bash shell in a container, which is attached to at most one websocket at a time.
+type terminalSession struct {
+	containerName string
+	token         string // empty unless the session is kept alive after disconnects
+	input         io.Writer
+	resize        func(cols uint, lines uint)
+	cleanup       func()
+
+	mu         sync.Mutex
+	conn       *websocket.Conn // nil while detached
+	scrollback []byte
+	expiry     *time.Timer
+	closed     bool
+	closeOnce  sync.Once
+}
+
+// TerminalHandler attaches a websocket to a bash shell in the container. Clients that still send input as text
+// frames with in-band "$$MATRISEA_RESIZE cols lines" commands must connect with ?legacy_resize=true.
+//
+// With ?keepalive=true, the shell is kept for TERMINAL_SESSION_TTL (5m by default) after the websocket disconnects,
+// and the first message is a text frame {"type": "session", "token": "..."}. Connecting with ?session=<token> within
+// the TTL re-attaches to the same shell and replays the recent output.
 func TerminalHandler(c *gin.Context) {
-	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	header, ok := wsAuthorize(c.Writer, c.Request)
+	if !ok {
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, header)
 	if err != nil {
 		log.Print("upgrade:", err)
 		return
@@ -20,55 +68,235 @@ func TerminalHandler(c *gin.Context) {
 
 	// read container name from URL params
 	containerName := CFPrefix + c.Param("name")
-	// run bash in container and get the hijacked session
-	ir, hijackedResp, err := v.ContainerAttachToTerminal(containerName)
+	legacy := c.Query("legacy_resize") == "true"
+	if token := c.Query("session"); token != "" {
+		session, err := reattachTerminalSession(token, containerName)
+		if err != nil {
+			conn.WriteMessage(websocket.TextMessage, []byte("internal error:"+err.Error()))
+			return
+		}
+		log.Printf("%s: reattached to terminal session\n", containerName)
+		session.serve(conn, legacy)
+		return
+	}
+	session, err := newTerminalSession(containerName, c.Query("keepalive") == "true")
 	if err != nil {
 		log.Printf("%s: failed to attach to terminal: %v\n", containerName, err.Error())
 		conn.WriteMessage(websocket.TextMessage, []byte("internal error:"+err.Error()))
 		return
 	}
+	session.serve(conn, legacy)
+}
 
-	// clean up after quit
-	defer func() {
-		hijackedResp.Conn.Write([]byte("exit\r"))
-		if err := v.ContainerKillTerminal(containerName); err != nil {
-			log.Printf("Failed to kill terminal of container %s on exit due to %s", containerName, err.Error())
+// newTerminalSession starts bash in the container and forwards its output to the attached websocket in the background.
+func newTerminalSession(containerName string, keepAlive bool) (*terminalSession, error) {
+	// run bash in container and get the hijacked session
+	ir, hijackedResp, err := v.ContainerAttachToTerminal(containerName)
+	if err != nil {
+		return nil, err
+	}
+	var output io.Reader = hijackedResp.Conn
+	var input io.Writer = hijackedResp.Conn
+	resize := func(cols uint, lines uint) {
+		v.ContainerTerminalResize(ir.ID, lines, cols)
+	}
+	var rec *terminalRecorder
+	if terminalRecordingEnabled() {
+		rec, err = newTerminalRecorder(containerName)
+		if err != nil {
+			log.Printf("%s: failed to record terminal session: %v\n", containerName, err)
+		} else {
+			output = io.TeeReader(output, rec.stream("o"))
+			input = io.MultiWriter(input, rec.stream("i"))
+			resize = func(cols uint, lines uint) {
+				v.ContainerTerminalResize(ir.ID, lines, cols)
+				rec.resize(cols, lines)
+			}
 		}
-	}()
-	defer hijackedResp.Close()
+	}
+	s := &terminalSession{
+		containerName: containerName,
+		input:         input,
+		resize:        resize,
+		cleanup: func() {
+			hijackedResp.Conn.Write([]byte("exit\r"))
+			if err := v.ContainerKillExec(containerName, ir.ID); err != nil {
+				log.Printf("Failed to kill terminal of container %s on exit due to %s", containerName, err.Error())
+			}
+			v.ContainerReleaseProcess(ir.ID)
+			hijackedResp.Close()
+			if rec != nil {
+				rec.Close()
+			}
+		},
+	}
+	if keepAlive {
+		token := make([]byte, 16)
+		if _, err := rand.Read(token); err != nil {
+			s.close()
+			return nil, err
+		}
+		s.token = hex.EncodeToString(token)
+		terminalSessionsMu.Lock()
+		terminalSessions[s.token] = s
+		terminalSessionsMu.Unlock()
+	}
+	go s.pump(output)
+	return s, nil
+}
+
+func reattachTerminalSession(token string, containerName string) (*terminalSession, error) {
+	terminalSessionsMu.Lock()
+	s, ok := terminalSessions[token]
+	terminalSessionsMu.Unlock()
+	if !ok || s.containerName != containerName {
+		return nil, errors.New("terminal session not found or expired")
+	}
+	return s, nil
+}
 
-	// forward read/write to websocket
-	go wsWriterCopy(conn, hijackedResp.Conn)
-	// Why wsReaderCopy here is not invoked as goroutine is to use client ws close event (e.g. browser tab closed)
-	// as a signal of the end of user interaction, so we can trigger the deferred cleanup function.
+// serve attaches conn to the session and forwards user input until conn is closed. The session is then closed,
+// or kept for TERMINAL_SESSION_TTL if it has a reconnect token.
+func (s *terminalSession) serve(conn *websocket.Conn, legacy bool) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.WriteMessage(websocket.TextMessage, []byte("internal error:terminal session has ended"))
+		return
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	if s.conn != nil {
+		// a client reconnecting before its previous websocket timed out takes the session over
+		s.conn.Close()
+	}
+	s.conn = conn
+	if s.token != "" {
+		msg, _ := json.Marshal(gin.H{"type": "session", "token": s.token})
+		conn.WriteMessage(websocket.TextMessage, msg)
+	}
+	if len(s.scrollback) > 0 {
+		conn.WriteMessage(websocket.BinaryMessage, s.scrollback)
+	}
+	s.mu.Unlock()
+
+	// Why the reader isn't invoked as goroutine is to use client ws close event (e.g. browser tab closed)
+	// as a signal of the end of user interaction, so we can trigger the cleanup.
 	//
 	// Sequence of events:
 	//   --Start wsReaderCopy
 	//   --Error in wsReaderCopy - socket: close 1001 (going away)
 	//   --End of attach to terminal
-	//   --Deferred cleanup
-	wsReaderCopy(conn, hijackedResp.Conn, containerName, ir.ID)
+	//   --Cleanup, or keep the session for reconnecting
+	if legacy {
+		wsLegacyReaderCopy(conn, s.input, s.containerName, s.resize)
+	} else {
+		wsReaderCopy(conn, s.input, s.containerName, s.resize)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != conn {
+		// taken over by another websocket
+		return
+	}
+	s.conn = nil
+	if s.token == "" || s.closed {
+		go s.close()
+		return
+	}
+	ttl := 5 * time.Minute
+	if d, err := time.ParseDuration(getenv("TERMINAL_SESSION_TTL", "")); err == nil {
+		ttl = d
+	}
+	s.expiry = time.AfterFunc(ttl, func() {
+		log.Printf("%s: terminal session expired\n", s.containerName)
+		s.close()
+	})
 }
 
-// write terminal output to front end
-func wsWriterCopy(writer *websocket.Conn, reader io.Reader) {
+// pump forwards the terminal output to the attached websocket, if any, and keeps the latest output for replaying
+// when a websocket is attached.
+// The session is closed when the shell exits.
+func (s *terminalSession) pump(output io.Reader) {
 	buf := make([]byte, 8192)
 	for {
-		nr, err := reader.Read(buf)
+		nr, err := output.Read(buf)
 		if nr > 0 {
-			err := writer.WriteMessage(websocket.BinaryMessage, buf[0:nr])
-			if err != nil {
-				return
+			s.mu.Lock()
+			// also covers the prompt printed before the first websocket is attached
+			s.scrollback = append(s.scrollback, buf[0:nr]...)
+			if len(s.scrollback) > terminalScrollbackSize {
+				s.scrollback = s.scrollback[len(s.scrollback)-terminalScrollbackSize:]
+			}
+			if s.conn != nil {
+				s.conn.WriteMessage(websocket.BinaryMessage, buf[0:nr])
 			}
+			s.mu.Unlock()
 		}
+		if err != nil {
+			break
+		}
+	}
+	s.mu.Lock()
+	s.closed = true
+	if s.conn != nil {
+		// ends serve, which then closes the session
+		s.conn.Close()
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	s.close()
+}
+
+func (s *terminalSession) close() {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		if s.expiry != nil {
+			s.expiry.Stop()
+		}
+		s.mu.Unlock()
+		if s.token != "" {
+			terminalSessionsMu.Lock()
+			delete(terminalSessions, s.token)
+			terminalSessionsMu.Unlock()
+		}
+		s.cleanup()
+	})
+}
+
+// wsReaderCopy forwards front end input (binary frames) to the terminal and handles control messages (text frames).
+func wsReaderCopy(reader *websocket.Conn, writer io.Writer, containerName string, resize func(cols uint, lines uint)) {
+	for {
+		messageType, p, err := reader.ReadMessage()
 		if err != nil {
 			return
 		}
+		switch messageType {
+		case websocket.BinaryMessage:
+			writer.Write(p)
+		case websocket.TextMessage:
+			var msg TerminalControlMessage
+			if err := json.Unmarshal(p, &msg); err != nil {
+				log.Printf("%s: failed to parse terminal control message: %s\n", containerName, string(p))
+				continue
+			}
+			switch msg.Type {
+			case "resize":
+				resize(msg.Cols, msg.Rows)
+			default:
+				log.Printf("%s: unknown terminal control message type %s\n", containerName, msg.Type)
+			}
+		}
 	}
 }
 
-// wsReaderCopy forwards front end input to the terminal.
-func wsReaderCopy(reader *websocket.Conn, writer io.Writer, containerName string, execID string) {
+// wsLegacyReaderCopy forwards front end input to the terminal. Resize commands are mixed into the input.
+func wsLegacyReaderCopy(reader *websocket.Conn, writer io.Writer, containerName string, resize func(cols uint, lines uint)) {
 	for {
 		messageType, p, err := reader.ReadMessage()
 		if err != nil {
@@ -89,7 +317,7 @@ func wsReaderCopy(reader *websocket.Conn, writer io.Writer, containerName string
 				}
 
 				// log.Printf("resize %s to %d, %d\n", containerName, cols, lines)
-				v.ContainerTerminalResize(execID, uint(lines), uint(cols))
+				resize(uint(cols), uint(lines))
 				continue
 			}
 			// Pass user input to the terminal
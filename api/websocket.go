@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"log"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -19,6 +22,44 @@ var (
 	maxMessageSize int64 = 512
 )
 
+// Prefix of the websocket subprotocol that carries an API token, i.e. "token.<API_TOKEN>"
+const wsTokenProtocolPrefix = "token."
+
+// wsAuthorize checks the API token of a websocket handshake before upgrading the connection. Browsers can't set
+// the Authorization header on websockets, so the token may be passed in any of
+//   - the Sec-WebSocket-Protocol header as "token.<token>"
+//   - the `token` query parameter
+//   - the Authorization header as "Bearer <token>", for non-browser clients
+//
+// Authentication is disabled if API_TOKEN is not set.
+//
+// On success, it returns the response header to be passed to wsUpgrader.Upgrade. When the token comes from
+// Sec-WebSocket-Protocol, the same protocol has to be echoed back or browsers will drop the connection.
+// On failure, a 401 response has been written and the connection must not be upgraded.
+func wsAuthorize(w http.ResponseWriter, r *http.Request) (http.Header, bool) {
+	expected := getenv("API_TOKEN", "")
+	if expected == "" {
+		return nil, true
+	}
+	var header http.Header
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, wsTokenProtocolPrefix) {
+			token = strings.TrimPrefix(protocol, wsTokenProtocolPrefix)
+			header = http.Header{"Sec-Websocket-Protocol": []string{protocol}}
+			break
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		http.Error(w, "invalid or missing API token", http.StatusUnauthorized)
+		return nil, false
+	}
+	return header, true
+}
+
 // Wrapper for gorilla/websocket's connection handler
 type Connection struct {
 	conn *websocket.Conn
@@ -1,43 +1,113 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/urfave/cli"
 	"sea.com/matrisea/vmm"
 )
 
-// A CLI dev tool for fast access of VMM's functions
+// A CLI tool for scripting against VMM's functions without the API server, e.g.
+//
+//	DATA_DIR=/data CF_PREFIX=matrisea-cvd- cli list
+//
+// Results are printed to stdout as JSON while logs go to stderr. Notice that the KVStore in DATA_DIR can only be opened
+// by one process at a time, so the API server using the same DATA_DIR has to be stopped first.
 func main() {
 	app := cli.NewApp()
+	app.Name = "matrisea"
+	app.Usage = "manage matrisea VMs from the command line"
 
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "data-dir",
+			Value:  "/tmp/matrisea",
+			EnvVar: "DATA_DIR",
+		},
+		cli.StringFlag{
+			Name:   "prefix",
+			Usage:  "container name prefix of VMs",
+			Value:  "matrisea-test-",
+			EnvVar: "CF_PREFIX",
+		},
+		// deprecated, use the prunevm command instead
 		cli.StringFlag{
 			Name: "cmd",
 		},
 	}
 
+	app.Commands = []cli.Command{
+		{
+			Name:   "list",
+			Usage:  "list all VMs",
+			Action: listVMs,
+		},
+		{
+			Name:      "create",
+			Usage:     "create a VM, and load the images if given",
+			ArgsUsage: "<device>",
+			Flags: []cli.Flag{
+				cli.IntFlag{Name: "cpu", Value: 2},
+				cli.IntFlag{Name: "ram", Value: 4, Usage: "in GB"},
+				cli.StringFlag{Name: "aosp-version", Usage: "e.g. \"Android 12\", see vmm.AOSPVersions"},
+				cli.StringFlag{Name: "cmdline", Usage: "extra launch_cvd options"},
+				cli.StringFlag{Name: "image", Usage: "cuttlefish image, defaults to " + vmm.CFImage},
+				cli.StringFlag{Name: "system-image", Usage: "file name of a system image (.zip) in the upload folder"},
+				cli.StringFlag{Name: "cvd-image", Usage: "file name of a CVD image (.tar) in the upload folder"},
+				cli.StringFlag{Name: "cpuset", Usage: "host CPUs to pin the VM to, e.g. 0-3"},
+			},
+			Action: createVM,
+		},
+		{
+			Name:      "start",
+			Usage:     "start a VM and wait for it to boot",
+			ArgsUsage: "<device>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "wait-for-ui", Usage: "also wait for the boot animation to end"},
+				cli.BoolFlag{Name: "daemon", Usage: "run launch_cvd detached from the exec session"},
+			},
+			Action: startVM,
+		},
+		{
+			Name:      "stop",
+			Usage:     "stop a VM",
+			ArgsUsage: "<device>",
+			Action:    stopVM,
+		},
+		{
+			Name:      "logs",
+			Usage:     "print the latest lines of a VM's log",
+			ArgsUsage: "<device>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "source", Value: "launcher", Usage: strings.Join(vmm.LogSources, ", ")},
+				cli.IntFlag{Name: "lines", Value: 500, Usage: "number of lines from the end, 0 to print the whole log"},
+			},
+			Action: printLogs,
+		},
+		{
+			Name:  "prunevm",
+			Usage: "stop and remove all VMs with the prefix and clear the devices folder",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "dry-run", Usage: "only list the VMs to be removed"},
+			},
+			Action: pruneVMs,
+		},
+	}
+
 	app.Action = func(c *cli.Context) error {
 		if c.String("cmd") == "prunevm" {
-			dataDir := getenv("DATA_DIR", "/tmp/matrisea")
-			cfPrefix := getenv("CF_PREFIX", "matrisea-test-")
-			devicesDir := path.Join(dataDir, "devices")
-			v := vmm.NewVMMImpl(dataDir, cfPrefix, 120*time.Second)
-			v.VMPrune()
-			if err := os.RemoveAll(devicesDir); err != nil {
-				log.Fatalln(err.Error())
-			}
-			if err := os.Mkdir(devicesDir, 0755); err != nil {
-				log.Fatalln(err.Error())
-			}
-			return nil
+			return pruneVMs(c)
 		}
-		fmt.Println("Usage: --cmd prunevm")
-		return nil
+		return cli.ShowAppHelp(c)
 	}
 
 	err := app.Run(os.Args)
@@ -46,10 +116,187 @@ func main() {
 	}
 }
 
-func getenv(key, fallback string) string {
-	value := os.Getenv(key)
-	if len(value) == 0 {
-		return fallback
+// newVMM creates a VMM with the global flags.
+func newVMM(c *cli.Context) (*vmm.VMM, error) {
+	return vmm.NewVMMImpl(c.GlobalString("data-dir"), c.GlobalString("prefix"), 120*time.Second)
+}
+
+// deviceArg returns the container name of the device given as the first argument.
+func deviceArg(c *cli.Context) (string, error) {
+	if c.NArg() != 1 {
+		return "", fmt.Errorf("usage: %s %s", c.Command.Name, c.Command.ArgsUsage)
+	}
+	return c.GlobalString("prefix") + c.Args().First(), nil
+}
+
+func printJSON(obj interface{}) error {
+	out, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func listVMs(c *cli.Context) error {
+	v, err := newVMM(c)
+	if err != nil {
+		return err
+	}
+	vmList, err := v.VMList()
+	if err != nil {
+		return err
+	}
+	return printJSON(vmList)
+}
+
+func createVM(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("usage: create %s", c.Command.ArgsUsage)
+	}
+	v, err := newVMM(c)
+	if err != nil {
+		return err
+	}
+	// check the images before creating anything
+	var images []string
+	for _, file := range []string{c.String("system-image"), c.String("cvd-image")} {
+		if file == "" {
+			continue
+		}
+		img := path.Join(v.UploadDir, file)
+		if _, err := os.Stat(img); err != nil {
+			return err
+		}
+		images = append(images, img)
+	}
+	containerName, err := v.VMCreateWithOptions(c.Args().First(), vmm.VMCreateOptions{
+		CPU:         c.Int("cpu"),
+		RAM:         c.Int("ram"),
+		AOSPVersion: c.String("aosp-version"),
+		Cmdline:     c.String("cmdline"),
+		Image:       c.String("image"),
+		CpusetCpus:  c.String("cpuset"),
+	})
+	if err != nil {
+		return err
+	}
+	if err := v.VMPreBootSetup(containerName); err != nil {
+		return err
+	}
+	for _, img := range images {
+		if err := v.VMLoadFile(containerName, img); err != nil {
+			return err
+		}
+	}
+	if file := c.String("system-image"); file != "" {
+		if err := v.VMUnzipImage(containerName, file); err != nil {
+			return err
+		}
+	}
+	return printJSON(map[string]string{"container_name": containerName})
+}
+
+func startVM(c *cli.Context) error {
+	containerName, err := deviceArg(c)
+	if err != nil {
+		return err
+	}
+	v, err := newVMM(c)
+	if err != nil {
+		return err
+	}
+	opts := vmm.VMStartOptions{WaitForUI: c.Bool("wait-for-ui"), Daemon: c.Bool("daemon")}
+	result, err := v.VMStart(containerName, false, opts, func(string) {})
+	if perr := printJSON(result); perr != nil {
+		return perr
+	}
+	return err
+}
+
+func stopVM(c *cli.Context) error {
+	containerName, err := deviceArg(c)
+	if err != nil {
+		return err
+	}
+	v, err := newVMM(c)
+	if err != nil {
+		return err
+	}
+	if err := v.VMStop(containerName); err != nil {
+		return err
+	}
+	return printJSON(map[string]string{"message": "ok"})
+}
+
+func printLogs(c *cli.Context) error {
+	containerName, err := deviceArg(c)
+	if err != nil {
+		return err
+	}
+	logFile, err := vmm.LogSourcePath(c.String("source"))
+	if err != nil {
+		return err
+	}
+	v, err := newVMM(c)
+	if err != nil {
+		return err
+	}
+	reader, err := v.ContainerReadFile(containerName, logFile)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	// the file comes as a single-entry TAR archive
+	tr := tar.NewReader(reader)
+	if _, err := tr.Next(); err != nil {
+		return err
+	}
+	lines := c.Int("lines")
+	if lines <= 0 {
+		_, err = io.Copy(os.Stdout, tr)
+		return err
+	}
+	// keep the last lines only since logcat can grow to hundreds of MBs
+	tail := make([]string, 0, lines)
+	scanner := bufio.NewScanner(tr)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(tail) == lines {
+			tail = tail[1:]
+		}
+		tail = append(tail, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, line := range tail {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func pruneVMs(c *cli.Context) error {
+	v, err := newVMM(c)
+	if err != nil {
+		return err
+	}
+	result, err := v.VMPruneWithOptions(vmm.VMPruneOptions{DryRun: c.Bool("dry-run")})
+	if err != nil {
+		return err
+	}
+	if err := printJSON(result); err != nil {
+		return err
+	}
+	if c.Bool("dry-run") {
+		return nil
+	}
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("failed to remove %d VM(s)", len(result.Failed))
+	}
+	devicesDir := path.Join(c.GlobalString("data-dir"), "devices")
+	if err := os.RemoveAll(devicesDir); err != nil {
+		return err
 	}
-	return value
+	return os.Mkdir(devicesDir, 0755)
 }
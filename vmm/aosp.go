@@ -0,0 +1,320 @@
+package vmm
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Fetch AOSP images from Android CI, same as download-aosp.sh but without leaving the API server
+
+var (
+	AOSPCIURL         = "https://ci.android.com"
+	DefaultAOSPBranch = "aosp-master"
+	DefaultAOSPTarget = "aosp_cf_x86_64_phone-userdebug"
+	// branches, targets and build IDs end up in URLs and file names
+	aospParamRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+	// minimum interval between two byte-level progress reports of the same file
+	fetchProgressInterval = 1 * time.Second
+	// a download that receives nothing for this long is aborted, and can be resumed later
+	fetchStallTimeout = 1 * time.Minute
+	// maximum time to look up the latest build
+	buildLookupTimeout = 30 * time.Second
+)
+
+// ErrFetchInProgress is returned by FetchAOSPImages when the same build is being downloaded by another call.
+var ErrFetchInProgress = errors.New("the build is already being fetched")
+
+// aospHTTPClient talks to Android CI. There is no overall timeout since images take a long time to download, instead
+// every step of a request is bounded and downloadFile aborts stalled downloads.
+var aospHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+// FetchAOSPOptions selects an Android CI build for FetchAOSPImages.
+type FetchAOSPOptions struct {
+	Branch  string // e.g. aosp-master. Defaults to DefaultAOSPBranch
+	Target  string // e.g. aosp_cf_x86_64_phone-userdebug. Defaults to DefaultAOSPTarget
+	BuildID string // empty for the latest build of Branch
+}
+
+// FetchProgress is reported by FetchAOSPImages either as a human readable Message or as the byte-level
+// progress of File.
+type FetchProgress struct {
+	Message    string `json:"message,omitempty"`
+	File       string `json:"file,omitempty"`
+	BytesDone  int64  `json:"bytes_done"`
+	BytesTotal int64  `json:"bytes_total"` // -1 if the server doesn't tell the size
+}
+
+// FetchAOSPImages downloads the system image (.zip) and the cuttlefish host package (.tar.gz) of an Android CI build
+// to UploadDir, and returns their file names.
+//
+// Files are downloaded to a temporary folder in TmpDir and only moved to UploadDir once complete and verified.
+// If a download is interrupted or cancelled through ctx, the partial file is kept and the next FetchAOSPImages call
+// of the same build resumes from where it stopped. Only one call at a time can fetch a build since they'd write to
+// the same partial files.
+func (v *VMM) FetchAOSPImages(ctx context.Context, opts FetchAOSPOptions, progress func(FetchProgress)) ([]string, error) {
+	if opts.Branch == "" {
+		opts.Branch = DefaultAOSPBranch
+	}
+	if opts.Target == "" {
+		opts.Target = DefaultAOSPTarget
+	}
+	for _, param := range []string{opts.Branch, opts.Target, opts.BuildID} {
+		if param != "" && !aospParamRegex.MatchString(param) {
+			return nil, fmt.Errorf("invalid build parameter %s", param)
+		}
+	}
+	tmpDir, err := v.tempDir("fetch-aosp")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create temp folder")
+	}
+	if opts.BuildID == "" {
+		progress(FetchProgress{Message: fmt.Sprintf("Looking up the latest build of %s on %s", opts.Target, opts.Branch)})
+		buildID, err := latestAOSPBuildID(ctx, opts.Branch, opts.Target)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to find the latest build")
+		}
+		opts.BuildID = buildID
+	}
+	build := opts.Target + "/" + opts.BuildID
+	if !v.startFetching(build) {
+		return nil, errors.Wrap(ErrFetchInProgress, build)
+	}
+	defer v.endFetching(build)
+	// aosp_cf_x86_64_phone-userdebug => aosp_cf_x86_64_phone
+	product := strings.SplitN(opts.Target, "-", 2)[0]
+	downloads := []struct {
+		remote string
+		local  string
+	}{
+		{product + "-img-" + opts.BuildID + ".zip", product + "-img-" + opts.BuildID + ".zip"},
+		// the host package has the same name in every build
+		{"cvd-host_package.tar.gz", "cvd-host_package-" + opts.BuildID + ".tar.gz"},
+	}
+
+	files := []string{}
+	for _, d := range downloads {
+		dst := path.Join(v.UploadDir, d.local)
+		if _, err := os.Stat(dst); err == nil {
+			progress(FetchProgress{Message: d.local + " already exists, skipping"})
+			files = append(files, d.local)
+			continue
+		}
+		url := fmt.Sprintf("%s/builds/submitted/%s/%s/latest/raw/%s", AOSPCIURL, opts.BuildID, opts.Target, d.remote)
+		progress(FetchProgress{Message: fmt.Sprintf("Downloading %s of build %s", d.remote, opts.BuildID)})
+		tmp := path.Join(tmpDir, d.local+".part")
+		err := downloadFile(ctx, url, tmp, func(done int64, total int64) {
+			progress(FetchProgress{File: d.local, BytesDone: done, BytesTotal: total})
+		})
+		if err != nil {
+			return files, errors.Wrap(err, "failed to download "+d.remote)
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			return files, errors.Wrap(err, "failed to move "+d.local+" to the upload folder")
+		}
+		progress(FetchProgress{Message: "Downloaded " + d.local})
+		files = append(files, d.local)
+	}
+	return files, nil
+}
+
+// startFetching marks a build as being fetched, and returns false if it already is
+func (v *VMM) startFetching(build string) bool {
+	v.fetchingMu.Lock()
+	defer v.fetchingMu.Unlock()
+	if v.fetching == nil {
+		v.fetching = map[string]bool{}
+	}
+	if v.fetching[build] {
+		return false
+	}
+	v.fetching[build] = true
+	return true
+}
+
+func (v *VMM) endFetching(build string) {
+	v.fetchingMu.Lock()
+	defer v.fetchingMu.Unlock()
+	delete(v.fetching, build)
+}
+
+// latestAOSPBuildID resolves the latest build of a branch/target. Android CI redirects BUILD_INFO of the latest
+// build to /builds/submitted/<build id>/<target>/latest/view/BUILD_INFO.
+func latestAOSPBuildID(ctx context.Context, branch string, target string) (string, error) {
+	url := fmt.Sprintf("%s/builds/latest/branches/%s/targets/%s/view/BUILD_INFO", AOSPCIURL, branch, target)
+	ctx, cancel := context.WithTimeout(ctx, buildLookupTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := aospHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	parts := strings.Split(resp.Request.URL.Path, "/")
+	if len(parts) < 4 || parts[2] != "submitted" || !aospParamRegex.MatchString(parts[3]) {
+		return "", fmt.Errorf("unexpected build URL %s", resp.Request.URL)
+	}
+	return parts[3], nil
+}
+
+// downloadFile downloads url to dst, resuming from the end of dst if it already exists, and verifies the complete
+// file against the size and MD5 reported by the server. onProgress is called periodically with the bytes
+// downloaded so far and the total size. The download is aborted if no data arrives within fetchStallTimeout.
+func downloadFile(ctx context.Context, url string, dst string, onProgress func(done int64, total int64)) error {
+	var offset int64
+	if info, err := os.Stat(dst); err == nil {
+		offset = info.Size()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := aospHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// cancelling the request unblocks the pending read of the body
+	stalled := make(chan struct{})
+	stallTimer := time.AfterFunc(fetchStallTimeout, func() {
+		close(stalled)
+		cancel()
+	})
+	defer stallTimer.Stop()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the partial file is already complete, e.g. cancelled right before the rename
+		return verifyDownload(dst, offset, resp.Header)
+	case resp.StatusCode == http.StatusOK:
+		// the server ignored the Range header, start over
+		flags |= os.O_TRUNC
+		offset = 0
+	default:
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+
+	f, err := os.OpenFile(dst, flags, 0644)
+	if err != nil {
+		return err
+	}
+	done := offset
+	lastReport := time.Time{}
+	buf := make([]byte, 1024*1024)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		// a stopped timer hasn't fired yet
+		if n > 0 && stallTimer.Stop() {
+			stallTimer.Reset(fetchStallTimeout)
+		}
+		if n > 0 {
+			if _, err := f.Write(buf[:n]); err != nil {
+				f.Close()
+				return err
+			}
+			done += int64(n)
+			if time.Since(lastReport) > fetchProgressInterval {
+				onProgress(done, total)
+				lastReport = time.Now()
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			// keep the partial file for resuming
+			f.Close()
+			select {
+			case <-stalled:
+				return fmt.Errorf("no data received for %v", fetchStallTimeout)
+			default:
+			}
+			return readErr
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	onProgress(done, total)
+	return verifyDownload(dst, total, resp.Header)
+}
+
+// verifyDownload checks the size of a downloaded file and its MD5 if the server sends one in x-goog-hash (Android CI
+// serves artifacts from Google Cloud Storage). A corrupted file is deleted so that the next attempt starts over.
+func verifyDownload(file string, size int64, header http.Header) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && info.Size() != size {
+		os.Remove(file)
+		return fmt.Errorf("size mismatch, expected %d bytes but got %d", size, info.Size())
+	}
+	expected := ""
+	for _, h := range header.Values("x-goog-hash") {
+		for _, hash := range strings.Split(h, ",") {
+			if strings.HasPrefix(strings.TrimSpace(hash), "md5=") {
+				expected = strings.TrimPrefix(strings.TrimSpace(hash), "md5=")
+			}
+		}
+	}
+	if expected == "" {
+		return nil
+	}
+	expectedSum, err := base64.StdEncoding.DecodeString(expected)
+	if err != nil {
+		return errors.Wrap(err, "invalid md5 "+expected)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), expectedSum) {
+		os.Remove(file)
+		return fmt.Errorf("md5 mismatch, expected %s but got %s", expected, base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package vmm
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadFileResume(t *testing.T) {
+	content := bytes.Repeat([]byte("matrisea"), 1024)
+	sum := md5.Sum(content)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-goog-hash", "crc32c=AAAAAA==,md5="+base64.StdEncoding.EncodeToString(sum[:]))
+		http.ServeContent(w, r, "image.zip", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dst := path.Join(t.TempDir(), "image.zip.part")
+	// an interrupted download
+	require.Nil(t, ioutil.WriteFile(dst, content[:1000], 0644))
+
+	var lastDone, lastTotal int64
+	err := downloadFile(context.Background(), server.URL, dst, func(done int64, total int64) {
+		lastDone, lastTotal = done, total
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), lastDone)
+	assert.Equal(t, int64(len(content)), lastTotal)
+	downloaded, err := ioutil.ReadFile(dst)
+	require.Nil(t, err)
+	assert.Equal(t, content, downloaded)
+}
+
+func TestDownloadFileChecksumMismatch(t *testing.T) {
+	content := []byte("matrisea")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-goog-hash", "md5="+base64.StdEncoding.EncodeToString(make([]byte, md5.Size)))
+		http.ServeContent(w, r, "image.zip", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dst := path.Join(t.TempDir(), "image.zip.part")
+	err := downloadFile(context.Background(), server.URL, dst, func(int64, int64) {})
+	assert.Error(t, err)
+	// corrupted files are removed so the next attempt starts over
+	assert.NoFileExists(t, dst)
+}
+
+func TestDownloadFileStalled(t *testing.T) {
+	content := []byte("matrisea")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "16")
+		w.Write(content)
+		w.(http.Flusher).Flush()
+		// never sends the rest
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	defer func(timeout time.Duration) { fetchStallTimeout = timeout }(fetchStallTimeout)
+	fetchStallTimeout = 200 * time.Millisecond
+
+	dst := path.Join(t.TempDir(), "image.zip.part")
+	err := downloadFile(context.Background(), server.URL, dst, func(int64, int64) {})
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, context.Canceled), err.Error())
+	// the partial file is kept for resuming
+	downloaded, err := ioutil.ReadFile(dst)
+	require.Nil(t, err)
+	assert.Equal(t, content, downloaded)
+}
+
+func TestStartFetching(t *testing.T) {
+	v := &VMM{}
+	assert.True(t, v.startFetching("aosp_cf_x86_64_phone-userdebug/8000000"))
+	assert.False(t, v.startFetching("aosp_cf_x86_64_phone-userdebug/8000000"))
+	assert.True(t, v.startFetching("aosp_cf_x86_64_phone-userdebug/8000001"))
+	v.endFetching("aosp_cf_x86_64_phone-userdebug/8000000")
+	assert.True(t, v.startFetching("aosp_cf_x86_64_phone-userdebug/8000000"))
+}
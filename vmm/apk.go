@@ -0,0 +1,199 @@
+package vmm
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+// Reading the package name of an APK on the host, as aapt isn't available in the cuttlefish image. The package name
+// is the "package" attribute of the root <manifest> element in AndroidManifest.xml, which is compiled into Android's
+// binary XML format: a string pool chunk followed by a chunk for each XML node, where attributes refer to strings by
+// their index in the pool.
+
+const (
+	axmlStringPoolType   = 0x0001
+	axmlStartElementType = 0x0102
+	axmlUTF8Flag         = 1 << 8
+	axmlTypeString       = 0x03
+	axmlNoIndex          = 0xffffffff
+)
+
+// APKPackageName returns the package name declared in an APK's manifest.
+func APKPackageName(apkPath string) (string, error) {
+	r, err := zip.OpenReader(apkPath)
+	if err != nil {
+		return "", errors.Wrap(err, "not an APK")
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if f.Name != "AndroidManifest.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return "", err
+		}
+		return manifestPackageName(data)
+	}
+	return "", errors.New("AndroidManifest.xml not found in APK")
+}
+
+// manifestPackageName returns the package attribute of the first element in a binary XML manifest.
+func manifestPackageName(data []byte) (string, error) {
+	le := binary.LittleEndian
+	if len(data) < 8 {
+		return "", errors.New("manifest too short")
+	}
+	var pool []string
+	// skip the header of the XML chunk and walk through its child chunks
+	offset := int(le.Uint16(data[2:]))
+	for offset+8 <= len(data) {
+		chunkType := le.Uint16(data[offset:])
+		headerSize := int(le.Uint16(data[offset+2:]))
+		chunkSize := int(le.Uint32(data[offset+4:]))
+		if chunkSize < 8 || offset+chunkSize > len(data) {
+			return "", errors.New("malformed manifest chunk")
+		}
+		chunk := data[offset : offset+chunkSize]
+		switch chunkType {
+		case axmlStringPoolType:
+			var err error
+			if pool, err = parseStringPool(chunk); err != nil {
+				return "", err
+			}
+		case axmlStartElementType:
+			// the first element is <manifest>
+			return packageAttribute(chunk, headerSize, pool)
+		}
+		offset += chunkSize
+	}
+	return "", errors.New("no element found in manifest")
+}
+
+func packageAttribute(chunk []byte, headerSize int, pool []string) (string, error) {
+	le := binary.LittleEndian
+	// namespace, name, attributeStart, attributeSize and attributeCount after the node header
+	if len(chunk) < headerSize+14 {
+		return "", errors.New("malformed manifest element")
+	}
+	ext := chunk[headerSize:]
+	attrStart := int(le.Uint16(ext[8:]))
+	attrSize := int(le.Uint16(ext[10:]))
+	attrCount := int(le.Uint16(ext[12:]))
+	for i := 0; i < attrCount; i++ {
+		attr := headerSize + attrStart + i*attrSize
+		if attrSize < 20 || attr+20 > len(chunk) {
+			return "", errors.New("malformed manifest attribute")
+		}
+		name := le.Uint32(chunk[attr+4:])
+		if int(name) >= len(pool) || pool[name] != "package" {
+			continue
+		}
+		value := le.Uint32(chunk[attr+8:])
+		if value == axmlNoIndex && chunk[attr+15] == axmlTypeString {
+			value = le.Uint32(chunk[attr+16:])
+		}
+		if int(value) >= len(pool) {
+			return "", errors.New("invalid package attribute")
+		}
+		return pool[value], nil
+	}
+	return "", errors.New("no package attribute in manifest")
+}
+
+// parseStringPool decodes the strings of a string pool chunk, in UTF-8 or UTF-16 depending on its flags.
+func parseStringPool(chunk []byte) ([]string, error) {
+	le := binary.LittleEndian
+	if len(chunk) < 28 {
+		return nil, errors.New("malformed string pool")
+	}
+	headerSize := int(le.Uint16(chunk[2:]))
+	count := int(le.Uint32(chunk[8:]))
+	utf8 := le.Uint32(chunk[16:])&axmlUTF8Flag != 0
+	stringsStart := int(le.Uint32(chunk[20:]))
+	if headerSize+count*4 > len(chunk) {
+		return nil, errors.New("malformed string pool")
+	}
+	pool := make([]string, count)
+	for i := range pool {
+		start := stringsStart + int(le.Uint32(chunk[headerSize+i*4:]))
+		var s string
+		var err error
+		if utf8 {
+			s, err = decodeUTF8PoolString(chunk, start)
+		} else {
+			s, err = decodeUTF16PoolString(chunk, start)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("string %d: %v", i, err)
+		}
+		pool[i] = s
+	}
+	return pool, nil
+}
+
+// decodeUTF8PoolString decodes a string prefixed by its lengths in characters and bytes, each 1 or 2 bytes long.
+func decodeUTF8PoolString(chunk []byte, start int) (string, error) {
+	pos := start
+	readLen := func() (int, error) {
+		if pos >= len(chunk) {
+			return 0, errors.New("out of bounds")
+		}
+		n := int(chunk[pos])
+		pos++
+		if n&0x80 != 0 {
+			if pos >= len(chunk) {
+				return 0, errors.New("out of bounds")
+			}
+			n = (n&0x7f)<<8 | int(chunk[pos])
+			pos++
+		}
+		return n, nil
+	}
+	if _, err := readLen(); err != nil {
+		return "", err
+	}
+	n, err := readLen()
+	if err != nil {
+		return "", err
+	}
+	if pos+n > len(chunk) {
+		return "", errors.New("out of bounds")
+	}
+	return string(chunk[pos : pos+n]), nil
+}
+
+// decodeUTF16PoolString decodes a string prefixed by its length in code units, which is 1 or 2 units long.
+func decodeUTF16PoolString(chunk []byte, start int) (string, error) {
+	le := binary.LittleEndian
+	if start+2 > len(chunk) {
+		return "", errors.New("out of bounds")
+	}
+	n := int(le.Uint16(chunk[start:]))
+	pos := start + 2
+	if n&0x8000 != 0 {
+		if pos+2 > len(chunk) {
+			return "", errors.New("out of bounds")
+		}
+		n = (n&0x7fff)<<16 | int(le.Uint16(chunk[pos:]))
+		pos += 2
+	}
+	if pos+n*2 > len(chunk) {
+		return "", errors.New("out of bounds")
+	}
+	units := make([]uint16, n)
+	for i := range units {
+		units[i] = le.Uint16(chunk[pos+i*2:])
+	}
+	return string(utf16.Decode(units)), nil
+}
@@ -0,0 +1,93 @@
+package vmm
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildManifest compiles <manifest versionCode="1" package="..."> into binary XML with a UTF-8 or UTF-16 string pool.
+func buildManifest(packageName string, utf8 bool) []byte {
+	le := binary.LittleEndian
+	strs := []string{"versionCode", "package", "manifest", packageName}
+
+	var data bytes.Buffer
+	var offsets []uint32
+	for _, s := range strs {
+		offsets = append(offsets, uint32(data.Len()))
+		if utf8 {
+			data.Write([]byte{byte(len(s)), byte(len(s))})
+			data.WriteString(s)
+			data.WriteByte(0)
+		} else {
+			units := utf16.Encode([]rune(s))
+			binary.Write(&data, le, uint16(len(units)))
+			binary.Write(&data, le, units)
+			binary.Write(&data, le, uint16(0))
+		}
+	}
+	for data.Len()%4 != 0 {
+		data.WriteByte(0)
+	}
+	var flags uint32
+	if utf8 {
+		flags = axmlUTF8Flag
+	}
+	var pool bytes.Buffer
+	stringsStart := 28 + 4*len(strs)
+	binary.Write(&pool, le, []uint16{axmlStringPoolType, 28})
+	binary.Write(&pool, le, []uint32{uint32(stringsStart + data.Len()), uint32(len(strs)), 0, flags, uint32(stringsStart), 0})
+	binary.Write(&pool, le, offsets)
+	pool.Write(data.Bytes())
+
+	var elem bytes.Buffer
+	binary.Write(&elem, le, []uint16{axmlStartElementType, 16})
+	binary.Write(&elem, le, []uint32{16 + 20 + 2*20, 1, axmlNoIndex, axmlNoIndex, 2})
+	binary.Write(&elem, le, []uint16{20, 20, 2, 0, 0, 0})
+	// versionCode="1" as an integer, then package as a string
+	binary.Write(&elem, le, []uint32{axmlNoIndex, 0, axmlNoIndex, 0x10000008, 1})
+	binary.Write(&elem, le, []uint32{axmlNoIndex, 1, 3, 0x03000008, 3})
+
+	var xml bytes.Buffer
+	binary.Write(&xml, le, []uint16{0x0003, 8})
+	binary.Write(&xml, le, uint32(8+pool.Len()+elem.Len()))
+	xml.Write(pool.Bytes())
+	xml.Write(elem.Bytes())
+	return xml.Bytes()
+}
+
+func TestManifestPackageName(t *testing.T) {
+	for _, utf8 := range []bool{false, true} {
+		name, err := manifestPackageName(buildManifest("com.example.app", utf8))
+		require.Nil(t, err)
+		assert.Equal(t, "com.example.app", name)
+	}
+	_, err := manifestPackageName([]byte("<manifest package=\"com.example.app\"/>"))
+	assert.Error(t, err)
+}
+
+func TestAPKPackageName(t *testing.T) {
+	apk := path.Join(t.TempDir(), "app.apk")
+	f, err := os.Create(apk)
+	require.Nil(t, err)
+	w := zip.NewWriter(f)
+	entry, err := w.Create("AndroidManifest.xml")
+	require.Nil(t, err)
+	entry.Write(buildManifest("com.example.app", false))
+	require.Nil(t, w.Close())
+	require.Nil(t, f.Close())
+
+	name, err := APKPackageName(apk)
+	require.Nil(t, err)
+	assert.Equal(t, "com.example.app", name)
+
+	_, err = APKPackageName(path.Join(t.TempDir(), "missing.apk"))
+	assert.Error(t, err)
+}
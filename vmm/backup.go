@@ -0,0 +1,199 @@
+package vmm
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// App backups with `adb backup`. The guest asks the user to confirm every backup with a "Back up my data" button,
+// which is tapped through `input tap` at the button's position found in a `uiautomator dump` of the screen.
+
+const (
+	// Resource id of the "Back up my data" button in the confirmation dialog of com.android.backupconfirm
+	backupAllowButtonID = "com.android.backupconfirm:id/button_allow"
+	// Maximum waiting time for the confirmation dialog to show up
+	backupConfirmTimeout = 30 * time.Second
+	// Maximum waiting time for `adb backup` to complete after it's confirmed
+	backupTimeout = 10 * time.Minute
+	// Where the screen is dumped on the guest
+	uiautomatorDumpFile = "/sdcard/window_dump.xml"
+)
+
+var nodeBoundsRegex = regexp.MustCompile(`bounds="\[(\d+),(\d+)\]\[(\d+),(\d+)\]"`)
+
+// VMBackupApp backs up the data of an app with `adb backup`, confirming the backup on the guest's screen, and saves
+// the .ab file into the VM's device folder. The host path of the .ab file is returned.
+func (v *VMM) VMBackupApp(containerName string, packageName string) (string, error) {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return "", err
+	}
+	if err := validatePackageName(packageName); err != nil {
+		return "", err
+	}
+	unlock, err := v.lockVM(containerName, "backup")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	serial, err := v.getADBSerial(containerName)
+	if err != nil {
+		return "", err
+	}
+
+	fileName := fmt.Sprintf("backup-%s-%s.ab", packageName, time.Now().Format("20060102-150405"))
+	hostPath := path.Join(v.DevicesDir, containerName, fileName)
+	type backupResult struct {
+		resp ExecResult
+		err  error
+	}
+	// adb backup blocks until the backup is confirmed on the guest, or the guest gives up waiting
+	exited := make(chan backupResult, 1)
+	go func() {
+		resp, err := v.containerExecWithTimeout(containerName, fmt.Sprintf("adb -s %s backup -f %s %s", serial,
+			shellQuote(path.Join(DeviceDir, fileName)), packageName), "root", backupTimeout)
+		exited <- backupResult{resp, err}
+	}()
+
+	confirmed := false
+	deadline := time.Now().Add(backupConfirmTimeout)
+	for !confirmed && time.Now().Before(deadline) {
+		select {
+		case res := <-exited:
+			os.Remove(hostPath)
+			return "", errors.Errorf("adb backup exited before it was confirmed. err: %v stderr: %s", res.err, res.resp.errBuffer)
+		case <-time.After(time.Second):
+		}
+		if confirmed, err = v.tapBackupConfirmation(containerName); err != nil {
+			log.Printf("VMBackupApp (%s): %v\n", containerName, err)
+		}
+	}
+	if !confirmed {
+		// adb backup would otherwise keep waiting for backupTimeout while the VM is locked. exited is buffered so the
+		// exec goroutine finishes on its own once adb is killed.
+		if _, err := v.containerExec(containerName, "pkill -f "+shellQuote("adb .* backup -f .*"+regexp.QuoteMeta(fileName)), "root"); err != nil {
+			log.Printf("VMBackupApp (%s): failed to kill adb backup: %v\n", containerName, err)
+		}
+		os.Remove(hostPath)
+		return "", errors.New("the backup confirmation dialog didn't show up on the VM")
+	}
+	res := <-exited
+	if res.err != nil || res.resp.ExitCode != 0 {
+		os.Remove(hostPath)
+		return "", errors.Errorf("failed to back up %s. err: %v stderr: %s", packageName, res.err, res.resp.errBuffer)
+	}
+	// adb backup exits with 0 even if the guest fails to write the backup, or skips the app because it's excluded
+	// from adb backup, i.e. android:allowBackup="false" or targetSdkVersion 31+ on Android 12+
+	hasData, err := backupHasData(hostPath)
+	if err != nil {
+		os.Remove(hostPath)
+		return "", errors.Wrap(err, "failed to read the backup of "+packageName)
+	}
+	if !hasData {
+		os.Remove(hostPath)
+		return "", errors.New("adb backup produced no data for " + packageName + ", the app may not allow adb backup")
+	}
+	log.Printf("VMBackupApp (%s): saved backup of %s to %s\n", containerName, packageName, fileName)
+	return hostPath, nil
+}
+
+// backupHasData checks if an .ab file has any file of the app after its header, i.e.
+//
+//	ANDROID BACKUP\n<version>\n<compressed: 0 or 1>\n<encryption: none or AES-256>\n<tar stream>
+//
+// A skipped app leaves only the end-of-archive blocks in the tar stream. Encrypted backups can't be checked and are
+// assumed to have data.
+func backupHasData(abPath string) (bool, error) {
+	f, err := os.Open(abPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	header := make([]string, 4)
+	for i := range header {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return false, errors.Wrap(err, "incomplete backup header")
+		}
+		header[i] = strings.TrimSpace(line)
+	}
+	if header[0] != "ANDROID BACKUP" {
+		return false, errors.New("not an android backup")
+	}
+	if header[3] != "none" {
+		return true, nil
+	}
+	var payload io.Reader = r
+	if header[2] == "1" {
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return false, errors.Wrap(err, "invalid backup payload")
+		}
+		defer zr.Close()
+		payload = zr
+	}
+	if _, err := tar.NewReader(payload).Next(); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "invalid backup payload")
+	}
+	return true, nil
+}
+
+// tapBackupConfirmation taps the "Back up my data" button if the backup confirmation dialog is on the screen, and
+// returns whether it was tapped.
+func (v *VMM) tapBackupConfirmation(containerName string) (bool, error) {
+	resp, err := v.containerADBShell(containerName, fmt.Sprintf("uiautomator dump %s >/dev/null && cat %s",
+		uiautomatorDumpFile, uiautomatorDumpFile))
+	if err != nil {
+		return false, errors.Wrap(err, "adb shell uiautomator dump")
+	}
+	if resp.ExitCode != 0 {
+		return false, errors.New("failed to dump the screen. output: " + strings.TrimSpace(resp.outBuffer.String()+resp.errBuffer.String()))
+	}
+	x, y, found := nodeCenter(resp.outBuffer.String(), backupAllowButtonID)
+	if !found {
+		return false, nil
+	}
+	resp, err = v.containerADBShell(containerName, fmt.Sprintf("input tap %d %d", x, y))
+	if err != nil {
+		return false, errors.Wrap(err, "adb shell input tap")
+	}
+	if resp.ExitCode != 0 {
+		return false, errors.New("failed to tap the backup confirmation. output: " + strings.TrimSpace(resp.outBuffer.String()+resp.errBuffer.String()))
+	}
+	return true, nil
+}
+
+// nodeCenter returns the center of the node with resourceID in a `uiautomator dump`, e.g.
+//
+//	<node ... resource-id="com.android.backupconfirm:id/button_allow" ... bounds="[540,1500][1000,1620]" />
+func nodeCenter(dump string, resourceID string) (int, int, bool) {
+	re := regexp.MustCompile(`<node [^>]*resource-id="` + regexp.QuoteMeta(resourceID) + `"[^>]*>`)
+	node := re.FindString(dump)
+	if node == "" {
+		return 0, 0, false
+	}
+	match := nodeBoundsRegex.FindStringSubmatch(node)
+	if match == nil {
+		return 0, 0, false
+	}
+	var b [4]int
+	for i := range b {
+		b[i], _ = strconv.Atoi(match[i+1])
+	}
+	return (b[0] + b[2]) / 2, (b[1] + b[3]) / 2, true
+}
@@ -0,0 +1,87 @@
+package vmm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testWindowDump = `<?xml version='1.0' encoding='UTF-8' standalone='yes' ?><hierarchy rotation="0">` +
+	`<node index="0" text="" resource-id="com.android.backupconfirm:id/button_deny" class="android.widget.Button" bounds="[80,1500][520,1620]" />` +
+	`<node index="1" text="Back up my data" resource-id="com.android.backupconfirm:id/button_allow" class="android.widget.Button" bounds="[540,1500][1000,1620]" />` +
+	`</hierarchy>`
+
+func TestNodeCenter(t *testing.T) {
+	x, y, found := nodeCenter(testWindowDump, backupAllowButtonID)
+	assert.True(t, found)
+	assert.Equal(t, 770, x)
+	assert.Equal(t, 1560, y)
+
+	_, _, found = nodeCenter(testWindowDump, "com.android.backupconfirm:id/password")
+	assert.False(t, found)
+	_, _, found = nodeCenter(`<node resource-id="com.android.backupconfirm:id/button_allow" />`, backupAllowButtonID)
+	assert.False(t, found)
+}
+
+// writeTestBackup writes an .ab file with the given files in its tar stream
+func writeTestBackup(t *testing.T, dir string, compressed bool, files ...string) string {
+	var payload bytes.Buffer
+	var w io.WriteCloser = nopWriteCloser{&payload}
+	header := "ANDROID BACKUP\n5\n0\nnone\n"
+	if compressed {
+		w = zlib.NewWriter(&payload)
+		header = "ANDROID BACKUP\n5\n1\nnone\n"
+	}
+	tw := tar.NewWriter(w)
+	for _, name := range files {
+		assert.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: 4}))
+		_, err := tw.Write([]byte("data"))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, w.Close())
+	f, err := ioutil.TempFile(dir, "backup-*.ab")
+	assert.Nil(t, err)
+	defer f.Close()
+	_, err = f.Write(append([]byte(header), payload.Bytes()...))
+	assert.Nil(t, err)
+	return f.Name()
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestBackupHasData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matrisea-backup-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	hasData, err := backupHasData(writeTestBackup(t, dir, true, "apps/com.example.app/_manifest"))
+	assert.Nil(t, err)
+	assert.True(t, hasData)
+	hasData, err = backupHasData(writeTestBackup(t, dir, false, "apps/com.example.app/_manifest"))
+	assert.Nil(t, err)
+	assert.True(t, hasData)
+	// an app excluded from adb backup only leaves the end of the tar stream
+	hasData, err = backupHasData(writeTestBackup(t, dir, true))
+	assert.Nil(t, err)
+	assert.False(t, hasData)
+
+	truncated := path.Join(dir, "truncated.ab")
+	assert.Nil(t, ioutil.WriteFile(truncated, []byte("ANDROID BACKUP\n5\n"), 0644))
+	_, err = backupHasData(truncated)
+	assert.Error(t, err)
+	encrypted := path.Join(dir, "encrypted.ab")
+	assert.Nil(t, ioutil.WriteFile(encrypted, []byte("ANDROID BACKUP\n5\n1\nAES-256\n"), 0644))
+	hasData, err = backupHasData(encrypted)
+	assert.Nil(t, err)
+	assert.True(t, hasData)
+}
@@ -0,0 +1,124 @@
+package vmm
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Moving a VM's configs in KVStore (cmdline, tags, sdcard size etc) to a VM on another host. Only the configs that
+// describe how a VM is configured are moved. The ones that describe its state on this host, e.g. boot_attempts and
+// cf_instance, would be wrong for the other VM.
+
+var portableConfigKeys = map[string]bool{
+	CONFIG_KEY_CPU:                    true,
+	CONFIG_KEY_RAM:                    true,
+	CONFIG_KEY_AOSP_VERSION:           true,
+	CONFIG_KEY_TAGS:                   true,
+	CONFIG_KEY_CMDLINE:                true,
+	CONFIG_KEY_GUEST_ENFORCE_SECURITY: true,
+	CONFIG_KEY_GUEST_AUDIT_SECURITY:   true,
+	CONFIG_KEY_SDCARD_MB:              true,
+	CONFIG_KEY_DATA_IMAGE_MB:          true,
+	CONFIG_KEY_AUTOSTART:              true,
+	CONFIG_KEY_WEBSOCKIFY_LOG_LEVEL:   true,
+}
+
+// ErrInvalidConfig is returned by VMImportConfig when the imported configs are rejected.
+var ErrInvalidConfig = errors.New("invalid config")
+
+// VMExportConfig returns the configs of a VM as a JSON object, which can be applied to another VM with VMImportConfig.
+func (v *VMM) VMExportConfig(containerName string) ([]byte, error) {
+	if _, err := v.isManagedContainer(containerName); err != nil {
+		return nil, err
+	}
+	data, err := v.KVStore.ExportContainerConfig(containerName)
+	if err != nil {
+		return nil, errors.Wrap(err, "kvstore: ExportContainerConfig")
+	}
+	configs := map[string]string{}
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	for key := range configs {
+		if !portableConfigKeys[key] {
+			delete(configs, key)
+		}
+	}
+	return json.Marshal(configs)
+}
+
+// VMImportConfig applies the configs exported by VMExportConfig to a VM, which takes effect on its next VMStart.
+// Unknown and host-specific configs are ignored, and the values that VMCreate and ContainerUpdateConfig would reject
+// are rejected as a whole with ErrInvalidConfig before anything is changed.
+func (v *VMM) VMImportConfig(containerName string, data []byte) error {
+	if _, err := v.isManagedContainer(containerName); err != nil {
+		return err
+	}
+	configs := map[string]string{}
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return errors.Wrap(ErrInvalidConfig, err.Error())
+	}
+	ignored := []string{}
+	for key, value := range configs {
+		if !portableConfigKeys[key] {
+			ignored = append(ignored, key)
+			delete(configs, key)
+			continue
+		}
+		if err := v.validateConfig(key, value); err != nil {
+			return errors.Wrap(ErrInvalidConfig, err.Error())
+		}
+	}
+	if aospVersion := configs[CONFIG_KEY_AOSP_VERSION]; aospVersion != "" {
+		normalized, _ := NormalizeAOSPVersion(aospVersion)
+		configs[CONFIG_KEY_AOSP_VERSION] = string(normalized)
+	}
+	if len(ignored) > 0 {
+		sort.Strings(ignored)
+		log.Printf("VMImportConfig (%s): ignored unknown or host-specific configs %v\n", containerName, ignored)
+	}
+	data, err := json.Marshal(configs)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(v.KVStore.ImportContainerConfig(containerName, data), "kvstore: ImportContainerConfig")
+}
+
+// validateConfig checks the value of an imported config that has constraints.
+func (v *VMM) validateConfig(key string, value string) error {
+	switch key {
+	case CONFIG_KEY_CMDLINE:
+		if _, rejected := v.FilterLaunchFlags(value); len(rejected) > 0 {
+			return fmt.Errorf("disallowed launch_cvd flags %v", rejected)
+		}
+	case CONFIG_KEY_GUEST_ENFORCE_SECURITY, CONFIG_KEY_GUEST_AUDIT_SECURITY:
+		return ValidateSecurityConfig(key, value)
+	case CONFIG_KEY_AOSP_VERSION:
+		if value != "" {
+			_, err := NormalizeAOSPVersion(value)
+			return err
+		}
+	case CONFIG_KEY_AUTOSTART:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("invalid %s %q, must be true or false", key, value)
+		}
+	case CONFIG_KEY_WEBSOCKIFY_LOG_LEVEL:
+		if value != "" {
+			return ValidateWebsockifyLogLevel(value)
+		}
+	case CONFIG_KEY_CPU, CONFIG_KEY_RAM:
+		if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+			return fmt.Errorf("invalid %s %q, must be a positive number", key, value)
+		}
+	case CONFIG_KEY_SDCARD_MB, CONFIG_KEY_DATA_IMAGE_MB:
+		if n, err := strconv.Atoi(value); value != "" && (err != nil || n < 0) {
+			return fmt.Errorf("invalid %s %q, must be a size in MB", key, value)
+		}
+	}
+	return nil
+}
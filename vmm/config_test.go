@@ -0,0 +1,27 @@
+package vmm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateConfig(t *testing.T) {
+	vm := &VMM{AllowedLaunchFlags: DefaultAllowedLaunchFlags}
+	assert.Nil(t, vm.validateConfig(CONFIG_KEY_CMDLINE, "--x_res=720"))
+	assert.Error(t, vm.validateConfig(CONFIG_KEY_CMDLINE, "--system_image_dir=/etc"))
+	assert.Nil(t, vm.validateConfig(CONFIG_KEY_GUEST_ENFORCE_SECURITY, "false"))
+	assert.Error(t, vm.validateConfig(CONFIG_KEY_GUEST_ENFORCE_SECURITY, "no"))
+	assert.Nil(t, vm.validateConfig(CONFIG_KEY_AOSP_VERSION, "android 12"))
+	assert.Error(t, vm.validateConfig(CONFIG_KEY_AOSP_VERSION, "Android 99"))
+	assert.Nil(t, vm.validateConfig(CONFIG_KEY_CPU, "4"))
+	assert.Error(t, vm.validateConfig(CONFIG_KEY_RAM, "0"))
+	assert.Nil(t, vm.validateConfig(CONFIG_KEY_SDCARD_MB, ""))
+	assert.Error(t, vm.validateConfig(CONFIG_KEY_DATA_IMAGE_MB, "-1"))
+	assert.Nil(t, vm.validateConfig(CONFIG_KEY_WEBSOCKIFY_LOG_LEVEL, WebsockifyLogOff))
+	assert.Error(t, vm.validateConfig(CONFIG_KEY_WEBSOCKIFY_LOG_LEVEL, "trace"))
+	assert.Nil(t, vm.validateConfig(CONFIG_KEY_AUTOSTART, "true"))
+	assert.Error(t, vm.validateConfig(CONFIG_KEY_AUTOSTART, "yes"))
+	// configs without constraints
+	assert.Nil(t, vm.validateConfig(CONFIG_KEY_TAGS, "anything"))
+}
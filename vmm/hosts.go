@@ -0,0 +1,189 @@
+package vmm
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Host entries in the guest's /etc/hosts, e.g. to point an app at a staging backend. /etc/hosts links to
+// /system/etc/hosts, so the system partition is remounted read-write with `adb root` and `adb remount` before it's
+// edited, which needs a userdebug or eng build.
+
+const guestHostsFile = "/system/etc/hosts"
+
+// ErrRemountNeedsReboot is returned when `adb remount` had to disable verity first, which only takes effect after the
+// VM is rebooted.
+var ErrRemountNeedsReboot = errors.New("verity has been disabled to remount /system, restart the VM and try again")
+
+var hostnameRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+
+type HostEntry struct {
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname"`
+}
+
+// VMListHostEntries lists the entries in the guest's /etc/hosts, one for each hostname.
+func (v *VMM) VMListHostEntries(containerName string) ([]HostEntry, error) {
+	content, err := v.readGuestHosts(containerName)
+	if err != nil {
+		return nil, err
+	}
+	return parseHosts(content), nil
+}
+
+// VMAddHostEntry maps hostname to ip in the guest's /etc/hosts, replacing the existing entry of hostname if any.
+func (v *VMM) VMAddHostEntry(containerName string, hostname string, ip string) error {
+	if !hostnameRegex.MatchString(hostname) {
+		return fmt.Errorf("invalid hostname %q", hostname)
+	}
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid IP address %q", ip)
+	}
+	content, err := v.readGuestHosts(containerName)
+	if err != nil {
+		return err
+	}
+	content = removeHostname(content, hostname) + ip + " " + hostname + "\n"
+	if err := v.writeGuestHosts(containerName, content); err != nil {
+		return err
+	}
+	log.Printf("VMAddHostEntry (%s): %s %s\n", containerName, ip, hostname)
+	return nil
+}
+
+// VMRemoveHostEntry removes hostname from the guest's /etc/hosts. It's not an error if there is no such entry.
+func (v *VMM) VMRemoveHostEntry(containerName string, hostname string) error {
+	if !hostnameRegex.MatchString(hostname) {
+		return fmt.Errorf("invalid hostname %q", hostname)
+	}
+	content, err := v.readGuestHosts(containerName)
+	if err != nil {
+		return err
+	}
+	updated := removeHostname(content, hostname)
+	if updated == content {
+		return nil
+	}
+	if err := v.writeGuestHosts(containerName, updated); err != nil {
+		return err
+	}
+	log.Printf("VMRemoveHostEntry (%s): %s\n", containerName, hostname)
+	return nil
+}
+
+func (v *VMM) readGuestHosts(containerName string) (string, error) {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return "", err
+	}
+	resp, err := v.containerADBShell(containerName, "cat "+guestHostsFile)
+	if err != nil {
+		return "", errors.Wrap(err, "adb shell cat")
+	}
+	if resp.ExitCode != 0 {
+		return "", errors.New("failed to read " + guestHostsFile + ". output: " + strings.TrimSpace(resp.outBuffer.String()+resp.errBuffer.String()))
+	}
+	return resp.outBuffer.String(), nil
+}
+
+// writeGuestHosts remounts the system partition read-write and replaces the guest's hosts file with content.
+func (v *VMM) writeGuestHosts(containerName string, content string) error {
+	if err := v.remountGuestSystem(containerName); err != nil {
+		return err
+	}
+	// encoded so that any comment in the file survives the shell
+	cmd := fmt.Sprintf("echo %s | base64 -d > %s", base64.StdEncoding.EncodeToString([]byte(content)), guestHostsFile)
+	resp, err := v.containerADBShell(containerName, cmd)
+	if err != nil {
+		return errors.Wrap(err, "adb shell write hosts")
+	}
+	if resp.ExitCode != 0 {
+		return errors.New("failed to write " + guestHostsFile + ". output: " + strings.TrimSpace(resp.outBuffer.String()+resp.errBuffer.String()))
+	}
+	return nil
+}
+
+// remountGuestSystem restarts adbd in the guest as root and remounts the system partition read-write. Both are no-ops
+// if they have been done since the last boot.
+func (v *VMM) remountGuestSystem(containerName string) error {
+	serial, err := v.getADBSerial(containerName)
+	if err != nil {
+		return err
+	}
+	// adbd restarts as root, so wait for it to come back before remounting
+	resp, err := v.containerExec(containerName, fmt.Sprintf("adb -s %s root && adb -s %s wait-for-device", serial, serial), "root")
+	if err != nil {
+		return errors.Wrap(err, "adb root")
+	}
+	if resp.ExitCode != 0 {
+		return errors.New("failed to restart adbd as root, which needs a userdebug build. output: " + strings.TrimSpace(resp.outBuffer.String()+resp.errBuffer.String()))
+	}
+	resp, err = v.containerExec(containerName, fmt.Sprintf("adb -s %s remount", serial), "root")
+	if err != nil {
+		return errors.Wrap(err, "adb remount")
+	}
+	output := resp.outBuffer.String() + resp.errBuffer.String()
+	if strings.Contains(output, "reboot") {
+		return ErrRemountNeedsReboot
+	}
+	if resp.ExitCode != 0 {
+		return errors.New("failed to remount /system. output: " + strings.TrimSpace(output))
+	}
+	return nil
+}
+
+// parseHosts returns an entry for each hostname in a hosts file, skipping comments.
+func parseHosts(content string) []HostEntry {
+	entries := []HostEntry{}
+	for _, line := range strings.Split(content, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, hostname := range fields[1:] {
+			entries = append(entries, HostEntry{IP: fields[0], Hostname: hostname})
+		}
+	}
+	return entries
+}
+
+// removeHostname removes hostname from the lines of a hosts file, and the lines left with no hostname.
+func removeHostname(content string, hostname string) string {
+	var out []string
+	for _, line := range strings.Split(strings.TrimSuffix(content, "\n"), "\n") {
+		entry := line
+		comment := ""
+		if i := strings.Index(line, "#"); i >= 0 {
+			entry, comment = line[:i], line[i:]
+		}
+		fields := strings.Fields(entry)
+		if len(fields) < 2 {
+			out = append(out, line)
+			continue
+		}
+		kept := []string{fields[0]}
+		for _, h := range fields[1:] {
+			if h != hostname {
+				kept = append(kept, h)
+			}
+		}
+		switch {
+		case len(kept) == len(fields):
+			out = append(out, line)
+		case len(kept) > 1:
+			out = append(out, strings.TrimSpace(strings.Join(kept, " ")+" "+comment))
+		}
+	}
+	if len(out) == 0 {
+		return ""
+	}
+	return strings.Join(out, "\n") + "\n"
+}
@@ -0,0 +1,35 @@
+package vmm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testHosts = `# comment
+127.0.0.1       localhost
+::1             ip6-localhost
+10.0.0.5 api.staging.example.com cdn.staging.example.com # staging
+`
+
+func TestParseHosts(t *testing.T) {
+	assert.Equal(t, []HostEntry{
+		{IP: "127.0.0.1", Hostname: "localhost"},
+		{IP: "::1", Hostname: "ip6-localhost"},
+		{IP: "10.0.0.5", Hostname: "api.staging.example.com"},
+		{IP: "10.0.0.5", Hostname: "cdn.staging.example.com"},
+	}, parseHosts(testHosts))
+}
+
+func TestRemoveHostname(t *testing.T) {
+	assert.Equal(t, testHosts, removeHostname(testHosts, "example.com"))
+	assert.Equal(t, `# comment
+127.0.0.1       localhost
+::1             ip6-localhost
+10.0.0.5 cdn.staging.example.com # staging
+`, removeHostname(testHosts, "api.staging.example.com"))
+	assert.Equal(t, `# comment
+::1             ip6-localhost
+10.0.0.5 api.staging.example.com cdn.staging.example.com # staging
+`, removeHostname(testHosts, "localhost"))
+}
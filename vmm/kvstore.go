@@ -1,6 +1,7 @@
 package vmm
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"path"
@@ -16,6 +17,13 @@ var (
 	ContainerBucket = []byte("container")
 )
 
+// KVStore is safe for concurrent use. The *bolt.DB is shared by all goroutines: bolt runs any number of read
+// transactions concurrently and queues write transactions, one at a time, without failing. The Timeout given to
+// bolt.Open only applies to the file lock taken when the DB is opened, which is why a second process can't open the
+// same DB (see tools/cli.go) while goroutines of the same process never wait on it.
+//
+// Every method is a single transaction. A read followed by a write in separate calls isn't atomic, so callers that
+// update a value based on the old one need their own lock (e.g. VMM.webhooksMu).
 type KVStore struct {
 	db *bolt.DB
 }
@@ -25,16 +33,16 @@ type KeyValue struct {
 	value string
 }
 
-func NewKVStore(basePath string) *KVStore {
+func NewKVStore(basePath string) (*KVStore, error) {
 	dbPath := path.Join(basePath, DBFile)
 	log.Printf("KVStore path %s\n", dbPath)
 	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
-		log.Fatalf("Failed to create kvstore. Reason: %v", err)
+		return nil, errors.Wrap(err, "failed to create kvstore")
 	}
 	return &KVStore{
 		db: db,
-	}
+	}, nil
 }
 
 func (s *KVStore) PutContainterValue(containerName string, kvs []KeyValue) error {
@@ -63,7 +71,7 @@ func (s *KVStore) PutContainterValue(containerName string, kvs []KeyValue) error
 }
 
 func (s *KVStore) GetContainerValue(containerName string, key string) (string, error) {
-	var value []byte
+	var value string
 	err := s.db.View(func(tx *bolt.Tx) error {
 		cbkt := tx.Bucket(ContainerBucket)
 		if cbkt == nil {
@@ -73,17 +81,19 @@ func (s *KVStore) GetContainerValue(containerName string, key string) (string, e
 		if bkt == nil {
 			return fmt.Errorf("bucket %s not found", containerName)
 		}
-		value = bkt.Get([]byte(key))
-		if value == nil {
+		v := bkt.Get([]byte(key))
+		if v == nil {
 			return fmt.Errorf("key %s not found in %s", key, containerName)
 		}
+		// copied since v is only valid during the transaction and can be overwritten by a concurrent write
+		value = string(v)
 		return nil
 	})
 
 	if err != nil {
 		return "", err
 	}
-	return string(value), nil
+	return value, nil
 }
 
 func (s *KVStore) GetContainerValueOrEmpty(containerName string, key string) string {
@@ -104,6 +114,72 @@ func (s *KVStore) GetContainerValueOrEmpty(containerName string, key string) str
 	return value
 }
 
+// PutGlobalValue stores a host-wide setting that isn't specific to any container
+func (s *KVStore) PutGlobalValue(key string, value string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists(GlobalBucket)
+		if err != nil {
+			return errors.Wrap(err, "fail to get global bucket")
+		}
+		return bkt.Put([]byte(key), []byte(value))
+	})
+	if err != nil {
+		return errors.Wrap(err, "fail to update db")
+	}
+	return nil
+}
+
+func (s *KVStore) GetGlobalValueOrEmpty(key string) string {
+	var value string
+	s.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(GlobalBucket)
+		if bkt != nil {
+			if v := bkt.Get([]byte(key)); v != nil {
+				value = string(v)
+			}
+		}
+		return nil
+	})
+	return value
+}
+
+// ExportContainerConfig serializes all configs of a container into a JSON object of keys to values.
+func (s *KVStore) ExportContainerConfig(containerName string) ([]byte, error) {
+	configs := map[string]string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cbkt := tx.Bucket(ContainerBucket)
+		if cbkt == nil {
+			return fmt.Errorf("container bucket not found")
+		}
+		bkt := cbkt.Bucket([]byte(containerName))
+		if bkt == nil {
+			return fmt.Errorf("bucket %s not found", containerName)
+		}
+		return bkt.ForEach(func(k, v []byte) error {
+			configs[string(k)] = string(v)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(configs)
+}
+
+// ImportContainerConfig stores the configs serialized by ExportContainerConfig for a container in a single
+// transaction. Existing configs of the same keys are overwritten and the others are kept.
+func (s *KVStore) ImportContainerConfig(containerName string, data []byte) error {
+	configs := map[string]string{}
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return errors.Wrap(err, "invalid config")
+	}
+	kvs := []KeyValue{}
+	for key, value := range configs {
+		kvs = append(kvs, KeyValue{key, value})
+	}
+	return s.PutContainterValue(containerName, kvs)
+}
+
 func (s *KVStore) RemoveContainerConfigs(containerName string) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
 		cbkt := tx.Bucket(ContainerBucket)
@@ -2,11 +2,22 @@ package vmm
 
 import (
 	"fmt"
+	"path"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// newTestKVStoreVMM returns a VMM with a KVStore in a temporary folder, which is removed after the test
+func newTestKVStoreVMM(t *testing.T) *VMM {
+	kvStore, err := NewKVStore(t.TempDir())
+	require.Nil(t, err)
+	t.Cleanup(func() { kvStore.Close() })
+	return &VMM{KVStore: kvStore}
+}
+
 func TestPutThenGetContainerValue(t *testing.T) {
 	testCases := []struct {
 		container     string
@@ -33,3 +44,73 @@ func TestPutThenGetContainerValue(t *testing.T) {
 		})
 	}
 }
+
+func TestNewKVStoreInvalidPathReturnsError(t *testing.T) {
+	kvs, err := NewKVStore(path.Join(dataDir, "non-exist-folder"))
+	assert.Nil(t, kvs)
+	assert.Error(t, err)
+}
+
+func TestKVStoreConcurrentAccess(t *testing.T) {
+	kvStore := newTestKVStoreVMM(t).KVStore
+
+	const workers = 20
+	const rounds = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*rounds*2)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// workers share containers so that reads race with writes to the same buckets
+			containerName := fmt.Sprintf("matrisea-test-%d", w%4)
+			key := fmt.Sprintf("key-%d", w)
+			for i := 0; i < rounds; i++ {
+				value := fmt.Sprintf("%d-%d", w, i)
+				if err := kvStore.PutContainterValue(containerName, []KeyValue{{key, value}}); err != nil {
+					errs <- err
+					continue
+				}
+				got, err := kvStore.GetContainerValue(containerName, key)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				// only this worker writes key
+				if got != value {
+					errs <- fmt.Errorf("got %s, want %s", got, value)
+				}
+				kvStore.GetContainerValueOrEmpty(containerName, "key-0")
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+	for w := 0; w < workers; w++ {
+		got, err := kvStore.GetContainerValue(fmt.Sprintf("matrisea-test-%d", w%4), fmt.Sprintf("key-%d", w))
+		require.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("%d-%d", w, rounds-1), got)
+	}
+}
+
+func TestExportImportContainerConfig(t *testing.T) {
+	kvStore := newTestKVStoreVMM(t).KVStore
+
+	_, err := kvStore.ExportContainerConfig("cvd-1")
+	assert.Error(t, err)
+	require.Nil(t, kvStore.PutContainterValue("cvd-1", []KeyValue{{"cpu", "4"}, {"cmdline", "--x_res=720"}}))
+	data, err := kvStore.ExportContainerConfig("cvd-1")
+	require.Nil(t, err)
+
+	require.Nil(t, kvStore.PutContainterValue("cvd-2", []KeyValue{{"cpu", "2"}, {"tags", "qa"}}))
+	require.Nil(t, kvStore.ImportContainerConfig("cvd-2", data))
+	assert.Equal(t, "4", kvStore.GetContainerValueOrEmpty("cvd-2", "cpu"))
+	assert.Equal(t, "--x_res=720", kvStore.GetContainerValueOrEmpty("cvd-2", "cmdline"))
+	// configs missing from the import are kept
+	assert.Equal(t, "qa", kvStore.GetContainerValueOrEmpty("cvd-2", "tags"))
+
+	assert.Error(t, kvStore.ImportContainerConfig("cvd-2", []byte("not json")))
+}
@@ -0,0 +1,164 @@
+package vmm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Mock GPS locations. The location is set through a test provider that replaces the "gps" provider in the guest's
+// LocationManager, which requires `cmd location providers` (Android 12+) and com.android.shell to be allowed to mock
+// locations, i.e. "Select mock location app" in the developer options or
+// `appops set com.android.shell android:mock_location allow`.
+
+var ErrMockLocationDisabled = errors.New("mock location is not allowed for com.android.shell, enable it with " +
+	"`appops set com.android.shell android:mock_location allow` or in the developer options")
+
+// Minimum interval between the points of a route
+const MinRouteInterval = 100 * time.Millisecond
+
+type LocationPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+func (p LocationPoint) validate() error {
+	if p.Lat < -90 || p.Lat > 90 || p.Lon < -180 || p.Lon > 180 {
+		return fmt.Errorf("invalid location %v,%v", p.Lat, p.Lon)
+	}
+	return nil
+}
+
+// VMSetLocation sets the GPS location of the guest. It stops the route being played on the VM if any.
+func (v *VMM) VMSetLocation(containerName string, lat float64, lon float64) error {
+	point := LocationPoint{Lat: lat, Lon: lon}
+	if err := point.validate(); err != nil {
+		return err
+	}
+	if err := v.checkMockLocation(containerName); err != nil {
+		return err
+	}
+	v.VMStopRoute(containerName)
+	return v.setTestProviderLocation(containerName, point)
+}
+
+// VMPlayRoute replays a list of locations in the background for navigation testing, moving to the next point after
+// each interval. The route replaces the one being played on the VM if any, and stays at the last point when it ends.
+func (v *VMM) VMPlayRoute(containerName string, points []LocationPoint, interval time.Duration) error {
+	if len(points) == 0 {
+		return errors.New("empty route")
+	}
+	if interval < MinRouteInterval {
+		return fmt.Errorf("route interval must be at least %v", MinRouteInterval)
+	}
+	for _, p := range points {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	if err := v.checkMockLocation(containerName); err != nil {
+		return err
+	}
+
+	ctx, route := v.startRoute(containerName)
+	log.Printf("VMPlayRoute (%s): %d points every %v\n", containerName, len(points), interval)
+	go func() {
+		defer v.endRoute(containerName, route)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for i, p := range points {
+			if i > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+			if err := v.setTestProviderLocation(containerName, p); err != nil {
+				log.Printf("VMPlayRoute (%s): stopped at point %d: %v\n", containerName, i, err)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// VMStopRoute stops the route being played on the VM, and returns false if there isn't one.
+func (v *VMM) VMStopRoute(containerName string) bool {
+	v.routesMu.Lock()
+	defer v.routesMu.Unlock()
+	stop, ok := v.routes[containerName]
+	if !ok {
+		return false
+	}
+	stop.cancel()
+	delete(v.routes, containerName)
+	return true
+}
+
+// playingRoute is a route being played by VMPlayRoute
+type playingRoute struct {
+	cancel context.CancelFunc
+}
+
+// startRoute registers a new route of the VM, stopping the one being played if any. The route plays until the
+// returned context is done.
+func (v *VMM) startRoute(containerName string) (context.Context, *playingRoute) {
+	ctx, cancel := context.WithCancel(context.Background())
+	route := &playingRoute{cancel: cancel}
+	v.routesMu.Lock()
+	defer v.routesMu.Unlock()
+	if v.routes == nil {
+		v.routes = map[string]*playingRoute{}
+	}
+	if stop, ok := v.routes[containerName]; ok {
+		stop.cancel()
+	}
+	v.routes[containerName] = route
+	return ctx, route
+}
+
+// endRoute unregisters a route once it stops playing, unless it has been replaced by a newer route of the VM
+func (v *VMM) endRoute(containerName string, route *playingRoute) {
+	route.cancel()
+	v.routesMu.Lock()
+	defer v.routesMu.Unlock()
+	if v.routes[containerName] == route {
+		delete(v.routes, containerName)
+	}
+}
+
+// checkMockLocation returns ErrMockLocationDisabled if the shell isn't allowed to mock locations
+func (v *VMM) checkMockLocation(containerName string) error {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	resp, err := v.containerADBShell(containerName, "appops get com.android.shell android:mock_location")
+	if err != nil {
+		return errors.Wrap(err, "adb shell appops get")
+	}
+	if !strings.Contains(resp.outBuffer.String(), "allow") {
+		return ErrMockLocationDisabled
+	}
+	return nil
+}
+
+func (v *VMM) setTestProviderLocation(containerName string, p LocationPoint) error {
+	location := strconv.FormatFloat(p.Lat, 'f', -1, 64) + "," + strconv.FormatFloat(p.Lon, 'f', -1, 64)
+	cmd := "cmd location providers add-test-provider gps && " +
+		"cmd location providers set-test-provider-enabled gps true && " +
+		"cmd location providers set-test-provider-location gps --location " + location
+	resp, err := v.containerADBShell(containerName, cmd)
+	if err != nil {
+		return errors.Wrap(err, "adb shell cmd location")
+	}
+	if resp.ExitCode != 0 {
+		return errors.New("failed to set location. output: " + strings.TrimSpace(resp.outBuffer.String()+resp.errBuffer.String()))
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package vmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVMPlayRouteValidation(t *testing.T) {
+	v := &VMM{}
+	assert.Error(t, v.VMPlayRoute("device", nil, time.Second))
+	assert.Error(t, v.VMPlayRoute("device", []LocationPoint{{Lat: 1.3, Lon: 103.8}}, time.Millisecond))
+	assert.Error(t, v.VMPlayRoute("device", []LocationPoint{{Lat: 1.3, Lon: 103.8}, {Lat: 91, Lon: 0}}, time.Second))
+	assert.False(t, v.VMStopRoute("device"))
+}
+
+func TestEndRoute(t *testing.T) {
+	v := &VMM{}
+	_, first := v.startRoute("device")
+	_, second := v.startRoute("device")
+	// a route replaced by a newer one doesn't unregister the newer one when it ends
+	v.endRoute("device", first)
+	assert.True(t, v.VMStopRoute("device"))
+	v.endRoute("device", second)
+
+	ctx, route := v.startRoute("device")
+	v.endRoute("device", route)
+	assert.Error(t, ctx.Err())
+	assert.False(t, v.VMStopRoute("device"))
+}
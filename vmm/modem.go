@@ -0,0 +1,135 @@
+package vmm
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+// Simulation of incoming calls and SMS. Each cuttlefish instance runs a modem_simulator in the container, which
+// listens on TCP port 1000 + CUTTLEFISH_INSTANCE for the AT commands that another instance sends when it calls or
+// texts this one. Sending the same commands from inside the container makes the guest see a call or SMS coming from
+// the network.
+
+const modemSimulatorPortBase = 1000
+
+// Max length of an SMS in UCS-2, i.e. 140 octets of user data
+const MaxSMSLength = 70
+
+// Phone numbers in the originating address of calls and SMS e.g. "+6581234567" or "5551234"
+var phoneNumberRegex = regexp.MustCompile(`^\+?[0-9]{1,20}$`)
+
+// VMSimulateCall makes the guest receive an incoming call from a phone number. The call rings until it's answered or
+// rejected in the guest.
+func (v *VMM) VMSimulateCall(containerName string, number string) error {
+	if !phoneNumberRegex.MatchString(number) {
+		return fmt.Errorf("invalid phone number %q", number)
+	}
+	numberType := 129 // unknown
+	if strings.HasPrefix(number, "+") {
+		numberType = 145 // international
+	}
+	// AT+REMOTECALL=<state>,<mode>,<mpty>,<number>,<type> where state 4 is an incoming call and mode 0 is voice
+	cmd := fmt.Sprintf("AT+REMOTECALL=4,0,0,\"%s\",%d", number, numberType)
+	if err := v.sendModemCommand(containerName, cmd); err != nil {
+		return err
+	}
+	log.Printf("VMSimulateCall (%s): incoming call from %s\n", containerName, number)
+	return nil
+}
+
+// VMSimulateSMS makes the guest receive an SMS from a phone number. The text is limited to MaxSMSLength characters
+// since multipart messages are not supported.
+func (v *VMM) VMSimulateSMS(containerName string, number string, text string) error {
+	pdu, err := smsDeliverPDU(number, text, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := v.sendModemCommand(containerName, "AT+REMOTESMS="+pdu); err != nil {
+		return err
+	}
+	log.Printf("VMSimulateSMS (%s): SMS from %s\n", containerName, number)
+	return nil
+}
+
+// sendModemCommand sends an AT command to the modem simulator of the container's first instance.
+func (v *VMM) sendModemCommand(containerName string, cmd string) error {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	cfInstance, err := v.getContainerCFInstanceNumber(containerName)
+	if err != nil {
+		return errors.Wrap(err, "failed to read cf_instance")
+	}
+	port := modemSimulatorPortBase + cfInstance
+	// the command is built from a validated number and hex, so only its double quotes need escaping
+	resp, err := v.containerExec(containerName, fmt.Sprintf("bash -c 'printf \"%%s\\r\" %s >/dev/tcp/127.0.0.1/%d'",
+		strings.ReplaceAll(cmd, "\"", "\\\""), port), "vsoc-01")
+	if err != nil {
+		return errors.Wrap(err, "send modem command")
+	}
+	if resp.ExitCode != 0 {
+		return fmt.Errorf("failed to reach the modem simulator on port %d: %s", port, strings.TrimSpace(resp.errBuffer.String()))
+	}
+	return nil
+}
+
+// smsDeliverPDU encodes an SMS-DELIVER PDU (3GPP TS 23.040) in hex as the modem passes it to the guest in +CMT. The
+// text is encoded in UCS-2 so that any language fits.
+func smsDeliverPDU(number string, text string, ts time.Time) (string, error) {
+	if !phoneNumberRegex.MatchString(number) {
+		return "", fmt.Errorf("invalid phone number %q", number)
+	}
+	ud := utf16.Encode([]rune(text))
+	if len(ud) > MaxSMSLength {
+		return "", fmt.Errorf("SMS text is longer than %d characters", MaxSMSLength)
+	}
+
+	var pdu []byte
+	pdu = append(pdu, 0x00) // no SMSC address
+	pdu = append(pdu, 0x04) // SMS-DELIVER, no more messages to send
+	// originating address: number of digits, type of number, BCD digits in swapped nibbles
+	addrType := byte(0x81)
+	if strings.HasPrefix(number, "+") {
+		addrType = 0x91
+		number = number[1:]
+	}
+	pdu = append(pdu, byte(len(number)), addrType)
+	pdu = append(pdu, swappedNibbles(number)...)
+	pdu = append(pdu, 0x00) // TP-PID
+	pdu = append(pdu, 0x08) // TP-DCS: UCS-2
+	// TP-SCTS: service centre timestamp in UTC
+	ts = ts.UTC()
+	pdu = append(pdu, swappedNibbles(fmt.Sprintf("%02d%02d%02d%02d%02d%02d00",
+		ts.Year()%100, ts.Month(), ts.Day(), ts.Hour(), ts.Minute(), ts.Second()))...)
+	pdu = append(pdu, byte(len(ud)*2))
+	for _, u := range ud {
+		pdu = append(pdu, byte(u>>8), byte(u))
+	}
+	return strings.ToUpper(hex.EncodeToString(pdu)), nil
+}
+
+// swappedNibbles encodes a string of digits in semi-octets, e.g. "12345" to 0x21 0x43 0xF5.
+func swappedNibbles(digits string) []byte {
+	if len(digits)%2 == 1 {
+		digits += "F"
+	}
+	out := make([]byte, 0, len(digits)/2)
+	for i := 0; i < len(digits); i += 2 {
+		out = append(out, nibble(digits[i+1])<<4|nibble(digits[i]))
+	}
+	return out
+}
+
+func nibble(c byte) byte {
+	if c == 'F' {
+		return 0xF
+	}
+	return c - '0'
+}
@@ -0,0 +1,27 @@
+package vmm
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSMSDeliverPDU(t *testing.T) {
+	ts := time.Date(2021, 12, 31, 23, 59, 58, 0, time.UTC)
+	pdu, err := smsDeliverPDU("+6512345", "Hi", ts)
+	require.Nil(t, err)
+	// header, address of 7 digits, PID, DCS, timestamp, length of 4 octets and "Hi" in UCS-2
+	assert.Equal(t, "0004"+"0791"+"562143F5"+"00"+"08"+"12211332958500"+"04"+"00480069", pdu)
+
+	pdu, err = smsDeliverPDU("5551234", "", ts)
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(pdu, "00040781551532F4"))
+
+	_, err = smsDeliverPDU("not-a-number", "Hi", ts)
+	assert.Error(t, err)
+	_, err = smsDeliverPDU("5551234", strings.Repeat("a", MaxSMSLength+1), ts)
+	assert.Error(t, err)
+}
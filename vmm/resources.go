@@ -0,0 +1,90 @@
+package vmm
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// Reservations of host CPUs and memory for VMs that are being created. Loading and unzipping images can take minutes,
+// during which the new VM isn't running and wouldn't be counted by a concurrent create checking the free resources. A
+// create reserves the CPUs and RAM of its VM in the preflight checks and releases them when the VM has booted or
+// failed to.
+
+var ErrInsufficientResources = errors.New("insufficient host resources")
+
+// vmResources are the CPUs and RAM in GB of a VM
+type vmResources struct {
+	CPU   int
+	RAMGB int
+}
+
+// ReserveResources checks that the host has enough CPUs and memory for a new VM of cpu and ramGB on top of the
+// running VMs and the reservations of other creates in progress, and reserves them until the returned release
+// function is called. Release is safe to be called more than once. A container can only have one reservation at a
+// time, a second create of the same name fails with ErrVMExists.
+func (v *VMM) ReserveResources(containerName string, cpu int, ramGB int) (func(), error) {
+	// held while listing the running VMs so that a VM can't be missed between its reservation being released and
+	// it showing up as running
+	v.reservationsMu.Lock()
+	defer v.reservationsMu.Unlock()
+
+	if _, ok := v.reservations[containerName]; ok {
+		return nil, errors.Wrap(ErrVMExists, containerName+" is being created")
+	}
+	info, err := v.Client.Info(context.Background())
+	if err != nil {
+		return nil, errors.Wrap(err, "docker: failed to get host resources")
+	}
+	vmList, err := v.VMList()
+	if err != nil {
+		return nil, err
+	}
+	running := vmResources{}
+	for _, vm := range vmList {
+		if vm.Status == VMRunning || vm.Status == VMPartiallyRunning {
+			running.CPU += vm.CPU
+			running.RAMGB += vm.RAM
+		}
+	}
+	reserved := vmResources{}
+	for _, r := range v.reservations {
+		reserved.CPU += r.CPU
+		reserved.RAMGB += r.RAMGB
+	}
+	requested := vmResources{CPU: cpu, RAMGB: ramGB}
+	if err := checkFreeResources(info.NCPU, info.MemTotal, running, reserved, requested); err != nil {
+		return nil, err
+	}
+
+	if v.reservations == nil {
+		v.reservations = map[string]vmResources{}
+	}
+	v.reservations[containerName] = requested
+	log.Printf("ReserveResources: reserved %d CPUs and %dGB for %s\n", cpu, ramGB, containerName)
+	return func() {
+		v.reservationsMu.Lock()
+		defer v.reservationsMu.Unlock()
+		if _, ok := v.reservations[containerName]; ok {
+			delete(v.reservations, containerName)
+			log.Printf("ReserveResources: released %d CPUs and %dGB of %s\n", cpu, ramGB, containerName)
+		}
+	}, nil
+}
+
+// checkFreeResources returns ErrInsufficientResources if the requested VM doesn't fit in numCPU CPUs and memTotal
+// bytes after the running and reserved VMs.
+func checkFreeResources(numCPU int, memTotal int64, running vmResources, reserved vmResources, requested vmResources) error {
+	if running.CPU+reserved.CPU+requested.CPU > numCPU {
+		return errors.Wrap(ErrInsufficientResources, fmt.Sprintf("%d CPUs requested, %d of %d used by running VMs and %d reserved by VMs being created",
+			requested.CPU, running.CPU, numCPU, reserved.CPU))
+	}
+	totalGB := int(memTotal / (1024 * 1024 * 1024))
+	if running.RAMGB+reserved.RAMGB+requested.RAMGB > totalGB {
+		return errors.Wrap(ErrInsufficientResources, fmt.Sprintf("%dGB requested, %dGB of %dGB used by running VMs and %dGB reserved by VMs being created",
+			requested.RAMGB, running.RAMGB, totalGB, reserved.RAMGB))
+	}
+	return nil
+}
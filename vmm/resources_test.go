@@ -0,0 +1,28 @@
+package vmm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckFreeResources(t *testing.T) {
+	gb := int64(1024 * 1024 * 1024)
+	assert.Nil(t, checkFreeResources(16, 32*gb, vmResources{8, 16}, vmResources{4, 8}, vmResources{4, 8}))
+	err := checkFreeResources(16, 32*gb, vmResources{8, 16}, vmResources{4, 8}, vmResources{4, 9})
+	assert.True(t, errors.Is(err, ErrInsufficientResources))
+	// a reservation of an in-progress create counts the same as a running VM
+	assert.Nil(t, checkFreeResources(16, 32*gb, vmResources{8, 24}, vmResources{}, vmResources{4, 8}))
+	assert.Error(t, checkFreeResources(16, 32*gb, vmResources{8, 24}, vmResources{0, 4}, vmResources{4, 8}))
+	// CPUs are counted as well as memory
+	err = checkFreeResources(16, 32*gb, vmResources{8, 8}, vmResources{4, 8}, vmResources{5, 8})
+	assert.True(t, errors.Is(err, ErrInsufficientResources))
+}
+
+func TestReserveResourcesSameName(t *testing.T) {
+	v := &VMM{reservations: map[string]vmResources{"matrisea-cvd-test": {CPU: 2, RAMGB: 4}}}
+	_, err := v.ReserveResources("matrisea-cvd-test", 2, 4)
+	assert.True(t, errors.Is(err, ErrVMExists))
+	assert.Equal(t, vmResources{CPU: 2, RAMGB: 4}, v.reservations["matrisea-cvd-test"])
+}
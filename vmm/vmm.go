@@ -20,16 +20,21 @@ When setting up a new VM, the caller of should follow the call sequence below:
 package vmm
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	"net"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
@@ -57,19 +62,100 @@ var (
 	DefaultNetwork   = "bridge"        // use docker's default bridge
 	CFImage          = "cuttlefish"    // cuttlefish image name
 	HomeDir          = "/home/vsoc-01" // workdir in container
+	DeviceDir        = "/data"         // the VM's device folder mounted in container
 	HomeDirSizeLimit = 50              //soft disk quota for HomeDir
+	// Maximum waiting time for an adb command before resetting the adb server
+	ADBCommandTimeout = 60 * time.Second
+	// Maximum waiting time for a containerExec command if VMM.ExecTimeout is not set
+	DefaultExecTimeout = 10 * time.Minute
+	// Maximum waiting time for a containerExecLong command if VMM.LongExecTimeout is not set
+	DefaultLongExecTimeout = 2 * time.Hour
+	// Default of VMM.MaxBootAttempts
+	DefaultMaxBootAttempts = 5
+	// Default of VMM.DiskLimitChecks
+	DefaultDiskLimitChecks = 3
+	// values of launch_cvd's --gpu_mode. The hardware-accelerated ones need GPUDevicePath.
+	GPUModes      = []string{GPUModeSwiftShader, "drm_virgl", "gfxstream"}
+	GPUDevicePath = "/dev/dri" // render nodes of the host GPU
+	// packages installed by installTools
+	aptPackages = []string{"adb", "git", "htop", "python3-pip", "iputils-ping", "less", "websockify"}
+	pipPackages = []string{"frida-tools"}
+	// DefaultAllowedLaunchFlags are the launch_cvd flags users may set in a VM's cmdline config. Flags managed by
+	// VMStart itself (e.g. --cpus, --vsock_guest_cid) and flags that reference arbitrary host paths are excluded.
+	DefaultAllowedLaunchFlags = []string{
+		"x_res",
+		"y_res",
+		"dpi",
+		"refresh_rate_hz",
+		"gpu_mode",
+		"setupwizard_mode",
+		"extra_kernel_cmdline",
+		"pause_in_bootloader",
+		"guest_enforce_security",
+		"guest_audit_security",
+		"data_policy",
+		"blank_data_image_mb",
+		"report_anonymous_usage_stats",
+	}
 )
 
 type VMM struct {
 	Client      *client.Client // Docker Engine client
+	DockerHost  string         // Docker daemon address, empty if read from DOCKER_HOST
 	DataDir     string
 	DevicesDir  string
 	DBDir       string
 	UploadDir   string
+	TmpDir      string        // Base folder of temporary files. Defaults to DataDir/tmp as /tmp is often a small tmpfs
 	createMu    sync.Mutex    // Ensures only one CreateVM() call at a time
 	CFPrefix    string        // Container name prefix
-	BootTimeout time.Duration // Maximum waiting time for VMStart
+	BootTimeout time.Duration // Maximum waiting time for VMStart, unless overridden by SetBootTimeout
+	ExecTimeout time.Duration // Maximum waiting time for a command run by containerExec
 	KVStore     *KVStore
+	// Maximum waiting time for commands that can legitimately take long, e.g. unzipping images or installing packages
+	LongExecTimeout time.Duration
+	// launch_cvd flags (without leading dashes) that are allowed in the cmdline config
+	AllowedLaunchFlags []string
+	// Offline skips network-dependent setup in VMPreBootSetup. CFImage must then have all tools pre-installed.
+	Offline bool
+	// Restart policy of new containers if not specified in VMCreateOptions. Empty means docker's default "no".
+	DefaultRestartPolicy string
+	// Number of VMStart calls in a row without a confirmed boot, after which a VM is marked as boot-failed and
+	// skipped by VMAutostart until VMAcknowledgeBootFailure. 0 disables the check.
+	MaxBootAttempts int
+	// Number of consecutive diskSheriff checks, 30s apart, that a VM has to exceed HomeDirSizeLimit before it's
+	// stopped, so that a transient spike doesn't stop the VM. Values below 1 stop the VM on the first check.
+	DiskLimitChecks int
+	// Containers exited or dead for longer than ReapAfter are periodically removed with VMReap. 0 disables it.
+	ReapAfter time.Duration
+	// If set, the periodic VMReap only logs the containers to be removed
+	ReapDryRun bool
+	// Default of VMRemoveOptions.KeepData for VMRemove
+	KeepDataOnRemove bool
+
+	// recent results of getContainerHomeDirUsage by container name
+	diskUsageMu    sync.Mutex
+	diskUsageCache map[string]homeDirUsage
+	// serializes the changes to the webhooks in KVStore
+	webhooksMu sync.Mutex
+	// serializes the changes to the create failures in KVStore
+	createFailuresMu sync.Mutex
+	// tokens of the processes started by ContainerAttachToProcess that are still in use by exec ID,
+	// see VMCleanupStaleExecs
+	execTokensMu sync.Mutex
+	execTokens   map[string]string
+	// cancels the routes being played by VMPlayRoute by container name
+	routesMu sync.Mutex
+	routes   map[string]*playingRoute
+	// builds being downloaded by FetchAOSPImages by "<target>/<build id>"
+	fetchingMu sync.Mutex
+	fetching   map[string]bool
+	// CPUs and RAM reserved by ReserveResources by container name
+	reservationsMu sync.Mutex
+	reservations   map[string]vmResources
+	// mutating operation in progress by container name, see lockVM
+	operationsMu sync.Mutex
+	operations   map[string]string
 }
 
 type VMItem struct {
@@ -85,6 +171,38 @@ type VMItem struct {
 	RAM        int      `json:"ram"`
 	OSVersion  string   `json:"os_version"`
 	Cmdline    string   `json:"cmdline"` //launch_cvd options
+	Image      string   `json:"image"`   // cuttlefish image
+	// Why the VM was stopped last time, empty if it has never been stopped
+	LastStopReason StopReason `json:"last_stop_reason"`
+	// SELinux settings, empty if launch_cvd's default is used
+	GuestEnforceSecurity string `json:"guest_enforce_security"`
+	GuestAuditSecurity   string `json:"guest_audit_security"`
+	// Image overrides in HomeDir, empty if the system image's own is used
+	BootImage       string `json:"boot_image"`
+	VendorBootImage string `json:"vendor_boot_image"`
+	SuperImage      string `json:"super_image"`
+	// Custom DNS servers, empty if inherited from the host
+	DNS []string `json:"dns"`
+	// Size of the blank sdcard in MB, 0 if launch_cvd's default is used
+	SDCardMB int `json:"sdcard_mb"`
+	// sdcard image file in HomeDir, empty if the sdcard is a blank one
+	SDCardImage string `json:"sdcard_image"`
+	// Size of the userdata partition in MB, 0 if the system image's own size is used
+	DataImageMB int `json:"data_image_mb"`
+	// Whether VMAutostart boots the VM if its container is up but launch_cvd isn't
+	Autostart bool `json:"autostart"`
+	// VMStart calls since the last confirmed boot
+	BootAttempts int `json:"boot_attempts"`
+	// true if BootAttempts has exceeded VMM.MaxBootAttempts, see VMAcknowledgeBootFailure
+	BootFailed bool `json:"boot_failed"`
+	// launch_cvd's --gpu_mode given at VMCreate, empty if launch_cvd's default is used
+	GPUMode string `json:"gpu_mode"`
+	// Custom metadata given at VMCreate, see VMCreateOptions.Labels
+	Labels map[string]string `json:"labels"`
+	// Host CPUs the container is pinned to e.g. "0-3", empty if not pinned
+	CpusetCpus string `json:"cpuset_cpus"`
+	// ro.build.fingerprint of the guest as of its last boot, empty if it has never booted
+	BuildFingerprint string `json:"build_fingerprint"`
 }
 
 type VMStatus int
@@ -98,6 +216,52 @@ const (
 	// which shouldn't happen if the container is fully managed by Matrisea.
 	// Require admin intervention to remove/resume using Docker CLI
 	VMContainerError VMStatus = iota
+	// Container is up but VMPreBootSetup hasn't completed yet
+	VMInitializing VMStatus = iota
+	// Some but not all of the guest instances in the container are running, see VMStopInstance
+	VMPartiallyRunning VMStatus = iota
+)
+
+// StopReason records who or what stopped a VM
+type StopReason string
+
+const (
+	StopReasonUser      StopReason = "user"       // requested through the API or CLI
+	StopReasonDiskLimit StopReason = "disk_limit" // stopped by diskSheriff, see HomeDirSizeLimit
+	StopReasonIdle      StopReason = "idle"       // stopped by an idle policy
+	StopReasonBootLoop  StopReason = "boot_loop"  // stopped after repeated failed boots
+	StopReasonRestart   StopReason = "restart"    // stopped by VMRestart, which launches the VM again
+)
+
+// Labels of matrisea containers, in addition to those used by android-cuttlefish
+const (
+	LABEL_IMAGE             = "matrisea_image"             // the cuttlefish image reference given at VMCreate
+	LABEL_BOOT_IMAGE        = "matrisea_boot_image"        // file name of the boot image override in HomeDir
+	LABEL_VENDOR_BOOT_IMAGE = "matrisea_vendor_boot_image" // file name of the vendor_boot image override in HomeDir
+	LABEL_DNS               = "matrisea_dns"               // comma-separated DNS servers given at VMCreate
+	LABEL_SDCARD_IMAGE      = "matrisea_sdcard_image"      // file name of the sdcard image in HomeDir
+	LABEL_DATA_IMAGE_MB     = "matrisea_data_image_mb"     // size of the userdata partition given at VMCreate
+	LABEL_GPU_MODE          = "matrisea_gpu_mode"          // launch_cvd's --gpu_mode given at VMCreate
+	LABEL_USER_PREFIX       = "matrisea_tag_"              // prefix of VMCreateOptions.Labels
+	LABEL_SUPER_IMAGE       = "matrisea_super_image"       // file name of the super image override in HomeDir
+	LABEL_CPUSET_CPUS       = "matrisea_cpuset_cpus"       // host CPUs the container is pinned to at VMCreate
+	LABEL_CF_PREFIX         = "matrisea_cf_prefix"         // CFPrefix of the VMM that created the container
+)
+
+// Keys of host-wide settings in KVStorage
+const (
+	GLOBAL_KEY_BOOT_TIMEOUT    = "boot_timeout"    // overrides VMM.BootTimeout, see SetBootTimeout
+	GLOBAL_KEY_CREATE_FAILURES = "create_failures" // JSON-encoded []CreateFailure, see RecordCreateFailure
+)
+
+// Base ports of a VM. Every VM gets its own ports with portForInstance, so that VMs on the same host don't collide.
+// See VMGetPorts.
+const (
+	WebsockifyBasePort = 6080 // websockify started by startVNCProxy, published on the host
+	VNCBasePort        = 6444 // vnc_server of launch_cvd, on the container's lo only
+	ADBBasePort        = 6520 // adbd in the guest, published on the host's 127.0.0.1
+	// host port of the cuttlefish operator, which listens on WebRTCOperatorPort in every container
+	WebRTCOperatorBasePort = 1080
 )
 
 // Keys of per-container configs in KVStorage
@@ -108,8 +272,44 @@ const (
 	CONFIG_KEY_AOSP_VERSION = "aosp_version"
 	CONFIG_KEY_TAGS         = "tags"
 	CONFIG_KEY_CMDLINE      = "cmdline"
+	CONFIG_KEY_INITIALIZING = "initializing" // "true" until VMPreBootSetup finishes
+	CONFIG_KEY_STOP_REASON  = "stop_reason"  // StopReason of the last successful VMStop
+	// "true" or "false" to pass the launch_cvd flag of the same name, empty to use launch_cvd's default
+	CONFIG_KEY_GUEST_ENFORCE_SECURITY = "guest_enforce_security"
+	CONFIG_KEY_GUEST_AUDIT_SECURITY   = "guest_audit_security"
+	// size of a blank sdcard created by launch_cvd, empty to use launch_cvd's default
+	CONFIG_KEY_SDCARD_MB = "sdcard_mb"
+	// size of the userdata partition after VMResizeData, takes precedence over LABEL_DATA_IMAGE_MB
+	CONFIG_KEY_DATA_IMAGE_MB = "data_image_mb"
+	// "true" to start the VM in VMAutostart, e.g. after the host reboots
+	CONFIG_KEY_AUTOSTART = "autostart"
+	// number of VMStart calls since the last confirmed boot, and "true" if it has exceeded VMM.MaxBootAttempts
+	CONFIG_KEY_BOOT_ATTEMPTS = "boot_attempts"
+	CONFIG_KEY_BOOT_FAILED   = "boot_failed"
+	// ro.build.fingerprint of the guest as of its last boot, see VMGetBuildFingerprint
+	CONFIG_KEY_BUILD_FINGERPRINT = "build_fingerprint"
+	// cf_instance assigned to a container without a valid cf_instance label, see getContainerCFInstanceNumber
+	CONFIG_KEY_CF_INSTANCE = "cf_instance"
+	// one of WebsockifyLogLevels, empty for WebsockifyLogInfo. See VMSetWebsockifyLogLevel.
+	CONFIG_KEY_WEBSOCKIFY_LOG_LEVEL = "websockify_log_level"
+	// VMStartOptions of the last VMStart in JSON, reused by VMRestart
+	CONFIG_KEY_START_OPTIONS = "start_options"
 )
 
+// VMStartOptions customizes how VMStart launches and waits for a VM.
+type VMStartOptions struct {
+	// WaitForUI makes VMStart additionally wait for the package manager to come up and the boot animation
+	// to end after VIRTUAL_DEVICE_BOOT_COMPLETED. sys.boot_completed flips before the UI is interactive,
+	// so automations that tap on the screen right after boot should set this option.
+	// Only effective when VMStart waits for the VM to boot (i.e. isAsync is false).
+	WaitForUI bool `json:"wait_for_ui,omitempty"`
+	// Daemon runs launch_cvd as a detached process so that the VM outlives the exec stream. Boot completion is
+	// detected by polling launcher.log rather than reading launch_cvd's stdout.
+	Daemon bool `json:"daemon,omitempty"`
+	// GPUMode overrides VMCreateOptions.GPUMode for this start only.
+	GPUMode string `json:"gpu_mode,omitempty"`
+}
+
 // ExecResult represents a result returned from Exec()
 type ExecResult struct {
 	ExitCode  int
@@ -117,17 +317,94 @@ type ExecResult struct {
 	errBuffer *bytes.Buffer
 }
 
-func NewVMM(dataDir string) *VMM {
-	v := NewVMMImpl(dataDir, "matrisea-cvd-", 120*time.Second)
+// NewVMM creates a VMM with the default container prefix and boot timeout.
+// An error is returned if the Docker daemon isn't reachable so that the caller may retry later.
+func NewVMM(dataDir string) (*VMM, error) {
+	return NewVMMForHost(dataDir, "")
+}
+
+// NewVMMForHost is the same as NewVMM except that the VMM is bound to the Docker daemon at dockerHost
+// (e.g. tcp://10.0.0.2:2376 or unix:///var/run/docker.sock) instead of the one in DOCKER_HOST. An empty dockerHost
+// falls back to the environment. TLS settings are still read from DOCKER_CERT_PATH/DOCKER_TLS_VERIFY.
+//
+// Notice that device folders are bind-mounted into containers by their paths in dataDir, so for a remote
+// Docker host dataDir must point to a storage shared between the two hosts at the same path.
+// Each VMM must also have its own dataDir as the KVStore file can only be opened once.
+func NewVMMForHost(dataDir string, dockerHost string) (*VMM, error) {
+	v, err := newVMM(dataDir, "matrisea-cvd-", 120*time.Second, dockerHost)
+	if err != nil {
+		return nil, err
+	}
 	// watch for VMs in boot loops
 	v.diskSheriff()
-	return v
+	v.execJanitor()
+	v.reaper()
+	v.daemonLogRotator()
+	return v, nil
+}
+
+// ExpandPath expands environment variables and a leading "~" in a configured path, e.g. "$HOME/matrisea" or
+// "~/matrisea". An error is returned if a variable isn't set, or if the result isn't absolute as device folders are
+// bind-mounted by their paths.
+func ExpandPath(p string) (string, error) {
+	var unset []string
+	expanded := os.Expand(p, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			unset = append(unset, name)
+		}
+		return value
+	})
+	if len(unset) > 0 {
+		return "", fmt.Errorf("environment variable(s) %s in %q are not set", strings.Join(unset, ", "), p)
+	}
+	if expanded == "~" || strings.HasPrefix(expanded, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", errors.Wrap(err, "failed to expand ~")
+		}
+		expanded = path.Join(home, expanded[1:])
+	}
+	if !path.IsAbs(expanded) {
+		return "", fmt.Errorf("%q resolves to %q, which is not an absolute path", p, expanded)
+	}
+	return path.Clean(expanded), nil
 }
 
-func NewVMMImpl(dataDir string, cfPrefix string, bootTimeout time.Duration) *VMM {
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+// checkWritable returns an error if files can't be created in dir.
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".write-check-")
 	if err != nil {
-		log.Fatalf("Failed to create a Docker API client. Reason: %v", err)
+		return errors.Wrap(err, dir+" is not writable")
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func NewVMMImpl(dataDir string, cfPrefix string, bootTimeout time.Duration) (*VMM, error) {
+	return newVMM(dataDir, cfPrefix, bootTimeout, "")
+}
+
+func newVMM(dataDir string, cfPrefix string, bootTimeout time.Duration, dockerHost string) (*VMM, error) {
+	dataDir, err := ExpandPath(dataDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid data dir")
+	}
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if dockerHost != "" {
+		opts = append(opts, client.WithHost(dockerHost))
+	}
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create a Docker API client")
+	}
+	// NewClientWithOpts doesn't connect to the daemon, so ping it to make sure Docker is actually up.
+	// This must happen before opening the KVStore as bolt holds a file lock until Close().
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := cli.Ping(ctx); err != nil {
+		cli.Close()
+		return nil, errors.Wrap(err, "docker daemon unreachable")
 	}
 
 	// populate initial data folders
@@ -145,23 +422,42 @@ func NewVMMImpl(dataDir string, cfPrefix string, bootTimeout time.Duration) *VMM
 		if _, err := os.Stat(f); os.IsNotExist(err) {
 			err := os.MkdirAll(f, 0755)
 			if err != nil {
-				log.Fatalf("Failed to create folder %s. Reason: %v", f, err)
+				cli.Close()
+				return nil, errors.Wrap(err, "failed to create folder "+f)
 			}
 		}
 	}
+	if err := checkWritable(dataDir); err != nil {
+		cli.Close()
+		return nil, err
+	}
 	log.Printf("DATA_DIR=%s\n", dataDir)
 
+	kvStore, err := NewKVStore(dataDir)
+	if err != nil {
+		cli.Close()
+		return nil, err
+	}
+
 	v := &VMM{
 		Client:      cli,
+		DockerHost:  dockerHost,
 		DataDir:     dataDir,
 		DevicesDir:  devicesDir,
 		DBDir:       dbDir,
 		UploadDir:   uploadDir,
+		TmpDir:      path.Join(dataDir, "tmp"),
 		CFPrefix:    cfPrefix,
 		BootTimeout: bootTimeout,
-		KVStore:     NewKVStore(dataDir),
+		ExecTimeout: DefaultExecTimeout,
+		KVStore:     kvStore,
+
+		AllowedLaunchFlags: DefaultAllowedLaunchFlags,
+		MaxBootAttempts:    DefaultMaxBootAttempts,
+		DiskLimitChecks:    DefaultDiskLimitChecks,
+		LongExecTimeout:    DefaultLongExecTimeout,
 	}
-	return v
+	return v, nil
 }
 
 // Close cleans up various resources used
@@ -172,10 +468,277 @@ func (v *VMM) Close() {
 	}
 }
 
+// SetBootTimeout changes the maximum waiting time of VMStart for all VMs. The value is kept in KVStore so it
+// survives restarts and takes precedence over BootTimeout.
+func (v *VMM) SetBootTimeout(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("invalid boot timeout %s", d)
+	}
+	return v.KVStore.PutGlobalValue(GLOBAL_KEY_BOOT_TIMEOUT, d.String())
+}
+
+// GetBootTimeout returns the boot timeout set by SetBootTimeout, or BootTimeout if it has never been set.
+func (v *VMM) GetBootTimeout() time.Duration {
+	if d, err := time.ParseDuration(v.KVStore.GetGlobalValueOrEmpty(GLOBAL_KEY_BOOT_TIMEOUT)); err == nil && d > 0 {
+		return d
+	}
+	return v.BootTimeout
+}
+
+// Number of the latest CreateFailures kept in KVStore
+const MaxCreateFailures = 20
+
+// CreateFailure records a failed VM creation for diagnosing it afterwards.
+type CreateFailure struct {
+	Device    string `json:"device"`
+	RequestID string `json:"request_id"`
+	Step      string `json:"step"` // the step that failed
+	Error     string `json:"error"`
+	Log       string `json:"log"` // tail of the log streamed to the client
+	Timestamp int64  `json:"timestamp"`
+}
+
+// RecordCreateFailure saves a failed creation, dropping the oldest ones beyond MaxCreateFailures.
+func (v *VMM) RecordCreateFailure(failure CreateFailure) error {
+	v.createFailuresMu.Lock()
+	defer v.createFailuresMu.Unlock()
+	failures, err := v.ListCreateFailures()
+	if err != nil {
+		return err
+	}
+	failures = append([]CreateFailure{failure}, failures...)
+	if len(failures) > MaxCreateFailures {
+		failures = failures[:MaxCreateFailures]
+	}
+	value, err := json.Marshal(failures)
+	if err != nil {
+		return err
+	}
+	return v.KVStore.PutGlobalValue(GLOBAL_KEY_CREATE_FAILURES, string(value))
+}
+
+// ListCreateFailures returns the latest failed creations, newest first.
+func (v *VMM) ListCreateFailures() ([]CreateFailure, error) {
+	failures := []CreateFailure{}
+	value := v.KVStore.GetGlobalValueOrEmpty(GLOBAL_KEY_CREATE_FAILURES)
+	if value == "" {
+		return failures, nil
+	}
+	if err := json.Unmarshal([]byte(value), &failures); err != nil {
+		return nil, errors.Wrap(err, "failed to read create failures")
+	}
+	return failures, nil
+}
+
+// VMPruneOptions controls which VMs are spared by VMPruneWithOptions.
+type VMPruneOptions struct {
+	// VMs with any of these tags are not removed
+	KeepTags []string
+	// Optional predicate, VMs are not removed if it returns true
+	Keep func(containerName string, tags []string) bool
+	// If set, only report the VMs to be removed
+	DryRun bool
+}
+
+// PruneResult summarizes VMPruneWithOptions.
+type PruneResult struct {
+	// Containers that have been removed, or would have been removed in dry-run mode
+	Removed []string `json:"removed"`
+	// Errors of the containers that failed to be removed, by container name
+	Failed map[string]string `json:"failed"`
+}
+
+// BootStatus tells how far VMStart got
+type BootStatus string
+
+const (
+	BootStatusBooted  BootStatus = "booted"  // VIRTUAL_DEVICE_BOOT_COMPLETED is seen (and the UI is ready if requested)
+	BootStatusStarted BootStatus = "started" // launch_cvd is started but VMStart didn't wait for the boot
+	BootStatusTimeout BootStatus = "timeout" // not booted within BootTimeout, launch_cvd may still be booting
+	BootStatusCrashed BootStatus = "crashed" // launch_cvd exited before the boot completed
+	BootStatusFailed  BootStatus = "failed"  // launch_cvd couldn't be started
+)
+
+// Maximum number of launcher output lines kept in BootResult
+const bootResultLogLines = 20
+
+// BootResult is the outcome of VMStart.
+type BootResult struct {
+	Status         BootStatus `json:"status"`
+	ElapsedSeconds float64    `json:"elapsed_seconds"`
+	// The last lines of launcher output seen by VMStart, useful to tell why the boot failed
+	LastLogLines []string `json:"last_log_lines"`
+	// Error message if the VM didn't boot
+	Reason string `json:"reason,omitempty"`
+}
+
+// lineTail keeps the last max lines added to it. It's safe for concurrent use.
+type lineTail struct {
+	mu    sync.Mutex
+	max   int
+	lines []string
+}
+
+func (t *lineTail) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+func (t *lineTail) get() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string{}, t.lines...)
+}
+
+// VMCreateOptions are the settings of a new VM for VMCreateWithOptions.
+type VMCreateOptions struct {
+	CPU         int
+	RAM         int    // in GB
+	AOSPVersion string // one of AOSPVersions in any case, or empty if unknown. See NormalizeAOSPVersion.
+	Cmdline     string // extra launch_cvd options
+	// Image is the cuttlefish image reference to run the VM with (e.g. cuttlefish:v2). Defaults to CFImage.
+	Image string
+	// RestartPolicy is the container's restart policy: "no", "always", "unless-stopped" or "on-failure".
+	// Defaults to VMM.DefaultRestartPolicy. Notice that launch_cvd isn't restarted along with the container,
+	// set Autostart for that.
+	RestartPolicy string
+	// Autostart makes VMAutostart boot the VM when its container is up but launch_cvd isn't. Can be changed later
+	// with ContainerUpdateConfig.
+	Autostart bool
+	// "true" or "false" to set the guest's SELinux mode with --guest_enforce_security and --guest_audit_security.
+	// Empty keeps launch_cvd's default. Can be changed later with ContainerUpdateConfig.
+	GuestEnforceSecurity string
+	GuestAuditSecurity   string
+	// File names of boot/vendor_boot images in HomeDir that replace the ones in the system image, passed to
+	// launch_cvd as --boot_image/--vendor_boot_image. The files have to be loaded with VMLoadFile before VMStart.
+	BootImage       string
+	VendorBootImage string
+	// DNS servers (IP addresses) of the container, which replace the ones inherited from the host.
+	// Cannot be changed after the container is created.
+	DNS []string
+	// Size of the blank sdcard in MB, 0 to use launch_cvd's default. Ignored if SDCardImage is set.
+	SDCardMB int
+	// File name of an sdcard image in HomeDir to attach instead of a blank one. The file has to be loaded with
+	// VMLoadFile before VMStart.
+	SDCardImage string
+	// Size of the userdata partition in MB, 0 to keep the size in the system image. The partition is grown by
+	// launch_cvd (--data_policy=resize_up_to) and never shrinks.
+	DataImageMB int
+	// launch_cvd's --gpu_mode, one of GPUModes or empty for launch_cvd's default. The host's GPU is passed to the
+	// container for the hardware-accelerated modes, and VMStart falls back to GPUModeSwiftShader if there is none.
+	GPUMode string
+	// Custom metadata for external systems (e.g. team, project or ticket), stored as container labels with
+	// LABEL_USER_PREFIX. Cannot be changed after the container is created. See ValidateLabels.
+	Labels map[string]string
+	// File name of a prebuilt super image in HomeDir that replaces super.img of the system image, passed to
+	// launch_cvd as --super_image. VMUnzipImage then skips the system image's super.img. The file has to be
+	// loaded with VMLoadFile before VMStart, see ValidateSuperImage.
+	SuperImage string
+	// Host CPUs to pin the container to, in the cpuset format e.g. "0-3,8", for consistent performance on NUMA
+	// hosts. Empty means no pinning. Cannot be changed after the container is created. See ValidateCpuset.
+	CpusetCpus string
+	// ReuseData seeds the VM with the device folder of a removed VM of the same name, kept by VMRemoveWithOptions
+	// with KeepData, instead of starting with an empty one.
+	ReuseData bool
+}
+
+// The container name is also its hostname, which is limited to 63 characters
+const maxHostnameLength = 63
+
+var deviceNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// MaxDeviceNameLength returns the longest device name that fits in a container name with CFPrefix.
+func (v *VMM) MaxDeviceNameLength() int {
+	return maxHostnameLength - len(v.CFPrefix)
+}
+
+// ValidateDeviceName checks that a device name can be used in a container name.
+func (v *VMM) ValidateDeviceName(deviceName string) error {
+	if !deviceNameRegex.MatchString(deviceName) {
+		return errors.New("device name contains characters other than alphanumerics and _-")
+	}
+	if max := v.MaxDeviceNameLength(); len(deviceName) > max {
+		return fmt.Errorf("device name exceeds %d characters", max)
+	}
+	return nil
+}
+
 // VMCreate creates a new container and sets up the corresponding folders in DevicesDir.
 func (v *VMM) VMCreate(deviceName string, cpu int, ram int, aospVersion string, cmdline string) (string, error) {
+	return v.VMCreateWithOptions(deviceName, VMCreateOptions{
+		CPU:         cpu,
+		RAM:         ram,
+		AOSPVersion: aospVersion,
+		Cmdline:     cmdline,
+	})
+}
+
+// VMCreateWithOptions is the same as VMCreate but accepts additional settings in opts.
+func (v *VMM) VMCreateWithOptions(deviceName string, opts VMCreateOptions) (string, error) {
 	ctx := context.Background()
+	if err := v.ValidateDeviceName(deviceName); err != nil {
+		return "", err
+	}
 	containerName := v.CFPrefix + deviceName
+	if opts.Image == "" {
+		opts.Image = CFImage
+	}
+	if opts.RestartPolicy == "" {
+		opts.RestartPolicy = v.DefaultRestartPolicy
+	}
+	restartPolicy := container.RestartPolicy{Name: opts.RestartPolicy}
+	if !(restartPolicy.IsNone() || restartPolicy.IsAlways() || restartPolicy.IsUnlessStopped() || restartPolicy.IsOnFailure()) {
+		return "", fmt.Errorf("invalid restart policy %s", opts.RestartPolicy)
+	}
+	for key, value := range map[string]string{
+		CONFIG_KEY_GUEST_ENFORCE_SECURITY: opts.GuestEnforceSecurity,
+		CONFIG_KEY_GUEST_AUDIT_SECURITY:   opts.GuestAuditSecurity,
+	} {
+		if err := ValidateSecurityConfig(key, value); err != nil {
+			return "", err
+		}
+	}
+	if opts.SDCardMB < 0 {
+		return "", fmt.Errorf("invalid sdcard size %d MB", opts.SDCardMB)
+	}
+	if opts.DataImageMB < 0 {
+		return "", fmt.Errorf("invalid data partition size %d MB", opts.DataImageMB)
+	}
+	if err := ValidateGPUMode(opts.GPUMode); err != nil {
+		return "", err
+	}
+	// empty for an unknown version, which gets no version-specific flags
+	if opts.AOSPVersion != "" {
+		aospVersion, err := NormalizeAOSPVersion(opts.AOSPVersion)
+		if err != nil {
+			return "", err
+		}
+		opts.AOSPVersion = string(aospVersion)
+	}
+	if err := ValidateLabels(opts.Labels); err != nil {
+		return "", err
+	}
+	if opts.CpusetCpus != "" {
+		info, err := v.Client.Info(ctx)
+		if err != nil {
+			return "", errors.Wrap(err, "docker: failed to get the number of CPUs")
+		}
+		if err := ValidateCpuset(opts.CpusetCpus, info.NCPU); err != nil {
+			return "", err
+		}
+	}
+	for _, dns := range opts.DNS {
+		if net.ParseIP(dns) == nil {
+			return "", fmt.Errorf("invalid DNS server %s, must be an IP address", dns)
+		}
+	}
+	if err := v.ensureImage(opts.Image); err != nil {
+		return "", err
+	}
 
 	// There will be a race condition on cfInstance if VMCreate() is called multiple times.
 	// More specifically, findNextAvailableCFInstanceNumber() reads labels from existings containers.
@@ -186,11 +749,14 @@ func (v *VMM) VMCreate(deviceName string, cpu int, ram int, aospVersion string,
 	v.createMu.Lock()
 	defer v.createMu.Unlock()
 
+	// checked under createMu so that concurrent creates of the same name can't both pass
+	if err := v.checkNameAvailable(containerName); err != nil {
+		return "", err
+	}
+
 	deviceDir := path.Join(v.DevicesDir, containerName)
-	if _, err := os.Stat(deviceDir); os.IsNotExist(err) {
-		if err = os.Mkdir(deviceDir, 0755); err != nil {
-			return "", err
-		}
+	if err := v.prepareDeviceDir(deviceDir, opts.ReuseData); err != nil {
+		return "", err
 	}
 
 	// The next available index of cuttlefish VM. Always >= 1.
@@ -201,22 +767,28 @@ func (v *VMM) VMCreate(deviceName string, cpu int, ram int, aospVersion string,
 	if err != nil {
 		return "", errors.Wrap(err, "failed to get next cf_instance")
 	}
-	websockifyPort, err := nat.NewPort("tcp", strconv.Itoa(6080+cfInstance-1))
+	websockifyPort, err := nat.NewPort("tcp", strconv.Itoa(portForInstance(WebsockifyBasePort, cfInstance)))
+	if err != nil {
+		return "", err
+	}
+	adbPort, err := nat.NewPort("tcp", strconv.Itoa(portForInstance(ADBBasePort, cfInstance)))
 	if err != nil {
 		return "", err
 	}
-	adbPort, err := nat.NewPort("tcp", strconv.Itoa(6520+cfInstance-1))
+	operatorPort, err := nat.NewPort("tcp", strconv.Itoa(WebRTCOperatorPort))
 	if err != nil {
 		return "", err
 	}
 
 	containerConfig := &container.Config{
-		Image:    CFImage,
+		Image:    opts.Image,
 		Hostname: containerName,
 		Labels: map[string]string{
 			"cf_instance":     strconv.Itoa(cfInstance), //Used by android-cuttlefish CLI
 			"n_cf_instances":  "1",                      //Used by android-cuttlefish CLI
 			"vsock_guest_cid": "true",                   //Used by android-cuttlefish CLI
+			LABEL_IMAGE:       opts.Image,
+			LABEL_CF_PREFIX:   v.CFPrefix,
 		},
 		Env: []string{
 			"HOME=" + HomeDir,
@@ -224,11 +796,45 @@ func (v *VMM) VMCreate(deviceName string, cpu int, ram int, aospVersion string,
 		ExposedPorts: nat.PortSet{
 			websockifyPort: struct{}{},
 			adbPort:        struct{}{},
+			operatorPort:   struct{}{},
 		},
 	}
 
+	if opts.BootImage != "" {
+		containerConfig.Labels[LABEL_BOOT_IMAGE] = path.Base(opts.BootImage)
+	}
+	if opts.VendorBootImage != "" {
+		containerConfig.Labels[LABEL_VENDOR_BOOT_IMAGE] = path.Base(opts.VendorBootImage)
+	}
+	if len(opts.DNS) > 0 {
+		containerConfig.Labels[LABEL_DNS] = strings.Join(opts.DNS, ",")
+	}
+	if opts.SDCardImage != "" {
+		containerConfig.Labels[LABEL_SDCARD_IMAGE] = path.Base(opts.SDCardImage)
+	}
+	if opts.DataImageMB > 0 {
+		containerConfig.Labels[LABEL_DATA_IMAGE_MB] = strconv.Itoa(opts.DataImageMB)
+	}
+	if opts.GPUMode != "" {
+		containerConfig.Labels[LABEL_GPU_MODE] = opts.GPUMode
+	}
+	if opts.SuperImage != "" {
+		containerConfig.Labels[LABEL_SUPER_IMAGE] = path.Base(opts.SuperImage)
+	}
+	if opts.CpusetCpus != "" {
+		containerConfig.Labels[LABEL_CPUSET_CPUS] = opts.CpusetCpus
+	}
+	for key, value := range opts.Labels {
+		containerConfig.Labels[LABEL_USER_PREFIX+key] = value
+	}
+
 	hostConfig := &container.HostConfig{
-		Privileged: true,
+		Privileged:    true,
+		RestartPolicy: restartPolicy,
+		Resources:     container.Resources{CpusetCpus: opts.CpusetCpus},
+		// On hosts with systemd-resolved, the inherited resolv.conf may be rewritten by docker to public
+		// resolvers (see DefaultNetwork), so custom DNS servers are also a way to restore internal name resolution.
+		DNS: opts.DNS,
 		Mounts: []mount.Mount{
 			{
 				Type:     mount.TypeBind,
@@ -239,7 +845,7 @@ func (v *VMM) VMCreate(deviceName string, cpu int, ram int, aospVersion string,
 			{
 				Type:     mount.TypeBind,
 				Source:   deviceDir,
-				Target:   "/data",
+				Target:   DeviceDir,
 				ReadOnly: false,
 			},
 		},
@@ -247,18 +853,34 @@ func (v *VMM) VMCreate(deviceName string, cpu int, ram int, aospVersion string,
 			websockifyPort: []nat.PortBinding{
 				{ // Expose websockify port so novnc clients can connect directly
 					HostIP:   "0.0.0.0",
-					HostPort: strconv.Itoa(6080 + cfInstance - 1),
+					HostPort: strconv.Itoa(portForInstance(WebsockifyBasePort, cfInstance)),
 				},
 			},
 			adbPort: []nat.PortBinding{
 				{ // Expose adb port only to localhost
 					HostIP:   "127.0.0.1",
-					HostPort: strconv.Itoa(6520 + cfInstance - 1),
+					HostPort: strconv.Itoa(portForInstance(ADBBasePort, cfInstance)),
+				},
+			},
+			operatorPort: []nat.PortBinding{
+				{ // Expose the WebRTC operator so clients outside of the host can stream the VM, see VMListWebRTCDevices
+					HostIP:   "0.0.0.0",
+					HostPort: strconv.Itoa(portForInstance(WebRTCOperatorBasePort, cfInstance)),
 				},
 			},
 		},
 	}
 
+	if isHardwareGPUMode(opts.GPUMode) {
+		if _, err := os.Stat(GPUDevicePath); err == nil {
+			hostConfig.Devices = []container.DeviceMapping{
+				{PathOnHost: GPUDevicePath, PathInContainer: GPUDevicePath, CgroupPermissions: "rwm"},
+			}
+		} else {
+			log.Printf("VMCreate (%s): %s not found, %s will fall back to %s\n", containerName, GPUDevicePath, opts.GPUMode, GPUModeSwiftShader)
+		}
+	}
+
 	// Attach the container to the default bridge, which should have been created by now.
 	networkingConfig := &network.NetworkingConfig{
 		EndpointsConfig: map[string]*network.EndpointSettings{
@@ -280,35 +902,194 @@ func (v *VMM) VMCreate(deviceName string, cpu int, ram int, aospVersion string,
 	// Save configs to local storage
 	kvs := []KeyValue{
 		{CONFIG_KEY_DEVICE_NAME, deviceName},
-		{CONFIG_KEY_CPU, strconv.Itoa(cpu)},
-		{CONFIG_KEY_RAM, strconv.Itoa(ram)},
-		{CONFIG_KEY_AOSP_VERSION, aospVersion},
-		{CONFIG_KEY_TAGS, aospVersion},
-		{CONFIG_KEY_CMDLINE, cmdline},
+		{CONFIG_KEY_CPU, strconv.Itoa(opts.CPU)},
+		{CONFIG_KEY_RAM, strconv.Itoa(opts.RAM)},
+		{CONFIG_KEY_AOSP_VERSION, opts.AOSPVersion},
+		{CONFIG_KEY_TAGS, opts.AOSPVersion},
+		{CONFIG_KEY_CMDLINE, opts.Cmdline},
+		{CONFIG_KEY_INITIALIZING, "true"},
+		{CONFIG_KEY_GUEST_ENFORCE_SECURITY, opts.GuestEnforceSecurity},
+		{CONFIG_KEY_GUEST_AUDIT_SECURITY, opts.GuestAuditSecurity},
+		{CONFIG_KEY_AUTOSTART, strconv.FormatBool(opts.Autostart)},
+	}
+	if opts.SDCardMB > 0 {
+		kvs = append(kvs, KeyValue{CONFIG_KEY_SDCARD_MB, strconv.Itoa(opts.SDCardMB)})
 	}
 	err = v.KVStore.PutContainterValue(containerName, kvs)
 	if err != nil {
 		return "", errors.Wrap(err, "KVStore put")
 	}
+	v.notifyWebhooks(WebhookEventCreated, containerName, nil)
 	return containerName, nil
 }
 
 // VMPreBootSetup installs necessary tools and start auxillary deamons in the container.
+//
+// The VM is reported as VMInitializing until VMPreBootSetup returns, regardless of the result.
 func (v *VMM) VMPreBootSetup(containerName string) error {
 	if err := v.isManagedRunningContainer(containerName); err != nil {
 		return err
 	}
-	err := v.installTools(containerName)
+	err := v.KVStore.PutContainterValue(containerName, []KeyValue{{CONFIG_KEY_INITIALIZING, "true"}})
+	if err != nil {
+		return errors.Wrap(err, "KVStore put")
+	}
+	defer func() {
+		err := v.KVStore.PutContainterValue(containerName, []KeyValue{{CONFIG_KEY_INITIALIZING, "false"}})
+		if err != nil {
+			log.Printf("VMPreBootSetup (%s): failed to clear initializing status. reason: %v\n", containerName, err)
+		}
+	}()
+	if err := v.verifyHomeDir(containerName); err != nil {
+		return errors.Wrap(err, "failed to verify HomeDir")
+	}
+	if v.Offline {
+		// apt/pip can't reach package mirrors, so only check if the image has been pre-baked
+		err = v.checkToolsInstalled(containerName)
+	} else {
+		err = v.installTools(containerName)
+	}
 	if err != nil {
-		return errors.Wrap(err, "installTools")
+		return errors.Wrap(err, "failed to install tools")
 	}
 	err = v.startVNCProxy(containerName)
 	if err != nil {
-		return errors.Wrap(err, "startVNCProxy")
+		return errors.Wrap(err, "failed to start VNC proxy")
+	}
+	return nil
+}
+
+// verifyHomeDir checks that HomeDir is backed by its own mount (the anonymous volume declared by the cuttlefish
+// image) and is writable by vsoc-01. Otherwise images end up in the container's root layer or fail to load, and
+// launch_cvd/crosvm fail much later with cryptic errors.
+func (v *VMM) verifyHomeDir(containerName string) error {
+	resp, err := v.containerExec(containerName, "cat /proc/mounts", "vsoc-01")
+	if err != nil {
+		return errors.Wrap(err, "failed to read /proc/mounts")
+	}
+	mounted := false
+	for _, line := range strings.Split(resp.outBuffer.String(), "\n") {
+		// <device> <mount point> <fs type> <options> ...
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[1] == HomeDir {
+			mounted = true
+			if strings.HasPrefix(fields[3], "ro") {
+				return fmt.Errorf("%s is mounted read-only (%s)", HomeDir, line)
+			}
+		}
+	}
+	if !mounted {
+		return fmt.Errorf("%s is not mounted, check the VOLUME of the cuttlefish image", HomeDir)
+	}
+	probe := path.Join(HomeDir, ".matrisea-probe")
+	resp, err = v.containerExec(containerName, fmt.Sprintf("touch %s && rm %s", probe, probe), "vsoc-01")
+	if err != nil {
+		return errors.Wrap(err, "failed to write a probe file")
+	}
+	if resp.ExitCode != 0 {
+		return fmt.Errorf("%s is not writable by vsoc-01: %s", HomeDir, resp.errBuffer.String())
+	}
+	return nil
+}
+
+// VMRepairDaemons restarts the VNC proxy and the adb connection of a VM, e.g. after the container has been restarted
+// with docker CLI while launch_cvd is still running. Unlike VMPreBootSetup, no tools are installed.
+// It's safe to call VMRepairDaemons on a healthy VM as both daemons are left untouched if they are running.
+func (v *VMM) VMRepairDaemons(containerName string) error {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	if err := v.startVNCProxy(containerName); err != nil {
+		return errors.Wrap(err, "failed to start VNC proxy")
+	}
+	if err := v.startADBDaemon(containerName); err != nil {
+		return errors.Wrap(err, "failed to start adb daemon")
 	}
 	return nil
 }
 
+// VMAutostart boots the VMs with the autostart config whose containers are up but launch_cvd isn't, e.g. containers
+// brought back by their restart policy after a host reboot. VMs are started in daemon mode without waiting for them
+// to boot. The names of the started containers are returned.
+func (v *VMM) VMAutostart() []string {
+	containers, err := v.listCuttlefishContainers()
+	if err != nil {
+		log.Printf("VMAutostart: failed to list containers. error: %v\n", err)
+		return nil
+	}
+	started := []string{}
+	for _, c := range containers {
+		containerName := c.Names[0][1:]
+		if c.State != "running" || v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_AUTOSTART) != "true" {
+			continue
+		}
+		// containers that haven't finished VMPreBootSetup have nothing to boot
+		if v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_INITIALIZING) == "true" {
+			continue
+		}
+		if v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_BOOT_FAILED) == "true" {
+			log.Printf("VMAutostart: skipped %s as it failed to boot too many times\n", containerName)
+			continue
+		}
+		if running, err := v.isLaunchCVDRunning(containerName); err != nil || running {
+			continue
+		}
+		log.Printf("VMAutostart: starting %s\n", containerName)
+		// websockify doesn't survive a container restart either
+		if err := v.VMRepairDaemons(containerName); err != nil {
+			log.Printf("VMAutostart: failed to repair daemons of %s. error: %v\n", containerName, err)
+		}
+		// wait for the boot in the background so that a successful boot resets the boot attempts
+		go func() {
+			result, err := v.VMStart(containerName, false, VMStartOptions{Daemon: true}, func(string) {})
+			if err != nil {
+				log.Printf("VMAutostart: failed to start %s. status: %s error: %v\n", containerName, result.Status, err)
+				return
+			}
+			log.Printf("VMAutostart: %s booted after %.0fs\n", containerName, result.ElapsedSeconds)
+		}()
+		started = append(started, containerName)
+	}
+	return started
+}
+
+// countBootAttempt increments the boot attempts of a VM and marks the VM as boot-failed once it exceeds
+// MaxBootAttempts.
+func (v *VMM) countBootAttempt(containerName string) {
+	attempts, _ := strconv.Atoi(v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_BOOT_ATTEMPTS))
+	attempts++
+	kvs := []KeyValue{{CONFIG_KEY_BOOT_ATTEMPTS, strconv.Itoa(attempts)}}
+	if v.MaxBootAttempts > 0 && attempts > v.MaxBootAttempts {
+		if v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_BOOT_FAILED) != "true" {
+			log.Printf("VMStart (%s): %d attempts without a successful boot, marking the VM as boot-failed\n", containerName, attempts)
+			v.notifyWebhooks(WebhookEventBootLoopDetected, containerName, map[string]string{"attempts": strconv.Itoa(attempts)})
+		}
+		kvs = append(kvs, KeyValue{CONFIG_KEY_BOOT_FAILED, "true"})
+	}
+	if err := v.KVStore.PutContainterValue(containerName, kvs); err != nil {
+		log.Printf("VMStart (%s): failed to save boot attempts. error: %v\n", containerName, err)
+	}
+}
+
+// resetBootAttempts restarts counting the boot attempts of a VM after a confirmed boot.
+func (v *VMM) resetBootAttempts(containerName string) {
+	if err := v.KVStore.PutContainterValue(containerName, []KeyValue{{CONFIG_KEY_BOOT_ATTEMPTS, "0"}}); err != nil {
+		log.Printf("VMStart (%s): failed to reset boot attempts. error: %v\n", containerName, err)
+	}
+}
+
+// VMAcknowledgeBootFailure clears the boot-failed mark and the boot attempts of a VM so that VMAutostart starts it
+// again.
+func (v *VMM) VMAcknowledgeBootFailure(containerName string) error {
+	if _, err := v.isManagedContainer(containerName); err != nil {
+		return err
+	}
+	return v.KVStore.PutContainterValue(containerName, []KeyValue{
+		{CONFIG_KEY_BOOT_ATTEMPTS, "0"},
+		{CONFIG_KEY_BOOT_FAILED, "false"},
+	})
+}
+
 // VMStart runs launch_cvd in a running container.
 // Notice VMStart() doesn't guarentee succeesful VM boot. If launch_cvd takes more time than the timeout limit,
 // launch_cvd will continue in the background and VMStart will return a timeout error.
@@ -318,34 +1099,112 @@ func (v *VMM) VMPreBootSetup(containerName string) error {
 // boot successfuly for the first time.
 // When isAysnc is true, the caller can supply a callback functions, which will be called to every time there's new console
 // message from the launcher. The callback function can be used to stream live launch_cvd stdout/stderr.
-func (v *VMM) VMStart(containerName string, isAsync bool, options string, callback func(string)) error {
+//
+// See VMStartOptions for extra waiting conditions on top of VIRTUAL_DEVICE_BOOT_COMPLETED.
+//
+// The returned BootResult is always set, even if err is not nil, and tells a crash apart from a timeout.
+//
+// The VM is locked until launch_cvd has been spawned rather than through the whole boot, so that a stuck or
+// boot-looping VM can still be stopped by VMStop or diskSheriff while VMStart is waiting for it. A second VMStart
+// after that point fails with ErrVMAlreadyRunning.
+func (v *VMM) VMStart(containerName string, isAsync bool, opts VMStartOptions, callback func(string)) (BootResult, error) {
+	unlock, err := v.lockVM(containerName, "start")
+	if err != nil {
+		return BootResult{Status: BootStatusFailed, Reason: err.Error()}, err
+	}
+	var unlockOnce sync.Once
+	launched := func() { unlockOnce.Do(unlock) }
+	defer launched()
+	// a second launch_cvd would fail on the ports and vsock CIDs taken by the running one
+	if status, err := v.vmStatusByName(containerName); err == nil && (status == VMRunning || status == VMPartiallyRunning) {
+		return BootResult{Status: BootStatusFailed, Reason: ErrVMAlreadyRunning.Error()}, ErrVMAlreadyRunning
+	}
+	v.saveStartOptions(containerName, opts)
+	return v.bootVM(containerName, isAsync, opts, launched, callback)
+}
+
+// saveStartOptions keeps opts for VMRestart to relaunch the VM the same way.
+func (v *VMM) saveStartOptions(containerName string, opts VMStartOptions) {
+	data, _ := json.Marshal(opts)
+	if err := v.KVStore.PutContainterValue(containerName, []KeyValue{{CONFIG_KEY_START_OPTIONS, string(data)}}); err != nil {
+		log.Printf("VMStart (%s): failed to save start options. error: %v\n", containerName, err)
+	}
+}
+
+// lastStartOptions returns the options of the last VMStart, or the default options if there is none.
+func (v *VMM) lastStartOptions(containerName string) VMStartOptions {
+	var opts VMStartOptions
+	if data := v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_START_OPTIONS); data != "" {
+		if err := json.Unmarshal([]byte(data), &opts); err != nil {
+			log.Printf("VMRestart (%s): ignored invalid start options %s. error: %v\n", containerName, data, err)
+		}
+	}
+	return opts
+}
+
+// bootVM runs vmStart and records its result, see VMStart. launched is called once launch_cvd has been spawned.
+func (v *VMM) bootVM(containerName string, isAsync bool, opts VMStartOptions, launched func(), callback func(string)) (BootResult, error) {
 	start := time.Now()
+	tail := &lineTail{max: bootResultLogLines}
+	v.countBootAttempt(containerName)
+	status, err := v.vmStart(containerName, isAsync, opts, start, launched, func(line string) {
+		tail.add(line)
+		callback(line)
+	})
+	if status == BootStatusBooted {
+		v.bootSucceeded(containerName)
+	}
+	result := BootResult{
+		Status:         status,
+		ElapsedSeconds: time.Since(start).Seconds(),
+		LastLogLines:   tail.get(),
+	}
+	if err != nil {
+		result.Reason = err.Error()
+	}
+	return result, err
+}
+
+// bootSucceeded records a confirmed boot of a VM, whether VMStart waited for it or the boot was watched in the
+// background.
+func (v *VMM) bootSucceeded(containerName string) {
+	v.resetBootAttempts(containerName)
+	v.notifyWebhooks(WebhookEventBooted, containerName, nil)
+	// the system image may have changed since the last boot
+	go func() {
+		if _, err := v.VMGetBuildFingerprint(containerName); err != nil {
+			log.Printf("VMStart (%s): failed to cache build fingerprint. error: %v\n", containerName, err)
+		}
+	}()
+}
+
+func (v *VMM) vmStart(containerName string, isAsync bool, opts VMStartOptions, start time.Time, launched func(), callback func(string)) (BootStatus, error) {
 	if err := v.isManagedRunningContainer(containerName); err != nil {
-		return err
+		return BootStatusFailed, err
 	}
 	cf_instance, err := v.getContainerCFInstanceNumber(containerName)
 	if err != nil {
-		return errors.Wrap(err, "getContainerCFInstanceNumber")
+		return BootStatusFailed, errors.Wrap(err, "getContainerCFInstanceNumber")
 	}
 	ram, err := v.KVStore.GetContainerValue(containerName, CONFIG_KEY_RAM)
 	if err != nil {
-		return errors.Wrap(err, "read config ram")
+		return BootStatusFailed, errors.Wrap(err, "read config ram")
 	}
 	ram_gb, err := strconv.Atoi(ram)
 	if err != nil {
-		return errors.Wrap(err, "read config ram")
+		return BootStatusFailed, errors.Wrap(err, "read config ram")
 	}
 	cpu, err := v.KVStore.GetContainerValue(containerName, CONFIG_KEY_CPU)
 	if err != nil {
-		return errors.Wrap(err, "read config cpu")
+		return BootStatusFailed, errors.Wrap(err, "read config cpu")
 	}
 	aospVersion, err := v.KVStore.GetContainerValue(containerName, CONFIG_KEY_AOSP_VERSION)
 	if err != nil {
-		return errors.Wrap(err, "read aosp_version config")
+		return BootStatusFailed, errors.Wrap(err, "read aosp_version config")
 	}
 	cmdline, err := v.KVStore.GetContainerValue(containerName, CONFIG_KEY_CMDLINE)
 	if err != nil {
-		return errors.Wrap(err, "read cmdline config")
+		return BootStatusFailed, errors.Wrap(err, "read cmdline config")
 	}
 	// To show the files that define the flags, run `./bin/launch_cvd --help`
 	//
@@ -360,18 +1219,78 @@ func (v *VMM) VMStart(containerName string, isAsync bool, options string, callba
 		fmt.Sprintf("--cpus=%s", cpu),
 		fmt.Sprintf("--memory_mb=%d", ram_gb*1024),
 	}
-	launch_cmd = append(launch_cmd, cmdline)
-
-	if aospVersion != "Android 9" {
-		launch_cmd = append(launch_cmd, "--nostart_webrtc")
+	allowed, rejected := v.FilterLaunchFlags(cmdline)
+	if len(rejected) > 0 {
+		warning := fmt.Sprintf("Warning: ignored disallowed launch_cvd flags %v", rejected)
+		log.Printf("VMStart (%s): %s\n", containerName, warning)
+		callback(warning)
 	}
-	if aospVersion == "Android 12" {
-		launch_cmd = append(launch_cmd, "--report_anonymous_usage_stats=y")
+	launch_cmd = append(launch_cmd, allowed...)
+	cjson, err := v.getContainerJSON(containerName)
+	if err != nil {
+		return BootStatusFailed, errors.Wrap(err, "getContainerJSON")
 	}
-	log.Println("VMStart cmdline: ", launch_cmd)
-
-	// Create an exec config in docker but do not run the command yet.
-	ctx := context.Background()
+	if bootImage := cjson.Config.Labels[LABEL_BOOT_IMAGE]; bootImage != "" {
+		launch_cmd = append(launch_cmd, "--boot_image="+path.Join(HomeDir, bootImage))
+	}
+	if vendorBootImage := cjson.Config.Labels[LABEL_VENDOR_BOOT_IMAGE]; vendorBootImage != "" {
+		launch_cmd = append(launch_cmd, "--vendor_boot_image="+path.Join(HomeDir, vendorBootImage))
+	}
+	if superImage := cjson.Config.Labels[LABEL_SUPER_IMAGE]; superImage != "" {
+		launch_cmd = append(launch_cmd, "--super_image="+path.Join(HomeDir, superImage))
+	}
+	if sdcardImage := cjson.Config.Labels[LABEL_SDCARD_IMAGE]; sdcardImage != "" {
+		launch_cmd = append(launch_cmd, "--use_sdcard", "--sdcard_path="+path.Join(HomeDir, sdcardImage))
+	} else if sdcardMB := v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_SDCARD_MB); sdcardMB != "" {
+		launch_cmd = append(launch_cmd, "--use_sdcard", "--blank_sdcard_image_mb="+sdcardMB)
+	}
+	if dataImageMB := v.dataImageMB(containerName, cjson.Config.Labels); dataImageMB > 0 {
+		launch_cmd = append(launch_cmd, "--data_policy=resize_up_to", fmt.Sprintf("--blank_data_image_mb=%d", dataImageMB))
+	}
+	// placed after cmdline so that the GPU mode option takes precedence
+	gpuMode := opts.GPUMode
+	if gpuMode == "" {
+		gpuMode = cjson.Config.Labels[LABEL_GPU_MODE]
+	}
+	if err := ValidateGPUMode(gpuMode); err != nil {
+		return BootStatusFailed, err
+	}
+	if isHardwareGPUMode(gpuMode) && !v.containerHasGPU(containerName) {
+		warning := fmt.Sprintf("Warning: no GPU found in %s, falling back from %s to %s", GPUDevicePath, gpuMode, GPUModeSwiftShader)
+		log.Printf("VMStart (%s): %s\n", containerName, warning)
+		callback(warning)
+		gpuMode = GPUModeSwiftShader
+	}
+	if gpuMode != "" {
+		launch_cmd = append(launch_cmd, "--gpu_mode="+gpuMode)
+	}
+	// placed after cmdline so that the per-VM security configs take precedence
+	for _, key := range []string{CONFIG_KEY_GUEST_ENFORCE_SECURITY, CONFIG_KEY_GUEST_AUDIT_SECURITY} {
+		if value := v.KVStore.GetContainerValueOrEmpty(containerName, key); value != "" {
+			launch_cmd = append(launch_cmd, fmt.Sprintf("--%s=%s", key, value))
+		}
+	}
+
+	// VMs created before the version was validated may have a differently cased one
+	if normalized, err := NormalizeAOSPVersion(aospVersion); err == nil {
+		aospVersion = string(normalized)
+	}
+	if AOSPVersion(aospVersion) != Android9 {
+		launch_cmd = append(launch_cmd, "--nostart_webrtc")
+	}
+	if AOSPVersion(aospVersion) == Android12 {
+		launch_cmd = append(launch_cmd, "--report_anonymous_usage_stats=y")
+	}
+	log.Println("VMStart cmdline: ", launch_cmd)
+
+	if opts.Daemon {
+		return v.vmStartDaemon(containerName, launch_cmd, cf_instance, isAsync, opts, start, launched, callback)
+	}
+	// read on every start as it can be changed by SetBootTimeout at any time
+	bootTimeout := v.GetBootTimeout()
+
+	// Create an exec config in docker but do not run the command yet.
+	ctx := context.Background()
 	resp, err := v.Client.ContainerExecCreate(ctx, containerName, types.ExecConfig{
 		User:         "vsoc-01",
 		AttachStdout: true,
@@ -382,15 +1301,15 @@ func (v *VMM) VMStart(containerName string, isAsync bool, options string, callba
 	})
 
 	if err != nil {
-		return errors.Wrap(err, "docker: failed to create an exec config")
+		return BootStatusFailed, errors.Wrap(err, "docker: failed to create an exec config")
 	}
 
 	// Execute launch_cmd.
 	aresp, err := v.Client.ContainerExecAttach(ctx, resp.ID, types.ExecStartCheck{Detach: false, Tty: true})
 	if err != nil {
-		return errors.Wrap(err, "docker: failed to execute/attach to launch_cvd")
+		return BootStatusFailed, errors.Wrap(err, "docker: failed to execute/attach to launch_cvd")
 	}
-	defer aresp.Close()
+	launched()
 
 	// ADB daemon needs to wait for the VM to boot in order to connect.
 	// As we can't know for sure when the VM will start listening, our best chance to start ADB daemon is to
@@ -405,41 +1324,395 @@ func (v *VMM) VMStart(containerName string, isAsync bool, options string, callba
 	// While the VM is booting, read the console output and wait for VIRTUAL_DEVICE_BOOT_COMPLETED message
 	// to indicate a successful boot.
 	if !isAsync {
-		outputDone := make(chan int)
+		defer aresp.Close()
+		status, err := waitForBootOutput(aresp.Conn, bootTimeout, callback)
+		if status != BootStatusBooted {
+			return status, err
+		}
+		if opts.WaitForUI {
+			callback("Waiting for the boot animation to end...")
+			if err := v.waitForUIReady(containerName, start.Add(bootTimeout)); err != nil {
+				return BootStatusTimeout, errors.Wrap(err, "waitForUIReady")
+			}
+		}
+		elapsed := time.Since(start)
+		log.Printf("VMStart (%s): success after %d\n", containerName, elapsed)
+		return BootStatusBooted, nil
+	}
+	// keep reading the output in the background to confirm the boot, as the caller may be long gone by then
+	go func() {
+		defer aresp.Close()
+		if status, _ := waitForBootOutput(aresp.Conn, bootTimeout, func(string) {}); status == BootStatusBooted {
+			v.bootSucceeded(containerName)
+		}
+	}()
+	return BootStatusStarted, nil
+}
 
+// waitForBootOutput reads launch_cvd's console output and passes each line to callback until the output shows
+// VIRTUAL_DEVICE_BOOT_COMPLETED (BootStatusBooted), ends before that (BootStatusCrashed) or timeout passes
+// (BootStatusTimeout). The output is taken as a reader so that the boot detection can be tested with synthetic output.
+func waitForBootOutput(output io.Reader, timeout time.Duration, callback func(string)) (BootStatus, error) {
+	// buffered so that the reader can exit after VMStart has returned on timeout
+	outputDone := make(chan int, 2)
+
+	go func() {
+		scanner := bufio.NewScanner(output)
+		for scanner.Scan() {
+			line := scanner.Text()
+			fmt.Println(line)
+			callback(line)
+			if strings.Contains(line, "VIRTUAL_DEVICE_BOOT_COMPLETED") {
+				outputDone <- 1
+			}
+		}
+		outputDone <- 0
+	}()
+
+	select {
+	case done := <-outputDone:
+		if done == 1 {
+			return BootStatusBooted, nil
+		}
+		return BootStatusCrashed, errors.New("VMStart failed as launch_cvd terminated abnormally")
+	case <-time.After(timeout):
+		return BootStatusTimeout, errors.New("VMStart timeout")
+	}
+}
+
+// vmStartDaemon is the VMStartOptions.Daemon variant of VMStart. launch_cvd is started in a detached exec with its
+// stdout redirected to HomeDir/launch_cvd.out, so nothing depends on the API server holding a connection.
+func (v *VMM) vmStartDaemon(containerName string, launchCmd []string, cfInstance int, isAsync bool, opts VMStartOptions, start time.Time, launched func(), callback func(string)) (BootStatus, error) {
+	launcherLog := path.Join(HomeDir, "cuttlefish_runtime/launcher.log")
+	// Remove the log of the previous boot, otherwise an old VIRTUAL_DEVICE_BOOT_COMPLETED would be mistaken
+	// for the current one
+	if _, err := v.containerExec(containerName, "rm -f "+launcherLog, "vsoc-01"); err != nil {
+		return BootStatusFailed, errors.Wrap(err, "failed to remove old launcher.log")
+	}
+
+	quoted := make([]string, len(launchCmd))
+	for i, arg := range launchCmd {
+		quoted[i] = shellQuote(arg)
+	}
+	ctx := context.Background()
+	resp, err := v.Client.ContainerExecCreate(ctx, containerName, types.ExecConfig{
+		User:   "vsoc-01",
+		Detach: true,
+		Cmd: []string{"/bin/sh", "-c", fmt.Sprintf("exec %s </dev/null >%s 2>&1",
+			strings.Join(quoted, " "), path.Join(HomeDir, "launch_cvd.out"))},
+		Env: []string{fmt.Sprintf("CUTTLEFISH_INSTANCE=%d", cfInstance)},
+	})
+	if err != nil {
+		return BootStatusFailed, errors.Wrap(err, "docker: failed to create an exec config")
+	}
+	if err := v.Client.ContainerExecStart(ctx, resp.ID, types.ExecStartCheck{Detach: true}); err != nil {
+		return BootStatusFailed, errors.Wrap(err, "docker: failed to start launch_cvd")
+	}
+	launched()
+	// See VMStart for why the ADB daemon is started when VMStart returns
+	defer func() {
+		if err := v.startADBDaemon(containerName); err != nil {
+			log.Printf("error: failed to startADBDaemon in %s. reason:%v", containerName, err)
+		}
+	}()
+
+	bootTimeout := v.GetBootTimeout()
+	if isAsync {
+		// watch launcher.log in the background to confirm the boot
 		go func() {
-			scanner := bufio.NewScanner(aresp.Conn)
-			for scanner.Scan() {
-				line := scanner.Text()
-				fmt.Println(line)
+			if status, _ := v.waitForLauncherLog(containerName, launcherLog, start.Add(bootTimeout), func(string) {}); status == BootStatusBooted {
+				v.bootSucceeded(containerName)
+			}
+		}()
+		return BootStatusStarted, nil
+	}
+	if status, err := v.waitForLauncherLog(containerName, launcherLog, start.Add(bootTimeout), callback); err != nil {
+		return status, err
+	}
+	if opts.WaitForUI {
+		callback("Waiting for the boot animation to end...")
+		if err := v.waitForUIReady(containerName, start.Add(bootTimeout)); err != nil {
+			return BootStatusTimeout, errors.Wrap(err, "waitForUIReady")
+		}
+	}
+	log.Printf("VMStart (%s): success after %s\n", containerName, time.Since(start))
+	return BootStatusBooted, nil
+}
+
+// waitForLauncherLog polls launcher.log until VIRTUAL_DEVICE_BOOT_COMPLETED shows up, launch_cvd exits, or the
+// deadline passes. New lines are passed to callback as they are read.
+func (v *VMM) waitForLauncherLog(containerName string, launcherLog string, deadline time.Time, callback func(string)) (BootStatus, error) {
+	linesRead := 0
+	for time.Now().Before(deadline) {
+		// check the process before reading the log so that the lines written right before an exit are not missed
+		running, err := v.isLaunchCVDRunning(containerName)
+		if err != nil {
+			return BootStatusFailed, err
+		}
+
+		resp, err := v.containerExecWithTimeout(containerName,
+			fmt.Sprintf("tail -n +%d %s 2>/dev/null", linesRead+1, launcherLog), "vsoc-01", ADBCommandTimeout)
+		if err != nil {
+			return BootStatusFailed, errors.Wrap(err, "failed to read launcher.log")
+		}
+		out := resp.outBuffer.String()
+		// only consume complete lines, the last one may still be being written
+		if i := strings.LastIndex(out, "\n"); i >= 0 {
+			for _, line := range strings.Split(out[:i], "\n") {
+				linesRead++
 				callback(line)
 				if strings.Contains(line, "VIRTUAL_DEVICE_BOOT_COMPLETED") {
-					outputDone <- 1
+					return BootStatusBooted, nil
 				}
 			}
-			outputDone <- 0
-		}()
+		}
+		if !running {
+			return BootStatusCrashed, errors.New("VMStart failed as launch_cvd terminated abnormally")
+		}
+		time.Sleep(2 * time.Second)
+	}
+	return BootStatusTimeout, errors.New("VMStart timeout")
+}
 
-		select {
-		case done := <-outputDone:
-			if done == 1 {
-				elapsed := time.Since(start)
-				log.Printf("VMStart (%s): success after %d\n", containerName, elapsed)
-				return nil
+// isLaunchCVDRunning checks if there is a launch_cvd process in the container.
+func (v *VMM) isLaunchCVDRunning(containerName string) (bool, error) {
+	// use grep "[x]xxx" technique to prevent grep itself from showing up in the ps result
+	resp, err := v.containerExecWithTimeout(containerName, "ps aux|grep \"[l]aunch_cvd\"", "vsoc-01", ADBCommandTimeout)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to list processes")
+	}
+	return strings.Contains(resp.outBuffer.String(), "launch_cvd"), nil
+}
+
+// VMResizeSDCard changes the size of the blank sdcard. The current sdcard is deleted and a new one of sizeMB is
+// created by launch_cvd at the next VMStart, so all data on the sdcard is lost. The VM must be stopped.
+func (v *VMM) VMResizeSDCard(containerName string, sizeMB int) error {
+	if sizeMB <= 0 {
+		return fmt.Errorf("invalid sdcard size %d MB", sizeMB)
+	}
+	if err := v.VMWipeSDCard(containerName); err != nil {
+		return err
+	}
+	return v.KVStore.PutContainterValue(containerName, []KeyValue{{CONFIG_KEY_SDCARD_MB, strconv.Itoa(sizeMB)}})
+}
+
+// VMResizeData grows the userdata partition to sizeMB at the next VMStart. The partition can't be shrunk, so sizeMB
+// must be larger than the current size.
+func (v *VMM) VMResizeData(containerName string, sizeMB int) error {
+	cjson, err := v.isManagedContainer(containerName)
+	if err != nil {
+		return err
+	}
+	if current := v.dataImageMB(containerName, cjson.Config.Labels); sizeMB <= current {
+		return fmt.Errorf("invalid data partition size %d MB, must be larger than the current %d MB", sizeMB, current)
+	}
+	return v.KVStore.PutContainterValue(containerName, []KeyValue{{CONFIG_KEY_DATA_IMAGE_MB, strconv.Itoa(sizeMB)}})
+}
+
+// dataImageMB returns the requested size of the userdata partition of a VM, 0 if it has never been resized.
+func (v *VMM) dataImageMB(containerName string, labels map[string]string) int {
+	if size, err := strconv.Atoi(v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_DATA_IMAGE_MB)); err == nil {
+		return size
+	}
+	size, _ := strconv.Atoi(labels[LABEL_DATA_IMAGE_MB])
+	return size
+}
+
+// VMWipeSDCard deletes the blank sdcard, which is recreated empty by launch_cvd at the next VMStart.
+// The VM must be stopped. Uploaded sdcard images are not wiped, load the image again instead.
+func (v *VMM) VMWipeSDCard(containerName string) error {
+	cjson, err := v.isManagedContainer(containerName)
+	if err != nil {
+		return err
+	}
+	if cjson.State.Status != "running" {
+		return errors.Wrap(ErrVMNotRunning, "invalid container")
+	}
+	if cjson.Config.Labels[LABEL_SDCARD_IMAGE] != "" {
+		return errors.New("the sdcard is an uploaded image and can't be wiped")
+	}
+	running, err := v.isLaunchCVDRunning(containerName)
+	if err != nil {
+		return err
+	}
+	if running {
+		return errors.New("the VM must be stopped before changing the sdcard")
+	}
+	resp, err := v.containerExec(containerName, "rm -f "+path.Join(HomeDir, "cuttlefish_runtime/sdcard.img"), "vsoc-01")
+	if err != nil {
+		return errors.Wrap(err, "failed to remove sdcard.img")
+	}
+	if resp.ExitCode != 0 {
+		return errors.New("failed to remove sdcard.img: " + resp.errBuffer.String())
+	}
+	return nil
+}
+
+// FilterLaunchFlags splits a cmdline config into launch_cvd arguments and separates flags in AllowedLaunchFlags
+// from the rest. Both `--flag=value` and `--flag value` forms are supported, and a negated boolean flag `--noflag`
+// is allowed if `flag` is allowed.
+func (v *VMM) FilterLaunchFlags(cmdline string) (allowed []string, rejected []string) {
+	allowedSet := map[string]bool{}
+	for _, f := range v.AllowedLaunchFlags {
+		allowedSet[f] = true
+	}
+	isAllowed := false
+	for _, arg := range strings.Fields(cmdline) {
+		if !strings.HasPrefix(arg, "-") {
+			// value of the previous flag
+			if isAllowed {
+				allowed = append(allowed, arg)
+			} else {
+				rejected = append(rejected, arg)
+			}
+			continue
+		}
+		name := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+		isAllowed = allowedSet[name] || (strings.HasPrefix(name, "no") && allowedSet[strings.TrimPrefix(name, "no")])
+		if isAllowed {
+			allowed = append(allowed, arg)
+		} else {
+			rejected = append(rejected, arg)
+		}
+	}
+	return allowed, rejected
+}
+
+// ValidateSecurityConfig checks the value of CONFIG_KEY_GUEST_ENFORCE_SECURITY or CONFIG_KEY_GUEST_AUDIT_SECURITY.
+func ValidateSecurityConfig(key string, value string) error {
+	if value != "" && value != "true" && value != "false" {
+		return fmt.Errorf("invalid %s %s, must be true, false or empty", key, value)
+	}
+	return nil
+}
+
+var (
+	labelKeyRegex   = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,62}$`)
+	labelValueRegex = regexp.MustCompile(`^[a-zA-Z0-9 ._:/@#+-]{0,255}$`)
+)
+
+// ValidateLabels checks the keys and values of VMCreateOptions.Labels. Keys are up to 63 alphanumerics, '.', '_' or
+// '-', and values are up to 255 alphanumerics, spaces or any of "._:/@#+-".
+func ValidateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !labelKeyRegex.MatchString(key) {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+		if !labelValueRegex.MatchString(value) {
+			return fmt.Errorf("invalid value of label %s", key)
+		}
+	}
+	return nil
+}
+
+// ValidateCpuset checks VMCreateOptions.CpusetCpus, a comma-separated list of CPU numbers or ranges e.g. "0-3,8",
+// against the numCPU CPUs of the host.
+func ValidateCpuset(cpuset string, numCPU int) error {
+	for _, part := range strings.Split(cpuset, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return fmt.Errorf("invalid cpuset %q", cpuset)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return fmt.Errorf("invalid cpuset %q", cpuset)
 			}
-			return errors.New("VMStart failed as launch_cvd terminated abnormally")
-		case <-time.After(v.BootTimeout):
-			return errors.New("VMStart timeout")
+		}
+		if last >= numCPU {
+			return fmt.Errorf("invalid cpuset %q, the host only has CPUs 0-%d", cpuset, numCPU-1)
 		}
 	}
 	return nil
 }
 
-// VMStop kills launch_cvd process in the container.
+// userLabels returns the VMCreateOptions.Labels among container labels
+func userLabels(labels map[string]string) map[string]string {
+	user := map[string]string{}
+	for key, value := range labels {
+		if strings.HasPrefix(key, LABEL_USER_PREFIX) {
+			user[strings.TrimPrefix(key, LABEL_USER_PREFIX)] = value
+		}
+	}
+	return user
+}
+
+// AOSPVersion is the Android release of a VM's system image, which decides the version-specific launch_cvd flags
+// in VMStart.
+type AOSPVersion string
+
+const (
+	Android9  AOSPVersion = "Android 9"
+	Android10 AOSPVersion = "Android 10"
+	Android11 AOSPVersion = "Android 11"
+	Android12 AOSPVersion = "Android 12"
+)
+
+// Supported values of VMCreateOptions.AOSPVersion
+var AOSPVersions = []AOSPVersion{Android9, Android10, Android11, Android12}
+
+// NormalizeAOSPVersion returns the one of AOSPVersions that version refers to regardless of case and spaces, e.g.
+// "android12" for Android12, or an error listing the supported versions.
+func NormalizeAOSPVersion(version string) (AOSPVersion, error) {
+	key := strings.ToLower(strings.Join(strings.Fields(version), ""))
+	names := []string{}
+	for _, known := range AOSPVersions {
+		if key == strings.ToLower(strings.ReplaceAll(string(known), " ", "")) {
+			return known, nil
+		}
+		names = append(names, string(known))
+	}
+	return "", fmt.Errorf("unsupported AOSP version %q, must be one of %s", version, strings.Join(names, ", "))
+}
+
+// The software rendering GPU mode that works without a host GPU
+const GPUModeSwiftShader = "guest_swiftshader"
+
+// ValidateGPUMode checks if mode is one of GPUModes or empty.
+func ValidateGPUMode(mode string) error {
+	if mode == "" {
+		return nil
+	}
+	for _, m := range GPUModes {
+		if m == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid GPU mode %s, must be one of %s", mode, strings.Join(GPUModes, ", "))
+}
+
+func isHardwareGPUMode(mode string) bool {
+	return mode != "" && mode != GPUModeSwiftShader
+}
+
+// containerHasGPU checks if the container has access to a render node of the host GPU
+func (v *VMM) containerHasGPU(containerName string) bool {
+	resp, err := v.containerExec(containerName, "ls "+path.Join(GPUDevicePath, "renderD*"), "root")
+	return err == nil && resp.ExitCode == 0
+}
+
+// VMStop kills launch_cvd process in the container on behalf of a user.
 func (v *VMM) VMStop(containerName string) error {
+	return v.VMStopWithReason(containerName, StopReasonUser)
+}
+
+// VMStopWithReason kills launch_cvd process in the container and records the reason, which is shown as
+// LastStopReason in VMList.
+func (v *VMM) VMStopWithReason(containerName string, reason StopReason) error {
 	if err := v.isManagedRunningContainer(containerName); err != nil {
 		return err
 	}
+	unlock, err := v.lockVM(containerName, "stop")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return v.vmStop(containerName, reason)
+}
+
+// vmStop runs stop_cvd in the container, which returns once launch_cvd has been told to stop.
+func (v *VMM) vmStop(containerName string, reason StopReason) error {
 	fmt.Printf("StopVM: %s\n", containerName)
 	ctx := context.Background()
 	resp, err := v.Client.ContainerExecCreate(ctx, containerName, types.ExecConfig{
@@ -466,98 +1739,593 @@ func (v *VMM) VMStop(containerName string) error {
 		line := scanner.Text()
 		output = output + "\n" + line
 		if strings.Contains(line, "Successful") {
-			log.Printf("StopVM (%s): success\n", containerName)
-			return nil
+			log.Printf("StopVM (%s): success, reason: %s\n", containerName, reason)
+			v.notifyWebhooks(WebhookEventStopped, containerName, map[string]string{"reason": string(reason)})
+			err := v.KVStore.PutContainterValue(containerName, []KeyValue{{CONFIG_KEY_STOP_REASON, string(reason)}})
+			return errors.Wrap(err, "failed to save stop reason")
 		}
 	}
 	return errors.New("failed to stop the VM. log: " + output)
 }
 
-// VMLoadFile copies a file from the host's srcPath to the container's HomeDir.
-// If the file is a TAR archive, VMLoadFile will also untar it in the container.
-func (v *VMM) VMLoadFile(containerName string, srcPath string) error {
+// VMRestart reboots the guest of a running VM without recreating its container, so that the container's daemons
+// (e.g. websockify and the adb server) keep running. launch_cvd is stopped and relaunched with the same flags, which
+// VMStart derives from the container's labels and configs and the options of the last VMStart, so the VM keeps its
+// cf_instance and vsock CIDs.
+// VMRestart returns once launch_cvd has been relaunched, or an error if it doesn't exit within the boot timeout.
+func (v *VMM) VMRestart(containerName string) error {
 	if err := v.isManagedRunningContainer(containerName); err != nil {
 		return err
 	}
-	return v.containerCopyFile(srcPath, containerName, HomeDir)
-}
-
-// VMUnzipImage unzips a zip file at the imageFile path of the container.
-func (v *VMM) VMUnzipImage(containerName string, imageFile string) error {
-	if err := v.isManagedRunningContainer(containerName); err != nil {
+	unlock, err := v.lockVM(containerName, "restart")
+	if err != nil {
 		return err
 	}
-	match, _ := regexp.MatchString("^[a-zA-z0-9-_]+\\.zip$", imageFile)
-	if !match {
-		return errors.New("Failed to unzip due to invalid zip filename \"" + imageFile + "\"")
+	defer unlock()
+	running, err := v.isLaunchCVDRunning(containerName)
+	if err != nil {
+		return err
 	}
-	log.Printf("Unzip %s in container %s at %s", imageFile, containerName, HomeDir)
-	_, err := v.containerExec(containerName, "unzip "+path.Join(HomeDir, imageFile), "vsoc-01")
-	return errors.Wrap(err, "containerExec")
+	if running {
+		if err := v.vmStop(containerName, StopReasonRestart); err != nil {
+			return err
+		}
+		if err := v.waitForLaunchCVDExit(containerName, time.Now().Add(v.GetBootTimeout())); err != nil {
+			return err
+		}
+	}
+	log.Printf("VMRestart (%s): relaunching\n", containerName)
+	_, err = v.bootVM(containerName, true, v.lastStartOptions(containerName), func() {}, func(string) {})
+	return err
 }
 
-// VMRemove force removes a container, regardless of whether the VM is running.
-func (v *VMM) VMRemove(containerName string) error {
-	if _, err := v.isManagedContainer(containerName); err != nil {
+// waitForLaunchCVDExit polls the container's processes until launch_cvd and run_cvd have exited, which can take a
+// while after stop_cvd returns as the guest shuts down.
+func (v *VMM) waitForLaunchCVDExit(containerName string, deadline time.Time) error {
+	for {
+		resp, err := v.containerExecWithTimeout(containerName, "ps aux|grep -E \"[l]aunch_cvd|[r]un_cvd\"", "vsoc-01", ADBCommandTimeout)
+		if err != nil {
+			return errors.Wrap(err, "failed to list processes")
+		}
+		if strings.TrimSpace(resp.outBuffer.String()) == "" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("launch_cvd didn't exit within %s", v.GetBootTimeout())
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// VMStopInstance stops one guest instance of a container launched with --num_instances, leaving the other
+// instances running. instanceNum is the instance's CUTTLEFISH_INSTANCE number as listed by containerInstanceNums.
+func (v *VMM) VMStopInstance(containerName string, instanceNum int) error {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
 		return err
 	}
-	containerID, err := v.getContainerIDByName(containerName)
+	unlock, err := v.lockVM(containerName, "stop")
 	if err != nil {
-		return errors.Wrap(err, "no containerID")
+		return err
 	}
-
-	err = v.Client.ContainerRemove(context.Background(), containerID, types.ContainerRemoveOptions{
-		Force: true,
-		// required since /home/vsoc-01 is mounted as an anonymous volume
-		RemoveVolumes: true,
-	})
+	defer unlock()
+	instances, err := v.containerInstanceNums(containerName)
 	if err != nil {
-		return errors.Wrap(err, "docker: ContainerRemove")
+		return err
 	}
-	err = v.KVStore.RemoveContainerConfigs(containerName)
-	if err != nil {
-		return errors.Wrap(err, "kvstore: ContainerRemove")
+	found := false
+	for _, num := range instances {
+		found = found || num == instanceNum
+	}
+	if !found {
+		return fmt.Errorf("invalid instance %d, expecting one of %v", instanceNum, instances)
 	}
-	err = os.RemoveAll(path.Join(v.DevicesDir, containerName))
+	log.Printf("StopVMInstance: %s instance %d\n", containerName, instanceNum)
+	// stop_cvd picks the instance to stop by CUTTLEFISH_INSTANCE
+	resp, err := v.containerExec(containerName, fmt.Sprintf("CUTTLEFISH_INSTANCE=%d %s/bin/stop_cvd", instanceNum, HomeDir), "vsoc-01")
 	if err != nil {
-		return err
+		return errors.Wrap(err, "failed to execute stop_cvd")
+	}
+	if resp.ExitCode != 0 {
+		return fmt.Errorf("failed to stop instance %d. log: %s", instanceNum, resp.outBuffer.String()+resp.errBuffer.String())
+	}
+	if len(instances) == 1 {
+		v.notifyWebhooks(WebhookEventStopped, containerName, map[string]string{"reason": string(StopReasonUser)})
+		err := v.KVStore.PutContainterValue(containerName, []KeyValue{{CONFIG_KEY_STOP_REASON, string(StopReasonUser)}})
+		return errors.Wrap(err, "failed to save stop reason")
 	}
 	return nil
 }
 
-// VMPrune removes all managed containers of the VMM instance. If there are more than one VMM running
-// on the same host, VMPrune only removes containers with the VMM instance's CFPrefix.
-func (v *VMM) VMPrune() {
-	cfList, _ := v.listCuttlefishContainers()
-	for _, c := range cfList {
-		err := v.VMRemove(c.Names[0][1:])
-		if err != nil {
-			log.Printf("VMPrune (%s): failed. reason:%v\n", c.ID[:10], err)
+// containerInstanceNums lists the CUTTLEFISH_INSTANCE numbers of the guest instances in a container. A container runs
+// the single instance of its cf_instance label, or cf_instance and the following ones if --num_instances is in
+// its cmdline config.
+func (v *VMM) containerInstanceNums(containerName string) ([]int, error) {
+	base, err := v.getContainerCFInstanceNumber(containerName)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read cf_instance")
+	}
+	count := numInstancesFromCmdline(v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_CMDLINE))
+	nums := make([]int, count)
+	for i := range nums {
+		nums[i] = base + i
+	}
+	return nums, nil
+}
+
+// numInstancesFromCmdline returns the value of --num_instances in a cmdline config, or 1 if it's not given.
+func numInstancesFromCmdline(cmdline string) int {
+	count := 1
+	args := strings.Fields(cmdline)
+	for i, arg := range args {
+		var value string
+		switch {
+		case strings.HasPrefix(arg, "--num_instances="):
+			value = strings.TrimPrefix(arg, "--num_instances=")
+		case arg == "--num_instances" && i+1 < len(args):
+			value = args[i+1]
+		default:
+			continue
+		}
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			count = n
 		}
-		log.Printf("VMPrune (%s): success\n", c.ID[:10])
 	}
+	return count
 }
 
-// VMList lists all managed containers of the VMM instance.
-func (v *VMM) VMList() ([]VMItem, error) {
-	cfList, err := v.listCuttlefishContainers()
+// VMLoadFile copies a file from the host's srcPath to the container's HomeDir.
+// If the file is a TAR archive, VMLoadFile will also untar it in the container.
+func (v *VMM) VMLoadFile(containerName string, srcPath string) error {
+	return v.VMLoadFileWithProgress(containerName, srcPath, nil)
+}
+
+// VMLoadFileWithProgress is the same as VMLoadFile but also reports the progress of the copy to onProgress every
+// copyProgressInterval. onProgress can be nil.
+func (v *VMM) VMLoadFileWithProgress(containerName string, srcPath string, onProgress func(CopyProgress)) error {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	unlock, err := v.lockVM(containerName, "load file")
 	if err != nil {
-		return nil, errors.Wrap(err, "listCuttlefishContainers")
+		return err
 	}
-	resp := []VMItem{}
-	for _, c := range cfList {
-		status, err := v.getVMStatus(c)
-		containerName := c.Names[0][1:]
-		if err != nil {
-			return nil, errors.Wrap(err, "getVMStatus")
-		}
+	defer unlock()
+	return v.containerCopyFile(srcPath, containerName, HomeDir, onProgress)
+}
 
-		cpuStr := v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_CPU)
-		cpu, _ := strconv.Atoi(cpuStr)
-		ramStr := v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_RAM)
-		ram, _ := strconv.Atoi(ramStr)
-		tagsStr := v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_TAGS)
-		tags := strings.Split(tagsStr, ",")
+// minimum interval between two progress reports of VMLoadFileWithProgress
+var copyProgressInterval = 5 * time.Second
+
+// CopyProgress is the progress of copying a file into a container.
+type CopyProgress struct {
+	File           string // base name of the file
+	BytesDone      int64
+	BytesTotal     int64
+	BytesPerSecond float64 // throughput since the last report
+}
+
+// ETA estimates the remaining time at the current throughput, or -1 if the throughput is unknown.
+func (p CopyProgress) ETA() time.Duration {
+	if p.BytesPerSecond <= 0 {
+		return -1
+	}
+	return time.Duration(float64(p.BytesTotal-p.BytesDone) / p.BytesPerSecond * float64(time.Second))
+}
+
+// String formats the progress as e.g. "4.2GB/13GB (38%, 120MB/s, ~1m18s left)".
+func (p CopyProgress) String() string {
+	percent := 100.0
+	if p.BytesTotal > 0 {
+		percent = float64(p.BytesDone) / float64(p.BytesTotal) * 100
+	}
+	eta := "unknown time"
+	if d := p.ETA(); d >= 0 {
+		eta = "~" + d.Round(time.Second).String()
+	}
+	return fmt.Sprintf("%s/%s (%.0f%%, %s/s, %s left)", formatBytes(p.BytesDone), formatBytes(p.BytesTotal), percent,
+		formatBytes(int64(p.BytesPerSecond)), eta)
+}
+
+// formatBytes formats a size with the largest unit that keeps it >= 1, e.g. 4.2GB or 120MB.
+func formatBytes(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	size := float64(n)
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	if i == 0 || size >= 100 {
+		return fmt.Sprintf("%.0f%s", size, units[i])
+	}
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", size), ".0") + units[i]
+}
+
+// progressReader counts the bytes read from r and reports a CopyProgress every copyProgressInterval.
+type progressReader struct {
+	r          io.Reader
+	progress   CopyProgress
+	lastReport time.Time
+	lastDone   int64
+	onProgress func(CopyProgress)
+}
+
+func newProgressReader(r io.Reader, file string, total int64, onProgress func(CopyProgress)) io.Reader {
+	if onProgress == nil {
+		return r
+	}
+	return &progressReader{
+		r:          r,
+		progress:   CopyProgress{File: file, BytesTotal: total},
+		lastReport: time.Now(),
+		onProgress: onProgress,
+	}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.progress.BytesDone += int64(n)
+	elapsed := time.Since(p.lastReport)
+	// also report the end of the file
+	finished := err == io.EOF && p.progress.BytesDone > p.lastDone
+	if (elapsed >= copyProgressInterval || finished) && elapsed > 0 {
+		p.progress.BytesPerSecond = float64(p.progress.BytesDone-p.lastDone) / elapsed.Seconds()
+		p.lastReport = time.Now()
+		p.lastDone = p.progress.BytesDone
+		p.onProgress(p.progress)
+	}
+	return n, err
+}
+
+// Magic numbers of super images, which are either Android sparse images or raw images starting with the
+// dynamic partition metadata (LpMetadataGeometry) after a reserved area
+const (
+	sparseImageMagic       = 0xed26ff3a
+	superGeometryMagic     = 0x616c4467
+	superGeometryOffset    = 4096
+	superImageMinimumBytes = superGeometryOffset + 4
+)
+
+// ValidateSuperImage checks if a file on the host is a super image (super.img) in either the sparse or the raw format.
+func ValidateSuperImage(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := make([]byte, superImageMinimumBytes)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return fmt.Errorf("invalid super image %s: too small", path.Base(file))
+	}
+	if binary.LittleEndian.Uint32(header) == sparseImageMagic ||
+		binary.LittleEndian.Uint32(header[superGeometryOffset:]) == superGeometryMagic {
+		return nil
+	}
+	return fmt.Errorf("invalid super image %s: neither a sparse image nor a raw super image", path.Base(file))
+}
+
+// VMUnzipImage unzips a zip file at the imageFile path of the container.
+func (v *VMM) VMUnzipImage(containerName string, imageFile string) error {
+	return v.VMUnzipImageWithProgress(containerName, imageFile, nil)
+}
+
+// UnzipProgress is the progress of unzipping an image in a container.
+type UnzipProgress struct {
+	File       string // the member being extracted
+	FilesDone  int
+	FilesTotal int // 0 if unknown
+}
+
+// String formats the progress as e.g. "12/25 files (48%), super.img".
+func (p UnzipProgress) String() string {
+	if p.FilesTotal <= 0 {
+		return fmt.Sprintf("%d files, %s", p.FilesDone, p.File)
+	}
+	return fmt.Sprintf("%d/%d files (%.0f%%), %s", p.FilesDone, p.FilesTotal, float64(p.FilesDone)/float64(p.FilesTotal)*100, p.File)
+}
+
+// VMUnzipImageWithProgress is the same as VMUnzipImage but also reports each extracted member to onProgress, which
+// can be nil. The total is counted from the archive's member list beforehand.
+func (v *VMM) VMUnzipImageWithProgress(containerName string, imageFile string, onProgress func(UnzipProgress)) error {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	unlock, err := v.lockVM(containerName, "unzip")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	match, _ := regexp.MatchString("^[a-zA-z0-9-_]+\\.zip$", imageFile)
+	if !match {
+		return errors.New("Failed to unzip due to invalid zip filename \"" + imageFile + "\"")
+	}
+	zipFile := path.Join(HomeDir, imageFile)
+	cmd := "unzip " + zipFile
+	cjson, err := v.getContainerJSON(containerName)
+	if err != nil {
+		return errors.Wrap(err, "getContainerJSON")
+	}
+	// the system image's super.img (several GBs) is not used with a custom one
+	excluded := ""
+	if cjson.Config.Labels[LABEL_SUPER_IMAGE] != "" {
+		excluded = "super.img"
+		cmd += " -x " + excluded
+	}
+	total := 0
+	if onProgress != nil {
+		// -Z1 lists the member names, one per line
+		resp, err := v.containerExec(containerName, "unzip -Z1 "+zipFile, "vsoc-01")
+		if err != nil || resp.ExitCode != 0 {
+			log.Printf("VMUnzipImage (%s): failed to count the members of %s, reporting progress without a total. reason: %v\n", containerName, imageFile, err)
+		} else {
+			total = countZipMembers(resp.outBuffer.String(), excluded)
+		}
+	}
+	log.Printf("Unzip %s in container %s at %s", imageFile, containerName, HomeDir)
+	done := 0
+	resp, err := v.containerExecLines(containerName, cmd, "vsoc-01", func(line string) {
+		if member, ok := parseUnzipOutput(line); ok && onProgress != nil {
+			done++
+			onProgress(UnzipProgress{File: member, FilesDone: done, FilesTotal: total})
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "containerExec")
+	}
+	// e.g. no space left on device or a corrupt archive
+	if resp.ExitCode != 0 {
+		return fmt.Errorf("failed to unzip %s, exit code %d: %s", imageFile, resp.ExitCode, lastLines(resp.errBuffer.String(), 5))
+	}
+	return nil
+}
+
+// lastLines returns the last n lines of output, without the trailing newline.
+func lastLines(output string, n int) string {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Lines that unzip prints for each member it extracts, e.g. "  inflating: super.img"
+var unzipOutputRegex = regexp.MustCompile(`^\s*(inflating|extracting|creating):\s+(.+?)\s*$`)
+
+// parseUnzipOutput returns the member name in a line of unzip's output, if the line is about an extracted member.
+func parseUnzipOutput(line string) (string, bool) {
+	m := unzipOutputRegex.FindStringSubmatch(line)
+	if m == nil {
+		return "", false
+	}
+	return m[2], true
+}
+
+// countZipMembers counts the member names listed by `unzip -Z1`, except for excluded.
+func countZipMembers(list string, excluded string) int {
+	n := 0
+	for _, name := range strings.Split(list, "\n") {
+		if name = strings.TrimSpace(name); name != "" && name != excluded {
+			n++
+		}
+	}
+	return n
+}
+
+// VMRemoveOptions customizes what VMRemoveWithOptions cleans up along with the container.
+type VMRemoveOptions struct {
+	// KeepData keeps the VM's device folder in DevicesDir, with the VM's logs copied to its KeptLogsDir, so that it
+	// can be inspected later or seed a new VM of the same name with VMCreateOptions.ReuseData.
+	KeepData bool
+}
+
+// Folder in a kept device folder where VMRemoveWithOptions copies the logs of the removed container
+const KeptLogsDir = "logs"
+
+// Marks a device folder kept by VMRemoveWithOptions, so that VMCreate doesn't empty it by accident
+const keptDataMarker = ".matrisea-kept"
+
+// ErrDeviceDataKept is returned by VMCreate when the device folder has been kept by VMRemoveWithOptions and
+// VMCreateOptions.ReuseData isn't set.
+var ErrDeviceDataKept = errors.New("the device folder of a removed VM with the same name has been kept, reuse it or delete it first")
+
+// VMRemove force removes a container, regardless of whether the VM is running. The device folder is kept if
+// VMM.KeepDataOnRemove is set.
+func (v *VMM) VMRemove(containerName string) error {
+	return v.VMRemoveWithOptions(containerName, VMRemoveOptions{KeepData: v.KeepDataOnRemove})
+}
+
+// VMRemoveWithOptions is the same as VMRemove but takes the options from opts instead of the VMM's defaults.
+func (v *VMM) VMRemoveWithOptions(containerName string, opts VMRemoveOptions) error {
+	if _, err := v.isManagedContainer(containerName); err != nil {
+		return err
+	}
+	unlock, err := v.lockVM(containerName, "remove")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return v.vmRemove(containerName, opts)
+}
+
+// vmRemove removes a container without checking for the operations in progress.
+func (v *VMM) vmRemove(containerName string, opts VMRemoveOptions) error {
+	containerID, err := v.getContainerIDByName(containerName)
+	if err != nil {
+		return errors.Wrap(err, "no containerID")
+	}
+	deviceDir := path.Join(v.DevicesDir, containerName)
+	if opts.KeepData {
+		// the logs are in the container's home folder, which is removed along with it
+		logsDir := path.Join(deviceDir, KeptLogsDir)
+		if err := os.MkdirAll(logsDir, 0755); err != nil {
+			return errors.Wrap(err, "failed to create "+logsDir)
+		}
+		v.copyLogs(containerName, logsDir)
+		if err := ioutil.WriteFile(path.Join(deviceDir, keptDataMarker), []byte(time.Now().Format(time.RFC3339)), 0644); err != nil {
+			return errors.Wrap(err, "failed to mark the device folder as kept")
+		}
+	}
+
+	err = v.Client.ContainerRemove(context.Background(), containerID, types.ContainerRemoveOptions{
+		Force: true,
+		// required since /home/vsoc-01 is mounted as an anonymous volume
+		RemoveVolumes: true,
+	})
+	if err != nil {
+		return errors.Wrap(err, "docker: ContainerRemove")
+	}
+	v.diskUsageMu.Lock()
+	delete(v.diskUsageCache, containerName)
+	v.diskUsageMu.Unlock()
+	v.notifyWebhooks(WebhookEventRemoved, containerName, nil)
+	err = v.KVStore.RemoveContainerConfigs(containerName)
+	if err != nil {
+		return errors.Wrap(err, "kvstore: ContainerRemove")
+	}
+	if opts.KeepData {
+		log.Printf("VMRemove (%s): kept device folder %s\n", containerName, deviceDir)
+		return nil
+	}
+	err = os.RemoveAll(deviceDir)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// VMPrune removes all managed containers of the VMM instance. If there are more than one VMM running
+// on the same host, VMPrune only removes containers with the VMM instance's CFPrefix.
+func (v *VMM) VMPrune() {
+	v.VMPruneWithOptions(VMPruneOptions{})
+}
+
+// Maximum waiting time for VMPruneWithOptions to stop a VM before removing it anyway
+var pruneStopTimeout = 60 * time.Second
+
+// VMPruneWithOptions removes managed containers except the ones protected by opts. In dry-run mode nothing is
+// removed and the result lists the containers that would have been removed.
+//
+// Running VMs are stopped before any container is removed, so that launch_cvd and its disk images are shut down
+// cleanly rather than killed along with the container. A failure on one VM doesn't stop the others but is reported
+// in PruneResult.Failed.
+func (v *VMM) VMPruneWithOptions(opts VMPruneOptions) (PruneResult, error) {
+	result := PruneResult{Removed: []string{}, Failed: map[string]string{}}
+	cfList, err := v.listCuttlefishContainers()
+	if err != nil {
+		return result, errors.Wrap(err, "listCuttlefishContainers")
+	}
+	targets := []types.Container{}
+	for _, c := range cfList {
+		containerName := c.Names[0][1:]
+		if v.isPruneProtected(containerName, opts) {
+			log.Printf("VMPrune (%s): skipped protected VM\n", containerName)
+			continue
+		}
+		targets = append(targets, c)
+	}
+	if opts.DryRun {
+		for _, c := range targets {
+			result.Removed = append(result.Removed, c.Names[0][1:])
+		}
+		return result, nil
+	}
+
+	for _, c := range targets {
+		containerName := c.Names[0][1:]
+		if status, _ := v.getVMStatus(c); status != VMRunning && status != VMPartiallyRunning {
+			continue
+		}
+		if err := v.stopWithTimeout(containerName, pruneStopTimeout); err != nil {
+			// removing the container still kills launch_cvd
+			log.Printf("VMPrune (%s): failed to stop the VM, removing it anyway. reason: %v\n", containerName, err)
+		}
+	}
+	// operations in progress, e.g. a stop that timed out above, don't stop the removal and fail with the container
+	for _, c := range targets {
+		containerName := c.Names[0][1:]
+		if err := v.vmRemove(containerName, VMRemoveOptions{KeepData: v.KeepDataOnRemove}); err != nil {
+			log.Printf("VMPrune (%s): failed. reason:%v\n", c.ID[:10], err)
+			result.Failed[containerName] = err.Error()
+			continue
+		}
+		log.Printf("VMPrune (%s): success\n", c.ID[:10])
+		result.Removed = append(result.Removed, containerName)
+	}
+	return result, nil
+}
+
+// stopWithTimeout stops a VM, or gives up after timeout while stop_cvd keeps running in the background.
+func (v *VMM) stopWithTimeout(containerName string, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- v.VMStop(containerName)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("VM didn't stop within %s", timeout)
+	}
+}
+
+func (v *VMM) isPruneProtected(containerName string, opts VMPruneOptions) bool {
+	tags := strings.Split(v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_TAGS), ",")
+	for _, tag := range tags {
+		for _, keepTag := range opts.KeepTags {
+			if strings.TrimSpace(tag) == keepTag {
+				return true
+			}
+		}
+	}
+	return opts.Keep != nil && opts.Keep(containerName, tags)
+}
+
+// VMList lists all managed containers of the VMM instance.
+func (v *VMM) VMList() ([]VMItem, error) {
+	// fail fast rather than hang in ContainerList if the daemon is degraded
+	if err := v.CheckDocker(); err != nil {
+		return nil, err
+	}
+	cfList, err := v.listCuttlefishContainers()
+	if err != nil {
+		return nil, errors.Wrap(err, "listCuttlefishContainers")
+	}
+	return v.vmListItems(cfList)
+}
+
+// vmListItems converts containers to VMItems. Containers may be removed (e.g. by VMRemove or VMPrune) after they
+// have been listed, in which case they are omitted from the result instead of failing the whole list.
+func (v *VMM) vmListItems(cfList []types.Container) ([]VMItem, error) {
+	resp := []VMItem{}
+	for _, c := range cfList {
+		status, err := v.getVMStatus(c)
+		containerName := c.Names[0][1:]
+		if client.IsErrNotFound(err) {
+			log.Printf("VMList (%s): container no longer exists, skipping\n", containerName)
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "getVMStatus")
+		}
+
+		cpuStr := v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_CPU)
+		cpu, _ := strconv.Atoi(cpuStr)
+		ramStr := v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_RAM)
+		ram, _ := strconv.Atoi(ramStr)
+		tagsStr := v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_TAGS)
+		tags := strings.Split(tagsStr, ",")
+		sdcardMB, _ := strconv.Atoi(v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_SDCARD_MB))
+		bootAttempts, _ := strconv.Atoi(v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_BOOT_ATTEMPTS))
+		// VMs created before LABEL_IMAGE was introduced
+		image, ok := c.Labels[LABEL_IMAGE]
+		if !ok {
+			image = c.Image
+		}
+		// VMs with a missing or malformed label have been assigned an instance number in the KV store
+		cfInstance := c.Labels["cf_instance"]
+		if n, err := strconv.Atoi(cfInstance); err != nil || n <= 0 {
+			cfInstance = v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_CF_INSTANCE)
+		}
 
 		resp = append(resp, VMItem{
 			ID:         c.ID,
@@ -565,52 +2333,932 @@ func (v *VMM) VMList() ([]VMItem, error) {
 			Created:    strconv.FormatInt(c.Created, 10),
 			IP:         c.NetworkSettings.Networks[DefaultNetwork].IPAddress,
 			Status:     status,
-			CFInstance: c.Labels["cf_instance"],
+			CFInstance: cfInstance,
 			OSVersion:  v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_AOSP_VERSION),
 			CPU:        cpu,
 			RAM:        ram,
 			Tags:       tags,
 			Cmdline:    v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_CMDLINE),
+			Image:      image,
+
+			LastStopReason:       StopReason(v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_STOP_REASON)),
+			GuestEnforceSecurity: v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_GUEST_ENFORCE_SECURITY),
+			GuestAuditSecurity:   v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_GUEST_AUDIT_SECURITY),
+			BootImage:            c.Labels[LABEL_BOOT_IMAGE],
+			VendorBootImage:      c.Labels[LABEL_VENDOR_BOOT_IMAGE],
+			SuperImage:           c.Labels[LABEL_SUPER_IMAGE],
+			DNS:                  splitNonEmpty(c.Labels[LABEL_DNS], ","),
+			SDCardMB:             sdcardMB,
+			SDCardImage:          c.Labels[LABEL_SDCARD_IMAGE],
+			DataImageMB:          v.dataImageMB(containerName, c.Labels),
+			Autostart:            v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_AUTOSTART) == "true",
+			BootAttempts:         bootAttempts,
+			BootFailed:           v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_BOOT_FAILED) == "true",
+			GPUMode:              c.Labels[LABEL_GPU_MODE],
+			Labels:               userLabels(c.Labels),
+			CpusetCpus:           c.Labels[LABEL_CPUSET_CPUS],
+			BuildFingerprint:     v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_BUILD_FINGERPRINT),
 		})
 	}
 	return resp, nil
 }
 
+// Maximum waiting time for adbd in the guest to answer VMGetBuildFingerprint
+var buildFingerprintTimeout = 60 * time.Second
+
+// VMGetBuildFingerprint reads ro.build.fingerprint of a running VM, waiting for adbd in the guest to come up if needed,
+// and caches it in the container config for VMList.
+func (v *VMM) VMGetBuildFingerprint(containerName string) (string, error) {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return "", err
+	}
+	deadline := time.Now().Add(buildFingerprintTimeout)
+	for {
+		fingerprint, err := v.readBuildFingerprint(containerName)
+		if err == nil {
+			if err := v.KVStore.PutContainterValue(containerName, []KeyValue{{CONFIG_KEY_BUILD_FINGERPRINT, fingerprint}}); err != nil {
+				return "", errors.Wrap(err, "save build fingerprint")
+			}
+			return fingerprint, nil
+		}
+		if time.Now().After(deadline) {
+			return "", errors.Wrap(err, "timeout reading build fingerprint")
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (v *VMM) readBuildFingerprint(containerName string) (string, error) {
+	if err := v.startADBDaemon(containerName); err != nil {
+		return "", err
+	}
+	resp, err := v.containerADBShell(containerName, "getprop ro.build.fingerprint")
+	if err != nil {
+		return "", err
+	}
+	fingerprint := strings.TrimSpace(resp.outBuffer.String())
+	if resp.ExitCode != 0 || fingerprint == "" {
+		return "", errors.New("getprop ro.build.fingerprint failed. output: " + strings.TrimSpace(resp.outBuffer.String()+resp.errBuffer.String()))
+	}
+	return fingerprint, nil
+}
+
 // VMGetAOSPVersion reads the "aosp_version" key of a container config.
 func (v *VMM) VMGetAOSPVersion(containerName string) (string, error) {
 	return v.KVStore.GetContainerValue(containerName, CONFIG_KEY_AOSP_VERSION)
 }
 
+// Maximum waiting time for the package manager of a VM that is still booting in VMInstallAPK
+var packageManagerTimeout = 2 * time.Minute
+
+// InstallAPKOptions customizes VMInstallAPKWithOptions.
+type InstallAPKOptions struct {
+	// Launch opens the main activity of the app after it's installed
+	Launch bool
+}
+
+// InstallAPKResult is the outcome of VMInstallAPKWithOptions. A failed launch doesn't fail the install.
+type InstallAPKResult struct {
+	PackageName string `json:"package_name"` // empty if it couldn't be read from the APK
+	Launched    bool   `json:"launched"`
+	LaunchError string `json:"launch_error,omitempty"`
+}
+
+// VMInstallAPKWithOptions is the same as VMInstallAPK but accepts additional settings in opts.
+func (v *VMM) VMInstallAPKWithOptions(containerName string, apkFile string, opts InstallAPKOptions) (InstallAPKResult, error) {
+	packageName, err := v.VMInstallAPK(containerName, apkFile)
+	if err != nil {
+		return InstallAPKResult{}, err
+	}
+	result := InstallAPKResult{PackageName: packageName}
+	if !opts.Launch {
+		return result, nil
+	}
+	if packageName == "" {
+		result.LaunchError = "unknown package name"
+	} else if err := v.VMLaunchApp(containerName, packageName); err != nil {
+		result.LaunchError = err.Error()
+	} else {
+		result.Launched = true
+	}
+	return result, nil
+}
+
+// VMLaunchApp opens the launcher activity of an installed app.
+func (v *VMM) VMLaunchApp(containerName string, packageName string) error {
+	if err := validatePackageName(packageName); err != nil {
+		return err
+	}
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	// monkey picks the activity of the LAUNCHER category so that the caller doesn't need to know its name
+	resp, err := v.containerADBShell(containerName, "monkey -p "+packageName+" -c android.intent.category.LAUNCHER 1")
+	if err != nil {
+		return errors.Wrap(err, "adb shell monkey")
+	}
+	output := resp.outBuffer.String() + resp.errBuffer.String()
+	// monkey exits with 0 even if there's no launchable activity
+	if resp.ExitCode != 0 || strings.Contains(output, "No activities found") || strings.Contains(output, "monkey aborted") {
+		return errors.New("failed to launch " + packageName + ". output: " + strings.TrimSpace(output))
+	}
+	log.Printf("VMLaunchApp (%s): launched %s\n", containerName, packageName)
+	return nil
+}
+
 // VMInstallAPK attempts to start an ADB daemon in the container and installs an apkFile on the VM.
 // The apkFile should have been placed in the VM's deviceFolder. In the event that an ADB daemon
 // is already running, calling startADBDaemon should have no effects.
-func (v *VMM) VMInstallAPK(containerName string, apkFile string) error {
+//
+// The install waits for the package manager if the VM has just booted. The package name of the APK is returned, or
+// an empty string if it can't be read from the APK's manifest.
+func (v *VMM) VMInstallAPK(containerName string, apkFile string) (string, error) {
 	if err := v.isManagedRunningContainer(containerName); err != nil {
-		return err
+		return "", err
+	}
+	unlock, err := v.lockVM(containerName, "install")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	f := path.Join(v.DevicesDir, containerName, apkFile)
+	if _, err := os.Stat(f); os.IsNotExist(err) {
+		log.Printf("VMInstallAPK (%s): abort installAPK because %s does not exist", containerName, f)
+		return "", fmt.Errorf("apk file %s does not exist", apkFile)
+	}
+	// ADB daemon may have been terminated at this point so let's bring it up
+	err = v.startADBDaemon(containerName)
+	if err != nil {
+		return "", errors.Wrap(err, "startADBDaemon")
+	}
+	if err := v.waitForPackageManager(containerName, time.Now().Add(packageManagerTimeout)); err != nil {
+		return "", err
+	}
+	resp, err := v.containerExecLong(containerName, "adb install \"/data/"+apkFile+"\"", "vsoc-01")
+	if err != nil {
+		return "", errors.Wrap(err, "adb install failed")
+	}
+	if resp.ExitCode != 0 {
+		return "", errors.New("non-zero exit in installAPK: " + resp.errBuffer.String())
+	}
+	packageName, err := APKPackageName(f)
+	if err != nil {
+		// adb has accepted the APK so it's only the manifest parser that fails
+		log.Printf("VMInstallAPK (%s): installed %s but failed to read its package name. error: %v\n", containerName, apkFile, err)
+		return "", nil
+	}
+	return packageName, nil
+}
+
+// waitForPackageManager polls the VM until `pm` answers, or returns an error when the deadline is reached.
+func (v *VMM) waitForPackageManager(containerName string, deadline time.Time) error {
+	for {
+		resp, err := v.containerADBShell(containerName, "pm path android")
+		if err == nil && resp.ExitCode == 0 && strings.HasPrefix(strings.TrimSpace(resp.outBuffer.String()), "package:") {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("timeout waiting for the package manager")
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// VMResetADBServer restarts the adb server in the container and reconnects to the VM.
+// It recovers from the situation where the adb server is wedged and every adb command hangs.
+func (v *VMM) VMResetADBServer(containerName string) error {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	// kill-server also terminates adb clients that are stuck waiting for the server
+	resp, err := v.containerExecWithTimeout(containerName, "adb kill-server", "root", ADBCommandTimeout)
+	if err != nil {
+		return errors.Wrap(err, "adb kill-server")
+	}
+	if resp.ExitCode != 0 {
+		// the server may not be running at all, which is fine
+		log.Printf("VMResetADBServer (%s): adb kill-server stderr:%s\n", containerName, resp.errBuffer.String())
+	}
+	// adb connect starts a new adb server
+	return v.startADBDaemon(containerName)
+}
+
+// VMGetForegroundActivity returns the component name (e.g. com.android.settings/.Settings) of the activity
+// currently resumed on the VM's screen.
+func (v *VMM) VMGetForegroundActivity(containerName string) (string, error) {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return "", err
+	}
+	// Android 10 prints mResumedActivity while newer releases print topResumedActivity/ResumedActivity
+	resp, err := v.containerADBShell(containerName, "dumpsys activity activities | grep -E 'mResumedActivity|ResumedActivity'")
+	if err != nil {
+		return "", errors.Wrap(err, "adb shell dumpsys")
+	}
+	if resp.ExitCode != 0 {
+		return "", errors.New("failed to get resumed activity. stderr:" + resp.errBuffer.String())
+	}
+	return parseResumedActivity(resp.outBuffer.String())
+}
+
+// parseResumedActivity extracts the component name from the output of `dumpsys activity activities`, e.g.
+//
+//  mResumedActivity: ActivityRecord{9e4f3a5 u0 com.android.launcher3/.Launcher t6}
+func parseResumedActivity(dumpsys string) (string, error) {
+	re := regexp.MustCompile(`ResumedActivity.*\{\S+ u\d+ (\S+/\S+)`)
+	match := re.FindStringSubmatch(dumpsys)
+	if match == nil {
+		return "", errors.New("no resumed activity found")
+	}
+	return match[1], nil
+}
+
+// VMClearAppData resets an app to its first-run state with `pm clear`, which deletes its data and cache.
+func (v *VMM) VMClearAppData(containerName string, packageName string) error {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	if err := validatePackageName(packageName); err != nil {
+		return err
+	}
+	resp, err := v.containerADBShell(containerName, "pm clear "+packageName)
+	if err != nil {
+		return errors.Wrap(err, "adb shell pm clear")
+	}
+	// pm prints "Success" and may still exit with 0 on failures, e.g. for an unknown package
+	output := strings.TrimSpace(resp.outBuffer.String() + resp.errBuffer.String())
+	if resp.ExitCode != 0 || !strings.Contains(output, "Success") {
+		return errors.New("failed to clear data of " + packageName + ". output: " + output)
+	}
+	log.Printf("VMClearAppData (%s): cleared data of %s\n", containerName, packageName)
+	return nil
+}
+
+// VMStopApp kills all processes of an app with `am force-stop`.
+func (v *VMM) VMStopApp(containerName string, packageName string) error {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	if err := validatePackageName(packageName); err != nil {
+		return err
+	}
+	// force-stop silently succeeds for unknown packages, so check that the package exists first
+	resp, err := v.containerADBShell(containerName, "pm path "+packageName)
+	if err != nil {
+		return errors.Wrap(err, "adb shell pm path")
+	}
+	if resp.ExitCode != 0 || strings.TrimSpace(resp.outBuffer.String()) == "" {
+		return errors.New("unknown package " + packageName + ". output: " + strings.TrimSpace(resp.errBuffer.String()))
+	}
+	resp, err = v.containerADBShell(containerName, "am force-stop "+packageName)
+	if err != nil {
+		return errors.Wrap(err, "adb shell am force-stop")
+	}
+	if resp.ExitCode != 0 {
+		return errors.New("failed to stop " + packageName + ". output: " + strings.TrimSpace(resp.outBuffer.String()+resp.errBuffer.String()))
+	}
+	log.Printf("VMStopApp (%s): stopped %s\n", containerName, packageName)
+	return nil
+}
+
+// VMSetBattery overrides the battery level (0-100) and charging state reported to apps, e.g. to test low battery
+// behaviors. The override stays until VMResetBattery or a reboot.
+func (v *VMM) VMSetBattery(containerName string, level int, charging bool) error {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	if level < 0 || level > 100 {
+		return fmt.Errorf("invalid battery level %d, must be between 0 and 100", level)
+	}
+	// BatteryManager.BATTERY_STATUS_CHARGING = 2, BATTERY_STATUS_DISCHARGING = 3
+	ac, status := 0, 3
+	if charging {
+		ac, status = 1, 2
+	}
+	cmd := fmt.Sprintf("dumpsys battery set level %d && dumpsys battery set ac %d && dumpsys battery set status %d", level, ac, status)
+	resp, err := v.containerADBShell(containerName, cmd)
+	if err != nil {
+		return errors.Wrap(err, "adb shell dumpsys battery")
+	}
+	if resp.ExitCode != 0 {
+		return errors.New("failed to set battery. output: " + strings.TrimSpace(resp.outBuffer.String()+resp.errBuffer.String()))
+	}
+	log.Printf("VMSetBattery (%s): level %d charging %v\n", containerName, level, charging)
+	return nil
+}
+
+// VMResetBattery removes the overrides of VMSetBattery so that the real battery state of the VM is reported again.
+func (v *VMM) VMResetBattery(containerName string) error {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	resp, err := v.containerADBShell(containerName, "dumpsys battery reset")
+	if err != nil {
+		return errors.Wrap(err, "adb shell dumpsys battery reset")
+	}
+	if resp.ExitCode != 0 {
+		return errors.New("failed to reset battery. output: " + strings.TrimSpace(resp.outBuffer.String()+resp.errBuffer.String()))
+	}
+	return nil
+}
+
+// ScreenState is the wakefulness of the guest as reported by `dumpsys power`
+type ScreenState string
+
+const (
+	ScreenAwake    ScreenState = "Awake"
+	ScreenAsleep   ScreenState = "Asleep"
+	ScreenDozing   ScreenState = "Dozing"
+	ScreenDreaming ScreenState = "Dreaming"
+)
+
+// Maximum waiting time for the screen state to change after a key event
+var screenStateTimeout = 3 * time.Second
+
+// VMGetScreenState returns the current ScreenState of the guest.
+func (v *VMM) VMGetScreenState(containerName string) (ScreenState, error) {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return "", err
+	}
+	resp, err := v.containerADBShell(containerName, "dumpsys power | grep mWakefulness=")
+	if err != nil {
+		return "", errors.Wrap(err, "adb shell dumpsys power")
+	}
+	state, ok := parseWakefulness(resp.outBuffer.String())
+	if !ok {
+		return "", errors.New("failed to get the screen state. output: " + strings.TrimSpace(resp.outBuffer.String()+resp.errBuffer.String()))
+	}
+	return state, nil
+}
+
+// parseWakefulness parses the state in a "mWakefulness=Awake" line of `dumpsys power`
+func parseWakefulness(output string) (ScreenState, bool) {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "mWakefulness=") {
+			return ScreenState(strings.TrimPrefix(line, "mWakefulness=")), true
+		}
+	}
+	return "", false
+}
+
+// VMScreenOff turns off the screen of the guest, e.g. to test doze behaviors, and returns the resulting state.
+func (v *VMM) VMScreenOff(containerName string) (ScreenState, error) {
+	state, err := v.VMGetScreenState(containerName)
+	if err != nil {
+		return "", err
+	}
+	// KEYCODE_POWER toggles the screen, so it's only sent if the screen is on
+	if state != ScreenAwake {
+		return state, nil
+	}
+	if err := v.sendKeyEvent(containerName, "KEYCODE_POWER"); err != nil {
+		return "", err
+	}
+	return v.waitForScreenState(containerName, func(s ScreenState) bool { return s != ScreenAwake })
+}
+
+// VMScreenOn turns on the screen of the guest, which stays on the lock screen if there is one, and returns the
+// resulting state.
+func (v *VMM) VMScreenOn(containerName string) (ScreenState, error) {
+	if err := v.sendKeyEvent(containerName, "KEYCODE_WAKEUP"); err != nil {
+		return "", err
+	}
+	return v.waitForScreenState(containerName, func(s ScreenState) bool { return s == ScreenAwake })
+}
+
+// VMWake turns on the screen of the guest and dismisses the lock screen if it isn't secured by a credential, and
+// returns the resulting state.
+func (v *VMM) VMWake(containerName string) (ScreenState, error) {
+	state, err := v.VMScreenOn(containerName)
+	if err != nil {
+		return "", err
+	}
+	resp, err := v.containerADBShell(containerName, "wm dismiss-keyguard")
+	if err != nil {
+		return "", errors.Wrap(err, "adb shell wm dismiss-keyguard")
+	}
+	if resp.ExitCode != 0 {
+		return "", errors.New("failed to dismiss the lock screen. output: " + strings.TrimSpace(resp.outBuffer.String()+resp.errBuffer.String()))
+	}
+	return state, nil
+}
+
+func (v *VMM) sendKeyEvent(containerName string, keycode string) error {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	resp, err := v.containerADBShell(containerName, "input keyevent "+keycode)
+	if err != nil {
+		return errors.Wrap(err, "adb shell input keyevent")
+	}
+	if resp.ExitCode != 0 {
+		return errors.New("failed to send " + keycode + ". output: " + strings.TrimSpace(resp.outBuffer.String()+resp.errBuffer.String()))
+	}
+	return nil
+}
+
+// waitForScreenState polls the screen state until done returns true or screenStateTimeout, and returns the last state.
+func (v *VMM) waitForScreenState(containerName string, done func(ScreenState) bool) (ScreenState, error) {
+	deadline := time.Now().Add(screenStateTimeout)
+	for {
+		state, err := v.VMGetScreenState(containerName)
+		if err != nil || done(state) || time.Now().After(deadline) {
+			return state, err
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
+
+var (
+	// BCP 47 language tags in the form accepted by persist.sys.locale, e.g. "en-US", "zh-Hant-TW" or "es-419"
+	localeRegex = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z][a-z]{3})?(-([A-Z]{2}|[0-9]{3}))?$`)
+	// Olson time zone IDs, e.g. "Asia/Singapore" or "America/Argentina/Buenos_Aires"
+	timezoneRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_+-]*(/[A-Za-z0-9_+-]+)*$`)
+)
+
+// VMSetLocale changes the system locale of the guest, e.g. "fr-FR". The Android framework is restarted to apply the
+// change, so apps are killed and the screen goes blank for a few seconds. An error is returned if the build doesn't
+// accept the locale.
+func (v *VMM) VMSetLocale(containerName string, locale string) error {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	if !localeRegex.MatchString(locale) {
+		return fmt.Errorf("invalid locale %q, expecting a language tag like en-US", locale)
+	}
+	resp, err := v.containerADBShell(containerName, fmt.Sprintf("su 0 setprop persist.sys.locale %s && getprop persist.sys.locale", locale))
+	if err != nil {
+		return errors.Wrap(err, "adb shell setprop persist.sys.locale")
+	}
+	if resp.ExitCode != 0 || strings.TrimSpace(resp.outBuffer.String()) != locale {
+		return errors.New("failed to set locale " + locale + ". output: " + strings.TrimSpace(resp.outBuffer.String()+resp.errBuffer.String()))
+	}
+	// the locale is only read when the framework starts
+	resp, err = v.containerADBShell(containerName, "su 0 setprop ctl.restart zygote")
+	if err != nil {
+		return errors.Wrap(err, "adb shell restart zygote")
+	}
+	if resp.ExitCode != 0 {
+		return errors.New("failed to restart the framework. output: " + strings.TrimSpace(resp.outBuffer.String()+resp.errBuffer.String()))
+	}
+	log.Printf("VMSetLocale (%s): %s\n", containerName, locale)
+	return nil
+}
+
+// VMSetTimezone changes the time zone of the guest, e.g. "Asia/Singapore", and turns off automatic time zone so that
+// it isn't changed back. An error is returned if the build doesn't know the time zone.
+func (v *VMM) VMSetTimezone(containerName string, tz string) error {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	if !timezoneRegex.MatchString(tz) {
+		return fmt.Errorf("invalid time zone %q, expecting an ID like Asia/Singapore", tz)
+	}
+	// `cmd alarm set-timezone` (Android 9+) goes through AlarmManagerService, which broadcasts the change to running
+	// apps. Older builds fall back to setting persist.sys.timezone directly, which takes effect for new processes.
+	// Unknown IDs and rejected changes leave the property as it was, hence the check with getprop.
+	cmd := fmt.Sprintf("settings put global auto_time_zone 0 && { cmd alarm set-timezone %s >/dev/null 2>&1 || setprop persist.sys.timezone %s; } && getprop persist.sys.timezone", tz, tz)
+	resp, err := v.containerADBShell(containerName, cmd)
+	if err != nil {
+		return errors.Wrap(err, "adb shell cmd alarm set-timezone")
+	}
+	if resp.ExitCode != 0 || strings.TrimSpace(resp.outBuffer.String()) != tz {
+		return errors.New("failed to set time zone " + tz + ". output: " + strings.TrimSpace(resp.outBuffer.String()+resp.errBuffer.String()))
+	}
+	log.Printf("VMSetTimezone (%s): %s\n", containerName, tz)
+	return nil
+}
+
+// validatePackageName checks a package name before it ends up in guest shell commands
+func validatePackageName(packageName string) error {
+	if match, _ := regexp.MatchString(`^[a-zA-Z][a-zA-Z0-9_]*(\.[a-zA-Z0-9_]+)+$`, packageName); !match {
+		return fmt.Errorf("%w %s", ErrInvalidPackageName, packageName)
+	}
+	return nil
+}
+
+// VMCaptureTrace sends SIGQUIT to a process on the VM, which makes the runtime dump the stack traces of all threads
+// (the same trace as an ANR), and saves the trace into the VM's device folder. The host path of the trace is returned.
+func (v *VMM) VMCaptureTrace(containerName string, processName string) (string, error) {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return "", err
+	}
+	pid, err := v.getGuestPid(containerName, processName)
+	if err != nil {
+		return "", err
+	}
+	resp, err := v.containerADBShell(containerName, "su 0 kill -3 "+pid)
+	if err != nil || resp.ExitCode != 0 {
+		return "", errors.Errorf("failed to send SIGQUIT to %s. err: %v stderr: %s", processName, err, resp.errBuffer)
+	}
+	// tombstoned writes the trace to /data/anr/trace_xx in the background
+	time.Sleep(2 * time.Second)
+	resp, err = v.containerADBShell(containerName, "su 0 ls -t /data/anr | head -n1")
+	if err != nil || resp.ExitCode != 0 {
+		return "", errors.Errorf("failed to find the trace file. err: %v stderr: %s", err, resp.errBuffer)
+	}
+	traceFile := strings.TrimSpace(resp.outBuffer.String())
+	if traceFile == "" {
+		return "", errors.New("no trace file found in /data/anr")
+	}
+	fileName := fmt.Sprintf("trace-%s-%s.txt", processName, time.Now().Format("20060102-150405"))
+	// the trace is only readable by root so use `su` instead of `adb pull`
+	serial, err := v.getADBSerial(containerName)
+	if err != nil {
+		return "", err
+	}
+	resp, err = v.containerExec(containerName, rootCopyScript(serial, path.Join("/data/anr", traceFile), path.Join("/data", fileName)), "root")
+	if err != nil || resp.ExitCode != 0 {
+		return "", errors.Errorf("failed to pull the trace file. err: %v stderr: %s", err, resp.errBuffer)
+	}
+	log.Printf("VMCaptureTrace (%s): saved trace of %s to %s\n", containerName, processName, fileName)
+	return path.Join(v.DevicesDir, containerName, fileName), nil
+}
+
+// VMCaptureHeapDump dumps the java heap of a process on the VM with `am dumpheap` and saves the hprof file into
+// the VM's device folder. The host path of the hprof file is returned.
+func (v *VMM) VMCaptureHeapDump(containerName string, processName string) (string, error) {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return "", err
+	}
+	if _, err := v.getGuestPid(containerName, processName); err != nil {
+		return "", err
+	}
+	fileName := fmt.Sprintf("heap-%s-%s.hprof", processName, time.Now().Format("20060102-150405"))
+	guestPath := path.Join("/data/local/tmp", fileName)
+	resp, err := v.containerADBShell(containerName, fmt.Sprintf("am dumpheap %s %s", processName, guestPath))
+	if err != nil || resp.ExitCode != 0 {
+		return "", errors.Errorf("failed to dump heap of %s. err: %v stderr: %s", processName, err, resp.errBuffer)
+	}
+	serial, err := v.getADBSerial(containerName)
+	if err != nil {
+		return "", err
+	}
+	resp, err = v.containerExecLong(containerName, fmt.Sprintf("adb -s %s pull %s %s", serial, guestPath, path.Join("/data", fileName)), "root")
+	if err != nil || resp.ExitCode != 0 {
+		return "", errors.Errorf("failed to pull the heap dump. err: %v stderr: %s", err, resp.errBuffer)
+	}
+	// best effort as the hprof file could be huge
+	v.containerADBShell(containerName, "rm "+guestPath)
+	log.Printf("VMCaptureHeapDump (%s): saved heap dump of %s to %s\n", containerName, processName, fileName)
+	return path.Join(v.DevicesDir, containerName, fileName), nil
+}
+
+// getGuestPid returns the pid of a process running on the VM. If there are multiple matches, the first one is returned.
+func (v *VMM) getGuestPid(containerName string, processName string) (string, error) {
+	// processName ends up in guest shell commands and file names
+	if match, _ := regexp.MatchString("^[a-zA-Z0-9._:-]+$", processName); !match {
+		return "", fmt.Errorf("invalid process name %s", processName)
+	}
+	resp, err := v.containerADBShell(containerName, "pidof "+processName)
+	if err != nil {
+		return "", errors.Wrap(err, "adb shell pidof")
+	}
+	pids := strings.Fields(resp.outBuffer.String())
+	if resp.ExitCode != 0 || len(pids) == 0 {
+		return "", fmt.Errorf("process %s is not running", processName)
+	}
+	return pids[0], nil
+}
+
+// FileInfo describes a file on the VM as listed by `ls -la`.
+type FileInfo struct {
+	Name       string `json:"name"`
+	Mode       string `json:"mode"` // e.g. drwxr-xr-x
+	Owner      string `json:"owner"`
+	Group      string `json:"group"`
+	Size       int64  `json:"size"`     // 0 for device files
+	Modified   string `json:"modified"` // e.g. 2022-02-18 11:32, in the VM's timezone
+	IsDir      bool   `json:"is_dir"`
+	LinkTarget string `json:"link_target,omitempty"`
+}
+
+// ErrDockerUnresponsive is returned by CheckDocker, and the calls that use it, when the Docker daemon doesn't respond.
+var ErrDockerUnresponsive = errors.New("docker daemon unresponsive")
+
+// Maximum waiting time for CheckDocker
+var dockerPingTimeout = 2 * time.Second
+
+// CheckDocker pings the Docker daemon and returns ErrDockerUnresponsive if it doesn't answer within
+// dockerPingTimeout. A running container doesn't mean the daemon is healthy, and calls to a degraded daemon can
+// hang for minutes.
+func (v *VMM) CheckDocker() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerPingTimeout)
+	defer cancel()
+	if _, err := v.Client.Ping(ctx); err != nil {
+		return errors.Wrap(ErrDockerUnresponsive, err.Error())
+	}
+	return nil
+}
+
+// ErrVMExists is returned by VMCreate when a VM of the same name already exists.
+var ErrVMExists = errors.New("a VM of the same name already exists")
+
+// ErrVMAlreadyRunning is returned by VMStart when launch_cvd is already running in the container.
+var ErrVMAlreadyRunning = errors.New("VM already running")
+
+// ErrVMNotRunning is returned by the operations that need a running VM container.
+var ErrVMNotRunning = errors.New("container not running")
+
+// ErrInvalidPackageName is returned when a package name isn't valid, before it's passed to the guest.
+var ErrInvalidPackageName = errors.New("invalid package name")
+
+// ErrPermissionDenied is returned when a guest path can't be accessed even as root.
+var ErrPermissionDenied = errors.New("permission denied")
+
+// matches a line of `ls -la` on Android, e.g.
+//
+//	drwxr-xr-x  24 root   root      4096 2022-02-18 11:32 acct
+//	crw-rw-rw-   1 root   root    1,   3 2022-02-18 11:32 null
+var lsLineRegex = regexp.MustCompile(`^([-dlcbsp][-rwxsStT]{9}\S*)\s+\d+\s+(\S+)\s+(\S+)\s+(\d+|\d+,\s*\d+)\s+(\d{4}-\d{2}-\d{2} \d{2}:\d{2})\s(.+)$`)
+
+// VMListGuestFiles lists a folder on the VM. Paths that are not readable by the shell user (e.g. /data) are listed
+// as root, which requires a userdebug or eng build.
+func (v *VMM) VMListGuestFiles(containerName string, guestPath string) ([]FileInfo, error) {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return nil, err
+	}
+	if !path.IsAbs(guestPath) {
+		return nil, fmt.Errorf("invalid guest path %s", guestPath)
+	}
+	// the trailing slash lists the content of a symlinked folder like /sdcard instead of the link itself
+	cmd := "ls -la " + shellQuote(strings.TrimSuffix(path.Clean(guestPath), "/")+"/")
+	resp, err := v.containerADBShell(containerName, cmd)
+	if err != nil {
+		return nil, errors.Wrap(err, "adb shell ls")
+	}
+	if resp.ExitCode != 0 && isPermissionDenied(resp.errBuffer.String()) {
+		resp, err = v.containerADBShell(containerName, "su 0 "+cmd)
+		if err != nil {
+			return nil, errors.Wrap(err, "adb shell su 0 ls")
+		}
+	}
+	files := parseLsOutput(resp.outBuffer.String())
+	// ls still exits with 1 if only some of the entries can't be read, so only fail if nothing is listed
+	if resp.ExitCode != 0 && len(files) == 0 {
+		stderr := strings.TrimSpace(resp.errBuffer.String())
+		if isPermissionDenied(stderr) {
+			return nil, errors.Wrap(ErrPermissionDenied, guestPath)
+		}
+		return nil, errors.New("failed to list " + guestPath + ". stderr: " + stderr)
+	}
+	return files, nil
+}
+
+// rootCopyScript returns a script that copies guestPath on the guest to dst in the container with `su 0 cat`, for files
+// that `adb pull` can't read. `adb exec-out` doesn't forward the exit status of cat and the redirect creates dst even
+// if su or cat fails, so dst is checked against the size of guestPath, and removed if the copy failed.
+func rootCopyScript(serial string, guestPath string, dst string) string {
+	// quoted twice as the guest's shell parses the command again
+	remote := shellQuote(shellQuote(guestPath))
+	return fmt.Sprintf(`size=$(adb -s %s shell su 0 stat -c %%s %s) || exit 1; size=$(echo "$size" | tr -d '\r'); `+
+		`adb -s %s exec-out su 0 cat %s > %s && [ -n "$size" ] && [ "$(stat -c %%s %s)" = "$size" ] || { rm -f %s; exit 1; }`,
+		serial, remote, serial, remote, shellQuote(dst), shellQuote(dst), shellQuote(dst))
+}
+
+func isPermissionDenied(stderr string) bool {
+	// `su` prints "Permission denied" on user builds and toybox ls prints "Permission denied" or "EACCES"
+	return strings.Contains(stderr, "Permission denied") || strings.Contains(stderr, "EACCES")
+}
+
+// parseLsOutput parses the output of toybox `ls -la` into FileInfo. The total line, "." and ".." are skipped.
+func parseLsOutput(out string) []FileInfo {
+	files := []FileInfo{}
+	for _, line := range strings.Split(out, "\n") {
+		match := lsLineRegex.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if match == nil {
+			continue
+		}
+		f := FileInfo{
+			Mode:     match[1],
+			Owner:    match[2],
+			Group:    match[3],
+			Modified: match[5],
+			Name:     match[6],
+			IsDir:    match[1][0] == 'd',
+		}
+		// device files show "major, minor" instead of a size
+		f.Size, _ = strconv.ParseInt(match[4], 10, 64)
+		if match[1][0] == 'l' {
+			if parts := strings.SplitN(f.Name, " -> ", 2); len(parts) == 2 {
+				f.Name, f.LinkTarget = parts[0], parts[1]
+			}
+		}
+		if f.Name == "." || f.Name == ".." {
+			continue
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// VMPullGuestFile copies a file from the VM to the VM's device folder, from where it can be downloaded, and returns
+// the host path of the copy. Files that are not readable by the shell user are read as root. The copy is named
+// pulled-<time>-<name> so that it can't overwrite the VM's own files in the device folder, e.g. boot.img.
+func (v *VMM) VMPullGuestFile(containerName string, guestPath string) (string, error) {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return "", err
+	}
+	if !path.IsAbs(guestPath) || path.Base(guestPath) == "/" {
+		return "", fmt.Errorf("invalid guest path %s", guestPath)
+	}
+	serial, err := v.getADBSerial(containerName)
+	if err != nil {
+		return "", err
+	}
+	fileName := fmt.Sprintf("pulled-%s-%s", time.Now().Format("20060102-150405"), path.Base(guestPath))
+	if _, err := os.Stat(path.Join(v.DevicesDir, containerName, fileName)); err == nil {
+		return "", fmt.Errorf("%s already exists, try again later", fileName)
+	}
+	dst := path.Join(DeviceDir, fileName)
+	resp, err := v.containerExecLong(containerName, fmt.Sprintf("adb -s %s pull %s %s", serial, shellQuote(guestPath), shellQuote(dst)), "root")
+	if err != nil {
+		return "", errors.Wrap(err, "adb pull")
+	}
+	if resp.ExitCode != 0 && isPermissionDenied(resp.errBuffer.String()+resp.outBuffer.String()) {
+		// same as VMCaptureTrace, `adb pull` can't run as root on the guest
+		resp, err = v.containerExecLong(containerName, rootCopyScript(serial, guestPath, dst), "root")
+		if err != nil {
+			return "", errors.Wrap(err, "adb exec-out su 0 cat")
+		}
+		if resp.ExitCode != 0 {
+			return "", errors.Wrap(ErrPermissionDenied, guestPath)
+		}
+	}
+	if resp.ExitCode != 0 {
+		return "", errors.Errorf("failed to pull %s. stderr: %s", guestPath, resp.errBuffer.String()+resp.outBuffer.String())
+	}
+	log.Printf("VMPullGuestFile (%s): pulled %s to %s\n", containerName, guestPath, fileName)
+	return path.Join(v.DevicesDir, containerName, fileName), nil
+}
+
+// VMPushGuestFile copies a file in the VM's device folder (e.g. uploaded through the API) to guestPath on the VM.
+func (v *VMM) VMPushGuestFile(containerName string, fileName string, guestPath string) error {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	if fileName != path.Base(fileName) || fileName == "." || fileName == ".." {
+		return fmt.Errorf("invalid file name %s", fileName)
+	}
+	if !path.IsAbs(guestPath) {
+		return fmt.Errorf("invalid guest path %s", guestPath)
+	}
+	serial, err := v.getADBSerial(containerName)
+	if err != nil {
+		return err
+	}
+	resp, err := v.containerExecLong(containerName, fmt.Sprintf("adb -s %s push %s %s", serial,
+		shellQuote(path.Join("/data", fileName)), shellQuote(guestPath)), "root")
+	if err != nil {
+		return errors.Wrap(err, "adb push")
+	}
+	if resp.ExitCode != 0 {
+		output := resp.errBuffer.String() + resp.outBuffer.String()
+		if isPermissionDenied(output) {
+			return errors.Wrap(ErrPermissionDenied, guestPath)
+		}
+		return errors.New("failed to push " + fileName + ". stderr: " + output)
+	}
+	log.Printf("VMPushGuestFile (%s): pushed %s to %s\n", containerName, fileName, guestPath)
+	return nil
+}
+
+// ProcessInfo describes a process on the VM as listed by `ps -A`.
+type ProcessInfo struct {
+	User  string `json:"user"`
+	PID   int    `json:"pid"`
+	PPID  int    `json:"ppid"`
+	VSZ   int64  `json:"vsz"` // virtual memory size in KB
+	RSS   int64  `json:"rss"` // resident set size in KB
+	State string `json:"state"`
+	Name  string `json:"name"`
+}
+
+// VMListGuestProcesses lists the processes of all users on the VM.
+func (v *VMM) VMListGuestProcesses(containerName string) ([]ProcessInfo, error) {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return nil, err
+	}
+	resp, err := v.containerADBShell(containerName, "ps -A")
+	if err != nil {
+		return nil, errors.Wrap(err, "adb shell ps")
+	}
+	if resp.ExitCode != 0 {
+		return nil, errors.New("failed to list processes. stderr: " + resp.errBuffer.String())
+	}
+	return parsePsOutput(resp.outBuffer.String()), nil
+}
+
+// parsePsOutput parses the output of toybox `ps -A`, e.g.
+//
+//	USER            PID   PPID     VSZ    RSS WCHAN            ADDR S NAME
+//	root              1      0 10782796  9920 do_epoll_wait       0 S init
+func parsePsOutput(out string) []ProcessInfo {
+	processes := []ProcessInfo{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 9 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			// the header
+			continue
+		}
+		ppid, _ := strconv.Atoi(fields[2])
+		vsz, _ := strconv.ParseInt(fields[3], 10, 64)
+		rss, _ := strconv.ParseInt(fields[4], 10, 64)
+		processes = append(processes, ProcessInfo{
+			User:  fields[0],
+			PID:   pid,
+			PPID:  ppid,
+			VSZ:   vsz,
+			RSS:   rss,
+			State: fields[7],
+			Name:  strings.Join(fields[8:], " "),
+		})
+	}
+	return processes
+}
+
+// VMKillGuestProcess sends SIGKILL to a process on the VM as root.
+func (v *VMM) VMKillGuestProcess(containerName string, pid int) error {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	// pid 1 is init, killing it panics the guest kernel
+	if pid <= 1 {
+		return fmt.Errorf("invalid pid %d", pid)
+	}
+	resp, err := v.containerADBShell(containerName, fmt.Sprintf("su 0 kill -9 %d", pid))
+	if err != nil {
+		return errors.Wrap(err, "adb shell kill")
+	}
+	if resp.ExitCode != 0 {
+		return errors.New("failed to kill process " + strconv.Itoa(pid) + ". output: " + strings.TrimSpace(resp.outBuffer.String()+resp.errBuffer.String()))
+	}
+	log.Printf("VMKillGuestProcess (%s): killed %d\n", containerName, pid)
+	return nil
+}
+
+// Host pinged by VMGuestHasNetwork
+var GuestNetworkCheckHost = "8.8.8.8"
+
+// hosts checked by VMCheckGuestNetwork end up in a guest shell command
+var networkHostRegex = regexp.MustCompile(`^[a-zA-Z0-9.:-]+$`)
+
+// GuestNetworkStatus is the result of VMCheckGuestNetwork.
+type GuestNetworkStatus struct {
+	Host      string `json:"host"`
+	Reachable bool   `json:"reachable"` // whether Host answers a ping from the guest
+	// whether the guest has a default route, i.e. the guest's own network is up
+	DefaultRoute bool `json:"default_route"`
+	// DNS servers in net.dns1 and net.dns2, which are empty on recent Android versions that keep them in netd
+	DNS []string `json:"dns"`
+}
+
+// VMGuestHasNetwork checks if the VM can reach GuestNetworkCheckHost.
+func (v *VMM) VMGuestHasNetwork(containerName string) (bool, error) {
+	status, err := v.VMCheckGuestNetwork(containerName, GuestNetworkCheckHost)
+	return status.Reachable, err
+}
+
+// VMCheckGuestNetwork pings host (an IP address or a host name) from the VM and collects the guest's network
+// settings, to tell a guest without network apart from a host that can't be reached or resolved.
+func (v *VMM) VMCheckGuestNetwork(containerName string, host string) (GuestNetworkStatus, error) {
+	status := GuestNetworkStatus{Host: host, DNS: []string{}}
+	if !networkHostRegex.MatchString(host) {
+		return status, fmt.Errorf("invalid host %s", host)
 	}
-	f := path.Join(v.DevicesDir, containerName, apkFile)
-	if _, err := os.Stat(f); os.IsNotExist(err) {
-		log.Printf("VMInstallAPK (%s): abort installAPK because %s does not exist", containerName, f)
-		return fmt.Errorf("apk file %s does not exist", apkFile)
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return status, err
 	}
-	// ADB daemon may have been terminated at this point so let's bring it up
-	err := v.startADBDaemon(containerName)
+	// a failed ping exits with non-zero, which is an answer rather than an error
+	resp, err := v.containerADBShell(containerName, "ping -c1 -W2 "+host)
 	if err != nil {
-		return errors.Wrap(err, "startADBDaemon")
+		return status, errors.Wrap(err, "adb shell ping")
 	}
-	resp, err := v.containerExec(containerName, "adb install \"/data/"+apkFile+"\"", "vsoc-01")
+	status.Reachable = resp.ExitCode == 0
+	resp, err = v.containerADBShell(containerName, "ip route show table all")
 	if err != nil {
-		return errors.Wrap(err, "adb install failed")
+		return status, errors.Wrap(err, "adb shell ip route")
 	}
-	if resp.ExitCode != 0 {
-		return errors.New("non-zero exit in installAPK: " + resp.errBuffer.String())
+	status.DefaultRoute = strings.Contains(resp.outBuffer.String(), "default")
+	for _, prop := range []string{"net.dns1", "net.dns2"} {
+		resp, err := v.containerADBShell(containerName, "getprop "+prop)
+		if err != nil {
+			return status, errors.Wrap(err, "adb shell getprop")
+		}
+		if dns := strings.TrimSpace(resp.outBuffer.String()); dns != "" {
+			status.DNS = append(status.DNS, dns)
+		}
 	}
-	return nil
+	return status, nil
 }
 
 // ContainerAttachToTerminal starts a bash shell in the container and returns a bi-directional stream for the frontend to interact with.
 // It's up to the caller to close the hijacked connection by calling types.HijackedResponse.Close.
-// It's up to the caller to call KillTerminal() to kill the long running process at exit
+// It's up to the caller to call ContainerKillExec() to kill the long running process at exit
 func (v *VMM) ContainerAttachToTerminal(containerName string) (ir types.IDResponse, hr types.HijackedResponse, err error) {
 	if err := v.isManagedRunningContainer(containerName); err != nil {
 		return types.IDResponse{}, types.HijackedResponse{}, err
@@ -627,7 +3275,7 @@ func (v *VMM) ContainerAttachToTerminal(containerName string) (ir types.IDRespon
 // ContainerAttachToProcess starts a long running process with TTY and returns a bi-directional stream for the frontend to interact with.
 // Notice:
 //  - It's up to the caller to close the hijacked connection by calling types.HijackedResponse.Close.
-//  - It's up to the caller to call KillTerminal() to kill the long running process at exit. (see reason below)
+//  - It's up to the caller to call ContainerKillExec() to kill the long running process at exit. (see reason below)
 //
 // Explanation: types.HijackedResponse.Close only calls HijackedResponse.Conn.Close() which leaves the process in the
 // container to run forever. Moby's implementation of ContainerExecStart only terminates the process when either
@@ -646,19 +3294,30 @@ func (v *VMM) ContainerAttachToProcess(containerName string, cmd []string, env [
 	if err := v.isManagedRunningContainer(containerName); err != nil {
 		return types.IDResponse{}, types.HijackedResponse{}, err
 	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return types.IDResponse{}, types.HijackedResponse{}, err
+	}
+	token := hex.EncodeToString(b)
 	ctx := context.Background()
 	ir, err := v.Client.ContainerExecCreate(ctx, containerName, types.ExecConfig{
 		User:         "vsoc-01",
 		AttachStdin:  true,
 		AttachStdout: true,
 		AttachStderr: true,
-		Cmd:          cmd,
+		Cmd:          execRecordCommand(execPidDir, token, cmd),
 		Tty:          true,
 		Env:          env,
 	})
 	if err != nil {
 		return types.IDResponse{}, types.HijackedResponse{}, errors.Wrap(err, "docker: failed to create an exec config")
 	}
+	v.execTokensMu.Lock()
+	if v.execTokens == nil {
+		v.execTokens = map[string]string{}
+	}
+	v.execTokens[ir.ID] = token
+	v.execTokensMu.Unlock()
 
 	hijackedResp, err := v.Client.ContainerExecAttach(ctx, ir.ID, types.ExecStartCheck{Detach: false, Tty: true})
 	if err != nil {
@@ -667,6 +3326,250 @@ func (v *VMM) ContainerAttachToProcess(containerName string, cmd []string, env [
 	return ir, hijackedResp, nil
 }
 
+// ContainerReleaseProcess tells that the caller of ContainerAttachToProcess is done with the process of execID, after
+// which the process is considered stale by VMCleanupStaleExecs if it's still running.
+func (v *VMM) ContainerReleaseProcess(execID string) {
+	v.execTokensMu.Lock()
+	delete(v.execTokens, execID)
+	v.execTokensMu.Unlock()
+}
+
+// Folder in the container where each process started by ContainerAttachToProcess records its pid and start time, in
+// a file named after its token, so that VMCleanupStaleExecs kills exactly that process and not its children.
+const execPidDir = "/tmp/matrisea-exec"
+
+var execTokenRegex = regexp.MustCompile("^[0-9a-f]+$")
+
+// How often execJanitor looks for stale processes
+var staleExecCleanupInterval = 10 * time.Minute
+
+// VMCleanupStaleExecs kills the processes started by ContainerAttachToProcess (e.g. bash or tail -f) that are no longer
+// in use, and returns the number of killed processes. A process is in use until ContainerReleaseProcess is called, so
+// processes left behind by a crashed handler or a previous API server are killed, while the ones of kept-alive
+// terminal sessions are not. Processes started from a terminal, e.g. in the background, are left running.
+func (v *VMM) VMCleanupStaleExecs(containerName string) (int, error) {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return 0, err
+	}
+	resp, err := v.containerExec(containerName, "ls "+execPidDir+" 2>/dev/null; true", "root")
+	if err != nil {
+		return 0, errors.Wrap(err, "containerExec list processes")
+	}
+	// taken after the listing so that a process started in between is seen as in use
+	active := map[string]bool{}
+	v.execTokensMu.Lock()
+	for _, token := range v.execTokens {
+		active[token] = true
+	}
+	v.execTokensMu.Unlock()
+
+	stale := []string{}
+	for _, token := range strings.Fields(resp.outBuffer.String()) {
+		if execTokenRegex.MatchString(token) && !active[token] {
+			stale = append(stale, token)
+		}
+	}
+	if len(stale) == 0 {
+		return 0, nil
+	}
+	resp, err = v.containerExec(containerName, killExecsScript(execPidDir, stale), "root")
+	if err != nil {
+		return 0, errors.Wrap(err, "containerExec kill")
+	}
+	killed := strings.Fields(resp.outBuffer.String())
+	if len(killed) > 0 {
+		log.Printf("VMCleanupStaleExecs (%s): killed %v\n", containerName, killed)
+	}
+	return len(killed), nil
+}
+
+// execRecordCommand wraps cmd so that it records its pid and start time in dir/token before it starts. The shell
+// replaces itself with cmd, so the recorded pid is the pid of cmd. cmd still runs if the record can't be written.
+func execRecordCommand(dir string, token string, cmd []string) []string {
+	script := fmt.Sprintf(`mkdir -p %s 2>/dev/null; `+
+		`echo "$$ $(sed 's/.*) //' /proc/$$/stat | cut -d' ' -f20)" 2>/dev/null > %s/$0; exec "$@"`, dir, dir)
+	return append([]string{"sh", "-c", script, token}, cmd...)
+}
+
+// killExecsScript returns a script that kills the processes recorded in dir by execRecordCommand under tokens, and
+// prints their pids. A process is only killed if its start time matches the record, in case the pid has been reused
+// after it exited. The records are removed.
+func killExecsScript(dir string, tokens []string) string {
+	return fmt.Sprintf(`for t in %s; do f=%s/$t; `+
+		`if read pid start 2>/dev/null < "$f"; then `+
+		`[ "$(sed 's/.*) //' /proc/$pid/stat 2>/dev/null | cut -d' ' -f20)" = "$start" ] && kill -9 $pid && echo $pid; `+
+		`fi; rm -f "$f"; done; true`, strings.Join(tokens, " "), dir)
+}
+
+// execJanitor periodically runs VMCleanupStaleExecs on all running containers.
+func (v *VMM) execJanitor() {
+	go func() {
+		for {
+			time.Sleep(staleExecCleanupInterval)
+			containers, err := v.listCuttlefishContainers()
+			if err != nil {
+				log.Printf("execJanitor: failed to list containers. error: %v\n", err)
+				continue
+			}
+			for _, c := range containers {
+				if c.State != "running" {
+					continue
+				}
+				if _, err := v.VMCleanupStaleExecs(c.Names[0][1:]); err != nil {
+					log.Printf("execJanitor: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// How often reaper looks for exited containers
+var reapInterval = 10 * time.Minute
+
+// Folder in DevicesDir where VMReap archives the logs of removed containers, as device folders are removed with them
+const ReapedLogsDir = "reaped"
+
+// VMReap removes the containers that have been exited or dead (e.g. crashed out of docker's view) for longer than
+// olderThan. The logs of each container (see LogSources) are first copied to DevicesDir/ReapedLogsDir. With dryRun,
+// VMReap only reports the containers to be removed.
+func (v *VMM) VMReap(olderThan time.Duration, dryRun bool) (PruneResult, error) {
+	result := PruneResult{Removed: []string{}, Failed: map[string]string{}}
+	containers, err := v.listCuttlefishContainers()
+	if err != nil {
+		return result, err
+	}
+	for _, c := range containers {
+		if c.State != "exited" && c.State != "dead" {
+			continue
+		}
+		containerName := c.Names[0][1:]
+		cjson, err := v.getContainerJSON(containerName)
+		if err != nil {
+			result.Failed[containerName] = err.Error()
+			continue
+		}
+		// zero for containers that never ran, which are reaped as well
+		finishedAt, err := time.Parse(time.RFC3339Nano, cjson.State.FinishedAt)
+		if err != nil || time.Since(finishedAt) < olderThan {
+			continue
+		}
+		if dryRun {
+			result.Removed = append(result.Removed, containerName)
+			continue
+		}
+		if dir, err := v.archiveLogs(containerName); err != nil {
+			log.Printf("VMReap (%s): failed to archive logs, removing anyway. reason: %v\n", containerName, err)
+		} else {
+			log.Printf("VMReap (%s): archived logs to %s\n", containerName, dir)
+		}
+		if err := v.VMRemove(containerName); err != nil {
+			result.Failed[containerName] = err.Error()
+			continue
+		}
+		result.Removed = append(result.Removed, containerName)
+	}
+	return result, nil
+}
+
+// archiveLogs copies the logs of a container, running or not, to a new folder in DevicesDir/ReapedLogsDir and
+// returns the folder.
+func (v *VMM) archiveLogs(containerName string) (string, error) {
+	dir := path.Join(v.DevicesDir, ReapedLogsDir, containerName+"-"+time.Now().Format("20060102-150405"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	v.copyLogs(containerName, dir)
+	return dir, nil
+}
+
+// copyLogs copies each of LogSources of a container, running or not, to dir as <source>.log. Missing logs are skipped.
+func (v *VMM) copyLogs(containerName string, dir string) {
+	for _, source := range LogSources {
+		logFile, _ := LogSourcePath(source)
+		if err := v.copyFileFromContainer(containerName, logFile, path.Join(dir, source+".log")); err != nil {
+			// e.g. there is no logcat if the VM never booted
+			log.Printf("copyLogs (%s): skipped %s. reason: %v\n", containerName, source, err)
+		}
+	}
+}
+
+// copyFileFromContainer copies a single file out of a container, which doesn't have to be running, to dstPath.
+func (v *VMM) copyFileFromContainer(containerName string, srcPath string, dstPath string) error {
+	rc, _, err := v.Client.CopyFromContainer(context.Background(), containerName, srcPath)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	// the file comes as a single-entry TAR archive
+	tr := tar.NewReader(rc)
+	if _, err := tr.Next(); err != nil {
+		return err
+	}
+	f, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, tr); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// reaper periodically runs VMReap if VMM.ReapAfter is set.
+func (v *VMM) reaper() {
+	go func() {
+		for {
+			time.Sleep(reapInterval)
+			if v.ReapAfter <= 0 {
+				continue
+			}
+			result, err := v.VMReap(v.ReapAfter, v.ReapDryRun)
+			if err != nil {
+				log.Printf("reaper: %v\n", err)
+				continue
+			}
+			if len(result.Removed) > 0 || len(result.Failed) > 0 {
+				log.Printf("reaper: removed %v (dry run: %t), failed %v\n", result.Removed, v.ReapDryRun, result.Failed)
+			}
+		}
+	}()
+}
+
+// ContainerKillExec kills the process started by ContainerAttachToProcess for execID, and none of the other processes
+// running the same command, e.g. the shells of other terminal sessions. To be called before ContainerReleaseProcess.
+//
+// ContainerExecInspect tells if the process is still running, but its pid is in the HOST pid namespace (see
+// ContainerKillProcess), so the process is killed by the pid it recorded in the container.
+func (v *VMM) ContainerKillExec(containerName string, execID string) error {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	v.execTokensMu.Lock()
+	token, ok := v.execTokens[execID]
+	v.execTokensMu.Unlock()
+	if !ok {
+		return fmt.Errorf("exec %s is not started by ContainerAttachToProcess or already released", execID)
+	}
+	inspect, err := v.Client.ContainerExecInspect(context.Background(), execID)
+	if err != nil {
+		return errors.Wrap(err, "docker: failed to inspect exec")
+	}
+	cmd := killExecsScript(execPidDir, []string{token})
+	if !inspect.Running {
+		// only the record is left
+		cmd = "rm -f " + path.Join(execPidDir, token)
+	}
+	resp, err := v.containerExec(containerName, cmd, "root")
+	if err != nil {
+		return errors.Wrap(err, "containerExec kill")
+	}
+	if pid := strings.TrimSpace(resp.outBuffer.String()); pid != "" {
+		log.Printf("ContainerKillExec (%s): killed %s\n", containerName, pid)
+	}
+	return nil
+}
+
 // ContainerKillTerminal kills the bash process after use. To be called after done with the process created by ExecAttachToTerminal().
 func (v *VMM) ContainerKillTerminal(containerName string) error {
 	if err := v.isManagedRunningContainer(containerName); err != nil {
@@ -714,6 +3617,25 @@ func (v *VMM) ContainerTerminalResize(execID string, lines uint, cols uint) erro
 	return v.Client.ContainerExecResize(context.Background(), execID, types.ResizeOptions{Height: lines, Width: cols})
 }
 
+// ConfinePath resolves a user supplied container path, relative to HomeDir unless absolute, and makes sure the result
+// is inside one of roots. Paths escaping roots through ".." are rejected.
+func ConfinePath(p string, roots ...string) (string, error) {
+	if p == "" {
+		return "", errors.New("empty path")
+	}
+	if !path.IsAbs(p) {
+		p = path.Join(HomeDir, p)
+	}
+	p = path.Clean(p)
+	for _, root := range roots {
+		root = path.Clean(root)
+		if p == root || strings.HasPrefix(p, root+"/") {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("path %s is outside of %s", p, strings.Join(roots, ", "))
+}
+
 // ContainerListFiles gets a list of files in the given container's path
 // Results are of the following format which each line represents a file/folder:
 //
@@ -745,6 +3667,124 @@ func (v *VMM) ContainaerFileExists(containerName string, filePath string) error
 	return err
 }
 
+// LogSources are the VM logs that can be read with LogSourcePath, in the order shown to users.
+var LogSources = []string{"launcher", "kernel", "logcat"}
+
+// log files of LogSources in cuttlefish_runtime
+var logSourceFiles = map[string]string{
+	"launcher": "launcher.log",
+	"kernel":   "kernel.log",
+	"logcat":   "logcat",
+}
+
+// LogSourcePath returns the path in the container of a VM's log. An error is returned if source isn't one of
+// LogSources.
+func LogSourcePath(source string) (string, error) {
+	file, ok := logSourceFiles[source]
+	if !ok {
+		return "", errors.Errorf("invalid log source %q, expecting one of %s", source, strings.Join(LogSources, ", "))
+	}
+	return path.Join(HomeDir, "cuttlefish_runtime", file), nil
+}
+
+// DaemonLogs are the daemons started in a container by VMM whose logs can be read with VMGetDaemonLog.
+var DaemonLogs = []string{"websockify", "adb"}
+
+// log files of DaemonLogs. websockify is started in HomeDir by startVNCProxy, and the adb server started by root in
+// startADBDaemon logs to $TMPDIR/adb.<uid>.log.
+var daemonLogFiles = map[string]string{
+	"websockify": path.Join(HomeDir, "websockify.log"),
+	"adb":        "/tmp/adb.0.log",
+}
+
+// Maximum size of a log returned by VMGetDaemonLog
+const maxDaemonLogSize = 1024 * 1024
+
+// VMGetDaemonLog returns the log of a daemon in DaemonLogs, e.g. to find out why VNC doesn't connect. Only the last
+// maxDaemonLogSize bytes are returned if the log is larger.
+func (v *VMM) VMGetDaemonLog(containerName string, daemon string) (string, error) {
+	logFile, ok := daemonLogFiles[daemon]
+	if !ok {
+		return "", errors.Errorf("invalid daemon %q, expecting one of %s", daemon, strings.Join(DaemonLogs, ", "))
+	}
+	reader, err := v.ContainerReadFile(containerName, logFile)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %s, the daemon may not have been started", logFile)
+	}
+	defer reader.Close()
+	// the file comes as a single-entry TAR archive
+	tr := tar.NewReader(reader)
+	hdr, err := tr.Next()
+	if err != nil {
+		return "", err
+	}
+	if hdr.Size > maxDaemonLogSize {
+		if _, err := io.CopyN(ioutil.Discard, tr, hdr.Size-maxDaemonLogSize); err != nil {
+			return "", err
+		}
+	}
+	data, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Daemon logs larger than this are rotated by daemonLogRotator, keeping one previous log as <file>.1
+var DaemonLogRotateSize int64 = 10 * 1024 * 1024
+
+// How often daemonLogRotator checks the size of daemon logs
+var daemonLogRotateInterval = 10 * time.Minute
+
+// daemonLogRotator periodically rotates the logs of DaemonLogs in running containers, as the daemons keep appending
+// to them for as long as the VM runs and would otherwise count towards HomeDirSizeLimit.
+func (v *VMM) daemonLogRotator() {
+	go func() {
+		for {
+			time.Sleep(daemonLogRotateInterval)
+			containers, err := v.listCuttlefishContainers()
+			if err != nil {
+				log.Printf("daemonLogRotator: failed to list containers. error: %v\n", err)
+				continue
+			}
+			for _, c := range containers {
+				if c.State != "running" {
+					continue
+				}
+				if err := v.rotateDaemonLogs(c.Names[0][1:]); err != nil {
+					log.Printf("daemonLogRotator: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// rotateDaemonLogs moves the content of each daemon log larger than DaemonLogRotateSize to <file>.1. The log is
+// copied then truncated rather than renamed, since the daemons keep it open in append mode.
+func (v *VMM) rotateDaemonLogs(containerName string) error {
+	for _, daemon := range DaemonLogs {
+		cmd := rotateLogCommand(daemonLogFiles[daemon], DaemonLogRotateSize)
+		resp, err := v.containerExec(containerName, cmd, "root")
+		if err != nil {
+			return errors.Wrapf(err, "failed to rotate the %s log of %s", daemon, containerName)
+		}
+		if resp.ExitCode != 0 {
+			return errors.Errorf("failed to rotate the %s log of %s. output: %s", daemon, containerName, strings.TrimSpace(resp.errBuffer.String()))
+		}
+		if out := strings.TrimSpace(resp.outBuffer.String()); out != "" {
+			log.Printf("rotateDaemonLogs (%s): %s\n", containerName, out)
+		}
+	}
+	return nil
+}
+
+// rotateLogCommand returns a shell command that rotates logFile if it's larger than maxSize bytes.
+func rotateLogCommand(logFile string, maxSize int64) string {
+	f := shellQuote(logFile)
+	return fmt.Sprintf("if [ -f %s ] && [ $(stat -c %%s %s) -gt %d ]; then cp -p %s %s.1 && truncate -s 0 %s && echo rotated %s; fi",
+		f, f, maxSize, f, f, f, f)
+}
+
 // ContainerReadFile gets a reader of a file in the container. As per Moby API's design, the file will be in TAR format so
 // the caller should use tar.NewReader(reader) to obtain a corresponding tar reader.
 // It is up to the caller to close the reader.
@@ -773,6 +3813,103 @@ func (v *VMM) ContainerUpdateConfig(containerName string, key string, value stri
 	return v.KVStore.PutContainterValue(containerName, []KeyValue{{key, value}})
 }
 
+// ensureImage checks if an image exists on the Docker host and tries to pull it otherwise.
+func (v *VMM) ensureImage(image string) error {
+	ctx := context.Background()
+	_, _, err := v.Client.ImageInspectWithRaw(ctx, image)
+	if err == nil {
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return errors.Wrap(err, "docker: ImageInspect")
+	}
+	log.Printf("ensureImage: %s not found locally, pulling\n", image)
+	rc, err := v.Client.ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "image %s not found and failed to pull", image)
+	}
+	defer rc.Close()
+	// the pull completes only after the progress stream is fully read
+	if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+		return errors.Wrapf(err, "failed to pull image %s", image)
+	}
+	return nil
+}
+
+// CuttlefishContainer is a cuttlefish container on the host, which may belong to another VMM with a different CFPrefix
+type CuttlefishContainer struct {
+	ContainerName string `json:"container_name"`
+	State         string `json:"state"`
+	CFInstance    int    `json:"cf_instance"`
+	// CFPrefix of the VMM that created the container, empty if unknown e.g. the container was created by an older
+	// version of another VMM or outside of matrisea
+	Prefix  string `json:"prefix"`
+	Managed bool   `json:"managed"` // whether the container belongs to this VMM
+	// ports derived from cf_instance as in VMGetPorts
+	Ports map[string]int `json:"ports"`
+	// names of the other containers with the same cf_instance, whose ports collide with this one
+	ConflictsWith []string `json:"conflicts_with"`
+}
+
+// VMListAllCuttlefish lists all containers with a cf_instance label on the host regardless of CFPrefix, i.e. the
+// containers that getNextCFInstanceNumber takes into account, sorted by cf_instance.
+func (v *VMM) VMListAllCuttlefish() ([]CuttlefishContainer, error) {
+	if err := v.CheckDocker(); err != nil {
+		return nil, err
+	}
+	containerList, err := v.Client.ContainerList(context.Background(), types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	result := []CuttlefishContainer{}
+	byInstance := map[int][]string{}
+	for _, c := range containerList {
+		value, ok := c.Labels["cf_instance"]
+		if !ok {
+			continue
+		}
+		cfInstance, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("VMListAllCuttlefish: invalid cf_instance %q of %s\n", value, c.Names[0])
+			continue
+		}
+		containerName := strings.TrimPrefix(c.Names[0], "/")
+		prefix := cuttlefishPrefix(c.Labels, containerName, v.CFPrefix)
+		result = append(result, CuttlefishContainer{
+			ContainerName: containerName,
+			State:         c.State,
+			CFInstance:    cfInstance,
+			Prefix:        prefix,
+			Managed:       prefix == v.CFPrefix,
+			Ports:         instancePorts(cfInstance),
+		})
+		byInstance[cfInstance] = append(byInstance[cfInstance], containerName)
+	}
+	for i := range result {
+		result[i].ConflictsWith = []string{}
+		for _, name := range byInstance[result[i].CFInstance] {
+			if name != result[i].ContainerName {
+				result[i].ConflictsWith = append(result[i].ConflictsWith, name)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CFInstance < result[j].CFInstance })
+	return result, nil
+}
+
+// cuttlefishPrefix returns the CFPrefix of the VMM that created a container from its label, which tells apart
+// overlapping prefixes such as "cvd-" and "cvd-test-". Containers created before the label was added are matched by
+// name against cfPrefix.
+func cuttlefishPrefix(labels map[string]string, containerName string, cfPrefix string) string {
+	if prefix, ok := labels[LABEL_CF_PREFIX]; ok {
+		return prefix
+	}
+	if strings.HasPrefix(containerName, cfPrefix) {
+		return cfPrefix
+	}
+	return ""
+}
+
 // getNextCFInstanceNumber returns the next smallest cf_instance number that have not been assigned.
 func (v *VMM) getNextCFInstanceNumber() (int, error) {
 	// Here we get all cuttlefish containers from the host's view, regardless of which VMM instance they belong to.
@@ -786,49 +3923,86 @@ func (v *VMM) getNextCFInstanceNumber() (int, error) {
 	}
 
 	indexes := []int{}
-	cfList := []types.Container{}
 	for _, c := range containerList {
-		if value, ok := c.Labels["cf_instance"]; ok {
-			cfList = append(cfList, c)
-			cf_idx, err := strconv.Atoi(value)
-			if err != nil {
-				return -1, err
-			}
+		value, ok := c.Labels["cf_instance"]
+		if cf_idx, err := strconv.Atoi(value); err == nil && cf_idx > 0 {
 			indexes = append(indexes, cf_idx)
+			continue
+		}
+		// VMs of this VMM without a valid label may have been assigned one by getContainerCFInstanceNumber
+		if assigned, err := strconv.Atoi(v.KVStore.GetContainerValueOrEmpty(c.Names[0][1:], CONFIG_KEY_CF_INSTANCE)); err == nil {
+			indexes = append(indexes, assigned)
+		} else if ok {
+			log.Printf("getNextCFInstanceNumber: ignored malformed cf_instance %q of %s\n", value, c.Names[0])
 		}
 	}
 	sort.Ints(indexes)
 	log.Printf("getNextCFInstanceNumber: num of existing cuttlefish containers: %d - %v\n", len(indexes), indexes)
-	if len(indexes) == 0 {
-		return 1, nil
-	} else if indexes[len(indexes)-1] == len(cfList) {
-		// if all assigned cf_instance numbers are continueous so far
-		return len(cfList) + 1, nil
-	} else {
-		// find the smallest available cf_instance number
-		i := 1
-		for {
-			if indexes[i-1] != i {
-				return i, nil
-			}
-			i = i + 1
+	// find the smallest available cf_instance number
+	next := 1
+	for _, idx := range indexes {
+		if idx == next {
+			next++
+		} else if idx > next {
+			break
 		}
 	}
+	return next, nil
 }
 
 // getContainerCFInstanceNumber reads the cf_instance label of a container.
+//
+// Containers created by older versions or imported from elsewhere may have a malformed cf_instance label, which
+// can't be fixed as labels are immutable. Such a container is assigned a cf_instance in its config instead, derived
+// from its published adb port if possible so that it matches the ports published at creation, or the next available
+// one otherwise.
 func (v *VMM) getContainerCFInstanceNumber(containerName string) (int, error) {
 	containerJSON, err := v.getContainerJSON(containerName)
 	if err != nil {
 		return -1, err
 	}
-	num, err := strconv.Atoi(containerJSON.Config.Labels["cf_instance"])
-	if err != nil {
-		return -1, err
+	label := containerJSON.Config.Labels["cf_instance"]
+	num, err := strconv.Atoi(label)
+	if err == nil && num > 0 {
+		return num, nil
+	}
+	if assigned, err := strconv.Atoi(v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_CF_INSTANCE)); err == nil {
+		return assigned, nil
+	}
+
+	// serialized with VMCreate so that the number isn't given to a new VM at the same time
+	v.createMu.Lock()
+	defer v.createMu.Unlock()
+	num, ok := cfInstanceFromPortBindings(containerJSON.HostConfig.PortBindings)
+	if !ok {
+		if num, err = v.getNextCFInstanceNumber(); err != nil {
+			return -1, errors.Wrap(err, "failed to assign a cf_instance")
+		}
+	}
+	log.Printf("Warning: %s has a malformed cf_instance label %q, assigned cf_instance %d\n", containerName, label, num)
+	if err := v.KVStore.PutContainterValue(containerName, []KeyValue{{CONFIG_KEY_CF_INSTANCE, strconv.Itoa(num)}}); err != nil {
+		return -1, errors.Wrap(err, "failed to save the assigned cf_instance")
 	}
 	return num, nil
 }
 
+// cfInstanceFromPortBindings derives the cf_instance of a container from its adb port, which is the only port
+// published on the host's 127.0.0.1, see VMCreate and portForInstance.
+func cfInstanceFromPortBindings(bindings nat.PortMap) (int, bool) {
+	for port, portBindings := range bindings {
+		if port.Proto() != "tcp" {
+			continue
+		}
+		for _, binding := range portBindings {
+			hostPort, err := strconv.Atoi(binding.HostPort)
+			if binding.HostIP == "127.0.0.1" && err == nil && hostPort >= ADBBasePort {
+				return hostPort - ADBBasePort + 1, true
+			}
+		}
+	}
+	return 0, false
+}
+
 func (v *VMM) getContainerIP(containerName string) (string, error) {
 	containerJSON, err := v.getContainerJSON(containerName)
 	if err != nil {
@@ -857,66 +4031,324 @@ func (v *VMM) startVNCProxy(containerName string) error {
 	if err != nil {
 		return errors.Wrap(err, "getContainerCFInstanceNumber")
 	}
-	vncPort := 6444 + cfIndex - 1
-	wsPort := 6080 + cfIndex - 1
-	resp, err := v.containerExec(containerName, fmt.Sprintf("websockify -D %d 127.0.0.1:%d --log-file websockify.log", wsPort, vncPort), "vsoc-01")
-	if err != nil {
-		return err
+	vncPort := portForInstance(VNCBasePort, cfIndex)
+	wsPort := portForInstance(WebsockifyBasePort, cfIndex)
+	if v.isPortListening(containerName, wsPort) {
+		log.Printf("startVNCProxy (%s): websockify is already running\n", containerName)
+		return nil
+	}
+	level := v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_WEBSOCKIFY_LOG_LEVEL)
+	resp, err := v.containerExec(containerName, websockifyCommand(wsPort, vncPort, level), "vsoc-01")
+	if err != nil {
+		return err
+	}
+	if resp.ExitCode != 0 {
+		return errors.New("non-zero exit code in websockify. output:" + resp.errBuffer.String())
+	}
+	// websockify -D returns as soon as it daemonizes so make sure it's actually listening
+	for i := 0; i < 10; i++ {
+		if v.isPortListening(containerName, wsPort) {
+			log.Printf("startVNCProxy (%s): websockify daemon started\n", containerName)
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	logResp, _ := v.containerExec(containerName, "tail -n 20 websockify.log", "vsoc-01")
+	output := ""
+	if logResp.outBuffer != nil {
+		output = logResp.outBuffer.String()
+	}
+	return fmt.Errorf("websockify is not listening on port %d. websockify.log: %s", wsPort, output)
+}
+
+// Verbosity of websockify.log
+const (
+	WebsockifyLogOff   = "off"   // no log file, e.g. for VMs left running for days
+	WebsockifyLogInfo  = "info"  // connections and errors
+	WebsockifyLogDebug = "debug" // websockify's --verbose, for debugging VNC connections
+)
+
+var WebsockifyLogLevels = []string{WebsockifyLogOff, WebsockifyLogInfo, WebsockifyLogDebug}
+
+// websockifyCommand returns the command that starts websockify as a daemon with a log level in WebsockifyLogLevels,
+// or WebsockifyLogInfo if the level is empty.
+func websockifyCommand(wsPort int, vncPort int, level string) string {
+	cmd := fmt.Sprintf("websockify -D %d 127.0.0.1:%d", wsPort, vncPort)
+	switch level {
+	case WebsockifyLogOff:
+		return cmd
+	case WebsockifyLogDebug:
+		return cmd + " --log-file " + daemonLogFiles["websockify"] + " --verbose"
+	default:
+		return cmd + " --log-file " + daemonLogFiles["websockify"]
+	}
+}
+
+// VMSetWebsockifyLogLevel changes the verbosity of a VM's websockify.log to one of WebsockifyLogLevels. websockify is
+// restarted if it's running for the level to take effect, which briefly disconnects VNC clients.
+func (v *VMM) VMSetWebsockifyLogLevel(containerName string, level string) error {
+	if err := ValidateWebsockifyLogLevel(level); err != nil {
+		return err
+	}
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return err
+	}
+	// VMStart and VMRestart may be bringing up websockify at the same time
+	unlock, err := v.lockVM(containerName, "websockify")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := v.KVStore.PutContainterValue(containerName, []KeyValue{{CONFIG_KEY_WEBSOCKIFY_LOG_LEVEL, level}}); err != nil {
+		return err
+	}
+	cfIndex, err := v.getContainerCFInstanceNumber(containerName)
+	if err != nil {
+		return errors.Wrap(err, "getContainerCFInstanceNumber")
+	}
+	if !v.isPortListening(containerName, portForInstance(WebsockifyBasePort, cfIndex)) {
+		return nil
 	}
-	if resp.ExitCode != 0 {
-		return errors.New("non-zero exit code in websockify. output:" + resp.errBuffer.String())
+	// websockify runs as "python3 /usr/bin/websockify ...", which the pattern matches unlike this shell's command line
+	if _, err := v.containerExec(containerName, "pkill -f '^[^ ]*python[^ ]* [^ ]*websockify'; pkill -x websockify", "root"); err != nil {
+		return errors.Wrap(err, "failed to stop websockify")
 	}
-	log.Printf("startVNCProxy (%s): websockify daemon started\n", containerName)
-	return nil
+	for i := 0; i < 10 && v.isPortListening(containerName, portForInstance(WebsockifyBasePort, cfIndex)); i++ {
+		time.Sleep(500 * time.Millisecond)
+	}
+	log.Printf("VMSetWebsockifyLogLevel (%s): restarting websockify with log level %s\n", containerName, level)
+	return v.startVNCProxy(containerName)
+}
+
+// ValidateWebsockifyLogLevel checks if level is one of WebsockifyLogLevels.
+func ValidateWebsockifyLogLevel(level string) error {
+	for _, l := range WebsockifyLogLevels {
+		if l == level {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid websockify log level %s, must be one of %s", level, strings.Join(WebsockifyLogLevels, ", "))
+}
+
+// isPortListening checks if a TCP port accepts connections on the container's localhost.
+func (v *VMM) isPortListening(containerName string, port int) bool {
+	resp, err := v.containerExec(containerName, fmt.Sprintf("bash -c '</dev/tcp/127.0.0.1/%d'", port), "vsoc-01")
+	return err == nil && resp.ExitCode == 0
 }
 
 // startADBDaemon starts an ADB daemon in the container and try connect to the VM.
 // The function should be called when VM has booted up and started listening on the adb port.
 // The function is safe to be called repeatedly as adb will ignore duplicated connect commands and return "already connected".
 func (v *VMM) startADBDaemon(containerName string) error {
-	cfIndex, err := v.getContainerCFInstanceNumber(containerName)
-	if err != nil {
-		return err
-	}
-	adbPort := 6520 + cfIndex - 1
-	ip, err := v.getContainerIP(containerName)
+	serial, err := v.getADBSerial(containerName)
 	if err != nil {
 		return err
 	}
-	resp, err := v.containerExec(containerName, fmt.Sprintf("adb connect %s:%d", ip, adbPort), "root")
+	resp, err := v.containerExec(containerName, "adb connect "+serial, "root")
 	if err != nil {
 		return err
 	}
 	if resp.ExitCode != 0 {
 		return errors.New("non-zero exit code in adb daemon. stderr:" + resp.errBuffer.String())
 	}
-	log.Printf("startADBDaemon (%s): connected to %s:%d\n", containerName, ip, adbPort)
+	log.Printf("startADBDaemon (%s): connected to %s\n", containerName, serial)
 	log.Printf("startADBDaemon (%s): stdout:%s\n", containerName, resp.outBuffer.String())
 	log.Printf("startADBDaemon (%s): stderr:%s\n", containerName, resp.outBuffer.String())
 	return nil
 }
 
-func (v *VMM) installTools(containerName string) error {
-	resp, err := v.containerExec(containerName, "apt update", "root")
+// portForInstance returns the port of the VM with the given cf_instance (starting from 1), the same way launch_cvd
+// offsets its own ports by the instance number.
+func portForInstance(base int, cfInstance int) int {
+	return base + cfInstance - 1
+}
+
+// VMGetPorts returns the container ports of a VM's "vnc", "websockify" and "adb". websockify and adb are published
+// on the host with the same port numbers.
+func (v *VMM) VMGetPorts(containerName string) (map[string]int, error) {
+	if _, err := v.isManagedContainer(containerName); err != nil {
+		return nil, err
+	}
+	cfIndex, err := v.getContainerCFInstanceNumber(containerName)
 	if err != nil {
-		return errors.Wrap(err, "failed to apt update")
+		return nil, errors.Wrap(err, "getContainerCFInstanceNumber")
 	}
-	if resp.ExitCode != 0 {
-		return errors.New("Failed to apt update. reason:" + resp.errBuffer.String())
+	return instancePorts(cfIndex), nil
+}
+
+func instancePorts(cfInstance int) map[string]int {
+	return map[string]int{
+		"vnc":        portForInstance(VNCBasePort, cfInstance),
+		"websockify": portForInstance(WebsockifyBasePort, cfInstance),
+		"adb":        portForInstance(ADBBasePort, cfInstance),
+	}
+}
+
+// VMGetADBSerial returns the serial that the adb server in the container connects to, i.e. <container-ip>:<adb-port>.
+// It's reachable from the Docker host and other containers on the same network. The same port is also published on
+// the host's 127.0.0.1.
+func (v *VMM) VMGetADBSerial(containerName string) (string, error) {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return "", err
 	}
-	resp, err = v.containerExec(containerName, "apt install -y -qq adb git htop python3-pip iputils-ping less websockify", "root")
+	serial, err := v.getADBSerial(containerName)
 	if err != nil {
-		return errors.Wrap(err, "failed to execute apt install")
+		return "", errors.Wrap(err, "getADBSerial")
 	}
-	if resp.ExitCode != 0 {
-		return errors.New("Failed to apt install additional tools, reason:" + resp.errBuffer.String())
+	return serial, nil
+}
+
+// getADBSerial returns the serial (ip:port) of the VM that startADBDaemon connects to.
+func (v *VMM) getADBSerial(containerName string) (string, error) {
+	cfIndex, err := v.getContainerCFInstanceNumber(containerName)
+	if err != nil {
+		return "", err
 	}
-	resp, err = v.containerExec(containerName, "pip3 install frida-tools", "root")
+	adbPort := portForInstance(ADBBasePort, cfIndex)
+	ip, err := v.getContainerIP(containerName)
 	if err != nil {
-		return err
+		return "", err
 	}
-	if resp.ExitCode != 0 {
-		return errors.New("non-zero return when install python packages. reason:" + resp.errBuffer.String())
+	return fmt.Sprintf("%s:%d", ip, adbPort), nil
+}
+
+// containerADBShell runs cmd with `adb shell` against the VM of the container.
+// Like containerExec, it's up to the caller to handle non-zero exit code.
+//
+// An in-container adb server occasionally gets into a bad state where every adb command hangs. If cmd doesn't
+// return within ADBCommandTimeout, the adb server is reset and cmd is retried once.
+func (v *VMM) containerADBShell(containerName string, cmd string) (ExecResult, error) {
+	serial, err := v.getADBSerial(containerName)
+	if err != nil {
+		return ExecResult{}, errors.Wrap(err, "getADBSerial")
+	}
+	adbCmd := fmt.Sprintf("adb -s %s shell %s", serial, shellQuote(cmd))
+	resp, err := v.containerExecWithTimeout(containerName, adbCmd, "vsoc-01", ADBCommandTimeout)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("containerADBShell (%s): adb timeout, resetting adb server\n", containerName)
+		if err := v.VMResetADBServer(containerName); err != nil {
+			return ExecResult{}, errors.Wrap(err, "adb timeout and failed to reset adb server")
+		}
+		return v.containerExecWithTimeout(containerName, adbCmd, "vsoc-01", ADBCommandTimeout)
+	}
+	return resp, err
+}
+
+// waitForUIReady polls the VM until the package manager is up and the boot animation has ended,
+// or returns an error when the deadline is reached.
+func (v *VMM) waitForUIReady(containerName string, deadline time.Time) error {
+	if err := v.startADBDaemon(containerName); err != nil {
+		return errors.Wrap(err, "startADBDaemon")
+	}
+	for {
+		if v.isUIReady(containerName) {
+			log.Printf("waitForUIReady (%s): boot animation ended\n", containerName)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("timeout waiting for the boot animation to end")
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// isUIReady checks if the package manager is ready and the boot animation has stopped.
+func (v *VMM) isUIReady(containerName string) bool {
+	checks := []struct {
+		cmd  string
+		want string
+	}{
+		{"pm path android", "package:"},
+		{"getprop init.svc.bootanim", "stopped"},
+		{"getprop service.bootanim.exit", "1"},
+	}
+	for _, c := range checks {
+		resp, err := v.containerADBShell(containerName, c.cmd)
+		if err != nil || resp.ExitCode != 0 {
+			return false
+		}
+		if !strings.HasPrefix(strings.TrimSpace(resp.outBuffer.String()), c.want) {
+			return false
+		}
+	}
+	return true
+}
+
+// installTools installs additional apt/pip packages in the container. Packages are installed one at a time so that
+// the returned error tells exactly which package failed.
+//
+// Packages that are already installed are skipped. If the image has been pre-provisioned with all packages,
+// installTools returns without touching the network at all.
+func (v *VMM) installTools(containerName string) error {
+	missingApt, missingPip := v.getMissingTools(containerName)
+	log.Printf("installTools (%s): to install apt%v pip%v, skipped the rest as already installed\n", containerName, missingApt, missingPip)
+	if len(missingApt) == 0 && len(missingPip) == 0 {
+		return nil
+	}
+
+	if len(missingApt) > 0 {
+		resp, err := v.containerExecLong(containerName, "apt update", "root")
+		if err != nil {
+			return errors.Wrap(err, "failed to apt update")
+		}
+		if resp.ExitCode != 0 {
+			return errors.New("Failed to apt update. reason:" + resp.errBuffer.String())
+		}
+	}
+	for _, pkg := range missingApt {
+		// apt-cache show exits with non-zero if the package can't be found in any source
+		resp, err := v.containerExec(containerName, "apt-cache show "+pkg, "root")
+		if err != nil {
+			return errors.Wrap(err, "failed to execute apt-cache show "+pkg)
+		}
+		if resp.ExitCode != 0 {
+			return fmt.Errorf("package %s is not available in apt sources", pkg)
+		}
+		resp, err = v.containerExecLong(containerName, "apt install -y -qq "+pkg, "root")
+		if err != nil {
+			return errors.Wrap(err, "failed to execute apt install "+pkg)
+		}
+		if resp.ExitCode != 0 {
+			return fmt.Errorf("failed to install %s. reason: %s", pkg, resp.errBuffer.String())
+		}
+		log.Printf("installTools (%s): installed %s\n", containerName, pkg)
+	}
+	for _, pkg := range missingPip {
+		resp, err := v.containerExecLong(containerName, "pip3 install "+pkg, "root")
+		if err != nil {
+			return errors.Wrap(err, "failed to execute pip3 install "+pkg)
+		}
+		if resp.ExitCode != 0 {
+			return fmt.Errorf("failed to install python package %s. reason: %s", pkg, resp.errBuffer.String())
+		}
+		log.Printf("installTools (%s): installed %s\n", containerName, pkg)
+	}
+	return nil
+}
+
+// getMissingTools returns apt and pip packages required by installTools that aren't installed in the container.
+func (v *VMM) getMissingTools(containerName string) (missingApt []string, missingPip []string) {
+	for _, pkg := range aptPackages {
+		resp, err := v.containerExec(containerName, "dpkg -s "+pkg, "root")
+		if err != nil || resp.ExitCode != 0 {
+			missingApt = append(missingApt, pkg)
+		}
+	}
+	for _, pkg := range pipPackages {
+		resp, err := v.containerExec(containerName, "pip3 show "+pkg, "root")
+		if err != nil || resp.ExitCode != 0 {
+			missingPip = append(missingPip, pkg)
+		}
+	}
+	return missingApt, missingPip
+}
+
+// checkToolsInstalled returns an error if any package required by installTools is missing in the container.
+// Used in offline mode as a replacement of installTools.
+func (v *VMM) checkToolsInstalled(containerName string) error {
+	missingApt, missingPip := v.getMissingTools(containerName)
+	if len(missingApt) > 0 || len(missingPip) > 0 {
+		return fmt.Errorf("offline mode requires pre-installed packages. missing apt%v pip%v", missingApt, missingPip)
 	}
 	return nil
 }
@@ -939,49 +4371,85 @@ func (v *VMM) getContainerIDByName(target string) (containerID string, err error
 }
 
 // containerCopyFile copies a single file into the container.
-// if srcPath isn't a .tar / tar.gz, it will be tar-ed in a temporary folder first
-func (v *VMM) containerCopyFile(srcPath string, containerName string, dstPath string) error {
+// if srcPath isn't a .tar / tar.gz, it's tar-ed on the fly and streamed to the container without an intermediate file
+func (v *VMM) containerCopyFile(srcPath string, containerName string, dstPath string, onProgress func(CopyProgress)) error {
 	start := time.Now()
 
 	if strings.HasSuffix(srcPath, ".tar") || strings.HasSuffix(srcPath, ".tar.gz") {
-		if err := v.containerCopyTarFile(srcPath, containerName, dstPath); err != nil {
+		if err := v.containerCopyTarFile(srcPath, containerName, dstPath, onProgress); err != nil {
 			return errors.Wrap(err, "containerCopyTarFile")
 		}
+		log.Printf("containerCopyFile (%s): src:%s dst:%s cost:%s\n", containerName, srcPath, dstPath, time.Since(start))
+		return nil
 	}
 
-	tmpdir, err := ioutil.TempDir("", "matrisea")
+	containerID, err := v.getContainerIDByName(containerName)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		// a tar error fails CopyToContainer through the pipe
+		pw.CloseWithError(tarSingleFile(pw, srcPath, onProgress))
+	}()
+	err = v.Client.CopyToContainer(context.Background(), containerID, dstPath, pr, types.CopyToContainerOptions{})
+	// unblocks the writer if CopyToContainer returned before reading everything
+	pr.Close()
 	if err != nil {
-		return errors.Wrap(err, "cannot create tmp dir")
+		return errors.Wrap(err, "docker: CopyToContainer")
 	}
-	defer os.RemoveAll(tmpdir)
-	srcFolder, srcFile := filepath.Split(srcPath)
 
-	cmdStr := fmt.Sprintf("cd %s && tar -cvzf \"%s/%s.tar\" \"%s\"", srcFolder, tmpdir, srcFile, srcFile)
-	log.Println(cmdStr)
+	elapsed := time.Since(start)
+	log.Printf("containerCopyFile (%s): src:%s dst:%s cost:%s\n", containerName, srcPath, dstPath, elapsed)
+	return nil
+}
 
-	// TODO read stderr and always print to console
-	cmd := exec.Command("sh", "-c", cmdStr)
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
+// tarSingleFile writes a tar archive containing only srcPath, stored under its base name, to w.
+// onProgress, if not nil, is reported with the bytes of srcPath written so far.
+func tarSingleFile(w io.Writer, srcPath string, onProgress func(CopyProgress)) error {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", srcPath)
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.Base(srcPath)
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, newProgressReader(f, header.Name, info.Size(), onProgress)); err != nil {
 		return errors.Wrap(err, "error during tar")
 	}
+	return tw.Close()
+}
 
-	archive := tmpdir + "/" + srcFile + ".tar"
-	if err = v.containerCopyTarFile(archive, containerName, dstPath); err != nil {
-		return errors.Wrap(err, "containerCopyTarFile")
+// tempDir returns a folder named name in VMM.TmpDir, or DataDir/tmp if TmpDir is not set, and creates it if needed.
+func (v *VMM) tempDir(name string) (string, error) {
+	base := v.TmpDir
+	if base == "" {
+		base = path.Join(v.DataDir, "tmp")
 	}
-
-	elapsed := time.Since(start)
-	log.Printf("containerCopyFile (%s): src:%s dst:%s cost:%s\n", containerName, srcPath, dstPath, elapsed)
-	return nil
+	dir := path.Join(base, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
 }
 
 // containerCopyTarFile is a wrapper function of docker's CopyToContainer API where the srcPath must be a tar file
 // The API will fail silently if srcPath isn't a tar.
-func (v *VMM) containerCopyTarFile(srcPath string, containerName string, dstPath string) error {
+func (v *VMM) containerCopyTarFile(srcPath string, containerName string, dstPath string, onProgress func(CopyProgress)) error {
 	containerID, err := v.getContainerIDByName(containerName)
 	if err != nil {
 		return err
@@ -992,16 +4460,101 @@ func (v *VMM) containerCopyTarFile(srcPath string, containerName string, dstPath
 		return err
 	}
 	defer archive.Close()
+	info, err := archive.Stat()
+	if err != nil {
+		return err
+	}
 
-	err = v.Client.CopyToContainer(context.Background(), containerID, dstPath, bufio.NewReader(archive), types.CopyToContainerOptions{})
+	reader := newProgressReader(bufio.NewReader(archive), filepath.Base(srcPath), info.Size(), onProgress)
+	err = v.Client.CopyToContainer(context.Background(), containerID, dstPath, reader, types.CopyToContainerOptions{})
 	if err != nil {
 		return errors.Wrap(err, "docker: CopyToContainer")
 	}
 	return nil
 }
 
+// containerExec runs cmd in a container and waits at most VMM.ExecTimeout for it to finish, so that a wedged
+// process in the container can't block the caller forever.
 func (v *VMM) containerExec(containerName string, cmd string, user string) (ExecResult, error) {
-	return v.containerExecWithContext(context.Background(), containerName, cmd, user)
+	timeout := v.ExecTimeout
+	if timeout <= 0 {
+		timeout = DefaultExecTimeout
+	}
+	return v.containerExecWithTimeout(containerName, cmd, user, timeout)
+}
+
+// containerExecLong is the same as containerExec but waits up to VMM.LongExecTimeout, for commands that may take
+// longer than VMM.ExecTimeout on large files, e.g. adb install or apt install.
+func (v *VMM) containerExecLong(containerName string, cmd string, user string) (ExecResult, error) {
+	return v.containerExecWithTimeout(containerName, cmd, user, v.longExecTimeout())
+}
+
+func (v *VMM) longExecTimeout() time.Duration {
+	if v.LongExecTimeout <= 0 {
+		return DefaultLongExecTimeout
+	}
+	return v.LongExecTimeout
+}
+
+// containerExecWithTimeout is the same as containerExec but gives up waiting after timeout.
+// Notice that the process may continue running in the container after the timeout.
+func (v *VMM) containerExecWithTimeout(containerName string, cmd string, user string, timeout time.Duration) (ExecResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return v.containerExecWithContext(ctx, containerName, cmd, user)
+}
+
+// containerExecLines runs cmd in a container like containerExecLong, but passes each line of its stdout to onLine as
+// soon as it's printed instead of buffering it. The returned ExecResult only has the exit code and stderr of cmd.
+func (v *VMM) containerExecLines(containerName string, cmd string, user string, onLine func(string)) (ExecResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), v.longExecTimeout())
+	defer cancel()
+	cresp, err := v.Client.ContainerExecCreate(ctx, containerName, types.ExecConfig{
+		User:         user,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          []string{"/bin/sh", "-c", cmd},
+	})
+	if err != nil {
+		return ExecResult{}, errors.Wrap(err, "docker: failed to create an exec config")
+	}
+	aresp, err := v.Client.ContainerExecAttach(ctx, cresp.ID, types.ExecStartCheck{})
+	if err != nil {
+		return ExecResult{}, errors.Wrap(err, "docker: failed to execute/attach to "+cmd)
+	}
+	defer aresp.Close()
+
+	var errBuf bytes.Buffer
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(pw, &errBuf, aresp.Reader)
+		pw.CloseWithError(err)
+	}()
+	outputDone := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			onLine(scanner.Text())
+		}
+		// unblock StdCopy if the scanner gave up on a long line
+		io.Copy(ioutil.Discard, pr)
+		outputDone <- scanner.Err()
+	}()
+
+	select {
+	case err := <-outputDone:
+		if err != nil {
+			return ExecResult{}, err
+		}
+	case <-ctx.Done():
+		return ExecResult{}, errors.Wrapf(ctx.Err(), "timed out waiting for \"%s\" in %s", cmd, containerName)
+	}
+	iresp, err := v.Client.ContainerExecInspect(ctx, cresp.ID)
+	if err != nil {
+		return ExecResult{}, errors.Wrap(err, "docker: ContainerExecInspect")
+	}
+	// StdCopy is done with errBuf once the output is closed
+	return ExecResult{ExitCode: iresp.ExitCode, outBuffer: &bytes.Buffer{}, errBuffer: &errBuf}, nil
 }
 
 // Execute a command in a container and return the result
@@ -1045,6 +4598,9 @@ func (v *VMM) containerExecWithContext(ctx context.Context, containerName string
 			return ExecResult{}, err
 		}
 	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return ExecResult{}, errors.Wrapf(ctx.Err(), "timed out waiting for \"%s\" in %s", cmd, containerName)
+		}
 		return ExecResult{}, errors.Wrap(ctx.Err(), "context done")
 	}
 
@@ -1056,6 +4612,102 @@ func (v *VMM) containerExecWithContext(ctx context.Context, containerName string
 	return ExecResult{ExitCode: iresp.ExitCode, outBuffer: &outBuf, errBuffer: &errBuf}, nil
 }
 
+// splitNonEmpty is strings.Split but returns an empty slice for an empty string.
+func splitNonEmpty(s string, sep string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, sep)
+}
+
+// shellQuote single-quotes s so that it is passed to sh as one literal argument.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "'\\''") + "'"
+}
+
+// checkNameAvailable returns ErrVMExists if a container of the exact name exists, running or not.
+func (v *VMM) checkNameAvailable(containerName string) error {
+	containers, err := v.Client.ContainerList(context.Background(), types.ContainerListOptions{All: true})
+	if err != nil {
+		return err
+	}
+	for _, c := range containers {
+		for _, name := range c.Names {
+			if name == "/"+containerName {
+				return errors.Wrap(ErrVMExists, containerName)
+			}
+		}
+	}
+	return nil
+}
+
+// prepareDeviceDir creates an empty device folder for a new container. A folder left over by a failed create or a
+// removal outside of VMRemove is emptied so that its stale images don't end up in the new VM, unless a container
+// still mounts it. A folder kept by VMRemoveWithOptions is reused as is with reuse, and never emptied.
+func (v *VMM) prepareDeviceDir(deviceDir string, reuse bool) error {
+	entries, err := os.ReadDir(deviceDir)
+	if os.IsNotExist(err) {
+		return os.Mkdir(deviceDir, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	containers, err := v.Client.ContainerList(context.Background(), types.ContainerListOptions{All: true})
+	if err != nil {
+		return err
+	}
+	for _, c := range containers {
+		for _, m := range c.Mounts {
+			if m.Source == deviceDir {
+				return fmt.Errorf("device folder %s is in use by container %s", deviceDir, strings.TrimPrefix(c.Names[0], "/"))
+			}
+		}
+	}
+	marker := path.Join(deviceDir, keptDataMarker)
+	if reuse {
+		log.Printf("VMCreate: reusing %d file(s) in %s\n", len(entries), deviceDir)
+		if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if _, err := os.Stat(marker); err == nil {
+		return ErrDeviceDataKept
+	}
+	log.Printf("VMCreate: removing %d leftover file(s) in %s\n", len(entries), deviceDir)
+	if err := os.RemoveAll(deviceDir); err != nil {
+		return errors.Wrap(err, "failed to clean up leftover device folder")
+	}
+	return os.Mkdir(deviceDir, 0755)
+}
+
+// ErrOperationInProgress is returned by an operation that changes a VM (e.g. VMStart, VMStop, VMRemove, VMLoadFile or
+// VMInstallAPK) while another one is in progress on the same VM.
+var ErrOperationInProgress = errors.New("another operation is in progress on the VM")
+
+// lockVM marks op as in progress on a container until the returned function is called. Operations that change a VM
+// can take minutes, so a conflicting one fails fast with ErrOperationInProgress instead of waiting. Read-only
+// operations such as VMList don't lock.
+func (v *VMM) lockVM(containerName string, op string) (func(), error) {
+	v.operationsMu.Lock()
+	defer v.operationsMu.Unlock()
+	if current, ok := v.operations[containerName]; ok {
+		return nil, errors.Wrapf(ErrOperationInProgress, "cannot %s %s while %s is in progress", op, containerName, current)
+	}
+	if v.operations == nil {
+		v.operations = map[string]string{}
+	}
+	v.operations[containerName] = op
+	return func() {
+		v.operationsMu.Lock()
+		delete(v.operations, containerName)
+		v.operationsMu.Unlock()
+	}, nil
+}
+
 // listCuttlefishContainers gets a list of managed containers of the VMM instance.
 func (v *VMM) listCuttlefishContainers() ([]types.Container, error) {
 	containers, err := v.Client.ContainerList(context.Background(), types.ContainerListOptions{All: true})
@@ -1095,10 +4747,13 @@ func (v *VMM) getVMStatus(c types.Container) (VMStatus, error) {
 	containerName := c.Names[0][1:]
 	// When a container is up, c.Status looks like "Up 2 days"
 	if strings.HasPrefix(c.Status, "Up") {
+		if v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_INITIALIZING) == "true" {
+			return VMInitializing, nil
+		}
 		ch := make(chan ExecChannelResult, 1)
 		go func() {
 			// use grep "[x]xxx" technique to prevent grep itself from showing up in the ps result
-			resp, err := v.containerExecWithContext(ctx, containerName, "ps aux|grep \"[l]aunch_cvd\"", "vsoc-01")
+			resp, err := v.containerExecWithContext(ctx, containerName, "ps aux|grep -E \"[l]aunch_cvd|[r]un_cvd\"", "vsoc-01")
 			ch <- ExecChannelResult{resp, err}
 		}()
 
@@ -1113,7 +4768,13 @@ func (v *VMM) getVMStatus(c types.Container) (VMStatus, error) {
 				fmt.Printf("getVMStatus failed to list processes: %v\n", execResult.err)
 				return -1, errors.Wrap(execResult.err, "getVMStatus failed to top")
 			}
-			if strings.Contains(execResult.resp.outBuffer.String(), "launch_cvd") {
+			out := execResult.resp.outBuffer.String()
+			// with --num_instances, each instance has its own run_cvd which can be stopped individually
+			expected := numInstancesFromCmdline(v.KVStore.GetContainerValueOrEmpty(containerName, CONFIG_KEY_CMDLINE))
+			if running := strings.Count(out, "run_cvd"); expected > 1 && running > 0 && running < expected {
+				return VMPartiallyRunning, nil
+			}
+			if strings.Contains(out, "launch_cvd") || strings.Contains(out, "run_cvd") {
 				return VMRunning, nil
 			}
 			return VMReady, nil
@@ -1122,6 +4783,20 @@ func (v *VMM) getVMStatus(c types.Container) (VMStatus, error) {
 	return VMContainerError, nil
 }
 
+// vmStatusByName is getVMStatus of a managed container by name.
+func (v *VMM) vmStatusByName(containerName string) (VMStatus, error) {
+	cfList, err := v.listCuttlefishContainers()
+	if err != nil {
+		return -1, err
+	}
+	for _, c := range cfList {
+		if c.Names[0][1:] == containerName {
+			return v.getVMStatus(c)
+		}
+	}
+	return -1, errors.New("container not found")
+}
+
 // isManagedRunningContainer checks if a given container exists && is managed by the VMM instance && is running
 func (v *VMM) isManagedRunningContainer(containerName string) error {
 	cjson, err := v.isManagedContainer(containerName)
@@ -1129,13 +4804,17 @@ func (v *VMM) isManagedRunningContainer(containerName string) error {
 		return err
 	}
 	if cjson.State.Status != "running" {
-		return fmt.Errorf("invalid container: container not running")
+		return fmt.Errorf("invalid container: %w", ErrVMNotRunning)
 	}
 	return nil
 }
 
 // isManagedContainer checks if a given container exists && is managed by the VMM instance
 func (v *VMM) isManagedContainer(containerName string) (types.ContainerJSON, error) {
+	// fail fast with ErrDockerUnresponsive before the operations on the container hang
+	if err := v.CheckDocker(); err != nil {
+		return types.ContainerJSON{}, err
+	}
 	cid, err := v.getContainerIDByName(containerName)
 	if err != nil {
 		return types.ContainerJSON{}, fmt.Errorf("invalid contaienr name: %w", err)
@@ -1162,12 +4841,16 @@ func (v *VMM) isManagedContainer(containerName string) (types.ContainerJSON, err
 func (v *VMM) diskSheriff() {
 	log.Println("DiskSheriff started")
 	go func() {
+		// consecutive checks over the limit by container name
+		breaches := map[string]int{}
 		for {
 			containers, err := v.listCuttlefishContainers()
 			if err != nil {
 				log.Printf("DiskSheriff: failed to list containers. error: %v\n", err)
 			}
 
+			// containers that are gone, stopped or back under the limit start over
+			nextBreaches := map[string]int{}
 			for _, c := range containers {
 				containerName := c.Names[0][1:]
 				// It's okay if getVMStatu is busy waiting for a lock. Let other request to finish first
@@ -1175,46 +4858,114 @@ func (v *VMM) diskSheriff() {
 				if err != nil {
 					log.Printf("DiskSheriff: failed to get VMStatus error: %v\n", err)
 				}
-				if status == VMRunning {
+				if status == VMRunning || status == VMPartiallyRunning {
 					volSize, err := v.getContainerHomeDirUsage(containerName)
 					if err != nil {
 						log.Printf("DiskSheriff: failed to get volume usage. error: %v\n", err)
+						nextBreaches[containerName] = breaches[containerName]
+						continue
 					}
 					// fmt.Printf("DiskSheriff,%s,%f\n", containerName, float64(volSize)/(math.Pow(1024, 3)))
 					// TODO read limit from container labels
 					if float64(volSize)/(math.Pow(1024, 3)) > float64(HomeDirSizeLimit) {
+						count := breaches[containerName] + 1
+						if count < v.DiskLimitChecks {
+							log.Printf("DiskSheriff: VM %s has exceeded disk limit (%d/%d checks)\n", containerName, count, v.DiskLimitChecks)
+							nextBreaches[containerName] = count
+							continue
+						}
 						log.Printf("DiskSheriff: VM %s has exceeded disk limit, probably in a boot loop, stopping now\n", containerName)
-						if err := v.VMStop(containerName); err != nil {
+						v.notifyWebhooks(WebhookEventDiskLimitExceeded, containerName, map[string]string{"size": strconv.FormatInt(volSize, 10)})
+						if err := v.VMStopWithReason(containerName, StopReasonDiskLimit); err != nil {
 							log.Printf("DiskSheriff: failed to stop VM %s. error %v\n", containerName, err)
 						}
 					}
 				}
 			}
+			breaches = nextBreaches
 			time.Sleep(30 * time.Second)
 		}
 	}()
 }
 
+const (
+	// How long the result of getContainerHomeDirUsage is reused, as du has to walk through GBs of images
+	diskUsageCacheTTL = 30 * time.Second
+	// Maximum waiting time for du in a container
+	diskUsageTimeout = 60 * time.Second
+)
+
+type homeDirUsage struct {
+	size int64
+	at   time.Time
+}
+
+// VMGetDiskUsage returns the size of the VM's HomeDir in bytes, which diskSheriff compares against
+// HomeDirSizeLimit. The result may be up to diskUsageCacheTTL old.
+func (v *VMM) VMGetDiskUsage(containerName string) (int64, error) {
+	if err := v.isManagedRunningContainer(containerName); err != nil {
+		return 0, err
+	}
+	return v.getContainerHomeDirUsage(containerName)
+}
+
+// VMGetAllDiskUsage returns the size of the HomeDir of every VM in bytes, keyed by container name. The size
+// is -1 if it is unknown, e.g. the container isn't running.
+func (v *VMM) VMGetAllDiskUsage() (map[string]int64, error) {
+	containers, err := v.listCuttlefishContainers()
+	if err != nil {
+		return nil, errors.Wrap(err, "listCuttlefishContainers")
+	}
+	usage := map[string]int64{}
+	for _, c := range containers {
+		containerName := c.Names[0][1:]
+		usage[containerName] = -1
+		if c.State != "running" {
+			continue
+		}
+		size, err := v.getContainerHomeDirUsage(containerName)
+		if err != nil {
+			log.Printf("VMGetAllDiskUsage (%s): %v\n", containerName, err)
+			continue
+		}
+		usage[containerName] = size
+	}
+	return usage, nil
+}
+
+// getContainerHomeDirUsage runs du in the container to get the disk space used by HomeDir. Unlike Client.DiskUsage,
+// which scans every image, container and volume on the host, only the container's own files are walked.
+//
+// Allocated blocks are counted rather than apparent sizes, because the sparse disk images created by launch_cvd
+// would otherwise count at their full size.
 func (v *VMM) getContainerHomeDirUsage(containerName string) (int64, error) {
-	// Volume.UsageData.Size is only populates by DiskUsage()
-	du, err := v.Client.DiskUsage(context.Background())
+	v.diskUsageMu.Lock()
+	cached, ok := v.diskUsageCache[containerName]
+	v.diskUsageMu.Unlock()
+	if ok && time.Since(cached.at) < diskUsageCacheTTL {
+		return cached.size, nil
+	}
+	resp, err := v.containerExecWithTimeout(containerName, "du -sk "+HomeDir, "root", diskUsageTimeout)
 	if err != nil {
 		return 0, err
 	}
-	c, err := v.getContainerJSON(containerName)
+	// du exits with 1 if some files vanished during the walk, e.g. rotated logs, but still prints the total
+	fields := strings.Fields(resp.outBuffer.String())
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("du failed with exit code %d: %s", resp.ExitCode, resp.errBuffer.String())
+	}
+	kb, err := strconv.ParseInt(fields[0], 10, 64)
 	if err != nil {
-		return 0, err
+		return 0, errors.Wrap(err, "failed to parse du output")
 	}
-	for _, m := range c.Mounts {
-		if m.Destination == HomeDir {
-			for _, vol := range du.Volumes {
-				if m.Name == vol.Name {
-					return vol.UsageData.Size, nil
-				}
-			}
-		}
+	size := kb * 1024
+	v.diskUsageMu.Lock()
+	if v.diskUsageCache == nil {
+		v.diskUsageCache = map[string]homeDirUsage{}
 	}
-	return 0, fmt.Errorf("couldn't find %s volume in container %s", HomeDir, containerName)
+	v.diskUsageCache[containerName] = homeDirUsage{size: size, at: time.Now()}
+	v.diskUsageMu.Unlock()
+	return size, nil
 }
 
 func init() {
@@ -7,7 +7,7 @@ import (
 
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
-func NewMockVMM(dataDir string, testBatch string) *VMM {
+func NewMockVMM(dataDir string, testBatch string) (*VMM, error) {
 	return NewVMMImpl(dataDir, testBatch, 300*time.Second)
 }
 
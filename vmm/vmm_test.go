@@ -1,8 +1,14 @@
 package vmm
 
 import (
+	"archive/tar"
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
@@ -10,11 +16,14 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/go-connections/nat"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -42,7 +51,10 @@ func setup() {
 		log.Fatal(err)
 	}
 
-	v = NewMockVMM(dataDir, testBatch)
+	v, err = NewMockVMM(dataDir, testBatch)
+	if err != nil {
+		log.Fatalf("NewMockVMM failed. reason: %v\n", err)
+	}
 	containerName, err = v.VMCreate("01", 2, 4, "Android 12", "")
 	if err != nil {
 		log.Printf("VMCreate failed. reason: %v\n", err)
@@ -78,6 +90,39 @@ func TestNewVMM(t *testing.T) {
 	assert.DirExists(t, path.Join(dataDir, "upload"))
 }
 
+func TestNewVMMInvalidDataDirReturnsError(t *testing.T) {
+	// a regular file can't be used as the parent of DataDir
+	f := path.Join(dataDir, "not-a-folder")
+	require.Nil(t, ioutil.WriteFile(f, []byte{}, 0644))
+	defer os.Remove(f)
+
+	vm, err := NewVMMImpl(path.Join(f, "data"), "matrisea-test-invalid-", 120*time.Second)
+	assert.Nil(t, vm)
+	assert.Error(t, err)
+}
+
+func TestExpandPath(t *testing.T) {
+	home, err := os.UserHomeDir()
+	require.Nil(t, err)
+	os.Setenv("MATRISEA_TEST_DIR", "/srv/matrisea")
+	defer os.Unsetenv("MATRISEA_TEST_DIR")
+
+	for input, want := range map[string]string{
+		"/data":                    "/data",
+		"~":                        home,
+		"~/matrisea":               path.Join(home, "matrisea"),
+		"$MATRISEA_TEST_DIR/data/": "/srv/matrisea/data",
+	} {
+		got, err := ExpandPath(input)
+		assert.Nil(t, err, input)
+		assert.Equal(t, want, got, input)
+	}
+	for _, input := range []string{"data", "$MATRISEA_UNSET_DIR/data", "~user/data"} {
+		_, err := ExpandPath(input)
+		assert.Error(t, err, input)
+	}
+}
+
 func TestGetContainerIDByInvalidName(t *testing.T) {
 	_, err := v.getContainerIDByName("invalid-name")
 	assert.Error(t, err)
@@ -102,7 +147,7 @@ func TestCopyTarToContainer(t *testing.T) {
 	cmd.Dir = dataDir
 	assert.Nil(t, cmd.Run())
 
-	err := v.containerCopyFile(dataDir+"/test.tar", containerName, "/home/vsoc-01")
+	err := v.containerCopyFile(dataDir+"/test.tar", containerName, "/home/vsoc-01", nil)
 	assert.Nil(t, err)
 
 	cmd = exec.Command("docker", "exec", containerName, "ls", "/home/vsoc-01/testfile")
@@ -114,7 +159,7 @@ func TestCopyNonTarToContainer(t *testing.T) {
 	cmd.Dir = dataDir
 	assert.Nil(t, cmd.Run())
 
-	err := v.containerCopyFile(dataDir+"/testfile", containerName, "/home/vsoc-01")
+	err := v.containerCopyFile(dataDir+"/testfile", containerName, "/home/vsoc-01", nil)
 	assert.Nil(t, err)
 
 	cmd = exec.Command("docker", "exec", containerName, "ls", "/home/vsoc-01/testfile")
@@ -182,12 +227,212 @@ func TestContainerAttachToProcessThenKill(t *testing.T) {
 	assert.Error(t, cmd.Run())
 }
 
+func TestContainerKillExecLeavesOtherSessions(t *testing.T) {
+	first, firstResp, err := v.ContainerAttachToProcess(containerName, []string{"top"}, []string{})
+	require.Nil(t, err)
+	defer firstResp.Close()
+	second, secondResp, err := v.ContainerAttachToProcess(containerName, []string{"top"}, []string{})
+	require.Nil(t, err)
+	defer func() {
+		v.ContainerKillExec(containerName, second.ID)
+		v.ContainerReleaseProcess(second.ID)
+		secondResp.Close()
+	}()
+	time.Sleep(time.Second)
+
+	assert.Nil(t, v.ContainerKillExec(containerName, first.ID))
+	v.ContainerReleaseProcess(first.ID)
+	time.Sleep(time.Second)
+	inspect, err := v.Client.ContainerExecInspect(context.Background(), first.ID)
+	assert.Nil(t, err)
+	assert.False(t, inspect.Running)
+	inspect, err = v.Client.ContainerExecInspect(context.Background(), second.ID)
+	assert.Nil(t, err)
+	assert.True(t, inspect.Running)
+}
+
+// fakeADB runs the command after "su 0" in the local shell as the guest's shell. Like the real adb, exec-out exits with
+// 0 even if the command fails, and FAKE_ADB_DENY makes su fail.
+const fakeADB = `#!/bin/sh
+shift 2
+mode=$1
+shift 3
+if [ "$mode" = exec-out ]; then
+  if [ -n "$FAKE_ADB_DENY" ]; then echo "su: Permission denied"; exit 0; fi
+  sh -c "$*"
+  exit 0
+fi
+sh -c "$*"
+`
+
+func TestRootCopyScript(t *testing.T) {
+	dir := t.TempDir()
+	require.Nil(t, os.Mkdir(path.Join(dir, "bin"), 0755))
+	require.Nil(t, ioutil.WriteFile(path.Join(dir, "bin", "adb"), []byte(fakeADB), 0755))
+	guestPath := path.Join(dir, "guest file's.txt")
+	require.Nil(t, ioutil.WriteFile(guestPath, []byte("secret\n"), 0644))
+	run := func(guestPath string, dst string, env ...string) error {
+		cmd := exec.Command("sh", "-c", rootCopyScript("0.0.0.0:6520", guestPath, dst))
+		cmd.Env = append(os.Environ(), append(env, "PATH="+path.Join(dir, "bin")+":"+os.Getenv("PATH"))...)
+		return cmd.Run()
+	}
+
+	dst := path.Join(dir, "copied.txt")
+	assert.Nil(t, run(guestPath, dst))
+	data, err := ioutil.ReadFile(dst)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret\n", string(data))
+
+	// a failed cat is not saved as the file's content
+	dst = path.Join(dir, "denied.txt")
+	assert.Error(t, run(guestPath, dst, "FAKE_ADB_DENY=1"))
+	assert.NoFileExists(t, dst)
+
+	dst = path.Join(dir, "missing.txt")
+	assert.Error(t, run(path.Join(dir, "missing"), dst))
+	assert.NoFileExists(t, dst)
+}
+
+func TestParseResumedActivity(t *testing.T) {
+	testCases := []struct {
+		dumpsys      string
+		wantActivity string
+		wantErr      bool
+	}{
+		{"  mResumedActivity: ActivityRecord{9e4f3a5 u0 com.android.launcher3/.Launcher t6}\n", "com.android.launcher3/.Launcher", false},
+		{"    topResumedActivity=ActivityRecord{2c1d0e8 u0 com.android.settings/.Settings t12}\n    ResumedActivity: ActivityRecord{2c1d0e8 u0 com.android.settings/.Settings t12}\n", "com.android.settings/.Settings", false},
+		{"", "", true},
+	}
+	for _, tc := range testCases {
+		activity, err := parseResumedActivity(tc.dumpsys)
+		assert.Equal(t, tc.wantActivity, activity)
+		if tc.wantErr {
+			assert.Error(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+}
+
+func TestFilterLaunchFlags(t *testing.T) {
+	testCases := []struct {
+		cmdline      string
+		wantAllowed  []string
+		wantRejected []string
+	}{
+		{"", nil, nil},
+		{"--x_res=720 --y_res 1280", []string{"--x_res=720", "--y_res", "1280"}, nil},
+		{"--noguest_enforce_security --kernel_path /etc/shadow", []string{"--noguest_enforce_security"}, []string{"--kernel_path", "/etc/shadow"}},
+		{"--cpus=32 --dpi=320", []string{"--dpi=320"}, []string{"--cpus=32"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.cmdline, func(t *testing.T) {
+			allowed, rejected := v.FilterLaunchFlags(tc.cmdline)
+			assert.Equal(t, tc.wantAllowed, allowed)
+			assert.Equal(t, tc.wantRejected, rejected)
+		})
+	}
+}
+
+func TestVMCreateSameNameConcurrently(t *testing.T) {
+	var wg sync.WaitGroup
+	names := make([]string, 2)
+	errs := make([]error, 2)
+	for i := range names {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			names[i], errs[i] = v.VMCreate("dup", 2, 4, "Android 12", "")
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for i, err := range errs {
+		if err == nil {
+			succeeded++
+			defer v.VMRemove(names[i])
+		} else {
+			assert.True(t, errors.Is(err, ErrVMExists), err.Error())
+		}
+	}
+	assert.Equal(t, 1, succeeded)
+}
+
+func TestVMCreateOverDirtyDeviceFolder(t *testing.T) {
+	deviceDir := path.Join(v.DevicesDir, v.CFPrefix+"dirty")
+	require.Nil(t, os.MkdirAll(deviceDir, 0755))
+	stale := path.Join(deviceDir, "system.img")
+	require.Nil(t, ioutil.WriteFile(stale, []byte("stale"), 0644))
+
+	containerName, err := v.VMCreate("dirty", 2, 4, "Android 12", "")
+	require.Nil(t, err)
+	defer v.VMRemove(containerName)
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(deviceDir)
+	assert.Nil(t, err)
+}
+
+func TestVMRemoveKeepData(t *testing.T) {
+	name, err := v.VMCreate("keep", 2, 4, "Android 12", "")
+	require.Nil(t, err)
+	deviceDir := path.Join(v.DevicesDir, name)
+	defer os.RemoveAll(deviceDir)
+	saved := path.Join(deviceDir, "trace.txt")
+	require.Nil(t, ioutil.WriteFile(saved, []byte("trace"), 0644))
+	require.Nil(t, v.VMRemoveWithOptions(name, VMRemoveOptions{KeepData: true}))
+	_, err = os.Stat(saved)
+	assert.Nil(t, err)
+
+	// the kept folder is only reused on request
+	_, err = v.VMCreate("keep", 2, 4, "Android 12", "")
+	assert.True(t, errors.Is(err, ErrDeviceDataKept))
+	name, err = v.VMCreateWithOptions("keep", VMCreateOptions{CPU: 2, RAM: 4, ReuseData: true})
+	require.Nil(t, err)
+	defer v.VMRemove(name)
+	_, err = os.Stat(saved)
+	assert.Nil(t, err)
+}
+
+func TestVMListAllCuttlefish(t *testing.T) {
+	containers, err := v.VMListAllCuttlefish()
+	require.Nil(t, err)
+	found := false
+	for _, c := range containers {
+		if c.ContainerName == containerName {
+			found = true
+			assert.True(t, c.Managed)
+			assert.Equal(t, v.CFPrefix, c.Prefix)
+			assert.Empty(t, c.ConflictsWith)
+		}
+	}
+	assert.True(t, found)
+}
+
 func TestVMList(t *testing.T) {
 	cfList, err := v.VMList()
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(cfList))
 }
 
+// Simulate a container that has been removed after listCuttlefishContainers but before VMList reads its status
+func TestVMListSkipsRemovedContainer(t *testing.T) {
+	cfList, err := v.listCuttlefishContainers()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(cfList))
+
+	removed := cfList[0]
+	removed.ID = "non-exist-id"
+	removed.Names = []string{"/" + v.CFPrefix + "removed"}
+	removed.Status = "Up 1 second"
+
+	vmList, err := v.vmListItems(append(cfList, removed))
+	assert.Nil(t, err)
+	require.Equal(t, 1, len(vmList))
+	assert.Equal(t, cfList[0].ID, vmList[0].ID)
+}
+
 // Test the full cycle from downloading aosp-main images from Android CI to start/stop the VM.
 // Use require instead of assert to fail fast.
 // Note: this could take 2-5 minutes depends on network conditions
@@ -249,14 +494,505 @@ func TestVMMIntegration(t *testing.T) {
 	require.Nil(t, err)
 
 	// Try start and stop the VM
-	err = v.VMStart(containerName, false, "", func(lines string) {
+	result, err := v.VMStart(containerName, false, VMStartOptions{WaitForUI: true}, func(lines string) {
 		fmt.Println(lines)
 	})
 	require.Nil(t, err)
+	require.Equal(t, BootStatusBooted, result.Status)
 
 	status, _ = v.getVMStatus(container)
 	require.Equal(t, VMRunning, status)
 
+	// starting it again doesn't launch a second launch_cvd
+	_, err = v.VMStart(containerName, true, VMStartOptions{}, func(string) {})
+	assert.True(t, errors.Is(err, ErrVMAlreadyRunning))
+
+	// restarting relaunches launch_cvd in the same container
+	require.Nil(t, v.VMRestart(containerName))
+	running, err := v.isLaunchCVDRunning(containerName)
+	require.Nil(t, err)
+	assert.True(t, running)
+	status, _ = v.getVMStatus(container)
+	assert.Equal(t, VMRunning, status)
+
 	err = v.VMStop(containerName)
 	require.Nil(t, err)
 }
+
+func TestParseLsOutput(t *testing.T) {
+	out := `total 48
+drwxr-xr-x  24 root   root      4096 2022-02-18 11:32 .
+drwxr-xr-x  24 root   root      4096 2022-02-18 11:32 ..
+drwxrwx--x  45 system system    4096 2022-02-18 11:33 data
+lrwxrwxrwx   1 root   root        11 2022-02-18 11:32 bin -> /system/bin
+-rw-r--r--   1 root   root     12345 2022-02-18 11:32 my file.txt
+crw-rw-rw-   1 root   root    1,   3 2022-02-18 11:32 null
+ls: ./proc/1: Permission denied
+`
+	files := parseLsOutput(out)
+	assert.Equal(t, []FileInfo{
+		{Name: "data", Mode: "drwxrwx--x", Owner: "system", Group: "system", Size: 4096, Modified: "2022-02-18 11:33", IsDir: true},
+		{Name: "bin", Mode: "lrwxrwxrwx", Owner: "root", Group: "root", Size: 11, Modified: "2022-02-18 11:32", LinkTarget: "/system/bin"},
+		{Name: "my file.txt", Mode: "-rw-r--r--", Owner: "root", Group: "root", Size: 12345, Modified: "2022-02-18 11:32"},
+		{Name: "null", Mode: "crw-rw-rw-", Owner: "root", Group: "root", Modified: "2022-02-18 11:32"},
+	}, files)
+	assert.Empty(t, parseLsOutput(""))
+}
+
+func TestConfinePath(t *testing.T) {
+	testCases := []struct {
+		path    string
+		roots   []string
+		want    string
+		wantErr bool
+	}{
+		{"/home/vsoc-01/cuttlefish_runtime/launcher.log", []string{HomeDir}, "/home/vsoc-01/cuttlefish_runtime/launcher.log", false},
+		{"/home/vsoc-01", []string{HomeDir}, "/home/vsoc-01", false},
+		{"cuttlefish_runtime/../launch_cvd.out", []string{HomeDir}, "/home/vsoc-01/launch_cvd.out", false},
+		{"/data/trace.txt", []string{HomeDir, DeviceDir}, "/data/trace.txt", false},
+		{"../../etc/passwd", []string{HomeDir}, "", true},
+		{"/home/vsoc-01/../../etc/passwd", []string{HomeDir}, "", true},
+		{"/etc/passwd", []string{HomeDir}, "", true},
+		{"/data/trace.txt", []string{HomeDir}, "", true},
+		// a sibling folder sharing the prefix of the root
+		{"/home/vsoc-01-other/file", []string{HomeDir}, "", true},
+		{"", []string{HomeDir}, "", true},
+	}
+	for _, tc := range testCases {
+		p, err := ConfinePath(tc.path, tc.roots...)
+		assert.Equal(t, tc.want, p, tc.path)
+		if tc.wantErr {
+			assert.Error(t, err, tc.path)
+		} else {
+			assert.Nil(t, err, tc.path)
+		}
+	}
+}
+
+func TestParseWakefulness(t *testing.T) {
+	state, ok := parseWakefulness("  mWakefulness=Asleep\n  mWakefulnessChanging=false\n")
+	assert.True(t, ok)
+	assert.Equal(t, ScreenAsleep, state)
+	_, ok = parseWakefulness("")
+	assert.False(t, ok)
+}
+
+func TestLocaleAndTimezoneRegex(t *testing.T) {
+	for _, locale := range []string{"en-US", "fr", "zh-Hant-TW", "es-419"} {
+		assert.True(t, localeRegex.MatchString(locale), locale)
+	}
+	for _, locale := range []string{"", "en_US", "EN-us", "en-US; reboot"} {
+		assert.False(t, localeRegex.MatchString(locale), locale)
+	}
+	for _, tz := range []string{"UTC", "Asia/Singapore", "America/Argentina/Buenos_Aires", "Etc/GMT+8"} {
+		assert.True(t, timezoneRegex.MatchString(tz), tz)
+	}
+	for _, tz := range []string{"", "/etc/passwd", "Asia/Singapore && reboot", "../UTC"} {
+		assert.False(t, timezoneRegex.MatchString(tz), tz)
+	}
+}
+
+func TestValidatePackageName(t *testing.T) {
+	assert.Nil(t, validatePackageName("com.android.settings"))
+	assert.Nil(t, validatePackageName("com.example.app_2"))
+	assert.Error(t, validatePackageName("settings"))
+	assert.Error(t, validatePackageName("com.example; reboot"))
+	assert.Error(t, validatePackageName(""))
+}
+
+func TestLogSourcePath(t *testing.T) {
+	for _, source := range LogSources {
+		p, err := LogSourcePath(source)
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(p, HomeDir+"/cuttlefish_runtime/"), p)
+	}
+	p, err := LogSourcePath("launcher")
+	assert.Nil(t, err)
+	assert.Equal(t, HomeDir+"/cuttlefish_runtime/launcher.log", p)
+	_, err = LogSourcePath("../../etc/passwd")
+	assert.Error(t, err)
+	_, err = LogSourcePath("")
+	assert.Error(t, err)
+}
+
+func TestPortForInstanceNoCollision(t *testing.T) {
+	// ports published on the host must be unique across all VMs
+	hostPorts := map[int]int{}
+	for cf := 1; cf <= 100; cf++ {
+		vnc := portForInstance(VNCBasePort, cf)
+		websockify := portForInstance(WebsockifyBasePort, cf)
+		adb := portForInstance(ADBBasePort, cf)
+		assert.NotEqual(t, vnc, websockify, "cf_instance %d", cf)
+		assert.NotEqual(t, vnc, adb, "cf_instance %d", cf)
+		assert.NotEqual(t, websockify, adb, "cf_instance %d", cf)
+		for _, port := range []int{websockify, adb} {
+			if other, ok := hostPorts[port]; ok {
+				t.Errorf("port %d of cf_instance %d collides with cf_instance %d", port, cf, other)
+			}
+			hostPorts[port] = cf
+		}
+	}
+	assert.Equal(t, 6080, portForInstance(WebsockifyBasePort, 1))
+	assert.Equal(t, 6521, portForInstance(ADBBasePort, 2))
+}
+
+func TestWaitForBootOutput(t *testing.T) {
+	var lines []string
+	status, err := waitForBootOutput(strings.NewReader("Launcher log\nVIRTUAL_DEVICE_BOOT_COMPLETED\n"), time.Second, func(line string) {
+		lines = append(lines, line)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, BootStatusBooted, status)
+	assert.Equal(t, []string{"Launcher log", "VIRTUAL_DEVICE_BOOT_COMPLETED"}, lines)
+
+	status, err = waitForBootOutput(strings.NewReader("Launcher log\nVIRTUAL_DEVICE_BOOT_FAILED\n"), time.Second, func(string) {})
+	assert.Error(t, err)
+	assert.Equal(t, BootStatusCrashed, status)
+
+	// a stream that never completes nor ends
+	r, w := io.Pipe()
+	defer w.Close()
+	status, err = waitForBootOutput(r, 50*time.Millisecond, func(string) {})
+	assert.Error(t, err)
+	assert.Equal(t, BootStatusTimeout, status)
+}
+
+func TestSetBootTimeout(t *testing.T) {
+	vm := newTestKVStoreVMM(t)
+	vm.BootTimeout = 120 * time.Second
+
+	assert.Equal(t, 120*time.Second, vm.GetBootTimeout())
+	assert.Error(t, vm.SetBootTimeout(0))
+	require.Nil(t, vm.SetBootTimeout(5*time.Minute))
+	assert.Equal(t, 5*time.Minute, vm.GetBootTimeout())
+}
+
+func TestRecordCreateFailureKeepsLatest(t *testing.T) {
+	vm := newTestKVStoreVMM(t)
+
+	failures, err := vm.ListCreateFailures()
+	require.Nil(t, err)
+	assert.Empty(t, failures)
+
+	for i := 0; i < MaxCreateFailures+5; i++ {
+		require.Nil(t, vm.RecordCreateFailure(CreateFailure{Device: fmt.Sprintf("cvd-%d", i)}))
+	}
+	failures, err = vm.ListCreateFailures()
+	require.Nil(t, err)
+	require.Len(t, failures, MaxCreateFailures)
+	assert.Equal(t, fmt.Sprintf("cvd-%d", MaxCreateFailures+4), failures[0].Device)
+	assert.Equal(t, "cvd-5", failures[MaxCreateFailures-1].Device)
+}
+
+func TestValidateSuperImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matrisea-super-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sparse := make([]byte, superImageMinimumBytes)
+	binary.LittleEndian.PutUint32(sparse, sparseImageMagic)
+	raw := make([]byte, superImageMinimumBytes+100)
+	binary.LittleEndian.PutUint32(raw[superGeometryOffset:], superGeometryMagic)
+	for name, content := range map[string][]byte{
+		"sparse.img": sparse,
+		"raw.img":    raw,
+		"zeros.img":  make([]byte, superImageMinimumBytes),
+		"small.img":  sparse[:4],
+	} {
+		require.Nil(t, ioutil.WriteFile(path.Join(dir, name), content, 0644))
+	}
+	assert.Nil(t, ValidateSuperImage(path.Join(dir, "sparse.img")))
+	assert.Nil(t, ValidateSuperImage(path.Join(dir, "raw.img")))
+	assert.Error(t, ValidateSuperImage(path.Join(dir, "zeros.img")))
+	assert.Error(t, ValidateSuperImage(path.Join(dir, "small.img")))
+	assert.Error(t, ValidateSuperImage(path.Join(dir, "missing.img")))
+}
+
+func TestValidateGPUMode(t *testing.T) {
+	assert.Nil(t, ValidateGPUMode(""))
+	assert.Nil(t, ValidateGPUMode("gfxstream"))
+	assert.Nil(t, ValidateGPUMode(GPUModeSwiftShader))
+	assert.Error(t, ValidateGPUMode("auto"))
+	assert.False(t, isHardwareGPUMode(GPUModeSwiftShader))
+	assert.True(t, isHardwareGPUMode("drm_virgl"))
+}
+
+func TestValidateLabels(t *testing.T) {
+	assert.Nil(t, ValidateLabels(nil))
+	assert.Nil(t, ValidateLabels(map[string]string{"team": "android-qa", "ticket": "JIRA-123", "owner": "alice@example.com"}))
+	assert.Error(t, ValidateLabels(map[string]string{"": "x"}))
+	assert.Error(t, ValidateLabels(map[string]string{"team name": "x"}))
+	assert.Error(t, ValidateLabels(map[string]string{"team": "a\nb"}))
+	assert.Error(t, ValidateLabels(map[string]string{"team": strings.Repeat("a", 256)}))
+
+	labels := userLabels(map[string]string{"cf_instance": "1", LABEL_USER_PREFIX + "team": "qa"})
+	assert.Equal(t, map[string]string{"team": "qa"}, labels)
+}
+
+func TestValidateDeviceName(t *testing.T) {
+	vm := &VMM{CFPrefix: "matrisea-cvd-"}
+	assert.Equal(t, 50, vm.MaxDeviceNameLength())
+	assert.Nil(t, vm.ValidateDeviceName("pixel_5-qa"))
+	assert.Nil(t, vm.ValidateDeviceName(strings.Repeat("a", 50)))
+	assert.Error(t, vm.ValidateDeviceName(strings.Repeat("a", 51)))
+	assert.Error(t, vm.ValidateDeviceName("a[b]"))
+	assert.Error(t, vm.ValidateDeviceName(""))
+}
+
+func TestValidateCpuset(t *testing.T) {
+	assert.Nil(t, ValidateCpuset("0", 8))
+	assert.Nil(t, ValidateCpuset("0-3,7", 8))
+	assert.Nil(t, ValidateCpuset("4-4", 8))
+	assert.Error(t, ValidateCpuset("8", 8))
+	assert.Error(t, ValidateCpuset("6-9", 8))
+	assert.Error(t, ValidateCpuset("3-1", 8))
+	assert.Error(t, ValidateCpuset("0,,1", 8))
+	assert.Error(t, ValidateCpuset("-1", 8))
+	assert.Error(t, ValidateCpuset("a-b", 8))
+}
+
+func TestKillExecsScript(t *testing.T) {
+	dir := t.TempDir()
+	cmd := execRecordCommand(dir, "abc", []string{"sleep", "30"})
+	p := exec.Command(cmd[0], cmd[1:]...)
+	assert.Nil(t, p.Start())
+	defer p.Process.Kill()
+	// wait for the record
+	recorded := false
+	for i := 0; i < 50 && !recorded; i++ {
+		_, err := os.Stat(path.Join(dir, "abc"))
+		recorded = err == nil
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.True(t, recorded)
+	// a record of a reused pid is left alone
+	assert.Nil(t, ioutil.WriteFile(path.Join(dir, "def"), []byte(fmt.Sprintf("%d 1\n", p.Process.Pid)), 0644))
+	out, err := exec.Command("sh", "-c", killExecsScript(dir, []string{"def"})).Output()
+	assert.Nil(t, err)
+	assert.Empty(t, strings.TrimSpace(string(out)))
+	assert.NoFileExists(t, path.Join(dir, "def"))
+
+	out, err = exec.Command("sh", "-c", killExecsScript(dir, []string{"abc", "missing"})).Output()
+	assert.Nil(t, err)
+	assert.Equal(t, strconv.Itoa(p.Process.Pid), strings.TrimSpace(string(out)))
+	assert.NoFileExists(t, path.Join(dir, "abc"))
+	assert.NotNil(t, p.Wait())
+}
+
+func TestNumInstancesFromCmdline(t *testing.T) {
+	assert.Equal(t, 1, numInstancesFromCmdline(""))
+	assert.Equal(t, 1, numInstancesFromCmdline("--gpu_mode=auto"))
+	assert.Equal(t, 3, numInstancesFromCmdline("--gpu_mode=auto --num_instances=3"))
+	assert.Equal(t, 2, numInstancesFromCmdline("--num_instances 2 --nostart_webrtc"))
+	assert.Equal(t, 1, numInstancesFromCmdline("--num_instances=0"))
+	assert.Equal(t, 1, numInstancesFromCmdline("--num_instances"))
+}
+
+func TestNormalizeAOSPVersion(t *testing.T) {
+	for _, version := range []string{"Android 12", "android 12", "ANDROID12", " Android  12 "} {
+		got, err := NormalizeAOSPVersion(version)
+		assert.Nil(t, err, version)
+		assert.Equal(t, Android12, got)
+	}
+	got, err := NormalizeAOSPVersion("Android 9")
+	assert.Nil(t, err)
+	assert.Equal(t, Android9, got)
+	for _, version := range []string{"", "12", "Android 1", "Android 13"} {
+		_, err := NormalizeAOSPVersion(version)
+		assert.NotNil(t, err, version)
+	}
+}
+
+func TestLastLines(t *testing.T) {
+	assert.Equal(t, "c\nd", lastLines("a\nb\nc\nd\n", 2))
+	assert.Equal(t, "write error (disk full?)", lastLines("write error (disk full?)\n", 5))
+	assert.Equal(t, "", lastLines("", 5))
+}
+
+func TestParseUnzipOutput(t *testing.T) {
+	member, ok := parseUnzipOutput("  inflating: super.img               ")
+	assert.True(t, ok)
+	assert.Equal(t, "super.img", member)
+	member, ok = parseUnzipOutput(" extracting: android-info.txt")
+	assert.True(t, ok)
+	assert.Equal(t, "android-info.txt", member)
+	_, ok = parseUnzipOutput("Archive:  /home/vsoc-01/aosp_cf_x86_64_phone-img.zip")
+	assert.False(t, ok)
+
+	assert.Equal(t, 2, countZipMembers("boot.img\nsuper.img\nvendor_boot.img\n", "super.img"))
+	assert.Equal(t, 3, countZipMembers("boot.img\nsuper.img\nvendor_boot.img\n", ""))
+	assert.Equal(t, "12/25 files (48%), super.img", UnzipProgress{File: "super.img", FilesDone: 12, FilesTotal: 25}.String())
+}
+
+func TestLockVM(t *testing.T) {
+	vm := &VMM{}
+	unlock, err := vm.lockVM("cvd-1", "start")
+	require.Nil(t, err)
+	_, err = vm.lockVM("cvd-1", "stop")
+	assert.True(t, errors.Is(err, ErrOperationInProgress))
+	assert.Contains(t, err.Error(), "start is in progress")
+	// other VMs are not affected
+	unlockOther, err := vm.lockVM("cvd-2", "stop")
+	require.Nil(t, err)
+	unlockOther()
+
+	unlock()
+	unlock, err = vm.lockVM("cvd-1", "stop")
+	assert.Nil(t, err)
+	unlock()
+}
+
+func TestWebsockifyCommand(t *testing.T) {
+	assert.Equal(t, "websockify -D 6080 127.0.0.1:6444 --log-file /home/vsoc-01/websockify.log", websockifyCommand(6080, 6444, ""))
+	assert.Equal(t, "websockify -D 6080 127.0.0.1:6444", websockifyCommand(6080, 6444, WebsockifyLogOff))
+	assert.Equal(t, "websockify -D 6081 127.0.0.1:6445 --log-file /home/vsoc-01/websockify.log --verbose", websockifyCommand(6081, 6445, WebsockifyLogDebug))
+}
+
+func TestRotateLogCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matrisea-rotate-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	logFile := path.Join(dir, "daemon.log")
+	require.Nil(t, ioutil.WriteFile(logFile, []byte("0123456789"), 0644))
+
+	// under the limit
+	out, err := exec.Command("sh", "-c", rotateLogCommand(logFile, 10)).CombinedOutput()
+	require.Nil(t, err, string(out))
+	_, err = os.Stat(logFile + ".1")
+	assert.True(t, os.IsNotExist(err))
+
+	out, err = exec.Command("sh", "-c", rotateLogCommand(logFile, 5)).CombinedOutput()
+	require.Nil(t, err, string(out))
+	rotated, _ := ioutil.ReadFile(logFile + ".1")
+	assert.Equal(t, "0123456789", string(rotated))
+	current, _ := ioutil.ReadFile(logFile)
+	assert.Empty(t, current)
+
+	// a missing log is not an error
+	out, err = exec.Command("sh", "-c", rotateLogCommand(path.Join(dir, "missing.log"), 5)).CombinedOutput()
+	assert.Nil(t, err, string(out))
+}
+
+func TestLastStartOptions(t *testing.T) {
+	vm := newTestKVStoreVMM(t)
+
+	assert.Equal(t, VMStartOptions{}, vm.lastStartOptions("cvd-1"))
+	opts := VMStartOptions{Daemon: true, GPUMode: GPUModeSwiftShader}
+	vm.saveStartOptions("cvd-1", opts)
+	assert.Equal(t, opts, vm.lastStartOptions("cvd-1"))
+}
+
+func TestResetBootAttempts(t *testing.T) {
+	vm := newTestKVStoreVMM(t)
+	vm.MaxBootAttempts = 2
+
+	// healthy VMs started more than MaxBootAttempts times are not quarantined
+	for i := 0; i < 3; i++ {
+		vm.countBootAttempt("cvd-1")
+		vm.resetBootAttempts("cvd-1")
+	}
+	assert.Equal(t, "0", vm.KVStore.GetContainerValueOrEmpty("cvd-1", CONFIG_KEY_BOOT_ATTEMPTS))
+	assert.NotEqual(t, "true", vm.KVStore.GetContainerValueOrEmpty("cvd-1", CONFIG_KEY_BOOT_FAILED))
+
+	for i := 0; i < 3; i++ {
+		vm.countBootAttempt("cvd-1")
+	}
+	assert.Equal(t, "true", vm.KVStore.GetContainerValueOrEmpty("cvd-1", CONFIG_KEY_BOOT_FAILED))
+}
+
+func TestCuttlefishPrefix(t *testing.T) {
+	assert.Equal(t, "cvd-test-", cuttlefishPrefix(map[string]string{LABEL_CF_PREFIX: "cvd-test-"}, "cvd-test-1", "cvd-"))
+	assert.Equal(t, "cvd-", cuttlefishPrefix(map[string]string{LABEL_CF_PREFIX: "cvd-"}, "cvd-1", "cvd-"))
+	// created before the label was added
+	assert.Equal(t, "cvd-", cuttlefishPrefix(map[string]string{}, "cvd-1", "cvd-"))
+	assert.Equal(t, "", cuttlefishPrefix(map[string]string{}, "other-1", "cvd-"))
+}
+
+func TestCfInstanceFromPortBindings(t *testing.T) {
+	bindings := nat.PortMap{
+		"6082/tcp": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "6082"}},
+		"6522/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "6522"}},
+	}
+	// map iteration order differs between runs
+	for i := 0; i < 10; i++ {
+		num, ok := cfInstanceFromPortBindings(bindings)
+		assert.True(t, ok)
+		assert.Equal(t, 3, num)
+	}
+	_, ok := cfInstanceFromPortBindings(nat.PortMap{"6080/tcp": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "6080"}}})
+	assert.False(t, ok)
+	_, ok = cfInstanceFromPortBindings(nil)
+	assert.False(t, ok)
+}
+
+func TestTempDirUsesTmpDir(t *testing.T) {
+	base, err := ioutil.TempDir("", "matrisea-tmpdir-")
+	require.Nil(t, err)
+	defer os.RemoveAll(base)
+	oldTmpDir := v.TmpDir
+	defer func() { v.TmpDir = oldTmpDir }()
+
+	v.TmpDir = path.Join(base, "not-created-yet")
+	tmp, err := v.tempDir("fetch-aosp")
+	require.Nil(t, err)
+	assert.Equal(t, path.Join(v.TmpDir, "fetch-aosp"), tmp)
+	assert.DirExists(t, tmp)
+}
+
+func TestTarSingleFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matrisea-tar-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	content := []byte("matrisea")
+	require.Nil(t, ioutil.WriteFile(path.Join(dir, "image.zip"), content, 0644))
+
+	var buf bytes.Buffer
+	require.Nil(t, tarSingleFile(&buf, path.Join(dir, "image.zip"), nil))
+	tr := tar.NewReader(&buf)
+	header, err := tr.Next()
+	require.Nil(t, err)
+	assert.Equal(t, "image.zip", header.Name)
+	assert.Equal(t, int64(len(content)), header.Size)
+	archived, err := ioutil.ReadAll(tr)
+	require.Nil(t, err)
+	assert.Equal(t, content, archived)
+	_, err = tr.Next()
+	assert.Equal(t, io.EOF, err)
+
+	assert.Error(t, tarSingleFile(&buf, dir, nil))
+}
+
+func TestCopyProgress(t *testing.T) {
+	p := CopyProgress{BytesDone: 4509715661, BytesTotal: 13958643712, BytesPerSecond: 120 * 1024 * 1024}
+	assert.Equal(t, "4.2GB/13GB (32%, 120MB/s, ~1m15s left)", p.String())
+	assert.Equal(t, "0B/512B (0%, 0B/s, unknown time left)", CopyProgress{BytesTotal: 512}.String())
+	assert.Equal(t, "1.5KB", formatBytes(1536))
+
+	oldInterval := copyProgressInterval
+	defer func() { copyProgressInterval = oldInterval }()
+	copyProgressInterval = time.Hour
+	var reports []CopyProgress
+	r := newProgressReader(bytes.NewReader(make([]byte, 1000)), "image.zip", 1000, func(p CopyProgress) {
+		reports = append(reports, p)
+	})
+	n, err := io.Copy(ioutil.Discard, r)
+	require.Nil(t, err)
+	assert.Equal(t, int64(1000), n)
+	// only the final report as the interval is never reached
+	require.Len(t, reports, 1)
+	assert.Equal(t, "image.zip", reports[0].File)
+	assert.Equal(t, int64(1000), reports[0].BytesDone)
+}
+
+func TestParsePsOutput(t *testing.T) {
+	out := `USER            PID   PPID     VSZ    RSS WCHAN            ADDR S NAME
+root              1      0 10782796  9920 do_epoll_wait       0 S init
+u0_a102        2731    334 14193232 98424 do_epoll_wait       0 S com.android.settings
+system         2802    334 13915504 72532 0                   0 R system_server
+`
+	assert.Equal(t, []ProcessInfo{
+		{User: "root", PID: 1, PPID: 0, VSZ: 10782796, RSS: 9920, State: "S", Name: "init"},
+		{User: "u0_a102", PID: 2731, PPID: 334, VSZ: 14193232, RSS: 98424, State: "S", Name: "com.android.settings"},
+		{User: "system", PID: 2802, PPID: 334, VSZ: 13915504, RSS: 72532, State: "R", Name: "system_server"},
+	}, parsePsOutput(out))
+}
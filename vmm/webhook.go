@@ -0,0 +1,198 @@
+package vmm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Outbound webhooks that are notified of VM lifecycle events, e.g. to post to Slack or trigger a CI job.
+// Webhooks are kept in KVStore and each event is POSTed to the matching webhooks in the background.
+
+type WebhookEvent string
+
+const (
+	WebhookEventCreated           WebhookEvent = "vm.created"
+	WebhookEventBooted            WebhookEvent = "vm.booted"
+	WebhookEventStopped           WebhookEvent = "vm.stopped" // with the StopReason in the details
+	WebhookEventRemoved           WebhookEvent = "vm.removed"
+	WebhookEventDiskLimitExceeded WebhookEvent = "vm.disk_limit_exceeded"
+	WebhookEventBootLoopDetected  WebhookEvent = "vm.boot_loop_detected" // exceeded VMM.MaxBootAttempts
+)
+
+var (
+	WebhookEvents = []WebhookEvent{
+		WebhookEventCreated,
+		WebhookEventBooted,
+		WebhookEventStopped,
+		WebhookEventRemoved,
+		WebhookEventDiskLimitExceeded,
+		WebhookEventBootLoopDetected,
+	}
+	// delays between the attempts to deliver an event
+	webhookRetryDelays = []time.Duration{1 * time.Second, 5 * time.Second, 30 * time.Second}
+	webhookClient      = &http.Client{Timeout: 10 * time.Second}
+)
+
+// key of the JSON-encoded []Webhook in the global bucket of KVStore
+const GLOBAL_KEY_WEBHOOKS = "webhooks"
+
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Events to be notified of, all events if empty
+	Events []WebhookEvent `json:"events"`
+}
+
+// WebhookPayload is the JSON body POSTed to webhooks.
+type WebhookPayload struct {
+	Event     WebhookEvent      `json:"event"`
+	VM        string            `json:"vm"` // container name
+	Timestamp int64             `json:"timestamp"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+func (h Webhook) accepts(event WebhookEvent) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// AddWebhook registers a http(s) URL to be notified of events, or of all events if events is empty.
+func (v *VMM) AddWebhook(webhookURL string, events []WebhookEvent) (Webhook, error) {
+	u, err := url.Parse(webhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, fmt.Errorf("invalid webhook URL %s", webhookURL)
+	}
+	for _, e := range events {
+		if !isWebhookEvent(e) {
+			return Webhook{}, fmt.Errorf("unknown webhook event %s", e)
+		}
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Webhook{}, err
+	}
+	hook := Webhook{ID: hex.EncodeToString(id), URL: webhookURL, Events: events}
+
+	v.webhooksMu.Lock()
+	defer v.webhooksMu.Unlock()
+	hooks, err := v.ListWebhooks()
+	if err != nil {
+		return Webhook{}, err
+	}
+	if err := v.saveWebhooks(append(hooks, hook)); err != nil {
+		return Webhook{}, err
+	}
+	return hook, nil
+}
+
+// RemoveWebhook unregisters the webhook of the given ID.
+func (v *VMM) RemoveWebhook(id string) error {
+	v.webhooksMu.Lock()
+	defer v.webhooksMu.Unlock()
+	hooks, err := v.ListWebhooks()
+	if err != nil {
+		return err
+	}
+	for i, hook := range hooks {
+		if hook.ID == id {
+			return v.saveWebhooks(append(hooks[:i], hooks[i+1:]...))
+		}
+	}
+	return fmt.Errorf("webhook %s not found", id)
+}
+
+func (v *VMM) ListWebhooks() ([]Webhook, error) {
+	hooks := []Webhook{}
+	value := v.KVStore.GetGlobalValueOrEmpty(GLOBAL_KEY_WEBHOOKS)
+	if value == "" {
+		return hooks, nil
+	}
+	if err := json.Unmarshal([]byte(value), &hooks); err != nil {
+		return nil, errors.Wrap(err, "failed to read webhooks")
+	}
+	return hooks, nil
+}
+
+func (v *VMM) saveWebhooks(hooks []Webhook) error {
+	value, err := json.Marshal(hooks)
+	if err != nil {
+		return err
+	}
+	return v.KVStore.PutGlobalValue(GLOBAL_KEY_WEBHOOKS, string(value))
+}
+
+func isWebhookEvent(event WebhookEvent) bool {
+	for _, e := range WebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyWebhooks sends an event to the matching webhooks in the background. Failed deliveries are retried after
+// each of webhookRetryDelays and then dropped.
+func (v *VMM) notifyWebhooks(event WebhookEvent, containerName string, details map[string]string) {
+	hooks, err := v.ListWebhooks()
+	if err != nil {
+		log.Printf("notifyWebhooks: %v\n", err)
+		return
+	}
+	body, err := json.Marshal(WebhookPayload{
+		Event:     event,
+		VM:        containerName,
+		Timestamp: time.Now().Unix(),
+		Details:   details,
+	})
+	if err != nil {
+		log.Printf("notifyWebhooks: %v\n", err)
+		return
+	}
+	for _, hook := range hooks {
+		if hook.accepts(event) {
+			go deliverWebhook(hook, body)
+		}
+	}
+}
+
+func deliverWebhook(hook Webhook, body []byte) {
+	for attempt := 0; ; attempt++ {
+		err := postWebhook(hook.URL, body)
+		if err == nil {
+			return
+		}
+		if attempt >= len(webhookRetryDelays) {
+			log.Printf("deliverWebhook (%s): giving up after %d attempts. error: %v\n", hook.ID, attempt+1, err)
+			return
+		}
+		time.Sleep(webhookRetryDelays[attempt])
+	}
+}
+
+func postWebhook(webhookURL string, body []byte) error {
+	resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package vmm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookDeliveryWithRetry(t *testing.T) {
+	oldDelays := webhookRetryDelays
+	defer func() { webhookRetryDelays = oldDelays }()
+	webhookRetryDelays = []time.Duration{10 * time.Millisecond, 10 * time.Millisecond}
+
+	received := make(chan WebhookPayload, 10)
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first attempt fails
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload WebhookPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		received <- payload
+	}))
+	defer server.Close()
+
+	vm := newTestKVStoreVMM(t)
+	_, err := vm.AddWebhook(server.URL, []WebhookEvent{WebhookEventStopped})
+	require.Nil(t, err)
+
+	// filtered out
+	vm.notifyWebhooks(WebhookEventBooted, "matrisea-cvd-01", nil)
+	vm.notifyWebhooks(WebhookEventStopped, "matrisea-cvd-01", map[string]string{"reason": string(StopReasonDiskLimit)})
+	select {
+	case payload := <-received:
+		assert.Equal(t, WebhookEventStopped, payload.Event)
+		assert.Equal(t, "matrisea-cvd-01", payload.VM)
+		assert.Equal(t, string(StopReasonDiskLimit), payload.Details["reason"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+	select {
+	case payload := <-received:
+		t.Fatalf("unexpected event %s", payload.Event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAddAndRemoveWebhook(t *testing.T) {
+	vm := newTestKVStoreVMM(t)
+	_, err := vm.AddWebhook("ftp://example.com", nil)
+	assert.Error(t, err)
+	_, err = vm.AddWebhook("https://example.com/hook", []WebhookEvent{"vm.unknown"})
+	assert.Error(t, err)
+
+	hook, err := vm.AddWebhook("https://example.com/hook", nil)
+	require.Nil(t, err)
+	hooks, err := vm.ListWebhooks()
+	require.Nil(t, err)
+	assert.Equal(t, []Webhook{hook}, hooks)
+
+	require.Nil(t, vm.RemoveWebhook(hook.ID))
+	assert.Error(t, vm.RemoveWebhook(hook.ID))
+	hooks, err = vm.ListWebhooks()
+	require.Nil(t, err)
+	assert.Empty(t, hooks)
+}
@@ -0,0 +1,121 @@
+package vmm
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+)
+
+// Discovery of devices streamed over WebRTC. When launch_cvd runs with --start_webrtc, the cuttlefish operator in the
+// container keeps a registry of the devices that can be connected to, with IDs like "cvd-1" where the number is the
+// device's CUTTLEFISH_INSTANCE.
+
+// HTTP port of the cuttlefish operator in a container
+const WebRTCOperatorPort = 1080
+
+var webrtcOperatorClient = &http.Client{Timeout: 2 * time.Second}
+
+type WebRTCDevice struct {
+	DeviceID      string `json:"device_id"` // ID in the operator's registry e.g. "cvd-1"
+	ContainerName string `json:"container_name"`
+	// Host port the operator is published on. The operator serves the WebRTC client at
+	// http://<docker host>:<OperatorPort>/client.html?deviceId=<DeviceID>
+	OperatorPort int `json:"operator_port"`
+}
+
+// VMListWebRTCDevices lists the devices registered to the operators of all running VMs. Each device is mapped to its
+// container by the instance number in the device ID. VMs without a reachable operator, e.g. those launched with
+// --nostart_webrtc, and VMs created before the operator was published on the host are skipped.
+func (v *VMM) VMListWebRTCDevices() ([]WebRTCDevice, error) {
+	containers, err := v.listCuttlefishContainers()
+	if err != nil {
+		return nil, err
+	}
+	devices := []WebRTCDevice{}
+	for _, c := range containers {
+		if c.State != "running" {
+			continue
+		}
+		containerName := c.Names[0][1:]
+		instances, err := v.containerInstanceNums(containerName)
+		if err != nil {
+			log.Printf("VMListWebRTCDevices (%s): %v\n", containerName, err)
+			continue
+		}
+		containerJSON, err := v.getContainerJSON(containerName)
+		if err != nil || containerJSON.NetworkSettings.IPAddress == "" {
+			continue
+		}
+		hostPort, ok := publishedPort(containerJSON.NetworkSettings.Ports, WebRTCOperatorPort)
+		if !ok {
+			continue
+		}
+		// the operator is queried on the container network, which is reachable from the API server
+		ids, err := getOperatorDevices(fmt.Sprintf("http://%s:%d", containerJSON.NetworkSettings.IPAddress, WebRTCOperatorPort))
+		if err != nil {
+			continue
+		}
+		for _, id := range ids {
+			num, ok := webrtcInstanceNumber(id)
+			if !ok || !containsInt(instances, num) {
+				continue
+			}
+			devices = append(devices, WebRTCDevice{DeviceID: id, ContainerName: containerName, OperatorPort: hostPort})
+		}
+	}
+	return devices, nil
+}
+
+// publishedPort returns the host port that a tcp port of a container is published on
+func publishedPort(ports nat.PortMap, containerPort int) (int, bool) {
+	for _, binding := range ports[nat.Port(fmt.Sprintf("%d/tcp", containerPort))] {
+		if hostPort, err := strconv.Atoi(binding.HostPort); err == nil {
+			return hostPort, true
+		}
+	}
+	return 0, false
+}
+
+// getOperatorDevices returns the device IDs in an operator's registry
+func getOperatorDevices(operatorURL string) ([]string, error) {
+	resp, err := webrtcOperatorClient.Get(operatorURL + "/devices")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	ids := []string{}
+	if err := json.NewDecoder(resp.Body).Decode(&ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// webrtcInstanceNumber parses the CUTTLEFISH_INSTANCE of an operator device ID e.g. 1 of "cvd-1"
+func webrtcInstanceNumber(deviceID string) (int, bool) {
+	if !strings.HasPrefix(deviceID, "cvd-") {
+		return 0, false
+	}
+	num, err := strconv.Atoi(strings.TrimPrefix(deviceID, "cvd-"))
+	if err != nil || num < 1 {
+		return 0, false
+	}
+	return num, true
+}
+
+func containsInt(list []int, target int) bool {
+	for _, n := range list {
+		if n == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package vmm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetOperatorDevices(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/devices" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`["cvd-1","cvd-2"]`))
+	}))
+	defer server.Close()
+
+	ids, err := getOperatorDevices(server.URL)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"cvd-1", "cvd-2"}, ids)
+
+	_, err = getOperatorDevices(server.URL + "/unknown")
+	assert.Error(t, err)
+}
+
+func TestWebRTCInstanceNumber(t *testing.T) {
+	num, ok := webrtcInstanceNumber("cvd-3")
+	assert.True(t, ok)
+	assert.Equal(t, 3, num)
+	for _, id := range []string{"cvd-0", "cvd-", "cvd-x", "device-1", ""} {
+		_, ok := webrtcInstanceNumber(id)
+		assert.False(t, ok, id)
+	}
+}
+
+func TestPublishedPort(t *testing.T) {
+	ports := nat.PortMap{
+		"1080/tcp": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "1082"}},
+		"6082/tcp": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "6082"}},
+	}
+	port, ok := publishedPort(ports, WebRTCOperatorPort)
+	assert.True(t, ok)
+	assert.Equal(t, 1082, port)
+	// not published, e.g. the VM was created before the operator was published
+	_, ok = publishedPort(nat.PortMap{"1080/tcp": nil}, WebRTCOperatorPort)
+	assert.False(t, ok)
+	_, ok = publishedPort(nil, WebRTCOperatorPort)
+	assert.False(t, ok)
+}
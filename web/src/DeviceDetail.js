@@ -52,6 +52,9 @@ function DeviceDetail(){
           {deviceDescription !== "" && "status" in deviceDetail && deviceDetail["status"] === 2 ?
             <Badge status="error" text="Error" style={{paddingRight: "20px"}}/> : ""
           }
+          {deviceDescription !== "" && "status" in deviceDetail && deviceDetail["status"] === 3 ?
+            <Badge status="processing" text="Initializing" style={{paddingRight: "20px"}}/> : ""
+          }
           {deviceDescription}
         </div> 
       }
@@ -152,7 +155,7 @@ function DeviceDetail(){
     })
     .catch(function (error) {
       if (error.response) {
-        message.error("Failed to start device " + vm_name + " due to " + error.response.status + " - " + error.response.data['error']);
+        message.error("Failed to start device " + vm_name + " due to " + error.response.status + " - " + error.response.data['error']['message']);
       }
     })
   }
@@ -168,7 +171,7 @@ function DeviceDetail(){
     })
     .catch(function (error) {
       if (error.response) {
-        message.error("Failed to stop device " + vm_name + " due to " + error.response.status + " - " + error.response.data['error']);
+        message.error("Failed to stop device " + vm_name + " due to " + error.response.status + " - " + error.response.data['error']['message']);
       }
     })
   }
@@ -51,7 +51,7 @@ const ApkPickerModal = ({ visible, onCancelCallback, deviceName }) => {
                 message.success(`${info.file.name} file uploaded successfully.`);
                 form.setFieldsValue({filename: info.file.name});
             } else if (status === 'error') {
-                message.error(`Failed to upload file due to ${ info.file.response.error }`);
+                message.error(`Failed to upload file due to ${ info.file.response.error.message }`);
             }
         },
         onDrop(e) {
@@ -76,6 +76,12 @@ function DeviceTable(props) {
             </>
             
           }
+          else if (status === 3){ // VMInitializing
+            return <Badge status="processing" text="Initializing" />
+          }
+          else if (status === 4){ // VMPartiallyRunning
+            return <Badge status="warning" text="Partially Running" />
+          }
         }
       },
       {
@@ -87,7 +93,7 @@ function DeviceTable(props) {
             if (row["status"] === 0) {
               actionButton = <Button type="link" onClick={() => startVM(row["name"])}>Start</Button>
             }
-            else if (row["status"] === 1) {
+            else if (row["status"] === 1 || row["status"] === 4) {
               actionButton = <Button type="link" onClick={() => stopVM(row["name"])}>Stop</Button>
             }
             else {
@@ -110,7 +116,7 @@ function DeviceTable(props) {
     })
     .catch(function (error) {
       if (error.response) {
-        message.error("Failed to start device " + vm_name + " due to " + error.response.status + " - " + error.response.data['error']);
+        message.error("Failed to start device " + vm_name + " due to " + error.response.status + " - " + error.response.data['error']['message']);
       }
     })
   }
@@ -124,7 +130,7 @@ function DeviceTable(props) {
     })
     .catch(function (error) {
       if (error.response) {
-        message.error("Failed to stop device " + vm_name + " due to " + error.response.status + " - " + error.response.data['error']);
+        message.error("Failed to stop device " + vm_name + " due to " + error.response.status + " - " + error.response.data['error']['message']);
       }
     })
   }
@@ -139,7 +145,7 @@ function DeviceTable(props) {
     .catch(function (error) {
       console.error(error);
       if (error.response) {
-        message.error("Failed to delete device " + vm_name + " due to " + error.response.status + " - " + error.response.data['error']);
+        message.error("Failed to delete device " + vm_name + " due to " + error.response.status + " - " + error.response.data['error']['message']);
       }
     })
   }
@@ -17,7 +17,7 @@ function WebTerminal(props){
         var charHeight = xtermCore._renderService.dimensions.actualCellHeight;
         var cols = Math.floor(width/charWidth);
         var lines = Math.floor(height/charHeight);
-        wsConn.send("$$MATRISEA_RESIZE " + cols +" " + lines + "");
+        wsConn.send(JSON.stringify({type: "resize", cols: cols, rows: lines}));
     }, []);
 
     // Terminal's websocket connection
@@ -31,7 +31,14 @@ function WebTerminal(props){
         };
         return newWS;
     }, [WS_ENDPOINT, props.deviceName, sendTerminalSize]);
-    const attachAddon = useMemo(() => new AttachAddon(ws),[ws]);
+    // user input is sent as binary frames by onData below, text frames are reserved for control messages
+    const attachAddon = useMemo(() => new AttachAddon(ws, { bidirectional: false }),[ws]);
+    const textEncoder = useMemo(() => new TextEncoder(),[]);
+    const sendInput = useCallback((data) => {
+        if (ws.readyState === 1) {
+            ws.send(textEncoder.encode(data));
+        }
+    }, [ws, textEncoder]);
 
     const resizeCallback = useCallback(() => {
         if (!props.isHidden) {
@@ -71,6 +78,7 @@ function WebTerminal(props){
             options={opts}
             ref={xtermRef}
             addons={[fitAddon, attachAddon]}
+            onData={sendInput}
         />
     );
 }